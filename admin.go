@@ -95,38 +95,51 @@ func (handler *MailAppHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 // will be logged.
 func LoginRequired(f AppHandleFunc) AppHandleFunc {
 	return func(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
-		// first check if the user is logged in
-		_, session, err := appcontext.SessionController.ValidateSession(r, appcontext.Store)
-		if err != nil {
-			switch err {
-			case goauth.ErrNotAuthSession, goauth.ErrKeyNotFound, goauth.ErrInvalidKey:
-				// consider lookup as failed, redirect to the login page!
-				http.Redirect(w, r, "/login", 302)
-				return nil
-			default:
-				// something really went wrong, report the error
-				return err
-			}
+		_, ok, err := validateLogin(appcontext, w, r)
+		if err != nil || !ok {
+			return err
 		}
-		// check the remember-me field from the session
-		rememberContainer, hasRemember := session.Values["remember-me"]
-		if !hasRemember {
-			appcontext.Logger.Info("Found session without remember-me set")
+		return f(appcontext, w, r)
+	}
+}
+
+// validateLogin does the checks described in LoginRequired.
+// It returns the id of the logged in admin and true if the login is valid.
+// If the login is not valid it writes the redirect to the login page and
+// returns false.
+func validateLogin(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) (goauth.UserKeyType, bool, error) {
+	// first check if the user is logged in
+	keyData, session, err := appcontext.SessionController.ValidateSession(r, appcontext.Store)
+	if err != nil {
+		switch err {
+		case goauth.ErrNotAuthSession, goauth.ErrKeyNotFound, goauth.ErrInvalidKey:
+			// consider lookup as failed, redirect to the login page!
+			http.Redirect(w, r, "/login", 302)
+			return goauth.NoUserID, false, nil
+		default:
+			// something really went wrong, report the error
+			return goauth.NoUserID, false, err
+		}
+	}
+	// check the remember-me field from the session
+	rememberContainer, hasRemember := session.Values["remember-me"]
+	if !hasRemember {
+		appcontext.Logger.Info("Found session without remember-me set")
+	} else {
+		rememberMe, ok := rememberContainer.(bool)
+		if !ok {
+			appcontext.Logger.Info("Got remember-me that is not a bool")
 		} else {
-			rememberMe, ok := rememberContainer.(bool)
-			if !ok {
-				appcontext.Logger.Info("Got remember-me that is not a bool")
-			} else {
-				if !rememberMe {
-					session.Options.MaxAge = 0
-				}
+			if !rememberMe {
+				session.Options.MaxAge = 0
 			}
 		}
-		if saveErr := session.Save(r, w); saveErr != nil {
-			appcontext.Logger.WithError(saveErr).Error("Saving session failed")
-		}
-		return f(appcontext, w, r)
 	}
+	if saveErr := session.Save(r, w); saveErr != nil {
+		appcontext.Logger.WithError(saveErr).Error("Saving session failed")
+	}
+	trackRequestSession(appcontext, r, keyData)
+	return keyData.User, true, nil
 }
 
 // Logout will set the MaxAge of the session to -1 and thus destroy the session.
@@ -151,6 +164,9 @@ func Logout(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request)
 			if delErr := appcontext.SessionController.DeleteKey(key); delErr != nil {
 				appcontext.Logger.WithField("remote", r.RemoteAddr).WithError(delErr).Error("Can't delete auth session key, this may be problematic!")
 			}
+			if delErr := deleteSessionByKey(appcontext, key); delErr != nil {
+				appcontext.Logger.WithField("remote", r.RemoteAddr).WithError(delErr).Warn("Can't delete information about session")
+			}
 		}
 	}
 	http.Redirect(w, r, "/login/", 302)
@@ -187,6 +203,27 @@ func BootstrapAdminsTemplate() *template.Template {
 	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/admins.html"))
 }
 
+// BootstrapAuditTemplate is the template for the audit log page.
+func BootstrapAuditTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/audit.html"))
+}
+
+// BootstrapTwoFactorTemplate is the template for the two-factor
+// authentication page.
+func BootstrapTwoFactorTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/twofactor.html"))
+}
+
+// BootstrapTokensTemplate is the template for the API tokens page.
+func BootstrapTokensTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/tokens.html"))
+}
+
+// BootstrapSessionsTemplate is the template for the active sessions page.
+func BootstrapSessionsTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/sessions.html"))
+}
+
 // BootstrapLicenseTemplate is the template for the license template.
 func BootstrapLicenseTemplate() *template.Template {
 	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/license.html"))
@@ -199,10 +236,14 @@ func BootstrapChangePWTemplate() *template.Template {
 
 // RenderLoginTemplate renders the template stored in
 // appContext.Templates["login"].
-// It adds the csrf.TemplateTag to the context of the template.
+// It adds the csrf.TemplateTag to the context of the template and, if SSO
+// is configured, the text of the SSO button as "sso".
 func RenderLoginTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	values := map[string]interface{}{
 		csrf.TemplateTag: csrf.TemplateField(r)}
+	if appContext.OIDC != nil {
+		values["sso"] = appContext.OIDC.Config.ButtonText
+	}
 	return appContext.Templates["login"].ExecuteTemplate(w, "layout", values)
 }
 
@@ -231,16 +272,38 @@ func RenderAdminsTemplate(appContext *MailAppContext, w http.ResponseWriter, r *
 	return appContext.Templates["admins"].ExecuteTemplate(w, "layout", nil)
 }
 
+// RenderAuditTemplate renders the template appContext.Templates["audit"].
+func RenderAuditTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	return appContext.Templates["audit"].ExecuteTemplate(w, "layout", nil)
+}
+
+// RenderTwoFactorTemplate renders the template appContext.Templates["2fa"].
+func RenderTwoFactorTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	return appContext.Templates["2fa"].ExecuteTemplate(w, "layout", nil)
+}
+
+// RenderTokensTemplate renders the template appContext.Templates["tokens"].
+func RenderTokensTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	return appContext.Templates["tokens"].ExecuteTemplate(w, "layout", nil)
+}
+
+// RenderSessionsTemplate renders the template appContext.Templates["sessions"].
+func RenderSessionsTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	return appContext.Templates["sessions"].ExecuteTemplate(w, "layout", nil)
+}
+
 // RenderRootTemplate renders the template appContext.Templates["root"].
 func RenderRootTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	return appContext.Templates["root"].ExecuteTemplate(w, "layout", nil)
 }
 
 // RenderChangePWTemplate renders the template appContext.Templates["change-pw"].
-// It adds the csrf.TemplateTag to the context of the template.
+// It adds the csrf.TemplateTag to the context of the template and sets
+// "reset" to true if the password reset is configured.
 func RenderChangePWTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	values := map[string]interface{}{
 		csrf.TemplateTag: csrf.TemplateField(r)}
+	values["reset"] = passwordResetEnabled(appContext)
 	return appContext.Templates["change-pw"].ExecuteTemplate(w, "layout", values)
 }
 
@@ -251,7 +314,12 @@ func RenderChangePWTemplate(appContext *MailAppContext, w http.ResponseWriter, r
 // If the login is correct it will create an auth session for the user, set
 // the MaxAge field of the session etc.
 // If the login succeeds it will return a 302 redirect to /.
-// If the login fails it will return a 400.
+// If the admin has two-factor authentication enabled (or it is required but
+// not set up yet) no auth session is created, instead it replies with
+// {"second-factor": "totp"} or {"second-factor": "enroll"}, see
+// SecondFactorLoginHandler and TOTPLoginEnrollHandler.
+// If the login fails it will return a 400, after too many failures it
+// returns a 429 (see LockoutPolicy).
 func CheckLogin(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	body, readErr := ioutil.ReadAll(r.Body)
 	if readErr != nil {
@@ -269,10 +337,15 @@ func CheckLogin(appcontext *MailAppContext, w http.ResponseWriter, r *http.Reque
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
+	// check if the remote address or user is locked
+	if allowed, lockErr := checkAttemptAllowed(appcontext, w, r, LockoutScopeAdmin, loginData.Username); !allowed {
+		return lockErr
+	}
 	// Validate the user
 	userId, checkErr := appcontext.UserHandler.Validate(loginData.Username, []byte(loginData.Password))
 	if checkErr == goauth.ErrUserNotFound {
 		appcontext.Logger.WithField("username", loginData.Username).WithField("remote", r.RemoteAddr).Warn("Login attempt with unkown username")
+		attemptFailed(appcontext, r, LockoutScopeAdmin, loginData.Username)
 		http.Error(w, "Login failed", 400)
 		return nil
 	}
@@ -284,27 +357,57 @@ func CheckLogin(appcontext *MailAppContext, w http.ResponseWriter, r *http.Reque
 	if userId == goauth.NoUserID {
 		// login failed
 		appcontext.Logger.WithField("username", loginData.Username).WithField("remote", r.RemoteAddr).Warn("Failed log in attempt")
+		attemptFailed(appcontext, r, LockoutScopeAdmin, loginData.Username)
 		http.Error(w, "Login failed", 400)
 		return nil
 	}
+	// password ok, check if a second factor is required
+	state, stateErr := secondFactorState(appcontext, userId)
+	if stateErr != nil {
+		return stateErr
+	}
+	if state != "" {
+		if pendingErr := startPendingLogin(appcontext, w, r, userId, loginData.RememberMe, state); pendingErr != nil {
+			return pendingErr
+		}
+		jsonEnc, jsonErr := json.Marshal(map[string]string{"second-factor": state})
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	}
 	// everything ok!
+	attemptSucceeded(appcontext, LockoutScopeAdmin, loginData.Username)
+	if loginErr := createLoginSession(appcontext, w, r, userId, loginData.RememberMe); loginErr != nil {
+		return loginErr
+	}
+	http.Redirect(w, r, "/", 302)
+	return nil
+}
+
+// createLoginSession creates an auth session for the admin and sets the
+// MaxAge of the session according to rememberMe.
+func createLoginSession(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request, userId goauth.UserKeyType, rememberMe bool) error {
 	// create an auth session
-	_, _, session, sessionErr := appcontext.SessionController.CreateAuthSession(r, appcontext.Store, userId, appcontext.DefaultSessionLifespan)
+	keyData, key, session, sessionErr := appcontext.SessionController.CreateAuthSession(r, appcontext.Store, userId, appcontext.DefaultSessionLifespan)
 	if sessionErr != nil {
 		// something went wrong, report it!
 		return sessionErr
 	}
+	if trackErr := TrackSession(appcontext, r, key, keyData); trackErr != nil {
+		appcontext.Logger.WithError(trackErr).WithField("admin-id", userId).Warn("Can't store information about admin session")
+	}
 	// save the session, set the max age to 0 if remember me is set to false
 	// also set a session value to set the MaxAge to 0 all the time
-	session.Values["remember-me"] = loginData.RememberMe
-	if !loginData.RememberMe {
+	session.Values["remember-me"] = rememberMe
+	if !rememberMe {
 		session.Options.MaxAge = 0
 	}
 	saveErr := session.Save(r, w)
 	if saveErr != nil {
 		appcontext.Logger.Error("Saving session failed", saveErr)
 	}
-	http.Redirect(w, r, "/", 302)
 	return nil
 }
 
@@ -342,6 +445,8 @@ func ChangeSinglePasswordHandler(appContext *MailAppContext, w http.ResponseWrit
 // {'mail': <Mail>, 'old_password': <Old>, 'new_password': <New>}
 // It compares the old password with the one in the database, if this is not
 // correct or the email doesn't exist it responds with a 400.
+// Failed attempts are counted and lead to a 429 after too many failures,
+// see LockoutPolicy.
 // If the password is correct the password gets updated.
 func ChangeSinglePw(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	body, readErr := ioutil.ReadAll(r.Body)
@@ -367,38 +472,34 @@ func ChangeSinglePw(appContext *MailAppContext, w http.ResponseWriter, r *http.R
 		http.Error(w, emailErr.Error(), 400)
 		return nil
 	}
-	if pwErr := passwordValid(changeData.NewPassword); pwErr != nil {
+	if pwErr := appContext.PasswordPolicy.Check(changeData.NewPassword, changeData.Mail); pwErr != nil {
 		appContext.Logger.WithError(pwErr).WithField("mail", changeData.Mail).Warn("Attempt to change password to an invalid one.")
-		http.Error(w, pwErr.Error(), 400)
+		writePasswordError(w, pwErr)
 		return nil
 	}
+	// check if the remote address or mail is locked
+	if allowed, lockErr := checkAttemptAllowed(appContext, w, r, LockoutScopeMail, changeData.Mail); !allowed {
+		return lockErr
+	}
 	// everything seems fine, now get the entry from the database and validate the
 	// old password
-	id, storedPW, getErr := getUserPassword(appContext, changeData.Mail)
-	if getErr != nil {
-		appContext.Logger.WithError(getErr).WithField("mail", changeData.Mail).Warn("Error receiving user to change password.")
-		http.Error(w, "Provided user and password don't match", 400)
-		return nil
-	}
-	enc, salt, _, parseErr := getPWParts(storedPW)
-	if parseErr != nil {
-		return parseErr
-	}
-	equal, encErr := comparePasswords(changeData.OldPassword, salt, enc)
-	if encErr != nil {
-		return encErr
+	id, _, equal, checkErr := checkMailPassword(appContext, changeData.Mail, changeData.OldPassword)
+	if checkErr != nil {
+		return checkErr
 	}
 	// check if they're equal, if yes allow the change
 	if !equal {
 		// report an error to the user
-		appContext.Logger.WithError(getErr).WithFields(logrus.Fields{
+		appContext.Logger.WithFields(logrus.Fields{
 			"mail":   changeData.Mail,
 			"remote": r.RemoteAddr,
 		}).Warn("Invalid attempt to change user password.")
+		attemptFailed(appContext, r, LockoutScopeMail, changeData.Mail)
 		http.Error(w, "Provided user and password don't match", 400)
 		return nil
 	} else {
 		// everything ok, update the password
+		attemptSucceeded(appContext, LockoutScopeMail, changeData.Mail)
 		return ChangeUserPassword(appContext, id, changeData.NewPassword)
 	}
 }
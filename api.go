@@ -23,6 +23,7 @@
 package mailwebadmin
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,6 +32,7 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/FabianWe/goauth"
 	"github.com/gorilla/csrf"
 	"github.com/sirupsen/logrus"
 )
@@ -92,6 +94,14 @@ func parseListAliasesURL(url string) (int64, error) {
 	return parseIDFromURL(listAliasRegx, url)
 }
 
+// listTrashRegex is the regex for parsing the id from /api/trash.
+var listTrashRegex = regexp.MustCompile(`^/api/trash/((\d+)/?)?$`)
+
+// parseListTrashURL parses the id from /api/trash.
+func parseListTrashURL(url string) (int64, error) {
+	return parseIDFromURL(listTrashRegex, url)
+}
+
 // adminsAliasRegx is the regex for parsing the username from /api/admins.
 var adminsAliasRegx = regexp.MustCompile(`^/api/admins/((\w+)/?)?$`)
 
@@ -105,6 +115,11 @@ func parseAdminListURL(url string) (string, error) {
 	}
 }
 
+// DomainRequest is the body of POST /api/domains/.
+type DomainRequest struct {
+	DomainName string `json:"domain-name"`
+}
+
 // addDomain adds a new domain to the database.
 // The body of the request must be a valid JSON dictionary of the form
 // {"domain-name": <domain>}
@@ -119,9 +134,7 @@ func addDomain(appContext *MailAppContext, w http.ResponseWriter, r *http.Reques
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	var domainData struct {
-		DomainName string `json:"domain-name"`
-	}
+	var domainData DomainRequest
 	jsonErr := json.Unmarshal(body, &domainData)
 	if jsonErr != nil {
 		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax for add domain.")
@@ -138,6 +151,7 @@ func addDomain(appContext *MailAppContext, w http.ResponseWriter, r *http.Reques
 	if err != nil {
 		return err
 	}
+	recordAudit(appContext, r, AuditAddDomain, AuditTargetDomain, domainID, nil, AuditValues{"domain-name": domainData.DomainName})
 	res := make(map[string]interface{})
 	res["domain-id"] = domainID
 	// encode to json
@@ -158,11 +172,11 @@ func addDomain(appContext *MailAppContext, w http.ResponseWriter, r *http.Reques
 // However backup and deleting will run in a different goroutine (we don't wait for
 // it to finish). The result will only get logged.
 func deleteDomain(domainID int64, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	// lookup domain name before deletion
+	name, err := getDomainName(appContext, domainID)
 	// first: check if the delete option is set, if so create backup if required and
 	// delete
 	if appContext.Delete {
-		// lookup domain name before deletion
-		name, err := getDomainName(appContext, domainID)
 		// start a go routine, we don't want the user to wait
 		go func() {
 			if err != nil {
@@ -171,7 +185,7 @@ func deleteDomain(domainID int64, appContext *MailAppContext, w http.ResponseWri
 			}
 			// backupr if requested
 			if appContext.Backup != "" {
-				if backupErr := zipDomainDir(appContext.Backup, appContext.MailDir, name); backupErr != nil {
+				if backupErr := zipDomainDir(appContext.Backup, appContext.MailDir, name, appContext.BackupRecipients); backupErr != nil {
 					appContext.Logger.WithError(backupErr).WithField("domain-name", name).Error("Can't create backup of domain. NOT deleting directory")
 					return
 				} else {
@@ -188,17 +202,36 @@ func deleteDomain(domainID int64, appContext *MailAppContext, w http.ResponseWri
 		}()
 	}
 	// try to remove the domain
-	return DeleteVirtualDomain(appContext, domainID)
+	if delErr := DeleteVirtualDomain(appContext, domainID); delErr != nil {
+		return delErr
+	}
+	var oldValue AuditValues
+	if err == nil {
+		oldValue = AuditValues{"domain-name": name}
+	}
+	recordAudit(appContext, r, AuditDeleteDomain, AuditTargetDomain, domainID, oldValue, nil)
+	return nil
 }
 
 // deleteAlias will delete the alias with the given id.
 func deleteAlias(aliasID int64, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
-	return DelAlias(appContext, aliasID)
+	// lookup alias before deletion for the audit log
+	alias, lookupErr := getAlias(appContext, aliasID)
+	if delErr := DelAlias(appContext, aliasID); delErr != nil {
+		return delErr
+	}
+	var oldValue AuditValues
+	if lookupErr == nil {
+		oldValue = AuditValues{"source": alias.Source, "dest": alias.Dest}
+	}
+	recordAudit(appContext, r, AuditDeleteAlias, AuditTargetAlias, aliasID, oldValue, nil)
+	return nil
 }
 
 // ListDomainsJSON is the main handler for domains.
 // It either renders the template on GET, creates a new domain on POST or deletes
 // a domain on DELETE.
+// GET /api/domains/<id> returns the DomainDetails of a single domain.
 func ListDomainsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	domainID, parseErr := parseListDomainURL(r.URL.String())
 	if parseErr != nil && parseErr != errNoID {
@@ -208,13 +241,26 @@ func ListDomainsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.
 	switch r.Method {
 	case getMethod:
 		if domainID >= 0 {
-			http.Error(w, "Invalid GET request. Must be GET /api/domains/", 400)
-			return nil
+			if ok, err := requireDomainAccess(appcontext, w, r, domainID); !ok {
+				return err
+			}
+			details, err := GetDomainDetails(appcontext, domainID)
+			return writeDetails(w, r, details, err)
 		}
 		res, err := ListVirtualDomains(appcontext)
 		if err != nil {
 			return err
 		}
+		// only return the domains the admin is allowed to see
+		scope, scopeErr := domainScopeFromRequest(appcontext, r)
+		if scopeErr != nil {
+			return scopeErr
+		}
+		for id := range res {
+			if !scope.Allows(id) {
+				delete(res, id)
+			}
+		}
 		// set csrf header
 		w.Header().Set("X-CSRF-Token", csrf.Token(r))
 		// create json encoding
@@ -235,6 +281,9 @@ func ListDomainsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.
 			http.Error(w, "Invalid DELETE request to /api/domains/: No id given.", 400)
 			return nil
 		}
+		if ok, err := requireDomainAccess(appcontext, w, r, domainID); !ok {
+			return err
+		}
 		return deleteDomain(domainID, appcontext, w, r)
 	default:
 		http.Error(w, fmt.Sprintf("Invalid method for /api/domains/: %s", r.Method), 400)
@@ -242,13 +291,23 @@ func ListDomainsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.
 	}
 }
 
+// UserRequest is the body of POST /api/users/, see addMail.
+type UserRequest struct {
+	Mail     string `json:"mail"`
+	Password string `json:"password"`
+	Generate string `json:"generate"`
+}
+
 // addMail adds a new mail user. It accepts a request in the following JSON dictionary
 // format:
-// {"mail": <mail>, "password": <password>}.
+// {"mail": <mail>, "password": <password>, "generate": <generator>}.
+// generate is optional, if it is set to "random" or "diceware" the password is
+// generated instead (see PasswordPolicy.GeneratePassword).
 // It tests if the email is valid according to emailValid and if the password is valid
-// according to passwordValid.
+// according to the PasswordPolicy.
 // On success it writes the following JSON to the response:
-// {"user-id": <id>}.
+// {"user-id": <id>}, if the password was generated it is included once as
+// "password".
 func addMail(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	body, readErr := ioutil.ReadAll(r.Body)
 	if readErr != nil {
@@ -256,9 +315,7 @@ func addMail(appContext *MailAppContext, w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	var userData struct {
-		Password, Mail string
-	}
+	var userData UserRequest
 	jsonErr := json.Unmarshal(body, &userData)
 	if jsonErr != nil {
 		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax to add a user")
@@ -270,18 +327,32 @@ func addMail(appContext *MailAppContext, w http.ResponseWriter, r *http.Request)
 		http.Error(w, emailErr.Error(), 400)
 		return nil
 	}
-	if pwErr := passwordValid(userData.Password); pwErr != nil {
+	if userData.Generate != "" {
+		generated, genErr := appContext.PasswordPolicy.GeneratePassword(userData.Generate, userData.Mail)
+		if genErr != nil {
+			http.Error(w, genErr.Error(), 400)
+			return nil
+		}
+		userData.Password = generated
+	} else if pwErr := appContext.PasswordPolicy.Check(userData.Password, userData.Mail); pwErr != nil {
 		appContext.Logger.WithError(pwErr).WithField("mail", userData.Mail).Warn("Attempt to add a user with invalid password")
-		http.Error(w, pwErr.Error(), 400)
+		writePasswordError(w, pwErr)
 		return nil
 	}
+	if ok, err := requireMailAccess(appContext, w, r, userData.Mail); !ok {
+		return err
+	}
 	// add user
 	userID, addErr := AddMailUser(appContext, userData.Mail, userData.Password)
 	if addErr != nil {
 		return addErr
 	}
+	recordAudit(appContext, r, AuditAddUser, AuditTargetUser, userID, nil, AuditValues{"mail": userData.Mail})
 	res := make(map[string]interface{})
 	res["user-id"] = userID
+	if userData.Generate != "" {
+		res["password"] = userData.Password
+	}
 	// encode to json
 	jsonEnc, jsonEncErr := json.Marshal(res)
 	if jsonEncErr != nil {
@@ -294,9 +365,22 @@ func addMail(appContext *MailAppContext, w http.ResponseWriter, r *http.Request)
 	return nil
 }
 
+// PasswordRequest is the body of UPDATE /api/users/<id>, see
+// changePassword.
+type PasswordRequest struct {
+	Password     string  `json:"password"`
+	RecoveryMail *string `json:"recovery-mail"`
+	Generate     string  `json:"generate"`
+}
+
 // changePassword changes the password for the user with the given id.
 // It accepts JSON requests of the form:
-// {"password": <password>}.
+// {"password": <password>, "recovery-mail": <mail>, "generate": <generator>}.
+// recovery-mail is optional and sets the recovery address used for the
+// password reset (the empty string removes it), if it is given the password
+// may be omitted.
+// generate is optional, if it is set to "random" or "diceware" the password is
+// generated and written once to the response as {"password": <password>}.
 // It replies with a 400 if something went wrong.
 func changePassword(userID int64, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	body, readErr := ioutil.ReadAll(r.Body)
@@ -305,21 +389,59 @@ func changePassword(userID int64, appContext *MailAppContext, w http.ResponseWri
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	var pwData struct {
-		Password string
-	}
+	var pwData PasswordRequest
 	jsonErr := json.Unmarshal(body, &pwData)
 	if jsonErr != nil {
 		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax to change password")
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	if pwErr := passwordValid(pwData.Password); pwErr != nil {
-		appContext.Logger.WithError(pwErr).WithField("user-id", userID).Warn("Attempt to change a user password to an invalid password")
-		http.Error(w, pwErr.Error(), 400)
-		return nil
+	// the password is optional if the recovery address is changed
+	changePW := pwData.Password != "" || pwData.Generate != "" || pwData.RecoveryMail == nil
+	if changePW {
+		userName, domain, nameErr := getUserName(appContext, userID)
+		if nameErr != nil {
+			return nameErr
+		}
+		if pwData.Generate != "" {
+			generated, genErr := appContext.PasswordPolicy.GeneratePassword(pwData.Generate, userName+"@"+domain)
+			if genErr != nil {
+				http.Error(w, genErr.Error(), 400)
+				return nil
+			}
+			pwData.Password = generated
+		} else if pwErr := appContext.PasswordPolicy.Check(pwData.Password, userName+"@"+domain); pwErr != nil {
+			appContext.Logger.WithError(pwErr).WithField("user-id", userID).Warn("Attempt to change a user password to an invalid password")
+			writePasswordError(w, pwErr)
+			return nil
+		}
+	}
+	if pwData.RecoveryMail != nil && *pwData.RecoveryMail != "" {
+		if emailErr := emailValid(*pwData.RecoveryMail); emailErr != nil {
+			http.Error(w, emailErr.Error(), 400)
+			return nil
+		}
 	}
-	return ChangeUserPassword(appContext, userID, pwData.Password)
+	if pwData.RecoveryMail != nil {
+		if recoveryErr := setRecoveryMailAudited(appContext, r, userID, *pwData.RecoveryMail); recoveryErr != nil {
+			return recoveryErr
+		}
+	}
+	if changePW {
+		if changeErr := ChangeUserPassword(appContext, userID, pwData.Password); changeErr != nil {
+			return changeErr
+		}
+		// the password itself is never written to the audit log
+		recordAudit(appContext, r, AuditChangePassword, AuditTargetUser, userID, nil, nil)
+	}
+	if pwData.Generate != "" {
+		jsonEnc, jsonEncErr := json.Marshal(map[string]string{"password": pwData.Password})
+		if jsonEncErr != nil {
+			return jsonEncErr
+		}
+		w.Write(jsonEnc)
+	}
+	return nil
 }
 
 // deleteMail deletes the mail with the given id.
@@ -328,12 +450,25 @@ func changePassword(userID int64, appContext *MailAppContext, w http.ResponseWri
 // location first.
 // Again, as in deleteDomain this happens in a different goroutine we don't
 // wait for.
+// If appContext.Delete and appContext.Trash are set the user is moved to the
+// trash instead, see SoftDeleteMailUser.
 func deleteMail(userID int64, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	// lookup domain name before deletion
+	mail, domain, err := getUserName(appContext, userID)
+	var oldValue AuditValues
+	if err == nil {
+		oldValue = AuditValues{"mail": mail + "@" + domain}
+	}
+	if appContext.Delete && appContext.Trash != "" {
+		if trashErr := SoftDeleteMailUser(appContext, userID); trashErr != nil {
+			return trashErr
+		}
+		recordAudit(appContext, r, AuditDeleteUser, AuditTargetUser, userID, oldValue, AuditValues{"trash": true})
+		return nil
+	}
 	// first: check if the delete option is set, if so create backup if required and
 	// delete
 	if appContext.Delete {
-		// lookup domain name before deletion
-		mail, domain, err := getUserName(appContext, userID)
 		// start a go routine, we don't want the user to wait
 		go func() {
 			if err != nil {
@@ -342,7 +477,7 @@ func deleteMail(userID int64, appContext *MailAppContext, w http.ResponseWriter,
 			}
 			// backupr if requested
 			if appContext.Backup != "" {
-				if backupErr := zipUserDir(appContext.Backup, appContext.MailDir, domain, mail); backupErr != nil {
+				if backupErr := zipUserDir(appContext.Backup, appContext.MailDir, domain, mail, appContext.BackupRecipients); backupErr != nil {
 					appContext.Logger.WithError(backupErr).WithField("user-id", userID).Error("Can't create backup of user id. NOT deleting directory")
 					return
 				} else {
@@ -358,13 +493,43 @@ func deleteMail(userID int64, appContext *MailAppContext, w http.ResponseWriter,
 			}
 		}()
 	}
-	// try to remove the domain
-	return DelMailUser(appContext, userID)
+	// try to remove the user
+	if delErr := DelMailUser(appContext, userID); delErr != nil {
+		return delErr
+	}
+	recordAudit(appContext, r, AuditDeleteUser, AuditTargetUser, userID, oldValue, nil)
+	return nil
 }
 
 // ListUsersJSON handles the /api/users domains.
 // Works nearly as ListDomainsJSON.
+// GET accepts the pagination parameters described in pagination.go, the
+// result is then a ListPage of ListUserEntry sorted by email.
+// GET /api/users/<id> returns the UserDetails of a single user.
+// GET /api/users/<id>/export streams an archive of the mail directory, see
+// exportMail, POST /api/users/<id>/import imports an archive into the mail
+// directory, see importMail.
 func ListUsersJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if exportID, exportErr := parseExportUserURL(r.URL.Path); exportErr == nil {
+		if r.Method != getMethod {
+			http.Error(w, fmt.Sprintf("Invalid method for /api/users/<id>/export: %s", r.Method), 400)
+			return nil
+		}
+		if ok, err := requireRowAccess(appcontext, w, r, usersTable, exportID); !ok {
+			return err
+		}
+		return exportMail(exportID, appcontext, w, r)
+	}
+	if importID, importErr := parseImportUserURL(r.URL.Path); importErr == nil {
+		if r.Method != postMethod {
+			http.Error(w, fmt.Sprintf("Invalid method for /api/users/<id>/import: %s", r.Method), 400)
+			return nil
+		}
+		if ok, err := requireRowAccess(appcontext, w, r, usersTable, importID); !ok {
+			return err
+		}
+		return importMail(importID, appcontext, w, r)
+	}
 	userID, parseErr := parseListUsersURL(r.URL.Path)
 	if parseErr != nil && parseErr != errNoID {
 		http.NotFound(w, r)
@@ -376,21 +541,28 @@ func ListUsersJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Re
 		return nil
 	case getMethod:
 		if userID >= 0 {
-			http.Error(w, "Invalid GET request. Must be GET /api/users/", 400)
-			return nil
+			if ok, err := requireRowAccess(appcontext, w, r, usersTable, userID); !ok {
+				return err
+			}
+			details, err := GetUserDetails(appcontext, userID)
+			return writeDetails(w, r, details, err)
+		}
+		domainID, ok, domainErr := domainFromQuery(appcontext, w, r)
+		if !ok {
+			return domainErr
 		}
-		var domainID int64 = -1
-		queryArgs := r.URL.Query()
-		if domainValues, has := queryArgs["domain"]; has {
-			if len(domainValues) != 1 {
-				http.Error(w, "Invalid GET request. query params must contain at most one domain=DOMAIN-ID", 400)
+		if wantsListPage(r) {
+			opts, optsErr := ParseListOptions(r, AllUsersSortColumns, "email")
+			if optsErr != nil {
+				http.Error(w, fmt.Sprintf("Invalid GET request: %s", optsErr), 400)
 				return nil
 			}
-			// get first element and try to parse it as an int
-			if domainID, parseErr = strconv.ParseInt(domainValues[0], 10, 64); parseErr != nil {
-				http.Error(w, "Invalid GET request. query params must contain at most one domain=DOMAIN-ID. DOMAIN-ID must be an int.", 400)
-				return nil
+			page, err := ListAllUsersPage(appcontext, domainID, opts)
+			if err != nil {
+				return err
 			}
+			w.Header().Set("X-CSRF-Token", csrf.Token(r))
+			return writeListPage(w, page)
 		}
 		users, err := ListAllUsers(appcontext, domainID)
 		if err != nil {
@@ -410,6 +582,9 @@ func ListUsersJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Re
 			http.Error(w, "Invalid UPDATE request to /api/users/: No id given.", 400)
 			return nil
 		}
+		if ok, err := requireRowAccess(appcontext, w, r, usersTable, userID); !ok {
+			return err
+		}
 		return changePassword(userID, appcontext, w, r)
 	case postMethod:
 		if userID >= 0 {
@@ -422,10 +597,107 @@ func ListUsersJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Re
 			http.Error(w, "Invalid DELETE request to /api/users/: No id given.", 400)
 			return nil
 		}
+		if ok, err := requireRowAccess(appcontext, w, r, usersTable, userID); !ok {
+			return err
+		}
 		return deleteMail(userID, appcontext, w, r)
 	}
 }
 
+// ListTrashJSON is the main handler for /api/trash.
+// GET returns all users in the trash, POST /api/trash/<id> restores the user
+// (it replies with a 400 if the domain was deleted and a 409 if the address
+// is used by another user, see RestoreMailUser) and DELETE /api/trash/<id>
+// purges the user immediately.
+func ListTrashJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	userID, parseErr := parseListTrashURL(r.URL.Path)
+	if parseErr != nil && parseErr != errNoID {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/trash/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		if userID >= 0 {
+			http.Error(w, "Invalid GET request. Must be GET /api/trash/", 400)
+			return nil
+		}
+		res, err := ListTrash(appcontext)
+		if err != nil {
+			return err
+		}
+		scope, scopeErr := domainScopeFromRequest(appcontext, r)
+		if scopeErr != nil {
+			return scopeErr
+		}
+		for id, entry := range res {
+			if !scope.Allows(entry.DomainID) {
+				delete(res, id)
+			}
+		}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		// create json encoding
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case postMethod:
+		if userID < 0 {
+			http.Error(w, "Invalid POST request to /api/trash/: No id given.", 400)
+			return nil
+		}
+		if ok, err := requireRowAccess(appcontext, w, r, trashTable, userID); !ok {
+			return err
+		}
+		restoreErr := RestoreMailUser(appcontext, userID)
+		switch restoreErr {
+		case sql.ErrNoRows:
+			http.Error(w, "User not found in trash", 400)
+			return nil
+		case ErrRestoreDomainDeleted:
+			http.Error(w, restoreErr.Error(), 400)
+			return nil
+		case ErrRestoreMailExists:
+			http.Error(w, restoreErr.Error(), 409)
+			return nil
+		}
+		if restoreErr != nil {
+			return restoreErr
+		}
+		recordAudit(appcontext, r, AuditRestoreUser, AuditTargetUser, userID, nil, nil)
+		return nil
+	case deleteMethod:
+		if userID < 0 {
+			http.Error(w, "Invalid DELETE request to /api/trash/: No id given.", 400)
+			return nil
+		}
+		if ok, err := requireRowAccess(appcontext, w, r, trashTable, userID); !ok {
+			return err
+		}
+		purgeErr := PurgeTrashEntry(appcontext, userID)
+		if purgeErr == sql.ErrNoRows {
+			http.Error(w, "User not found in trash", 400)
+			return nil
+		}
+		if purgeErr != nil {
+			return purgeErr
+		}
+		recordAudit(appcontext, r, AuditPurgeUser, AuditTargetUser, userID, nil, nil)
+		return nil
+	}
+}
+
+// AliasRequest is the body of POST /api/aliases/.
+type AliasRequest struct {
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
 // addAlias adds a new alias. The request must be JSON in the form
 // {"source": <source-mail>, "dest": <destination-mail>}.
 // It works as the other addXXX methods that have more documentation ;).
@@ -439,9 +711,7 @@ func addAlias(appContext *MailAppContext, w http.ResponseWriter, r *http.Request
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	var aliasData struct {
-		Source, Dest string
-	}
+	var aliasData AliasRequest
 	jsonErr := json.Unmarshal(body, &aliasData)
 	if jsonErr != nil {
 		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax to add an alias")
@@ -464,11 +734,15 @@ func addAlias(appContext *MailAppContext, w http.ResponseWriter, r *http.Request
 		http.Error(w, destMailErr.Error(), 400)
 		return nil
 	}
+	if ok, err := requireMailAccess(appContext, w, r, aliasData.Source); !ok {
+		return err
+	}
 	// add alias
 	aliasID, addErr := AddAlias(appContext, aliasData.Source, aliasData.Dest)
 	if addErr != nil {
 		return addErr
 	}
+	recordAudit(appContext, r, AuditAddAlias, AuditTargetAlias, aliasID, nil, AuditValues{"source": aliasData.Source, "dest": aliasData.Dest})
 	res := make(map[string]interface{})
 	res["alias-id"] = aliasID
 	// encode to json
@@ -485,6 +759,9 @@ func addAlias(appContext *MailAppContext, w http.ResponseWriter, r *http.Request
 
 // ListAliasesJSON is the main handler for /api/aliases.
 // It works nearly as ListDomainsJSON, which has more documentation ;).
+// GET accepts the query parameter domain=DOMAIN-ID as ListUsersJSON and the
+// pagination parameters (sort by id, source or destination).
+// GET /api/aliases/<id> returns the AliasDetails of a single alias.
 func ListAliasesJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	aliasID, parseErr := parseListAliasesURL(r.URL.String())
 	if parseErr != nil && parseErr != errNoID {
@@ -497,10 +774,30 @@ func ListAliasesJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.
 		return nil
 	case getMethod:
 		if aliasID >= 0 {
-			http.Error(w, "Invalid GET request. Must be GET /api/aliases/", 400)
-			return nil
+			if ok, err := requireRowAccess(appcontext, w, r, aliasesTable, aliasID); !ok {
+				return err
+			}
+			details, err := GetAliasDetails(appcontext, aliasID)
+			return writeDetails(w, r, details, err)
+		}
+		domainID, ok, domainErr := domainFromQuery(appcontext, w, r)
+		if !ok {
+			return domainErr
+		}
+		if wantsListPage(r) {
+			opts, optsErr := ParseListOptions(r, AliasSortColumns, "id")
+			if optsErr != nil {
+				http.Error(w, fmt.Sprintf("Invalid GET request: %s", optsErr), 400)
+				return nil
+			}
+			page, err := ListVirtualAliasesPage(appcontext, domainID, opts)
+			if err != nil {
+				return err
+			}
+			w.Header().Set("X-CSRF-Token", csrf.Token(r))
+			return writeListPage(w, page)
 		}
-		res, err := ListVirtualAliases(appcontext, -1)
+		res, err := ListVirtualAliases(appcontext, domainID)
 		if err != nil {
 			return err
 		}
@@ -518,6 +815,9 @@ func ListAliasesJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.
 			http.Error(w, "Invalid DELETE request to /api/aliases/: No id given.", 400)
 			return nil
 		}
+		if ok, err := requireRowAccess(appcontext, w, r, aliasesTable, aliasID); !ok {
+			return err
+		}
 		return deleteAlias(aliasID, appcontext, w, r)
 	case postMethod:
 		if aliasID >= 0 {
@@ -528,9 +828,18 @@ func ListAliasesJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.
 	}
 }
 
+// AdminRequest is the body of POST /api/admins/, see addAdmin.
+type AdminRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
 // addAdmin adds a new admin user.
 // See addDomain for more documentation, it does nearly the same thing.
 // Username and password are verified first.
+// The request may contain a role (see Role), if no role is given the admin
+// gets DefaultRole.
 // It writes the new id to the response in the JSON format:
 // {"admin-id": <id>}.
 func addAdmin(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
@@ -540,9 +849,7 @@ func addAdmin(appContext *MailAppContext, w http.ResponseWriter, r *http.Request
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	var adminData struct {
-		Username, Password string
-	}
+	var adminData AdminRequest
 	jsonErr := json.Unmarshal(body, &adminData)
 	if jsonErr != nil {
 		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax for add admin.")
@@ -554,16 +861,26 @@ func addAdmin(appContext *MailAppContext, w http.ResponseWriter, r *http.Request
 		http.Error(w, userNameErr.Error(), 400)
 		return nil
 	}
-	if pwErr := passwordValid(adminData.Password); pwErr != nil {
+	if pwErr := appContext.PasswordPolicy.Check(adminData.Password, adminData.Username); pwErr != nil {
 		appContext.Logger.WithError(pwErr).WithField("admin-name", adminData.Username).Warn("Invalid password for new admin user")
-		http.Error(w, pwErr.Error(), 400)
+		writePasswordError(w, pwErr)
 		return nil
 	}
+	role := DefaultRole
+	if adminData.Role != "" {
+		var roleErr error
+		if role, roleErr = ParseRole(adminData.Role); roleErr != nil {
+			appContext.Logger.WithError(roleErr).WithField("admin-name", adminData.Username).Warn("Invalid role for new admin user")
+			http.Error(w, roleErr.Error(), 400)
+			return nil
+		}
+	}
 	// try to add the user
-	adminID, insertErr := appContext.UserHandler.Insert(adminData.Username, "", "", "", []byte(adminData.Password))
+	adminID, insertErr := AddAdmin(appContext, adminData.Username, []byte(adminData.Password), role)
 	if insertErr != nil {
 		return insertErr
 	}
+	recordAudit(appContext, r, AuditAddAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"username": adminData.Username, "role": role})
 	res := make(map[string]interface{})
 	res["admin-id"] = adminID
 	// encode to json
@@ -579,31 +896,108 @@ func addAdmin(appContext *MailAppContext, w http.ResponseWriter, r *http.Request
 	return nil
 }
 
-// changeAdminPassword changes the password for the given admin user.
-// The password is validated first.
-// This method also deletes all sessions for the user.
-func changeAdminPassword(userName string, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+// AdminUpdateRequest is the body of UPDATE /api/admins/<username>, see
+// updateAdmin.
+type AdminUpdateRequest struct {
+	Password string   `json:"password"`
+	Role     string   `json:"role"`
+	Domains  *[]int64 `json:"domains"`
+	Reset2FA bool     `json:"reset-2fa"`
+}
+
+// updateAdmin changes the password, the role and / or the assigned domains
+// of the given admin user. It accepts JSON requests of the form:
+// {"password": <password>, "role": <role>, "domains": [<domain-id>, ...], "reset-2fa": <bool>},
+// all entries are optional. reset-2fa disables the two-factor authentication
+// of the admin, for example if they lost their device and recovery codes.
+// Admins can't change their own role, this way the last superadmin can't
+// lock themselves out.
+func updateAdmin(userName string, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	body, readErr := ioutil.ReadAll(r.Body)
 	if readErr != nil {
-		appContext.Logger.WithError(readErr).Info("Invalid request syntax to change admin password")
+		appContext.Logger.WithError(readErr).Info("Invalid request syntax to update admin")
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	var pwData struct {
-		Password string
-	}
-	jsonErr := json.Unmarshal(body, &pwData)
+	var updateData AdminUpdateRequest
+	jsonErr := json.Unmarshal(body, &updateData)
 	if jsonErr != nil {
-		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax to change admin password")
+		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax to update admin")
 		http.Error(w, "Invalid request syntax", 400)
 		return nil
 	}
-	if pwErr := passwordValid(pwData.Password); pwErr != nil {
+	if updateData.Role != "" {
+		role, roleErr := ParseRole(updateData.Role)
+		if roleErr != nil {
+			appContext.Logger.WithError(roleErr).WithField("admin-name", userName).Warn("Invalid role for admin user")
+			http.Error(w, roleErr.Error(), 400)
+			return nil
+		}
+		adminID, getIDErr := appContext.UserHandler.GetUserID(userName)
+		if getIDErr != nil {
+			return getIDErr
+		}
+		if loggedIn, _, ok := AdminFromRequest(r); ok && loggedIn == adminID {
+			http.Error(w, "You can't change your own role", 400)
+			return nil
+		}
+		oldRole, oldErr := GetAdminRole(appContext, adminID)
+		if oldErr != nil {
+			return oldErr
+		}
+		if setErr := SetAdminRole(appContext, adminID, role); setErr != nil {
+			return setErr
+		}
+		recordAudit(appContext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID),
+			AuditValues{"username": userName, "role": oldRole}, AuditValues{"username": userName, "role": role})
+	}
+	if updateData.Domains != nil {
+		adminID, getIDErr := appContext.UserHandler.GetUserID(userName)
+		if getIDErr != nil {
+			return getIDErr
+		}
+		oldDomains, oldErr := GetAdminDomains(appContext, adminID)
+		if oldErr != nil {
+			return oldErr
+		}
+		if setErr := SetAdminDomains(appContext, adminID, *updateData.Domains); setErr != nil {
+			return setErr
+		}
+		recordAudit(appContext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID),
+			AuditValues{"username": userName, "domains": oldDomains}, AuditValues{"username": userName, "domains": *updateData.Domains})
+	}
+	if updateData.Reset2FA {
+		adminID, getIDErr := appContext.UserHandler.GetUserID(userName)
+		if getIDErr != nil {
+			return getIDErr
+		}
+		if resetErr := DisableTOTP(appContext, adminID); resetErr != nil {
+			return resetErr
+		}
+		recordAudit(appContext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"username": userName, "2fa": false})
+	}
+	if updateData.Password != "" {
+		return changeAdminPassword(userName, updateData.Password, appContext, w, r)
+	}
+	return nil
+}
+
+// changeAdminPassword changes the password for the given admin user.
+// The password is validated first.
+// This method also deletes all sessions for the user.
+func changeAdminPassword(userName, password string, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if pwErr := appContext.PasswordPolicy.Check(password, userName); pwErr != nil {
 		appContext.Logger.WithError(pwErr).WithField("admin-name", userName).Warn("Invalid password for admin user")
-		http.Error(w, pwErr.Error(), 400)
+		writePasswordError(w, pwErr)
 		return nil
 	}
-	if updateErr := appContext.UserHandler.UpdatePassword(userName, []byte(pwData.Password)); updateErr != nil {
+	return setAdminPassword(userName, password, appContext, r)
+}
+
+// setAdminPassword changes the password of the admin without validating it
+// and deletes all sessions for the user.
+func setAdminPassword(userName, password string, appContext *MailAppContext, r *http.Request) error {
+	if updateErr := appContext.UserHandler.UpdatePassword(userName, []byte(password)); updateErr != nil {
 		return updateErr
 	}
 	// delete all sessions for the user, user has to login again
@@ -613,16 +1007,94 @@ func changeAdminPassword(userName string, appContext *MailAppContext, w http.Res
 		// don't return an error, password was changed
 		return nil
 	}
+	recordAudit(appContext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"username": userName, "password-changed": true})
 	// now try to delete the sessions
 	if _, delSessionsErr := appContext.SessionController.DeleteEntriesForUser(adminID); delSessionsErr != nil {
 		appContext.Logger.WithField("admin-user", userName).Error("Can't delete sessions for user after changing password, user may be still logged in!")
 		return nil
 	}
+	if delInfoErr := DeleteSessionsForAdmin(appContext, adminID); delInfoErr != nil {
+		appContext.Logger.WithError(delInfoErr).WithField("admin-user", userName).Warn("Can't delete information about sessions of user")
+	}
+	return nil
+}
+
+// AdminInfo is the information about an admin returned by /api/admins/.
+type AdminInfo struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+	// Domains are the ids of the domains assigned to the admin, see
+	// GetAdminDomains.
+	Domains []int64 `json:"domains"`
+}
+
+// listAdmins returns all admins in the form admin id --> AdminInfo.
+func listAdmins(appContext *MailAppContext) (map[goauth.UserKeyType]*AdminInfo, error) {
+	users, err := appContext.UserHandler.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	roles, rolesErr := ListAdminRoles(appContext)
+	if rolesErr != nil {
+		return nil, rolesErr
+	}
+	domains, domainsErr := ListAdminDomains(appContext)
+	if domainsErr != nil {
+		return nil, domainsErr
+	}
+	res := make(map[goauth.UserKeyType]*AdminInfo, len(users))
+	for id, username := range users {
+		role, hasRole := roles[id]
+		if !hasRole {
+			role = DefaultRole
+		}
+		adminDomains, hasDomains := domains[id]
+		if !hasDomains {
+			adminDomains = make([]int64, 0)
+		}
+		res[id] = &AdminInfo{Username: username, Role: role, Domains: adminDomains}
+	}
+	return res, nil
+}
+
+// deleteAdmin deletes the admin together with the sessions, role, domains,
+// SSO identity, two-factor secrets and API tokens of the admin.
+func deleteAdmin(userName string, adminID goauth.UserKeyType, appContext *MailAppContext, r *http.Request) error {
+	// delete user, if this fails reply with internal server error
+	if delErr := appContext.UserHandler.DeleteUser(userName); delErr != nil {
+		return delErr
+	}
+	// now delete all sessions for the user
+	if _, delAllErr := appContext.SessionController.DeleteEntriesForUser(adminID); delAllErr != nil {
+		appContext.Logger.WithField("admin-user", userName).Error("Can't delete sessions for user, he may still be logged in even after removal!")
+		// deletion took place, so still we return nil
+	}
+	if delInfoErr := DeleteSessionsForAdmin(appContext, adminID); delInfoErr != nil {
+		appContext.Logger.WithError(delInfoErr).WithField("admin-user", userName).Error("Can't delete information about sessions of removed admin user")
+	}
+	if delRoleErr := DeleteAdminRole(appContext, adminID); delRoleErr != nil {
+		appContext.Logger.WithError(delRoleErr).WithField("admin-user", userName).Error("Can't delete role of removed admin user")
+	}
+	if delDomainsErr := DeleteAdminDomains(appContext, adminID); delDomainsErr != nil {
+		appContext.Logger.WithError(delDomainsErr).WithField("admin-user", userName).Error("Can't delete domains of removed admin user")
+	}
+	if delTOTPErr := DisableTOTP(appContext, adminID); delTOTPErr != nil {
+		appContext.Logger.WithError(delTOTPErr).WithField("admin-user", userName).Error("Can't delete two-factor secrets of removed admin user")
+	}
+	if delTokensErr := DeleteAPITokensForAdmin(appContext, adminID); delTokensErr != nil {
+		appContext.Logger.WithError(delTokensErr).WithField("admin-user", userName).Error("Can't delete API tokens of removed admin user")
+	}
+	if delSubjectErr := DeleteOIDCSubject(appContext, adminID); delSubjectErr != nil {
+		appContext.Logger.WithError(delSubjectErr).WithField("admin-user", userName).Error("Can't delete SSO identity of removed admin user")
+	}
+	recordAudit(appContext, r, AuditDeleteAdmin, AuditTargetAdmin, int64(adminID), AuditValues{"username": userName}, nil)
 	return nil
 }
 
 // ListAdminsJSON is the main handler for /api/admins.
 // An admin is identified by the username, not an ID.
+// GET returns a JSON dictionary of the form
+// {<admin-id>: {"username": <username>, "role": <role>, "domains": [<domain-id>, ...]}}.
 // On delete all sessions for the user will be deleted as well.
 func ListAdminsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
 	userName, parseErr := parseAdminListURL(r.URL.String())
@@ -639,7 +1111,7 @@ func ListAdminsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.R
 			http.Error(w, "Invalid GET request. Must be GET /api/admins/", 400)
 			return nil
 		}
-		res, err := appcontext.UserHandler.ListUsers()
+		res, err := listAdmins(appcontext)
 		if err != nil {
 			return err
 		}
@@ -662,16 +1134,11 @@ func ListAdminsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.R
 		if getIDErr != nil {
 			return getIDErr
 		}
-		// delete user, if this fails reply with internal server error
-		if delErr := appcontext.UserHandler.DeleteUser(userName); delErr != nil {
-			return delErr
-		}
-		// now delete all sessions for the user
-		if _, delAllErr := appcontext.SessionController.DeleteEntriesForUser(adminID); delAllErr != nil {
-			appcontext.Logger.WithField("admin-user", userName).Error("Can't delete sessions for user, he may still be logged in even after removal!")
-			// deletion took place, so still we return nil
+		if loggedIn, _, ok := AdminFromRequest(r); ok && loggedIn == adminID {
+			http.Error(w, "You can't delete yourself", 400)
+			return nil
 		}
-		return nil
+		return deleteAdmin(userName, adminID, appcontext, r)
 	case postMethod:
 		if userName != "" {
 			http.Error(w, "Invalid POST request to /api/admins/.", 400)
@@ -683,6 +1150,6 @@ func ListAdminsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.R
 			http.Error(w, "Invalid UPDATE request to /api/admins/.", 400)
 			return nil
 		}
-		return changeAdminPassword(userName, appcontext, w, r)
+		return updateAdmin(userName, appcontext, w, r)
 	}
 }
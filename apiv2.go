@@ -0,0 +1,1041 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/FabianWe/goauth"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+// This file contains version 2 of the REST API, served at /api/v2/.
+// In contrast to the first version it uses the standard HTTP methods
+// (GET, POST, PUT, PATCH and DELETE), lists are returned as arrays of objects
+// with ids and all errors are JSON objects of the form
+// {"error": {"code": <code>, "message": <message>, "details": <details>}}.
+//
+// The resources are:
+//
+//	/api/v2/domains[/<id>]
+//	/api/v2/users[/<id>]
+//	/api/v2/aliases[/<id>]
+//	/api/v2/admins[/<id>]
+//
+// Lists of users and aliases can be paginated, see pagination.go.
+// GET on a single domain, user or alias returns the details (see details.go).
+// POST replies with 201 Created and the new object, PUT and PATCH with the
+// changed object and DELETE with 204 No Content.
+
+// Additional HTTP methods used by the v2 API.
+const (
+	putMethod   = "PUT"
+	patchMethod = "PATCH"
+)
+
+// Error codes used in the error envelope of the v2 API.
+const (
+	ErrCodeBadRequest       = "bad_request"
+	ErrCodeUnauthorized     = "unauthorized"
+	ErrCodeForbidden        = "forbidden"
+	ErrCodeNotFound         = "not_found"
+	ErrCodeMethodNotAllowed = "method_not_allowed"
+	ErrCodeConflict         = "conflict"
+	ErrCodeValidation       = "validation_failed"
+	ErrCodeTooManyRequests  = "too_many_requests"
+	ErrCodeInternal         = "internal_error"
+)
+
+// APIError is the error returned by the v2 API.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// APIErrorResponse is the body of all error replies of the v2 API.
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+// errorCodeForStatus returns the error code used for a HTTP status.
+func errorCodeForStatus(status int) string {
+	switch status {
+	case 401:
+		return ErrCodeUnauthorized
+	case 403:
+		return ErrCodeForbidden
+	case 404:
+		return ErrCodeNotFound
+	case 405:
+		return ErrCodeMethodNotAllowed
+	case 409:
+		return ErrCodeConflict
+	case 422:
+		return ErrCodeValidation
+	case 429:
+		return ErrCodeTooManyRequests
+	}
+	if status >= 500 {
+		return ErrCodeInternal
+	}
+	return ErrCodeBadRequest
+}
+
+// writeAPIError writes the error envelope with the given status.
+func writeAPIError(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	jsonEnc, jsonErr := json.Marshal(&APIErrorResponse{Error: &APIError{Code: code, Message: message, Details: details}})
+	if jsonErr != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(jsonEnc)
+}
+
+// writeAPIJSON writes value as JSON with the given status.
+func writeAPIJSON(w http.ResponseWriter, status int, value interface{}) error {
+	jsonEnc, jsonErr := json.Marshal(value)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonEnc)
+	return nil
+}
+
+// writeValidationError writes err as 422, password policy violations are
+// added as details.
+func writeValidationError(w http.ResponseWriter, err error) {
+	var details interface{}
+	if policyErr, ok := err.(*PasswordPolicyError); ok {
+		details = policyErr.Violations
+	}
+	writeAPIError(w, 422, ErrCodeValidation, err.Error(), details)
+}
+
+// isDuplicateEntry returns true if err is a MySQL error for a duplicate
+// unique key.
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// isForeignKeyError returns true if err is a MySQL error for a reference to
+// a row that doesn't exist.
+func isForeignKeyError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1452
+}
+
+// apiErrorWriter is used by APIErrors. It captures plain text error replies
+// (status >= 400 without a JSON Content-Type, for example from http.Error in
+// RoleRequired) and redirects to the login page, finish then writes the JSON
+// error envelope instead (401 for the redirect).
+type apiErrorWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	captured    bool
+	status      int
+	body        bytes.Buffer
+}
+
+func (w *apiErrorWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	isJSON := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json")
+	if status == http.StatusFound || (status >= 400 && !isJSON) {
+		w.captured = true
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *apiErrorWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if w.captured {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// finish writes the envelope for a captured error.
+func (w *apiErrorWriter) finish() {
+	if !w.captured {
+		return
+	}
+	if w.status == http.StatusFound {
+		// not logged in, validateLogin redirected to the login page
+		w.Header().Del("Location")
+		writeAPIError(w.ResponseWriter, 401, ErrCodeUnauthorized, "Authentication required", nil)
+		return
+	}
+	writeAPIError(w.ResponseWriter, w.status, errorCodeForStatus(w.status), strings.TrimSpace(w.body.String()), nil)
+}
+
+// APIErrors wraps the handlers of the v2 API, it replaces all plain text
+// error replies by the JSON error envelope and replies to internal errors
+// with a 500 in the same format.
+func APIErrors(f AppHandleFunc) AppHandleFunc {
+	return func(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+		errorWriter := &apiErrorWriter{ResponseWriter: w}
+		err := f(appcontext, errorWriter, r)
+		if err != nil {
+			appcontext.Logger.WithError(err).WithField("url", r.URL.Path).Error("Internal error in API request")
+			if !errorWriter.wroteHeader || errorWriter.captured {
+				writeAPIError(w, 500, ErrCodeInternal, "Internal Server Error", nil)
+			}
+			return nil
+		}
+		errorWriter.finish()
+		return nil
+	}
+}
+
+// apiV2Regex matches the resources of the v2 API.
+var apiV2Regex = regexp.MustCompile(`^/api/v2/(domains|users|aliases|admins)(/(\d+))?/?$`)
+
+// parseAPIv2URL returns the resource and the id (-1 if no id is given).
+func parseAPIv2URL(url string) (string, int64, error) {
+	match := apiV2Regex.FindStringSubmatch(url)
+	if match == nil {
+		return "", -1, fmt.Errorf("Invalid url %s", url)
+	}
+	if match[3] == "" {
+		return match[1], -1, nil
+	}
+	id, err := strconv.ParseInt(match[3], 10, 64)
+	return match[1], id, err
+}
+
+// APIv2Permission is the PermissionFunc for /api/v2/, it requires the same
+// permissions as the first version of the API.
+func APIv2Permission(r *http.Request) Permission {
+	resource, _, _ := parseAPIv2URL(r.URL.Path)
+	switch {
+	case resource == "admins":
+		return PermissionManageAdmins
+	case r.Method == getMethod:
+		return PermissionRead
+	case resource == "domains":
+		return PermissionManageDomains
+	case resource == "users" && (r.Method == putMethod || r.Method == patchMethod):
+		return PermissionResetPassword
+	default:
+		return PermissionManageUsers
+	}
+}
+
+// decodeAPIBody decodes the JSON body of the request into v, unknown fields
+// are not allowed. If the body is invalid it replies with a 400 and returns
+// false.
+func decodeAPIBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeAPIError(w, 400, ErrCodeBadRequest, fmt.Sprintf("Invalid request body: %s", err), nil)
+		return false
+	}
+	return true
+}
+
+// methodNotAllowed replies with a 405 and sets the Allow header.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) error {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeAPIError(w, 405, ErrCodeMethodNotAllowed, fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path), nil)
+	return nil
+}
+
+// created replies with 201 Created, the Location of the new resource and the
+// object.
+func created(w http.ResponseWriter, resource string, id int64, value interface{}) error {
+	w.Header().Set("Location", fmt.Sprintf("/api/v2/%s/%d", resource, id))
+	return writeAPIJSON(w, 201, value)
+}
+
+// APIv2 is the main handler for /api/v2/, it must be wrapped by RoleRequired
+// (with APIv2Permission) and APIErrors.
+func APIv2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	resource, id, parseErr := parseAPIv2URL(r.URL.Path)
+	if parseErr != nil {
+		writeAPIError(w, 404, ErrCodeNotFound, fmt.Sprintf("Unknown resource %s", r.URL.Path), nil)
+		return nil
+	}
+	if r.Method == getMethod {
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	}
+	if id < 0 {
+		switch {
+		case r.Method == getMethod:
+			return listAPIv2(resource, appcontext, w, r)
+		case r.Method == postMethod:
+			switch resource {
+			case "domains":
+				return createDomainV2(appcontext, w, r)
+			case "users":
+				return createUserV2(appcontext, w, r)
+			case "aliases":
+				return createAliasV2(appcontext, w, r)
+			case "admins":
+				return createAdminV2(appcontext, w, r)
+			}
+		}
+		return methodNotAllowed(w, r, getMethod, postMethod)
+	}
+	switch resource {
+	case "domains":
+		return domainV2(id, appcontext, w, r)
+	case "users":
+		return userV2(id, appcontext, w, r)
+	case "aliases":
+		return aliasV2(id, appcontext, w, r)
+	default:
+		return adminV2(goauth.UserKeyType(id), appcontext, w, r)
+	}
+}
+
+// DomainV2 is a domain in the v2 API.
+type DomainV2 struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// UserV2 is a mail user in the v2 API. Password is only set if the password
+// was generated.
+type UserV2 struct {
+	ID       int64  `json:"id"`
+	Email    string `json:"email"`
+	DomainID int64  `json:"domain-id"`
+	Password string `json:"password,omitempty"`
+}
+
+// AliasV2 is an alias in the v2 API.
+type AliasV2 struct {
+	ID          int64  `json:"id"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	DomainID    int64  `json:"domain-id"`
+}
+
+// AdminV2 is an admin in the v2 API.
+type AdminV2 struct {
+	ID goauth.UserKeyType `json:"id"`
+	*AdminInfo
+}
+
+// listAPIv2 handles GET on the collections, users and aliases accept the
+// query parameter domain=DOMAIN-ID and the pagination parameters described in
+// pagination.go, in this case the result is a ListPage.
+func listAPIv2(resource string, appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	switch resource {
+	case "domains":
+		domains, err := ListVirtualDomains(appcontext)
+		if err != nil {
+			return err
+		}
+		scope, scopeErr := domainScopeFromRequest(appcontext, r)
+		if scopeErr != nil {
+			return scopeErr
+		}
+		res := make([]*DomainV2, 0, len(domains))
+		for id, name := range domains {
+			if scope.Allows(id) {
+				res = append(res, &DomainV2{ID: id, Name: name})
+			}
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+		return writeAPIJSON(w, 200, res)
+	case "users":
+		domainID, ok, domainErr := domainFromQuery(appcontext, w, r)
+		if !ok {
+			return domainErr
+		}
+		if wantsListPage(r) {
+			opts, optsErr := ParseListOptions(r, VirtualUserSortColumns, "id")
+			if optsErr != nil {
+				writeAPIError(w, 400, ErrCodeBadRequest, optsErr.Error(), nil)
+				return nil
+			}
+			page, err := ListVirtualUsersPage(appcontext, domainID, opts)
+			if err != nil {
+				return err
+			}
+			entries := page.Items.([]*VirtualUserEntry)
+			res := make([]*UserV2, len(entries))
+			for i, entry := range entries {
+				res[i] = &UserV2{ID: entry.ID, Email: entry.Mail, DomainID: entry.DomainID}
+			}
+			page.Items = res
+			return writeAPIJSON(w, 200, page)
+		}
+		users, err := ListVirtualUsers(appcontext, domainID)
+		if err != nil {
+			return err
+		}
+		res := make([]*UserV2, 0, len(users))
+		for id, user := range users {
+			res = append(res, &UserV2{ID: id, Email: user.Mail, DomainID: user.DomainID})
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+		return writeAPIJSON(w, 200, res)
+	case "aliases":
+		domainID, ok, domainErr := domainFromQuery(appcontext, w, r)
+		if !ok {
+			return domainErr
+		}
+		if wantsListPage(r) {
+			opts, optsErr := ParseListOptions(r, AliasSortColumns, "id")
+			if optsErr != nil {
+				writeAPIError(w, 400, ErrCodeBadRequest, optsErr.Error(), nil)
+				return nil
+			}
+			page, err := ListVirtualAliasesPage(appcontext, domainID, opts)
+			if err != nil {
+				return err
+			}
+			entries := page.Items.([]*AliasEntry)
+			res := make([]*AliasV2, len(entries))
+			for i, entry := range entries {
+				res[i] = &AliasV2{ID: entry.ID, Source: entry.Source, Destination: entry.Dest, DomainID: entry.DomainID}
+			}
+			page.Items = res
+			return writeAPIJSON(w, 200, page)
+		}
+		aliases, err := ListVirtualAliases(appcontext, domainID)
+		if err != nil {
+			return err
+		}
+		res := make([]*AliasV2, 0, len(aliases))
+		for id, alias := range aliases {
+			res = append(res, &AliasV2{ID: id, Source: alias.Source, Destination: alias.Dest, DomainID: alias.DomainID})
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+		return writeAPIJSON(w, 200, res)
+	default:
+		admins, err := listAdmins(appcontext)
+		if err != nil {
+			return err
+		}
+		res := make([]*AdminV2, 0, len(admins))
+		for id, info := range admins {
+			res = append(res, &AdminV2{ID: id, AdminInfo: info})
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+		return writeAPIJSON(w, 200, res)
+	}
+}
+
+// DomainRequestV2 is the body for POST on domains.
+type DomainRequestV2 struct {
+	Name string `json:"name"`
+}
+
+// createDomainV2 handles POST /api/v2/domains with a body of the form
+// {"name": <domain>}.
+func createDomainV2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	var data DomainRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	if data.Name == "" {
+		writeAPIError(w, 422, ErrCodeValidation, "name is required", nil)
+		return nil
+	}
+	if nameErr := domainNameValid(data.Name); nameErr != nil {
+		writeValidationError(w, nameErr)
+		return nil
+	}
+	domainID, err := AddVirtualDomain(appcontext, data.Name)
+	if isDuplicateEntry(err) {
+		writeAPIError(w, 409, ErrCodeConflict, fmt.Sprintf("Domain %s already exists", data.Name), nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	recordAudit(appcontext, r, AuditAddDomain, AuditTargetDomain, domainID, nil, AuditValues{"domain-name": data.Name})
+	return created(w, "domains", domainID, &DomainV2{ID: domainID, Name: data.Name})
+}
+
+// domainV2 handles /api/v2/domains/<id>. Domains can't be renamed because
+// the name is part of all mail addresses and mail directories in the domain,
+// so PUT and PATCH are not allowed.
+func domainV2(domainID int64, appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != getMethod && r.Method != deleteMethod {
+		return methodNotAllowed(w, r, getMethod, deleteMethod)
+	}
+	if ok, err := requireDomainAccess(appcontext, w, r, domainID); !ok {
+		return err
+	}
+	details, err := GetDomainDetails(appcontext, domainID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, 404, ErrCodeNotFound, fmt.Sprintf("Domain %d not found", domainID), nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.Method == getMethod {
+		return writeAPIJSON(w, 200, details)
+	}
+	if delErr := deleteDomain(domainID, appcontext, w, r); delErr != nil {
+		return delErr
+	}
+	w.WriteHeader(204)
+	return nil
+}
+
+// userPasswordV2 returns the new password of the user: generated if generate
+// is not empty, otherwise password checked against the policy. If the
+// password is invalid it replies with a 422 and returns false.
+func userPasswordV2(appcontext *MailAppContext, w http.ResponseWriter, mail, password, generate string) (string, bool) {
+	if generate != "" {
+		generated, genErr := appcontext.PasswordPolicy.GeneratePassword(generate, mail)
+		if genErr != nil {
+			writeValidationError(w, genErr)
+			return "", false
+		}
+		return generated, true
+	}
+	if pwErr := appcontext.PasswordPolicy.Check(password, mail); pwErr != nil {
+		writeValidationError(w, pwErr)
+		return "", false
+	}
+	return password, true
+}
+
+// UserRequestV2 is the body for POST on users.
+type UserRequestV2 struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Generate string `json:"generate"`
+}
+
+// createUserV2 handles POST /api/v2/users with a body of the form
+// {"email": <mail>, "password": <password>, "generate": <generator>}, see
+// addMail.
+func createUserV2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	var data UserRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	if emailErr := emailValid(data.Email); emailErr != nil {
+		writeValidationError(w, emailErr)
+		return nil
+	}
+	password, ok := userPasswordV2(appcontext, w, data.Email, data.Password, data.Generate)
+	if !ok {
+		return nil
+	}
+	if ok, err := requireMailAccess(appcontext, w, r, data.Email); !ok {
+		return err
+	}
+	userID, addErr := AddMailUser(appcontext, data.Email, password)
+	switch {
+	case isDuplicateEntry(addErr):
+		writeAPIError(w, 409, ErrCodeConflict, fmt.Sprintf("User %s already exists", data.Email), nil)
+		return nil
+	case addErr == sql.ErrNoRows:
+		writeAPIError(w, 422, ErrCodeValidation, fmt.Sprintf("The domain of %s doesn't exist", data.Email), nil)
+		return nil
+	case addErr != nil:
+		return addErr
+	}
+	recordAudit(appcontext, r, AuditAddUser, AuditTargetUser, userID, nil, AuditValues{"mail": data.Email})
+	user, getErr := getVirtualUser(appcontext, userID)
+	if getErr != nil {
+		return getErr
+	}
+	res := &UserV2{ID: userID, Email: user.Mail, DomainID: user.DomainID}
+	if data.Generate != "" {
+		res.Password = password
+	}
+	return created(w, "users", userID, res)
+}
+
+// UserUpdateRequestV2 is the body for PUT and PATCH on users.
+type UserUpdateRequestV2 struct {
+	Password     string  `json:"password"`
+	Generate     string  `json:"generate"`
+	RecoveryMail *string `json:"recovery-mail"`
+}
+
+// userV2 handles /api/v2/users/<id>.
+// PUT and PATCH accept a body of the form
+// {"password": <password>, "generate": <generator>, "recovery-mail": <mail>},
+// PUT requires a password (or generate) and removes the recovery address if
+// it is not given, PATCH only changes the given fields.
+func userV2(userID int64, appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case getMethod, putMethod, patchMethod, deleteMethod:
+	default:
+		return methodNotAllowed(w, r, getMethod, putMethod, patchMethod, deleteMethod)
+	}
+	if ok, err := requireRowAccess(appcontext, w, r, usersTable, userID); !ok {
+		return err
+	}
+	user, err := getVirtualUser(appcontext, userID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, 404, ErrCodeNotFound, fmt.Sprintf("User %d not found", userID), nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res := &UserV2{ID: userID, Email: user.Mail, DomainID: user.DomainID}
+	switch r.Method {
+	case getMethod:
+		details, detailsErr := GetUserDetails(appcontext, userID)
+		if detailsErr != nil {
+			return detailsErr
+		}
+		return writeAPIJSON(w, 200, details)
+	case deleteMethod:
+		if delErr := deleteMail(userID, appcontext, w, r); delErr != nil {
+			return delErr
+		}
+		w.WriteHeader(204)
+		return nil
+	}
+	var data UserUpdateRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	changePW := data.Password != "" || data.Generate != ""
+	if r.Method == putMethod {
+		if !changePW {
+			writeAPIError(w, 422, ErrCodeValidation, "PUT requires password or generate", nil)
+			return nil
+		}
+		if data.RecoveryMail == nil {
+			empty := ""
+			data.RecoveryMail = &empty
+		}
+	}
+	var password string
+	if changePW {
+		var ok bool
+		if password, ok = userPasswordV2(appcontext, w, user.Mail, data.Password, data.Generate); !ok {
+			return nil
+		}
+	}
+	if data.RecoveryMail != nil && *data.RecoveryMail != "" {
+		if emailErr := emailValid(*data.RecoveryMail); emailErr != nil {
+			writeValidationError(w, emailErr)
+			return nil
+		}
+	}
+	if data.RecoveryMail != nil {
+		if recoveryErr := setRecoveryMailAudited(appcontext, r, userID, *data.RecoveryMail); recoveryErr != nil {
+			return recoveryErr
+		}
+	}
+	if changePW {
+		if changeErr := ChangeUserPassword(appcontext, userID, password); changeErr != nil {
+			return changeErr
+		}
+		// the password itself is never written to the audit log
+		recordAudit(appcontext, r, AuditChangePassword, AuditTargetUser, userID, nil, nil)
+		if data.Generate != "" {
+			res.Password = password
+		}
+	}
+	return writeAPIJSON(w, 200, res)
+}
+
+// AliasRequestV2 is the body for POST, PUT and PATCH on aliases.
+type AliasRequestV2 struct {
+	Source      *string `json:"source"`
+	Destination *string `json:"destination"`
+}
+
+// validAliasV2 validates source and destination of an alias and checks if
+// the admin can access the source domain. If not it writes an error and
+// returns false.
+func validAliasV2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request, source, destination string) (bool, error) {
+	if sourceErr := emailValid(source); sourceErr != nil {
+		writeValidationError(w, fmt.Errorf("Invalid source: %s", sourceErr))
+		return false, nil
+	}
+	if destErr := emailValid(destination); destErr != nil {
+		writeValidationError(w, fmt.Errorf("Invalid destination: %s", destErr))
+		return false, nil
+	}
+	if ok, err := requireMailAccess(appcontext, w, r, source); !ok {
+		return false, err
+	}
+	// aliases are not unique in the database, so check it here
+	var num int
+	query := "SELECT COUNT(*) FROM virtual_aliases WHERE source = ? AND destination = ?;"
+	if err := appcontext.DB.QueryRow(query, source, destination).Scan(&num); err != nil {
+		return false, err
+	}
+	if num > 0 {
+		writeAPIError(w, 409, ErrCodeConflict, fmt.Sprintf("Alias from %s to %s already exists", source, destination), nil)
+		return false, nil
+	}
+	return true, nil
+}
+
+// createAliasV2 handles POST /api/v2/aliases with a body of the form
+// {"source": <mail>, "destination": <mail>}.
+func createAliasV2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	var data AliasRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	if data.Source == nil || data.Destination == nil {
+		writeAPIError(w, 422, ErrCodeValidation, "source and destination are required", nil)
+		return nil
+	}
+	if ok, err := validAliasV2(appcontext, w, r, *data.Source, *data.Destination); !ok {
+		return err
+	}
+	aliasID, addErr := AddAlias(appcontext, *data.Source, *data.Destination)
+	if addErr == sql.ErrNoRows {
+		writeAPIError(w, 422, ErrCodeValidation, fmt.Sprintf("The domain of %s doesn't exist", *data.Source), nil)
+		return nil
+	}
+	if addErr != nil {
+		return addErr
+	}
+	recordAudit(appcontext, r, AuditAddAlias, AuditTargetAlias, aliasID, nil, AuditValues{"source": *data.Source, "dest": *data.Destination})
+	alias, getErr := getAlias(appcontext, aliasID)
+	if getErr != nil {
+		return getErr
+	}
+	return created(w, "aliases", aliasID, &AliasV2{ID: aliasID, Source: alias.Source, Destination: alias.Dest, DomainID: alias.DomainID})
+}
+
+// aliasV2 handles /api/v2/aliases/<id>.
+// PUT requires source and destination, PATCH only changes the given fields.
+func aliasV2(aliasID int64, appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case getMethod, putMethod, patchMethod, deleteMethod:
+	default:
+		return methodNotAllowed(w, r, getMethod, putMethod, patchMethod, deleteMethod)
+	}
+	if ok, err := requireRowAccess(appcontext, w, r, aliasesTable, aliasID); !ok {
+		return err
+	}
+	alias, err := getAlias(appcontext, aliasID)
+	if err == sql.ErrNoRows {
+		writeAPIError(w, 404, ErrCodeNotFound, fmt.Sprintf("Alias %d not found", aliasID), nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case getMethod:
+		details, detailsErr := GetAliasDetails(appcontext, aliasID)
+		if detailsErr != nil {
+			return detailsErr
+		}
+		return writeAPIJSON(w, 200, details)
+	case deleteMethod:
+		if delErr := deleteAlias(aliasID, appcontext, w, r); delErr != nil {
+			return delErr
+		}
+		w.WriteHeader(204)
+		return nil
+	}
+	var data AliasRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	if r.Method == putMethod && (data.Source == nil || data.Destination == nil) {
+		writeAPIError(w, 422, ErrCodeValidation, "PUT requires source and destination", nil)
+		return nil
+	}
+	source, destination := alias.Source, alias.Dest
+	if data.Source != nil {
+		source = *data.Source
+	}
+	if data.Destination != nil {
+		destination = *data.Destination
+	}
+	if source != alias.Source || destination != alias.Dest {
+		if ok, err := validAliasV2(appcontext, w, r, source, destination); !ok {
+			return err
+		}
+		updateErr := UpdateAlias(appcontext, aliasID, source, destination)
+		if updateErr == sql.ErrNoRows {
+			writeAPIError(w, 422, ErrCodeValidation, fmt.Sprintf("The domain of %s doesn't exist", source), nil)
+			return nil
+		}
+		if updateErr != nil {
+			return updateErr
+		}
+		recordAudit(appcontext, r, AuditUpdateAlias, AuditTargetAlias, aliasID,
+			AuditValues{"source": alias.Source, "dest": alias.Dest}, AuditValues{"source": source, "dest": destination})
+	}
+	updated, getErr := getAlias(appcontext, aliasID)
+	if getErr != nil {
+		return getErr
+	}
+	return writeAPIJSON(w, 200, &AliasV2{ID: aliasID, Source: updated.Source, Destination: updated.Dest, DomainID: updated.DomainID})
+}
+
+// AdminRequestV2 is the body for POST, PUT and PATCH on admins.
+type AdminRequestV2 struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Role     *string  `json:"role"`
+	Domains  *[]int64 `json:"domains"`
+	Reset2FA bool     `json:"reset-2fa"`
+}
+
+// getAdminV2 returns the admin with the given id, it returns
+// goauth.ErrUserNotFound if the admin doesn't exist.
+func getAdminV2(appcontext *MailAppContext, adminID goauth.UserKeyType) (*AdminV2, error) {
+	userName, err := appcontext.UserHandler.GetUserName(adminID)
+	if err != nil {
+		return nil, err
+	}
+	role, roleErr := GetAdminRole(appcontext, adminID)
+	if roleErr != nil {
+		return nil, roleErr
+	}
+	domains, domainsErr := GetAdminDomains(appcontext, adminID)
+	if domainsErr != nil {
+		return nil, domainsErr
+	}
+	if domains == nil {
+		domains = make([]int64, 0)
+	}
+	return &AdminV2{ID: adminID, AdminInfo: &AdminInfo{Username: userName, Role: role, Domains: domains}}, nil
+}
+
+// setAdminDomainsV2 assigns the domains to the admin, if a domain doesn't
+// exist it replies with a 422 and returns false.
+func setAdminDomainsV2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request, admin *AdminV2, domains []int64) (bool, error) {
+	setErr := SetAdminDomains(appcontext, admin.ID, domains)
+	if isForeignKeyError(setErr) {
+		writeAPIError(w, 422, ErrCodeValidation, "domains contains a domain that doesn't exist", nil)
+		return false, nil
+	}
+	if setErr != nil {
+		return false, setErr
+	}
+	recordAudit(appcontext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(admin.ID),
+		AuditValues{"username": admin.Username, "domains": admin.Domains}, AuditValues{"username": admin.Username, "domains": domains})
+	return true, nil
+}
+
+// adminDomainsExistV2 checks that all domains exist. If not it writes a 422
+// and returns false.
+func adminDomainsExistV2(appcontext *MailAppContext, w http.ResponseWriter, domains []int64) (bool, error) {
+	for _, domainID := range domains {
+		_, err := getDomainName(appcontext, domainID)
+		if err == sql.ErrNoRows {
+			writeAPIError(w, 422, ErrCodeValidation, "domains contains a domain that doesn't exist", nil)
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// createAdminV2 handles POST /api/v2/admins with a body of the form
+// {"username": <name>, "password": <password>, "role": <role>, "domains": [<domain-id>, ...]},
+// role and domains are optional.
+func createAdminV2(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	var data AdminRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	if data.Username == "" {
+		writeAPIError(w, 422, ErrCodeValidation, "username is required", nil)
+		return nil
+	}
+	if nameErr := adminNameValid(data.Username); nameErr != nil {
+		writeValidationError(w, nameErr)
+		return nil
+	}
+	if pwErr := appcontext.PasswordPolicy.Check(data.Password, data.Username); pwErr != nil {
+		writeValidationError(w, pwErr)
+		return nil
+	}
+	role := DefaultRole
+	if data.Role != nil {
+		var roleErr error
+		if role, roleErr = ParseRole(*data.Role); roleErr != nil {
+			writeValidationError(w, roleErr)
+			return nil
+		}
+	}
+	_, lookupErr := appcontext.UserHandler.GetUserID(data.Username)
+	switch lookupErr {
+	case nil:
+		writeAPIError(w, 409, ErrCodeConflict, fmt.Sprintf("Admin %s already exists", data.Username), nil)
+		return nil
+	case goauth.ErrUserNotFound:
+	default:
+		return lookupErr
+	}
+	// check the domains before the admin is created, otherwise an invalid
+	// request would leave the admin behind
+	if data.Domains != nil {
+		if ok, err := adminDomainsExistV2(appcontext, w, *data.Domains); !ok {
+			return err
+		}
+	}
+	adminID, insertErr := AddAdmin(appcontext, data.Username, []byte(data.Password), role)
+	if insertErr != nil {
+		return insertErr
+	}
+	recordAudit(appcontext, r, AuditAddAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"username": data.Username, "role": role})
+	appcontext.Logger.WithField("admin-name", data.Username).Info("Added new admin user")
+	admin, getErr := getAdminV2(appcontext, adminID)
+	if getErr != nil {
+		return getErr
+	}
+	if data.Domains != nil {
+		if ok, err := setAdminDomainsV2(appcontext, w, r, admin, *data.Domains); !ok {
+			return err
+		}
+		admin.Domains = *data.Domains
+	}
+	return created(w, "admins", int64(adminID), admin)
+}
+
+// adminV2 handles /api/v2/admins/<id>.
+// PUT and PATCH accept a body of the form
+// {"password": <password>, "role": <role>, "domains": [<domain-id>, ...], "reset-2fa": <bool>},
+// PUT requires role and domains, PATCH only changes the given fields.
+// Admins can't change their own role or delete themselves.
+func adminV2(adminID goauth.UserKeyType, appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case getMethod, putMethod, patchMethod, deleteMethod:
+	default:
+		return methodNotAllowed(w, r, getMethod, putMethod, patchMethod, deleteMethod)
+	}
+	admin, err := getAdminV2(appcontext, adminID)
+	if err == goauth.ErrUserNotFound {
+		writeAPIError(w, 404, ErrCodeNotFound, fmt.Sprintf("Admin %d not found", adminID), nil)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	loggedIn, _, _ := AdminFromRequest(r)
+	switch r.Method {
+	case getMethod:
+		return writeAPIJSON(w, 200, admin)
+	case deleteMethod:
+		if loggedIn == adminID {
+			writeAPIError(w, 409, ErrCodeConflict, "You can't delete yourself", nil)
+			return nil
+		}
+		if delErr := deleteAdmin(admin.Username, adminID, appcontext, r); delErr != nil {
+			return delErr
+		}
+		w.WriteHeader(204)
+		return nil
+	}
+	var data AdminRequestV2
+	if !decodeAPIBody(w, r, &data) {
+		return nil
+	}
+	if data.Username != "" && data.Username != admin.Username {
+		writeAPIError(w, 422, ErrCodeValidation, "Admins can't be renamed", nil)
+		return nil
+	}
+	if r.Method == putMethod && (data.Role == nil || data.Domains == nil) {
+		writeAPIError(w, 422, ErrCodeValidation, "PUT requires role and domains", nil)
+		return nil
+	}
+	// validate everything before changing anything
+	var role Role
+	if data.Role != nil {
+		var roleErr error
+		if role, roleErr = ParseRole(*data.Role); roleErr != nil {
+			writeValidationError(w, roleErr)
+			return nil
+		}
+		if role != admin.Role && loggedIn == adminID {
+			writeAPIError(w, 409, ErrCodeConflict, "You can't change your own role", nil)
+			return nil
+		}
+	}
+	if data.Password != "" {
+		if pwErr := appcontext.PasswordPolicy.Check(data.Password, admin.Username); pwErr != nil {
+			writeValidationError(w, pwErr)
+			return nil
+		}
+	}
+	if data.Domains != nil {
+		if ok, err := setAdminDomainsV2(appcontext, w, r, admin, *data.Domains); !ok {
+			return err
+		}
+		admin.Domains = *data.Domains
+	}
+	if data.Role != nil && role != admin.Role {
+		if setErr := SetAdminRole(appcontext, adminID, role); setErr != nil {
+			return setErr
+		}
+		recordAudit(appcontext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID),
+			AuditValues{"username": admin.Username, "role": admin.Role}, AuditValues{"username": admin.Username, "role": role})
+		admin.Role = role
+	}
+	if data.Reset2FA {
+		if resetErr := DisableTOTP(appcontext, adminID); resetErr != nil {
+			return resetErr
+		}
+		recordAudit(appcontext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"username": admin.Username, "2fa": false})
+	}
+	if data.Password != "" {
+		if pwErr := setAdminPassword(admin.Username, data.Password, appcontext, r); pwErr != nil {
+			return pwErr
+		}
+	}
+	appcontext.Logger.WithFields(log.Fields{
+		"admin-id":   adminID,
+		"admin-name": admin.Username,
+	}).Info("Updated admin user")
+	return writeAPIJSON(w, 200, admin)
+}
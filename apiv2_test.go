@@ -0,0 +1,59 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FabianWe/goauth"
+)
+
+func TestCreateAdminV2UnknownDomain(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	users := newMemoryUserHandler(nil)
+	appContext.UserHandler = users
+	appContext.PasswordPolicy = DefaultPasswordPolicy()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name FROM virtual_domains WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("example.org"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT name FROM virtual_domains WHERE id = ?")).
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"name"}))
+
+	body := `{"username": "helpdesk", "password": "correct-horse-battery", "domains": [1, 2]}`
+	req := httptest.NewRequest(postMethod, "/api/v2/admins", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	if err := createAdminV2(appContext, rec, req); err != nil {
+		t.Fatalf("Creating admin failed: %s", err)
+	}
+	if rec.Code != 422 {
+		t.Errorf("Expected status 422, got %d", rec.Code)
+	}
+	if _, err := users.GetUserID("helpdesk"); err != goauth.ErrUserNotFound {
+		t.Errorf("Expected admin not to be created, got error %v", err)
+	}
+}
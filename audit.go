@@ -0,0 +1,332 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the audit log: Every change made by an admin through the
+// API is stored in the table audit_log together with the admin that made the
+// change, the time and the remote address of the request.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditOperation describes the kind of change stored in the audit log.
+type AuditOperation string
+
+const (
+	AuditAddDomain         AuditOperation = "add-domain"
+	AuditDeleteDomain      AuditOperation = "delete-domain"
+	AuditAddUser           AuditOperation = "add-user"
+	AuditChangePassword    AuditOperation = "change-password"
+	AuditDeleteUser        AuditOperation = "delete-user"
+	AuditRestoreUser       AuditOperation = "restore-user"
+	AuditPurgeUser         AuditOperation = "purge-user"
+	AuditImportMail        AuditOperation = "import-mail"
+	AuditAddAlias          AuditOperation = "add-alias"
+	AuditUpdateAlias       AuditOperation = "update-alias"
+	AuditDeleteAlias       AuditOperation = "delete-alias"
+	AuditAddAdmin          AuditOperation = "add-admin"
+	AuditUpdateAdmin       AuditOperation = "update-admin"
+	AuditDeleteAdmin       AuditOperation = "delete-admin"
+	AuditClearLockout      AuditOperation = "clear-lockout"
+	AuditAddToken          AuditOperation = "add-token"
+	AuditDeleteToken       AuditOperation = "delete-token"
+	AuditRevokeSession     AuditOperation = "revoke-session"
+	AuditSetRecoveryMail   AuditOperation = "set-recovery-mail"
+	AuditSetPasswordExpiry AuditOperation = "set-password-expiry"
+)
+
+// Types of the objects changed, stored as target type in the audit log.
+const (
+	AuditTargetDomain = "domain"
+	AuditTargetUser   = "user"
+	AuditTargetAlias  = "alias"
+	AuditTargetAdmin  = "admin"
+	// AuditTargetLockout has no id, the subject is stored in the old value.
+	AuditTargetLockout = "lockout"
+	AuditTargetToken   = "token"
+	// AuditTargetSession has the id 0 if all other sessions were revoked.
+	AuditTargetSession = "session"
+)
+
+// AuditValues stores the old or new values of an object in the audit log.
+// Never store secrets (passwords, hashes) in it.
+type AuditValues map[string]interface{}
+
+// AuditEntry is an entry in the audit log.
+type AuditEntry struct {
+	ID         int64              `json:"id"`
+	AdminID    goauth.UserKeyType `json:"admin-id"`
+	Operation  AuditOperation     `json:"operation"`
+	TargetType string             `json:"target-type"`
+	TargetID   int64              `json:"target-id"`
+	OldValue   json.RawMessage    `json:"old-value,omitempty"`
+	NewValue   json.RawMessage    `json:"new-value,omitempty"`
+	Time       time.Time          `json:"time"`
+	RemoteAddr string             `json:"remote-addr"`
+}
+
+// remoteHost returns the host part of r.RemoteAddr.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// encodeAuditValues encodes the values as JSON, nil values are stored as
+// NULL.
+func encodeAuditValues(values AuditValues) (interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+	enc, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	return string(enc), nil
+}
+
+// AddAuditEntry adds an entry to the audit log. The admin and the remote
+// address are taken from the request (see AdminFromRequest). r may be nil for
+// changes not made through the web interface.
+func AddAuditEntry(appContext *MailAppContext, r *http.Request, op AuditOperation, targetType string, targetID int64, oldValue, newValue AuditValues) error {
+	adminID := goauth.NoUserID
+	remoteAddr := ""
+	// r is nil for changes made by the command line tools
+	if r != nil {
+		if requestAdmin, _, ok := AdminFromRequest(r); ok {
+			adminID = requestAdmin
+		}
+		remoteAddr = remoteHost(r)
+	}
+	oldEnc, oldErr := encodeAuditValues(oldValue)
+	if oldErr != nil {
+		return oldErr
+	}
+	newEnc, newErr := encodeAuditValues(newValue)
+	if newErr != nil {
+		return newErr
+	}
+	query := `INSERT INTO audit_log (admin_id, operation, target_type, target_id, old_value, new_value, created, remote_addr)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	_, err := appContext.DB.Exec(query, uint64(adminID), string(op), targetType, targetID, oldEnc, newEnc,
+		time.Now().UTC(), remoteAddr)
+	return err
+}
+
+// recordAudit calls AddAuditEntry and only logs an error, it is used after a
+// change has taken place and we can't report an error any more.
+func recordAudit(appContext *MailAppContext, r *http.Request, op AuditOperation, targetType string, targetID int64, oldValue, newValue AuditValues) {
+	if err := AddAuditEntry(appContext, r, op, targetType, targetID, oldValue, newValue); err != nil {
+		appContext.Logger.WithError(err).WithFields(log.Fields{
+			"operation":   op,
+			"target-type": targetType,
+			"target-id":   targetID,
+		}).Error("Can't write audit log entry")
+	}
+}
+
+// AuditFilter describes which entries are returned by ListAuditLog.
+// Empty values (or nil for the times) are ignored.
+type AuditFilter struct {
+	AdminID    *goauth.UserKeyType
+	Operation  AuditOperation
+	TargetType string
+	TargetID   *int64
+	Since      *time.Time
+	Until      *time.Time
+	// Limit is the maximal number of entries returned.
+	Limit int
+}
+
+const (
+	// defaultAuditLimit is the default value for AuditFilter.Limit.
+	defaultAuditLimit = 100
+	// maxAuditLimit is the maximal value for AuditFilter.Limit.
+	maxAuditLimit = 1000
+)
+
+// ListAuditLog returns all entries matching the filter, newest first.
+func ListAuditLog(appContext *MailAppContext, filter *AuditFilter) ([]*AuditEntry, error) {
+	conditions := make([]string, 0)
+	queryArgs := make([]interface{}, 0)
+	if filter.AdminID != nil {
+		conditions = append(conditions, "admin_id = ?")
+		queryArgs = append(queryArgs, uint64(*filter.AdminID))
+	}
+	if filter.Operation != "" {
+		conditions = append(conditions, "operation = ?")
+		queryArgs = append(queryArgs, string(filter.Operation))
+	}
+	if filter.TargetType != "" {
+		conditions = append(conditions, "target_type = ?")
+		queryArgs = append(queryArgs, filter.TargetType)
+	}
+	if filter.TargetID != nil {
+		conditions = append(conditions, "target_id = ?")
+		queryArgs = append(queryArgs, *filter.TargetID)
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, "created >= ?")
+		queryArgs = append(queryArgs, filter.Since.UTC())
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "created <= ?")
+		queryArgs = append(queryArgs, filter.Until.UTC())
+	}
+	query := "SELECT id, admin_id, operation, target_type, target_id, old_value, new_value, created, remote_addr FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	}
+	if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+	query += " ORDER BY id DESC LIMIT ?;"
+	queryArgs = append(queryArgs, limit)
+	rows, err := appContext.DB.Query(query, queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*AuditEntry, 0)
+	for rows.Next() {
+		var entry AuditEntry
+		var adminID uint64
+		var op string
+		var oldValue, newValue sql.NullString
+		var created sqlTime
+		scanErr := rows.Scan(&entry.ID, &adminID, &op, &entry.TargetType, &entry.TargetID,
+			&oldValue, &newValue, &created, &entry.RemoteAddr)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		entry.AdminID = goauth.UserKeyType(adminID)
+		entry.Operation = AuditOperation(op)
+		if oldValue.Valid {
+			entry.OldValue = json.RawMessage(oldValue.String)
+		}
+		if newValue.Valid {
+			entry.NewValue = json.RawMessage(newValue.String)
+		}
+		entry.Time = created.Time
+		res = append(res, &entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// parseAuditFilter parses the query parameters of a request to /api/audit/.
+// Supported parameters are admin, operation, target-type, target-id, since,
+// until (both RFC 3339) and limit.
+func parseAuditFilter(r *http.Request) (*AuditFilter, error) {
+	queryArgs := r.URL.Query()
+	res := &AuditFilter{
+		Operation:  AuditOperation(queryArgs.Get("operation")),
+		TargetType: queryArgs.Get("target-type"),
+	}
+	if s := queryArgs.Get("admin"); s != "" {
+		adminID, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid admin id \"%s\"", s)
+		}
+		id := goauth.UserKeyType(adminID)
+		res.AdminID = &id
+	}
+	if s := queryArgs.Get("target-id"); s != "" {
+		targetID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid target id \"%s\"", s)
+		}
+		res.TargetID = &targetID
+	}
+	if s := queryArgs.Get("since"); s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time \"%s\", must be in RFC 3339 format", s)
+		}
+		res.Since = &since
+	}
+	if s := queryArgs.Get("until"); s != "" {
+		until, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time \"%s\", must be in RFC 3339 format", s)
+		}
+		res.Until = &until
+	}
+	if s := queryArgs.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("Invalid limit \"%s\"", s)
+		}
+		res.Limit = limit
+	}
+	return res, nil
+}
+
+// ListAuditJSON is the main handler for /api/audit/. It only supports GET
+// and returns a JSON list of AuditEntry, newest first. The entries can be
+// filtered by query parameters, see parseAuditFilter.
+func ListAuditJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != getMethod {
+		http.Error(w, fmt.Sprintf("Invalid method for /api/audit/: %s", r.Method), 400)
+		return nil
+	}
+	filter, filterErr := parseAuditFilter(r)
+	if filterErr != nil {
+		http.Error(w, filterErr.Error(), 400)
+		return nil
+	}
+	res, err := ListAuditLog(appcontext, filter)
+	if err != nil {
+		return err
+	}
+	// set csrf header
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	// create json encoding
+	jsonEnc, jsonErr := json.Marshal(res)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	w.Write(jsonEnc)
+	return nil
+}
@@ -24,17 +24,30 @@ package mailwebadmin
 
 // This file contains functions for deleting the mail directory and backing it
 // up before deletion in a zip file.
+// If recipients are configured the zip file gets encrypted with age
+// (see https://age-encryption.org), encrypted backups have the suffix .zip.age.
 
 import (
 	"archive/zip"
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
+
+	"filippo.io/age"
 )
 
+// encryptedSuffix is the suffix appended to the zip file name if the backup
+// gets encrypted.
+const encryptedSuffix = ".age"
+
 // getSourcePath returns the pattern formatted given the domain and user.
 // This means it returns the mail directory for that domain and user.
 // It replaces the %d and %n placeholders.
@@ -46,13 +59,17 @@ func getSourcePath(pattern, domain, user string) string {
 // getDestPath returns the zip file path for backing up domains / user accounts.
 // The zip file is either called <domain>.zip when backing up a whole domain
 // or <domain>-<user>.zip for user accounts.
-func getDestPath(backupDir, domain, user string) string {
+// If encrypted is true the suffix .age is appended.
+func getDestPath(backupDir, domain, user string, encrypted bool) string {
 	var zipName string
 	if user == "" {
 		zipName = domain + ".zip"
 	} else {
 		zipName = fmt.Sprintf("%s-%s.zip", domain, user)
 	}
+	if encrypted {
+		zipName += encryptedSuffix
+	}
 	return filepath.Join(backupDir, zipName)
 }
 
@@ -78,17 +95,19 @@ func deleteUserDir(pattern, domain, user string) error {
 }
 
 // zipDomainDir zips the domain directory.
-func zipDomainDir(backupDir, pattern, domain string) error {
+// If recipients is not empty the zip file gets encrypted for the recipients.
+func zipDomainDir(backupDir, pattern, domain string, recipients []age.Recipient) error {
 	if containsErr := containsInvalidParts(domain); containsErr != nil {
 		return containsErr
 	}
 	sourcePath := getSourcePath(pattern, domain, "")
-	destPath := getDestPath(backupDir, domain, "")
-	return zipToFile(sourcePath, destPath)
+	destPath := getDestPath(backupDir, domain, "", len(recipients) > 0)
+	return zipToFile(sourcePath, filepath.Base(sourcePath), destPath, recipients)
 }
 
 // zipUserDir zips the user directory.
-func zipUserDir(backupDir, pattern, domain, user string) error {
+// If recipients is not empty the zip file gets encrypted for the recipients.
+func zipUserDir(backupDir, pattern, domain, user string, recipients []age.Recipient) error {
 	if containsErr := containsInvalidParts(domain); containsErr != nil {
 		return containsErr
 	}
@@ -96,24 +115,45 @@ func zipUserDir(backupDir, pattern, domain, user string) error {
 		return containsErr
 	}
 	sourcePath := getSourcePath(pattern, domain, user)
-	destPath := getDestPath(backupDir, domain, user)
-	return zipToFile(sourcePath, destPath)
+	destPath := getDestPath(backupDir, domain, user, len(recipients) > 0)
+	return zipToFile(sourcePath, filepath.Base(sourcePath), destPath, recipients)
+}
+
+// zipEntryName returns the name of the file path inside the zip archive
+// created by writeZip for sourcePath. baseDir is the top directory in the
+// archive if sourcePath is a directory and the empty string otherwise.
+func zipEntryName(sourcePath, baseDir, path string, info os.FileInfo) string {
+	name := info.Name()
+	if baseDir != "" {
+		name = filepath.Join(baseDir, strings.TrimPrefix(path, sourcePath))
+	}
+	if info.IsDir() {
+		name += "/"
+	}
+	return name
 }
 
 // writeZip recursively adds all files under sourcePath to a zip archive.
 // The zip will be written to the writer object.
-func writeZip(sourcePath string, w io.Writer) error {
+// If sourcePath is a directory baseName is the name of the top directory in
+// the archive, usually filepath.Base(sourcePath). The restore functions
+// extract the archive into the parent of the mail directory, so it must be
+// the name of the mail directory.
+// It returns a manifest entry (name, size and SHA-256 sum) for each file
+// written to the archive.
+func writeZip(sourcePath, baseName string, w io.Writer) ([]ManifestEntry, error) {
 	info, err := os.Stat(sourcePath)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 	archive := zip.NewWriter(w)
 	defer archive.Close()
 
 	var baseDir string
 	if info.IsDir() {
-		baseDir = filepath.Base(sourcePath)
+		baseDir = baseName
 	}
+	entries := make([]ManifestEntry, 0)
 	err = filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -124,13 +164,9 @@ func writeZip(sourcePath string, w io.Writer) error {
 			return err
 		}
 
-		if baseDir != "" {
-			header.Name = filepath.Join(baseDir, strings.TrimPrefix(path, sourcePath))
-		}
+		header.Name = zipEntryName(sourcePath, baseDir, path, info)
 
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
+		if !info.IsDir() {
 			header.Method = zip.Deflate
 		}
 
@@ -148,21 +184,38 @@ func writeZip(sourcePath string, w io.Writer) error {
 			return err
 		}
 		defer file.Close()
-		_, err = io.Copy(writer, file)
-		return err
+		// compute the checksum while writing, this way the manifest describes
+		// exactly what is in the archive
+		hasher := sha256.New()
+		size, err := io.Copy(io.MultiWriter(writer, hasher), file)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, ManifestEntry{Path: header.Name, Size: size,
+			SHA256: hex.EncodeToString(hasher.Sum(nil))})
+		return nil
 	})
 	closeErr := archive.Close()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
 	}
-	return closeErr
+	return entries, nil
 }
 
 // zipToFile writes all files under source to the destination file.
-// It uses writeZip with a file writer.
+// It uses writeZip with a file writer, baseName is passed to writeZip.
 // If source does not exist (dovecot never wrote some mails there)
 // the file gets not created.
-func zipToFile(source, destination string) error {
+// If recipients is not empty the zip gets encrypted with age for all
+// recipients before it is written to the file.
+// Next to the archive a manifest is written (see BackupManifest).
+// After writing the archive gets verified against the manifest and the
+// manifest against source, only if this succeeds nil is returned. So
+// it is safe to delete source if this function returns nil.
+func zipToFile(source, baseName, destination string, recipients []age.Recipient) error {
 	// first check if source exists
 	if _, err := os.Stat(source); os.IsNotExist(err) {
 		// in this case return nil, no error simply no mails there yet
@@ -173,13 +226,235 @@ func zipToFile(source, destination string) error {
 	if err != nil {
 		return err
 	}
-	writer := bufio.NewWriter(file)
-	zipErr := writeZip(source, writer)
-	if zipErr != nil {
-		return zipErr
+	archiveHasher := sha256.New()
+	writer := bufio.NewWriter(io.MultiWriter(file, archiveHasher))
+	var entries []ManifestEntry
+	if len(recipients) == 0 {
+		var zipErr error
+		if entries, zipErr = writeZip(source, baseName, writer); zipErr != nil {
+			return zipErr
+		}
+	} else {
+		encWriter, encErr := age.Encrypt(writer, recipients...)
+		if encErr != nil {
+			return encErr
+		}
+		var zipErr error
+		if entries, zipErr = writeZip(source, baseName, encWriter); zipErr != nil {
+			return zipErr
+		}
+		// closing the age writer flushes the last chunk, it must happen before
+		// we flush the file writer
+		if closeErr := encWriter.Close(); closeErr != nil {
+			return closeErr
+		}
 	}
 	if err = writer.Flush(); err != nil {
 		return err
 	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	manifest := &BackupManifest{
+		Created:       time.Now().UTC(),
+		Source:        source,
+		Encrypted:     len(recipients) > 0,
+		ArchiveSHA256: hex.EncodeToString(archiveHasher.Sum(nil)),
+		Files:         entries,
+	}
+	if err = writeManifest(manifest, manifestPath(destination)); err != nil {
+		return err
+	}
+	// now verify what we've written
+	// encrypted archives can't be opened (we only have the public key), but
+	// the checksum of the archive verifies that it was written correctly and
+	// the entries were computed from the plaintext stream
+	if err = verifyArchiveChecksum(destination, manifest); err != nil {
+		return err
+	}
+	if !manifest.Encrypted {
+		reader, openErr := zip.OpenReader(destination)
+		if openErr != nil {
+			return openErr
+		}
+		defer reader.Close()
+		if err = verifyArchiveEntries(&reader.Reader, manifest); err != nil {
+			return err
+		}
+	}
+	return verifySource(source, baseName, manifest)
+}
+
+// ErrNoIdentities is the error returned when an encrypted backup should be
+// opened but no identity to decrypt it is given.
+var ErrNoIdentities = errors.New("Backup is encrypted but no identities to decrypt it are given")
+
+// isEncryptedBackup returns true if the file name of the backup has the
+// suffix .age.
+func isEncryptedBackup(archive string) bool {
+	return strings.HasSuffix(archive, encryptedSuffix)
+}
+
+// openBackup opens the zip archive stored in the file archive.
+// If the backup is encrypted (see isEncryptedBackup) it gets decrypted with
+// the given identities to a temporary file first, this file gets removed
+// when the returned cleanup function is called.
+// The cleanup function must always be called if the error is nil.
+func openBackup(archive string, identities []age.Identity) (*zip.ReadCloser, func(), error) {
+	if !isEncryptedBackup(archive) {
+		reader, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, nil, err
+		}
+		return reader, func() { reader.Close() }, nil
+	}
+	if len(identities) == 0 {
+		return nil, nil, ErrNoIdentities
+	}
+	encFile, err := os.Open(archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encFile.Close()
+	decReader, decErr := age.Decrypt(bufio.NewReader(encFile), identities...)
+	if decErr != nil {
+		return nil, nil, decErr
+	}
+	// zip requires random access, so we write the plaintext to a temporary
+	// file
+	tmpFile, tmpErr := ioutil.TempFile("", "mailwebadmin-restore-")
+	if tmpErr != nil {
+		return nil, nil, tmpErr
+	}
+	removeTmp := func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}
+	if _, copyErr := io.Copy(tmpFile, decReader); copyErr != nil {
+		removeTmp()
+		return nil, nil, copyErr
+	}
+	if closeErr := tmpFile.Close(); closeErr != nil {
+		removeTmp()
+		return nil, nil, closeErr
+	}
+	reader, openErr := zip.OpenReader(tmpFile.Name())
+	if openErr != nil {
+		removeTmp()
+		return nil, nil, openErr
+	}
+	return reader, func() {
+		reader.Close()
+		removeTmp()
+	}, nil
+}
+
+// archivePath returns the path of the archive entry name when extracted to
+// destination (which must be cleaned).
+// It returns an error if the entry would be placed outside of destination.
+func archivePath(destination, name string) (string, error) {
+	target := filepath.Join(destination, name)
+	if target != destination && !strings.HasPrefix(target, destination+string(os.PathSeparator)) {
+		return "", fmt.Errorf("Invalid path in archive: \"%s\"", name)
+	}
+	return target, nil
+}
+
+// writeNewFile writes the content from r to a new file target.
+// Files that already exist are never overwritten, in this case false and
+// nil are returned.
+func writeNewFile(target string, perm os.FileMode, r io.Reader) (bool, error) {
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, r); err != nil {
+		return false, err
+	}
+	return true, out.Close()
+}
+
+// extractZip extracts all files from the archive to the directory
+// destination.
+// Files that already exist are not overwritten, they're simply skipped.
+// It returns an error if an entry of the zip would be placed outside of
+// destination, respecting the limits (nil for no limits).
+func extractZip(archive *zip.Reader, destination string, limits *archiveLimits) error {
+	destination = filepath.Clean(destination)
+	for _, entry := range archive.File {
+		if err := limits.entry(); err != nil {
+			return err
+		}
+		target, pathErr := archivePath(destination, entry.Name)
+		if pathErr != nil {
+			return &ArchiveError{Err: pathErr}
+		}
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if err := extractZipFile(entry, target, limits); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// extractZipFile writes a single file from a zip archive to target.
+// If target already exists nothing happens.
+func extractZipFile(entry *zip.File, target string, limits *archiveLimits) error {
+	in, err := entry.Open()
+	if err != nil {
+		return &ArchiveError{Err: err}
+	}
+	defer in.Close()
+	_, err = writeNewFile(target, entry.Mode().Perm(), limits.reader(in))
+	return err
+}
+
+// restoreFromFile restores a backup created by zipToFile.
+// Backups contain the mail directory itself, so destination must be the
+// parent directory of the mail directory.
+// Encrypted backups get decrypted with the given identities.
+func restoreFromFile(archive, destination string, identities []age.Identity) error {
+	reader, cleanup, err := openBackup(archive, identities)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	return extractZip(&reader.Reader, destination, nil)
+}
+
+// RestoreUserDir restores the mail directory of the given user from the
+// archive.
+// Existing files are not overwritten.
+func RestoreUserDir(appContext *MailAppContext, archive, domain, user string) error {
+	if containsErr := containsInvalidParts(domain); containsErr != nil {
+		return containsErr
+	}
+	if containsErr := containsInvalidParts(user); containsErr != nil {
+		return containsErr
+	}
+	userPath := filepath.Clean(getSourcePath(appContext.MailDir, domain, user))
+	return restoreFromFile(archive, filepath.Dir(userPath), appContext.BackupIdentities)
+}
+
+// RestoreDomainDir restores the mail directory of the given domain from the
+// archive.
+// Existing files are not overwritten.
+func RestoreDomainDir(appContext *MailAppContext, archive, domain string) error {
+	if containsErr := containsInvalidParts(domain); containsErr != nil {
+		return containsErr
+	}
+	domainPath := filepath.Clean(getSourcePath(appContext.MailDir, domain, ""))
+	return restoreFromFile(archive, filepath.Dir(domainPath), appContext.BackupIdentities)
+}
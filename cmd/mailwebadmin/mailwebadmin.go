@@ -60,12 +60,23 @@ func main() {
 		appContext.Templates["aliases"] = mailwebadmin.BootstrapAliasesTemplate()
 		appContext.Templates["license"] = mailwebadmin.BootstrapLicenseTemplate()
 		appContext.Templates["admins"] = mailwebadmin.BootstrapAdminsTemplate()
+		appContext.Templates["audit"] = mailwebadmin.BootstrapAuditTemplate()
+		appContext.Templates["2fa"] = mailwebadmin.BootstrapTwoFactorTemplate()
+		appContext.Templates["tokens"] = mailwebadmin.BootstrapTokensTemplate()
+		appContext.Templates["sessions"] = mailwebadmin.BootstrapSessionsTemplate()
+		appContext.Templates["portal-login"] = mailwebadmin.BootstrapPortalLoginTemplate()
+		appContext.Templates["portal"] = mailwebadmin.BootstrapPortalTemplate()
 		appContext.Templates["change-pw"] = mailwebadmin.BootstrapChangePWTemplate()
+		appContext.Templates["reset-pw"] = mailwebadmin.BootstrapResetPWTemplate()
 
 		// start the interface
 		http.Handle("/static/", mailwebadmin.StaticHandler())
 		http.Handle("/favicon.ico", http.FileServer(http.Dir("static")))
 		http.Handle("/login/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginPageHandler))
+		http.Handle("/login/2fa/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.SecondFactorLoginHandler))
+		http.Handle("/login/2fa/enroll/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.TOTPLoginEnrollHandler))
+		http.Handle("/login/oidc/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.OIDCLoginHandler))
+		http.Handle("/login/oidc/callback/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.OIDCCallbackHandler))
 		http.Handle("/logout/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.Logout)))
 		http.Handle("/license/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.RenderLicenseTemplate))
 		http.Handle("/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RootPageHandler)))
@@ -75,19 +86,22 @@ func main() {
 		http.Handle("/users/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderUsersTemplate)))
 		http.Handle("/aliases/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderAliasesTemplate)))
 		http.Handle("/admins/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderAdminsTemplate)))
+		http.Handle("/audit/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderAuditTemplate)))
+		http.Handle("/2fa/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderTwoFactorTemplate)))
+		http.Handle("/tokens/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderTokensTemplate)))
+		http.Handle("/sessions/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.RenderSessionsTemplate)))
 		http.Handle("/password/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.ChangeSinglePasswordHandler))
+		http.Handle("/password/reset/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.PasswordResetHandler))
+		http.Handle("/portal/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.PortalLoginRequired(mailwebadmin.RenderPortalTemplate)))
+		http.Handle("/portal/login/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.PortalLoginHandler))
+		http.Handle("/portal/logout/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.PortalLogoutHandler))
 	}
 
-	http.Handle("/api/domains/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.ListDomainsJSON)))
-	http.Handle("/api/users", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.ListUsersJSON)))
-	// really annoying, but I see no other way around this...
-	// we want both /users and /users/
-	http.Handle("/api/users/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.ListUsersJSON)))
-	http.Handle("/api/aliases/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.ListAliasesJSON)))
-	http.Handle("/api/admins/", mailwebadmin.NewMailAppHandler(appContext, mailwebadmin.LoginRequired(mailwebadmin.ListAdminsJSON)))
+	mailwebadmin.RegisterAPIRoutes(appContext, http.DefaultServeMux)
 	appContext.Logger.WithField("port", appContext.Port).Info("Ready. Waiting for requests.")
 	// appContext.Logger.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", appContext.Port),
 	// 	csrf.Protect(appContext.Keys[len(appContext.Keys)-1], csrf.Secure(false))(context.ClearHandler(http.DefaultServeMux))))
+	// requests with an API token don't need a CSRF token
 	appContext.Logger.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", appContext.Port),
-		csrf.Protect(appContext.Keys[len(appContext.Keys)-1])(context.ClearHandler(http.DefaultServeMux))))
+		mailwebadmin.BearerCSRFExempt(csrf.Protect(appContext.Keys[len(appContext.Keys)-1])(context.ClearHandler(http.DefaultServeMux)))))
 }
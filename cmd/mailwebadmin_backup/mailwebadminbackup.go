@@ -0,0 +1,111 @@
+// The MIT License (MIT)
+
+// Copyright (c) 2017 Fabian Wenzelmann
+
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/FabianWe/mailwebadmin"
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	configDirPtr := flag.String("config", "./config", "Directory to store the configuration files.")
+	actionPtr := flag.String("action", "", "Set to \"restore\" if you want to restore a backup, \"verify\" to verify a backup against its manifest or \"import\" to import a Maildir.")
+	archivePtr := flag.String("archive", "", "The backup file (.zip or .zip.age), for import a .zip, .tar or .tar.gz file.")
+	pathPtr := flag.String("path", "", "The directory to import a Maildir from (import only, instead of -archive).")
+	mailPtr := flag.String("mail", "", "The email of the user to restore / import.")
+	domainPtr := flag.String("domain", "", "The domain to restore, only used if mail is not set.")
+	flag.Parse()
+	configDir, configDirParseErr := filepath.Abs(*configDirPtr)
+	if configDirParseErr != nil {
+		log.WithError(configDirParseErr).Fatal("Can't parse config dir path: ", configDir)
+	}
+	appContext, configErr := mailwebadmin.ParseConfig(configDir, false)
+	if configErr != nil {
+		log.WithError(configErr).Fatal("Can't parse config file(s)")
+	}
+	if *archivePtr == "" && *pathPtr == "" {
+		appContext.Logger.Fatal("No archive given, use -archive")
+	}
+	// determine the action
+	switch strings.ToLower(*actionPtr) {
+	default:
+		appContext.Logger.WithField("action", *actionPtr).Fatal("Invalid action, must be either \"restore\", \"verify\" or \"import\"")
+	case "verify":
+		manifest, verifyErr := mailwebadmin.VerifyBackup(*archivePtr, appContext.BackupIdentities)
+		switch verifyErr {
+		case nil:
+			fmt.Printf("Backup is valid, verified %d files.\n", len(manifest.Files))
+		case mailwebadmin.ErrNoIdentities:
+			fmt.Println("Archive checksum is valid, but the archive is encrypted and no identity is configured: files not verified.")
+		default:
+			appContext.Logger.WithError(verifyErr).WithField("archive", *archivePtr).Fatal("Verification failed")
+		}
+	case "import":
+		user, domain, parseErr := mailwebadmin.ParseMailParts(*mailPtr)
+		if parseErr != nil {
+			appContext.Logger.WithError(parseErr).Fatal("Invalid email, use -mail")
+		}
+		var res *mailwebadmin.ImportResult
+		var importErr error
+		if *pathPtr != "" {
+			res, importErr = mailwebadmin.ImportMaildir(appContext, *pathPtr, domain, user)
+		} else {
+			file, openErr := os.Open(*archivePtr)
+			if openErr != nil {
+				appContext.Logger.WithError(openErr).Fatal("Can't open archive")
+			}
+			res, importErr = mailwebadmin.ImportArchive(appContext, file, mailwebadmin.ImportFormatFromName(*archivePtr), domain, user)
+			file.Close()
+		}
+		if importErr != nil {
+			appContext.Logger.WithError(importErr).Fatal("Import failed")
+		}
+		fmt.Printf("Imported %d files, skipped %d existing files.\n", res.Imported, res.Skipped)
+	case "restore":
+		switch {
+		case *mailPtr != "":
+			user, domain, parseErr := mailwebadmin.ParseMailParts(*mailPtr)
+			if parseErr != nil {
+				appContext.Logger.WithError(parseErr).Fatal("Invalid email")
+			}
+			if restoreErr := mailwebadmin.RestoreUserDir(appContext, *archivePtr, domain, user); restoreErr != nil {
+				appContext.Logger.WithError(restoreErr).WithField("archive", *archivePtr).Fatal("Restoring user directory failed")
+			}
+			appContext.Logger.WithField("mail", *mailPtr).Info("Successfully restored user directory")
+		case *domainPtr != "":
+			if restoreErr := mailwebadmin.RestoreDomainDir(appContext, *archivePtr, *domainPtr); restoreErr != nil {
+				appContext.Logger.WithError(restoreErr).WithField("archive", *archivePtr).Fatal("Restoring domain directory failed")
+			}
+			appContext.Logger.WithField("domain", *domainPtr).Info("Successfully restored domain directory")
+		default:
+			appContext.Logger.Fatal("Either -mail or -domain must be given")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/FabianWe/mailwebadmin"
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// mailwebadmin_import imports mail users and aliases from a CSV file, see
+// mailwebadmin.ImportCSV for the format.
+func main() {
+	configDirPtr := flag.String("config", "./config", "Directory to store the configuration files.")
+	filePtr := flag.String("file", "-", "The CSV file to import, \"-\" reads from stdin.")
+	dryRunPtr := flag.Bool("dry-run", false, "Only validate the CSV, don't import anything.")
+	flag.Parse()
+	configDir, configDirParseErr := filepath.Abs(*configDirPtr)
+	if configDirParseErr != nil {
+		log.WithError(configDirParseErr).Fatal("Can't parse config dir path: ", configDir)
+	}
+	appContext, configErr := mailwebadmin.ParseConfig(configDir, false)
+	if configErr != nil {
+		log.WithError(configErr).Fatal("Can't parse config file(s)")
+	}
+	var in io.Reader = os.Stdin
+	if *filePtr != "-" {
+		file, openErr := os.Open(*filePtr)
+		if openErr != nil {
+			appContext.Logger.WithError(openErr).Fatal("Can't open CSV file")
+		}
+		defer file.Close()
+		in = file
+	}
+	res, importErr := mailwebadmin.ImportCSV(appContext, in, mailwebadmin.UnrestrictedDomainScope(), *dryRunPtr)
+	if importErr != nil {
+		appContext.Logger.WithError(importErr).Fatal("Import failed")
+	}
+	for _, rowErr := range res.Errors {
+		fmt.Printf("line %d (%s): %s\n", rowErr.Line, rowErr.Email, rowErr.Message)
+	}
+	switch {
+	case len(res.Errors) > 0:
+		fmt.Printf("%d invalid rows, nothing was imported\n", len(res.Errors))
+		os.Exit(1)
+	case *dryRunPtr:
+		fmt.Printf("CSV is valid, would import %d users and %d aliases\n", res.Users, res.Aliases)
+	default:
+		fmt.Printf("Imported %d users and %d aliases\n", res.Users, res.Aliases)
+	}
+}
@@ -0,0 +1,118 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/FabianWe/mailwebadmin"
+	_ "github.com/go-sql-driver/mysql"
+	log "github.com/sirupsen/logrus"
+)
+
+// mailwebadmin_state exports the configuration (domains, users, aliases and
+// admins) or applies a previously exported and edited file, see
+// mailwebadmin.PlanState.
+func main() {
+	configDirPtr := flag.String("config", "./config", "Directory to store the configuration files.")
+	actionPtr := flag.String("action", "export", "The action to perform: export or apply.")
+	filePtr := flag.String("file", "-", "The file to write (export) or read (apply), \"-\" uses stdout / stdin.")
+	formatPtr := flag.String("format", "", "The file format, yaml or json. Defaults to json for files ending with .json and yaml otherwise.")
+	dryRunPtr := flag.Bool("dry-run", false, "Only print the changes apply would make, don't change anything.")
+	flag.Parse()
+	format := *formatPtr
+	if format == "" {
+		format = mailwebadmin.StateFormatFromPath(*filePtr)
+	}
+	configDir, configDirParseErr := filepath.Abs(*configDirPtr)
+	if configDirParseErr != nil {
+		log.WithError(configDirParseErr).Fatal("Can't parse config dir path: ", configDir)
+	}
+	appContext, configErr := mailwebadmin.ParseConfig(configDir, false)
+	if configErr != nil {
+		log.WithError(configErr).Fatal("Can't parse config file(s)")
+	}
+	switch *actionPtr {
+	case "export":
+		state, exportErr := mailwebadmin.ExportState(appContext)
+		if exportErr != nil {
+			appContext.Logger.WithError(exportErr).Fatal("Export failed")
+		}
+		var out io.Writer = os.Stdout
+		if *filePtr != "-" {
+			file, createErr := os.Create(*filePtr)
+			if createErr != nil {
+				appContext.Logger.WithError(createErr).Fatal("Can't create export file")
+			}
+			defer file.Close()
+			out = file
+		}
+		if writeErr := mailwebadmin.WriteMailState(state, format, out); writeErr != nil {
+			appContext.Logger.WithError(writeErr).Fatal("Can't write export")
+		}
+	case "apply":
+		var in io.Reader = os.Stdin
+		if *filePtr != "-" {
+			file, openErr := os.Open(*filePtr)
+			if openErr != nil {
+				appContext.Logger.WithError(openErr).Fatal("Can't open state file")
+			}
+			defer file.Close()
+			in = file
+		}
+		state, readErr := mailwebadmin.ReadMailState(in, format)
+		if readErr != nil {
+			appContext.Logger.WithError(readErr).Fatal("Can't parse state file")
+		}
+		plan, planErr := mailwebadmin.PlanState(appContext, state)
+		if planErr != nil {
+			appContext.Logger.WithError(planErr).Fatal("Can't compute changes")
+		}
+		if len(plan.Errors) > 0 {
+			for _, stateErr := range plan.Errors {
+				fmt.Println(stateErr)
+			}
+			fmt.Printf("%d errors, nothing was changed\n", len(plan.Errors))
+			os.Exit(1)
+		}
+		for _, change := range plan.Changes {
+			fmt.Println(change)
+		}
+		if *dryRunPtr {
+			fmt.Printf("Would apply %d changes\n", len(plan.Changes))
+			return
+		}
+		applied, applyErr := mailwebadmin.ApplyStatePlan(appContext, plan)
+		if applyErr != nil {
+			fmt.Printf("Applied %d of %d changes\n", applied, len(plan.Changes))
+			appContext.Logger.WithError(applyErr).Fatal("Apply failed")
+		}
+		fmt.Printf("Applied %d changes\n", applied)
+	default:
+		log.Fatalf("Invalid action \"%s\", must be export or apply", *actionPtr)
+	}
+}
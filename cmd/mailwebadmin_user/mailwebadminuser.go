@@ -41,6 +41,7 @@ import (
 func main() {
 	configDirPtr := flag.String("config", "./config", "Directory to store the configuration files.")
 	actionPtr := flag.String("action", "", "Set to \"add\" if you want to add a useror \"list\" to list all users.")
+	rolePtr := flag.String("role", "", "The role of the new user (superadmin, domainadmin, helpdesk or readonly), required for \"add\".")
 	flag.Parse()
 	configDir, configDirParseErr := filepath.Abs(*configDirPtr)
 	if configDirParseErr != nil {
@@ -61,11 +62,22 @@ func main() {
 		if listErr != nil {
 			appContext.Logger.WithError(listErr).Fatal("Can't receive users list.")
 		}
+		roles, rolesErr := mailwebadmin.ListAdminRoles(appContext)
+		if rolesErr != nil {
+			appContext.Logger.WithError(rolesErr).Fatal("Can't receive admin roles.")
+		}
 		fmt.Printf("There are %d admin users:\n", len(users))
-		for _, username := range users {
-			fmt.Printf("  - %s\n", username)
+		for id, username := range users {
+			role, hasRole := roles[id]
+			if !hasRole {
+				role = mailwebadmin.DefaultRole
+			}
+			fmt.Printf("  - %s (%s)\n", username, role)
 		}
 	case "add":
+		if *rolePtr == "" {
+			appContext.Logger.Fatal("The role of the new user is required, set it with -role")
+		}
 		fmt.Print("Username: ")
 		username, _ := reader.ReadString('\n')
 		username = strings.TrimSpace(username)
@@ -74,8 +86,16 @@ func main() {
 		if pwErr != nil {
 			appContext.Logger.WithError(pwErr).Fatal("Can't read from stdin")
 		}
-		if _, insertErr := appContext.UserHandler.Insert(username, "", "", "", bytePW); insertErr != nil {
-			appContext.Logger.WithError(insertErr).Fatal("Error while new admin.")
+		fmt.Println()
+		if policyErr := appContext.PasswordPolicy.Check(string(bytePW), username); policyErr != nil {
+			appContext.Logger.WithError(policyErr).Fatal("Invalid password")
+		}
+		role, roleErr := mailwebadmin.ParseRole(*rolePtr)
+		if roleErr != nil {
+			appContext.Logger.WithError(roleErr).Fatal("Invalid role")
+		}
+		if _, insertErr := mailwebadmin.AddAdmin(appContext, username, bytePW, role); insertErr != nil {
+			appContext.Logger.WithError(insertErr).Fatal("Error while adding new admin.")
 		}
 		appContext.Logger.WithField("username", username).Info("Successfully added new admin user")
 	}
@@ -32,11 +32,13 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net/http"
 	"os"
 	"path"
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	"github.com/BurntSushi/toml"
 	"github.com/FabianWe/goauth"
 	"github.com/gorilla/securecookie"
@@ -53,6 +55,9 @@ type MailAppContext struct {
 	// Store is the session store to be used. It gets initialized after reading
 	// the key file.
 	Store sessions.Store
+	// PortalStore is the session store for the self-service portal of mail
+	// users, it uses other keys than Store.
+	PortalStore sessions.Store
 	// Logger is used to log messages.
 	Logger *logrus.Logger
 	// UserHandler is used to administer admin users.
@@ -85,10 +90,48 @@ type MailAppContext struct {
 	// Otherwise backups (as zip files) are created inside this directory.
 	// It defaults to the empty string.
 	Backup string
+	// BackupRecipients are the age recipients backups get encrypted for.
+	// If empty backups are not encrypted.
+	BackupRecipients []age.Recipient
+	// BackupIdentities are the age identities used to decrypt backups
+	// on restore. They're read from the file given in backup_identity and
+	// are only required to restore encrypted backups.
+	BackupIdentities []age.Identity
+	// Trash is the directory deleted mail directories are moved to.
+	// If set and Delete is true users are not deleted immediately but moved
+	// to the trash, they can be restored until TrashLifespan has passed.
+	// Without Delete the mail directories are never touched, so the trash is
+	// not used.
+	// It defaults to the empty string (no trash).
+	Trash string
+	// TrashLifespan is the time a deleted user is kept in the trash before it
+	// gets purged.
+	TrashLifespan time.Duration
+	// TwoFactorRequired is set to true if all admins must use two-factor
+	// authentication. Admins without TOTP must enroll on their next login.
+	TwoFactorRequired bool
+	// Lockout is the policy for locking remote addresses and accounts after
+	// failed login attempts.
+	Lockout LockoutPolicy
+	// OIDC is used for the single sign-on, it is nil if no provider is
+	// configured.
+	OIDC *OIDCAuth
+	// Portal is the configuration of the self-service portal for mail users.
+	Portal PortalConfig
+	// Mailer is used to send mails, it is nil if no SMTP server is
+	// configured.
+	Mailer *Mailer
+	// PasswordReset is the configuration of the password reset for mail
+	// users.
+	PasswordReset PasswordResetConfig
+	// PasswordPolicy is the policy passwords of mail users and admins are
+	// checked against.
+	PasswordPolicy *PasswordPolicy
 }
 
 // ReadOrCreateKeys either reads the key file or, if it doesn't exist, creates
 // a key pair. contenxt.Keys are set to the keys read / created.
+// The same is done for the keys of PortalStore in ConfigDir/portal_keys.
 // If a key file (inside ConfigDir/keys) exists it must be a file with
 // a key in each line.
 // There must be pairs stored in the file: A list of
@@ -97,10 +140,24 @@ type MailAppContext struct {
 // ...
 // The auth-keys must be 64 byte long, the encryption keys 32 bytes long.
 func (context *MailAppContext) ReadOrCreateKeys() {
-	keyFile := path.Join(context.ConfigDir, "keys")
+	context.Keys = context.readOrCreateKeyFile(path.Join(context.ConfigDir, "keys"))
+	context.Store = sessions.NewCookieStore(context.Keys...)
+	// the portal for mail users uses its own keys, a portal session can never
+	// be used as an admin session
+	portalKeys := context.readOrCreateKeyFile(path.Join(context.ConfigDir, "portal_keys"))
+	portalStore := sessions.NewCookieStore(portalKeys...)
+	portalStore.Options.Path = "/"
+	portalStore.Options.HttpOnly = true
+	portalStore.Options.SameSite = http.SameSiteStrictMode
+	context.PortalStore = portalStore
+}
+
+// readOrCreateKeyFile reads the keys from keyFile or, if it doesn't exist,
+// creates a new key pair and writes it to keyFile.
+func (context *MailAppContext) readOrCreateKeyFile(keyFile string) [][]byte {
 	var res [][]byte
 	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
-		context.Logger.Info("Key file doesn't exist, creating new keys.")
+		context.Logger.WithField("file", keyFile).Info("Key file doesn't exist, creating new keys.")
 		// path does not exist, so get a new random pair
 		pairs, genErr := GenKeyPair()
 		if genErr != nil {
@@ -120,8 +177,7 @@ func (context *MailAppContext) ReadOrCreateKeys() {
 		}
 		res = pairs
 	}
-	context.Keys = res
-	context.Store = sessions.NewCookieStore(res...)
+	return res
 }
 
 // ReadKeyPairs reads the key pairs from the key files.
@@ -195,14 +251,34 @@ func GenKeyPair() ([][]byte, error) {
 // tomlConfig is used to parse the configuration file.
 // See wiki for configuration options.
 type tomlConfig struct {
-	Port          int
-	MailDir       string `toml:"maildir"`
-	Delete        bool
-	Backup        string
-	AdminUser     string       `toml:"admin_user"`
-	AdminPassword string       `toml:"admin_password"`
-	DB            dbInfo       `toml:"mysql"`
-	TimeSettings  timeSettings `toml:"timers"`
+	Port             int
+	MailDir          string `toml:"maildir"`
+	Delete           bool
+	Backup           string
+	BackupRecipients []string `toml:"backup_recipients"`
+	BackupIdentity   string   `toml:"backup_identity"`
+	Trash            string
+	Require2FA       bool               `toml:"require_2fa"`
+	AdminUser        string             `toml:"admin_user"`
+	AdminPassword    string             `toml:"admin_password"`
+	DB               dbInfo             `toml:"mysql"`
+	TimeSettings     timeSettings       `toml:"timers"`
+	Lockout          lockoutInfo        `toml:"lockout"`
+	LDAP             ldapInfo           `toml:"ldap"`
+	OIDC             oidcInfo           `toml:"oidc"`
+	Portal           portalInfo         `toml:"portal"`
+	SMTP             smtpInfo           `toml:"smtp"`
+	PasswordReset    passwordResetInfo  `toml:"password_reset"`
+	PasswordPolicy   passwordPolicyInfo `toml:"password_policy"`
+}
+
+// lockoutInfo is used in the server config in the [lockout] section.
+type lockoutInfo struct {
+	Threshold   int      `toml:"threshold"`
+	IPThreshold int      `toml:"ip_threshold"`
+	BaseDelay   duration `toml:"base_delay"`
+	MaxDelay    duration `toml:"max_delay"`
+	ResetAfter  duration `toml:"reset_after"`
 }
 
 // dbInfo is used in the server config in the [mysql] section.
@@ -228,15 +304,49 @@ func (d *duration) UnmarshalText(text []byte) error {
 type timeSettings struct {
 	SessionLifespan duration `toml:"session_lifespan"`
 	InvalidKeyTimer duration `toml:"invalid_keys"`
+	TrashLifespan   duration `toml:"trash_lifespan"`
+	PurgeTrashTimer duration `toml:"purge_trash"`
+}
+
+// parseBackupRecipients parses the age public keys from the config file.
+func parseBackupRecipients(keys []string) ([]age.Recipient, error) {
+	res := make([]age.Recipient, 0, len(keys))
+	for _, key := range keys {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backup recipient \"%s\": %s", key, err.Error())
+		}
+		res = append(res, recipient)
+	}
+	return res, nil
+}
+
+// readBackupIdentities reads the age identities from the given file.
+// If path is relative it is considered relative to the config directory.
+// If path is the empty string no identities are returned.
+func readBackupIdentities(configDir, identityFile string) ([]age.Identity, error) {
+	if identityFile == "" {
+		return nil, nil
+	}
+	if !path.IsAbs(identityFile) {
+		identityFile = path.Join(configDir, identityFile)
+	}
+	file, err := os.Open(identityFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return age.ParseIdentities(file)
 }
 
 // createAdminIfNotExists will create an adminUser with the given password.
 // If the username is empty no error will be thrown (default option is not to
 // create an admin user).
 // Otherwise password and username are verified with adminNameValid
-// and passwordValid.
+// and the PasswordPolicy.
 // If an admin with this name already exists this method doesn't attempt to add
 // the user and leave the password unchanged.
+// The admin is created as superadmin.
 func createAdminIfNotExists(context *MailAppContext, adminUser string, pw string) error {
 	if adminUser == "" {
 		return nil
@@ -244,7 +354,7 @@ func createAdminIfNotExists(context *MailAppContext, adminUser string, pw string
 	if nameErr := adminNameValid(adminUser); nameErr != nil {
 		return nameErr
 	}
-	if pwErr := passwordValid(pw); pwErr != nil {
+	if pwErr := context.PasswordPolicy.Check(pw, adminUser); pwErr != nil {
 		return pwErr
 	}
 	// user and password valid, lookup the user
@@ -255,7 +365,7 @@ func createAdminIfNotExists(context *MailAppContext, adminUser string, pw string
 		return nil
 	case goauth.ErrUserNotFound:
 		// lookup went well, we got no error, admin doesn't exist
-		if _, insertErr := context.UserHandler.Insert(adminUser, "", "", "", []byte(pw)); insertErr != nil {
+		if _, insertErr := AddAdmin(context, adminUser, []byte(pw), RoleSuperAdmin); insertErr != nil {
 			return insertErr
 		}
 		// everything fine
@@ -302,6 +412,16 @@ func ParseConfig(configDir string, startDaemon bool) (*MailAppContext, error) {
 		return nil, errors.New("Invalid maildir in conf: Must contain %d and %n")
 	}
 
+	backupRecipients, recipientsErr := parseBackupRecipients(conf.BackupRecipients)
+	if recipientsErr != nil {
+		return nil, recipientsErr
+	}
+
+	backupIdentities, identitiesErr := readBackupIdentities(configDir, conf.BackupIdentity)
+	if identitiesErr != nil {
+		return nil, identitiesErr
+	}
+
 	var confDBStr string
 
 	if conf.DB.Password == "" {
@@ -310,7 +430,7 @@ func ParseConfig(configDir string, startDaemon bool) (*MailAppContext, error) {
 		confDBStr = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", conf.DB.User, conf.DB.Password, conf.DB.Host, conf.DB.Port, conf.DB.DBName)
 	}
 
-	var invalidKeyTimer, sessionLifespan time.Duration
+	var invalidKeyTimer, sessionLifespan, trashLifespan, purgeTrashTimer time.Duration
 
 	if conf.TimeSettings.InvalidKeyTimer.Duration == time.Duration(0) {
 		invalidKeyTimer = time.Duration(24 * time.Hour)
@@ -324,24 +444,102 @@ func ParseConfig(configDir string, startDaemon bool) (*MailAppContext, error) {
 		sessionLifespan = conf.TimeSettings.SessionLifespan.Duration
 	}
 
+	if conf.TimeSettings.TrashLifespan.Duration == time.Duration(0) {
+		trashLifespan = time.Duration(168 * time.Hour)
+	} else {
+		trashLifespan = conf.TimeSettings.TrashLifespan.Duration
+	}
+
+	if conf.TimeSettings.PurgeTrashTimer.Duration == time.Duration(0) {
+		purgeTrashTimer = time.Duration(time.Hour)
+	} else {
+		purgeTrashTimer = conf.TimeSettings.PurgeTrashTimer.Duration
+	}
+
+	lockout := LockoutPolicy{
+		Threshold:   conf.Lockout.Threshold,
+		IPThreshold: conf.Lockout.IPThreshold,
+		BaseDelay:   conf.Lockout.BaseDelay.Duration,
+		MaxDelay:    conf.Lockout.MaxDelay.Duration,
+		ResetAfter:  conf.Lockout.ResetAfter.Duration,
+	}
+	if lockout.Threshold <= 0 {
+		lockout.Threshold = 5
+	}
+	if lockout.IPThreshold <= 0 {
+		lockout.IPThreshold = 20
+	}
+	if lockout.BaseDelay == time.Duration(0) {
+		lockout.BaseDelay = time.Minute
+	}
+	if lockout.MaxDelay == time.Duration(0) {
+		lockout.MaxDelay = time.Hour
+	}
+	if lockout.ResetAfter == time.Duration(0) {
+		lockout.ResetAfter = 24 * time.Hour
+	}
+
 	db, openErr := sql.Open("mysql", confDBStr)
 	if openErr != nil {
 		return nil, openErr
 	}
 
 	pwHandler := goauth.NewScryptHandler(nil)
-	userHandler := goauth.NewMySQLUserHandler(db, pwHandler)
+	var userHandler goauth.UserHandler
+	userHandler = goauth.NewMySQLUserHandler(db, pwHandler)
 	sessionController := goauth.NewMySQLSessionController(db, "", "")
 
 	res := &MailAppContext{DB: db, ConfigDir: configDir,
 		Store: nil, Logger: logrus.New(), UserHandler: userHandler,
 		SessionController: sessionController, Templates: make(map[string]*template.Template)}
 
+	// if an ldap server is given admins are authenticated against it
+	if conf.LDAP.URL != "" {
+		ldapConfig, ldapErr := parseLDAPConfig(conf.LDAP)
+		if ldapErr != nil {
+			return nil, ldapErr
+		}
+		userHandler = NewLDAPUserHandler(res, userHandler, ldapConfig)
+		res.UserHandler = userHandler
+	}
+
+	if conf.OIDC.Issuer != "" {
+		oidcConfig, oidcErr := parseOIDCConfig(conf.OIDC)
+		if oidcErr != nil {
+			return nil, oidcErr
+		}
+		res.OIDC = NewOIDCAuth(oidcConfig)
+	}
+
+	res.Portal = parsePortalConfig(conf.Portal)
+
+	mailer, mailerErr := parseMailer(conf.SMTP)
+	if mailerErr != nil {
+		return nil, mailerErr
+	}
+	res.Mailer = mailer
+	passwordReset, resetErr := parsePasswordResetConfig(conf.PasswordReset)
+	if resetErr != nil {
+		return nil, resetErr
+	}
+	res.PasswordReset = passwordReset
+	passwordPolicy, policyErr := parsePasswordPolicy(configDir, conf.PasswordPolicy)
+	if policyErr != nil {
+		return nil, policyErr
+	}
+	res.PasswordPolicy = passwordPolicy
+
 	res.DefaultSessionLifespan = sessionLifespan
 	res.Port = conf.Port
 	res.MailDir = conf.MailDir
 	res.Delete = conf.Delete
 	res.Backup = conf.Backup
+	res.BackupRecipients = backupRecipients
+	res.BackupIdentities = backupIdentities
+	res.Trash = conf.Trash
+	res.TrashLifespan = trashLifespan
+	res.TwoFactorRequired = conf.Require2FA
+	res.Lockout = lockout
 
 	res.ReadOrCreateKeys()
 
@@ -351,6 +549,9 @@ func ParseConfig(configDir string, startDaemon bool) (*MailAppContext, error) {
 	if err := sessionController.Init(); err != nil {
 		res.Logger.Fatal("Unable to connect to database:", err)
 	}
+	if err := initTables(res); err != nil {
+		res.Logger.Fatal("Unable to create tables:", err)
+	}
 	logrusFormatter := logrus.TextFormatter{}
 	logrusFormatter.FullTimestamp = true
 
@@ -366,6 +567,14 @@ func ParseConfig(configDir string, startDaemon bool) (*MailAppContext, error) {
 		// start a goroutine to clear the sessions table
 		sessionController.DeleteEntriesDaemon(invalidKeyTimer, nil, true)
 		res.Logger.WithField("sleep-time", invalidKeyTimer).Info("Starting daemon to delete invalid keys")
+		DeleteExpiredFailuresDaemon(res, invalidKeyTimer, nil)
+		DeleteExpiredSessionsDaemon(res, invalidKeyTimer, nil)
+		DeleteExpiredResetTokensDaemon(res, invalidKeyTimer, nil)
+		UpdateExpiredPasswordsDaemon(res, invalidKeyTimer, nil)
+		if res.Delete && res.Trash != "" {
+			PurgeTrashDaemon(res, purgeTrashTimer, nil)
+			res.Logger.WithField("sleep-time", purgeTrashTimer).Info("Starting daemon to purge the trash")
+		}
 	}
 	return res, nil
 }
@@ -0,0 +1,357 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// This file contains the bulk import of mail users and aliases from CSV,
+// used by POST /api/import and the mailwebadmin_import command.
+// The first line of the CSV must be a header with the column names, the
+// columns are:
+//
+//	type:          "user" or "alias" (required)
+//	email:         the mail address of the user or the source of the alias (required)
+//	password:      the plaintext password of a user
+//	password-hash: the password of a user as {SHA512-CRYPT} hash (as stored by Dovecot)
+//	destination:   the destination of an alias
+//
+// Users need either a password or a password-hash. Lines starting with # are
+// ignored.
+// All rows are imported in one transaction: if any row is invalid nothing
+// is imported and the errors of all rows are reported. In dry-run mode the
+// transaction is always rolled back.
+
+// MaxCSVImportSize is the maximal size of a CSV file for POST /api/import.
+const MaxCSVImportSize = 10 << 20
+
+// csvImportColumns are the valid columns of the CSV header.
+var csvImportColumns = map[string]bool{
+	"type":          true,
+	"email":         true,
+	"password":      true,
+	"password-hash": true,
+	"destination":   true,
+}
+
+// CSVImportError is the error for a single row of the CSV, Line is the line
+// number of the row in the file.
+type CSVImportError struct {
+	Line    int    `json:"line"`
+	Email   string `json:"email"`
+	Message string `json:"message"`
+}
+
+// CSVImportResult is the result of ImportCSV.
+// Users and Aliases are the number of users and aliases that were imported
+// (or would have been imported in dry-run mode) if there are no errors.
+type CSVImportResult struct {
+	DryRun  bool              `json:"dry-run"`
+	Users   int               `json:"users"`
+	Aliases int               `json:"aliases"`
+	Errors  []*CSVImportError `json:"errors"`
+	// imported contains the rows that were imported, used for the audit log.
+	imported []*csvImportRow
+}
+
+// csvImportRow is a row of the CSV, id is set after it was inserted.
+type csvImportRow struct {
+	line                                        int
+	rowType, email, password, hash, destination string
+	id                                          int64
+}
+
+// CSVSyntaxError is returned by ImportCSV if the CSV can't be read or the
+// header is invalid.
+type CSVSyntaxError struct {
+	Err error
+}
+
+func (err *CSVSyntaxError) Error() string {
+	return fmt.Sprintf("Invalid CSV: %s", err.Err)
+}
+
+// readCSVImport parses all rows of the CSV. The error is returned if the CSV
+// itself (or the header) is invalid.
+func readCSVImport(r io.Reader) ([]*csvImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	header, headerErr := reader.Read()
+	if headerErr == io.EOF {
+		return nil, errors.New("CSV is empty, the first line must contain the column names")
+	}
+	if headerErr != nil {
+		return nil, headerErr
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !csvImportColumns[name] {
+			return nil, fmt.Errorf("Invalid column \"%s\" in CSV header", name)
+		}
+		if _, has := columns[name]; has {
+			return nil, fmt.Errorf("Duplicate column \"%s\" in CSV header", name)
+		}
+		columns[name] = i
+	}
+	for _, required := range []string{"type", "email"} {
+		if _, has := columns[required]; !has {
+			return nil, fmt.Errorf("CSV header must contain the column \"%s\"", required)
+		}
+	}
+	get := func(record []string, column string) string {
+		if i, has := columns[column]; has {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	res := make([]*csvImportRow, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		res = append(res, &csvImportRow{line: line,
+			rowType:     strings.ToLower(get(record, "type")),
+			email:       get(record, "email"),
+			password:    get(record, "password"),
+			hash:        get(record, "password-hash"),
+			destination: get(record, "destination")})
+	}
+	return res, nil
+}
+
+// validate checks the row without accessing the database.
+func (row *csvImportRow) validate(appContext *MailAppContext) error {
+	if err := emailValid(row.email); err != nil {
+		return err
+	}
+	switch row.rowType {
+	case "user":
+		if row.destination != "" {
+			return errors.New("Users can't have a destination")
+		}
+		switch {
+		case row.password != "" && row.hash != "":
+			return errors.New("Users must have either a password or a password-hash, not both")
+		case row.hash != "":
+			if _, _, _, err := getPWParts(row.hash); err != nil {
+				return errors.New("password-hash must be a {SHA512-CRYPT} hash")
+			}
+			return nil
+		default:
+			return appContext.PasswordPolicy.Check(row.password, row.email)
+		}
+	case "alias":
+		if row.password != "" || row.hash != "" {
+			return errors.New("Aliases can't have a password")
+		}
+		if err := emailValid(row.destination); err != nil {
+			return fmt.Errorf("Invalid destination: %s", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Invalid type \"%s\", must be either user or alias", row.rowType)
+	}
+}
+
+// insert inserts the row in the transaction.
+func (row *csvImportRow) insert(tx *sql.Tx, domainID int64) error {
+	if row.rowType == "alias" {
+		// aliases are not unique in the database, so check it here
+		var num int
+		query := "SELECT COUNT(*) FROM virtual_aliases WHERE source = ? AND destination = ?;"
+		if err := tx.QueryRow(query, row.email, row.destination).Scan(&num); err != nil {
+			return err
+		}
+		if num > 0 {
+			return fmt.Errorf("Alias from %s to %s already exists", row.email, row.destination)
+		}
+		res, err := tx.Exec("INSERT INTO virtual_aliases (domain_id, source, destination) VALUES(?, ?, ?);",
+			domainID, row.email, row.destination)
+		if err != nil {
+			return err
+		}
+		row.id, _ = res.LastInsertId()
+		return nil
+	}
+	pwHash := row.hash
+	if pwHash == "" {
+		var pwErr error
+		if pwHash, pwErr = GenDovecotSHA512(row.password); pwErr != nil {
+			return pwErr
+		}
+	}
+	res, err := tx.Exec("INSERT INTO virtual_users (domain_id, email, password, password_set) VALUES(?, ?, ?, ?);",
+		domainID, row.email, pwHash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	row.id, _ = res.LastInsertId()
+	return nil
+}
+
+// ImportCSV imports the users and aliases from the CSV, see the
+// documentation at the top of this file. scope are the domains that can be
+// imported into.
+// The returned error is either a CSVSyntaxError or a database error, errors
+// of rows are reported in the result.
+func ImportCSV(appContext *MailAppContext, r io.Reader, scope *DomainScope, dryRun bool) (*CSVImportResult, error) {
+	rows, readErr := readCSVImport(r)
+	if readErr != nil {
+		return nil, &CSVSyntaxError{Err: readErr}
+	}
+	res := &CSVImportResult{DryRun: dryRun, Errors: make([]*CSVImportError, 0)}
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+	domainIDs := make(map[string]int64)
+	for _, row := range rows {
+		rowErr := row.validate(appContext)
+		var domainID int64
+		if rowErr == nil {
+			_, domain, _ := ParseMailParts(row.email)
+			var hasDomain bool
+			if domainID, hasDomain = domainIDs[domain]; !hasDomain {
+				switch err := tx.QueryRow("SELECT id FROM virtual_domains WHERE name = ?;", domain).Scan(&domainID); {
+				case err == sql.ErrNoRows:
+					domainID = -1
+				case err != nil:
+					return nil, err
+				}
+				domainIDs[domain] = domainID
+			}
+			switch {
+			case domainID < 0:
+				rowErr = fmt.Errorf("Domain %s doesn't exist", domain)
+			case !scope.Allows(domainID):
+				rowErr = fmt.Errorf("Not allowed to manage domain %s", domain)
+			}
+		}
+		if rowErr == nil {
+			if insertErr := row.insert(tx, domainID); insertErr != nil {
+				if !isDuplicateEntry(insertErr) {
+					return nil, insertErr
+				}
+				rowErr = fmt.Errorf("User %s already exists", row.email)
+			}
+		}
+		if rowErr != nil {
+			res.Errors = append(res.Errors, &CSVImportError{Line: row.line, Email: row.email, Message: rowErr.Error()})
+			continue
+		}
+		if row.rowType == "user" {
+			res.Users++
+		} else {
+			res.Aliases++
+		}
+	}
+	if dryRun || len(res.Errors) > 0 {
+		return res, nil
+	}
+	if commitErr := tx.Commit(); commitErr != nil {
+		return nil, commitErr
+	}
+	committed = true
+	res.imported = rows
+	appContext.Logger.WithFields(log.Fields{
+		"users":   res.Users,
+		"aliases": res.Aliases,
+	}).Info("Imported users and aliases from CSV")
+	return res, nil
+}
+
+// ImportCSVJSON is the handler for /api/import. It accepts POST requests
+// with a CSV body (see ImportCSV) and the query parameter dry-run=true to only
+// validate the CSV.
+// It replies with the CSVImportResult, if there were errors (and dry-run is
+// not set) the status is 400 and nothing was imported. Invalid CSV syntax is
+// reported as plain text error.
+func ImportCSVJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != postMethod {
+		http.Error(w, fmt.Sprintf("Invalid method for /api/import: %s", r.Method), 400)
+		return nil
+	}
+	dryRun := false
+	if dryRunStr := r.URL.Query().Get("dry-run"); dryRunStr != "" {
+		var parseErr error
+		if dryRun, parseErr = strconv.ParseBool(dryRunStr); parseErr != nil {
+			http.Error(w, "Invalid request: dry-run must be true or false", 400)
+			return nil
+		}
+	}
+	scope, scopeErr := domainScopeFromRequest(appcontext, r)
+	if scopeErr != nil {
+		return scopeErr
+	}
+	body := http.MaxBytesReader(w, r.Body, MaxCSVImportSize)
+	res, importErr := ImportCSV(appcontext, body, scope, dryRun)
+	if importErr != nil {
+		if _, isSyntaxErr := importErr.(*CSVSyntaxError); isSyntaxErr {
+			http.Error(w, importErr.Error(), 400)
+			return nil
+		}
+		return importErr
+	}
+	for _, row := range res.imported {
+		if row.rowType == "user" {
+			recordAudit(appcontext, r, AuditAddUser, AuditTargetUser, row.id, nil, AuditValues{"mail": row.email})
+		} else {
+			recordAudit(appcontext, r, AuditAddAlias, AuditTargetAlias, row.id, nil, AuditValues{"source": row.email, "dest": row.destination})
+		}
+	}
+	jsonEnc, jsonErr := json.Marshal(res)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(res.Errors) > 0 && !dryRun {
+		w.WriteHeader(400)
+	}
+	w.Write(jsonEnc)
+	return nil
+}
@@ -0,0 +1,209 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testPasswordHash is a {SHA512-CRYPT} hash as accepted by getPWParts.
+const testPasswordHash = "{SHA512-CRYPT}$6$0123456789abcdef$hash"
+
+func TestReadCSVImport(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		// err is a part of the expected error, empty if no error is expected
+		err  string
+		rows int
+	}{
+		{"valid", "type,email,password,destination\n# comment\nuser,alice@example.org,secret123,\nalias,info@example.org,,alice@example.org\n", "", 2},
+		{"header only", "type,email\n", "", 0},
+		{"column names are case insensitive", " Type , EMAIL \nuser,alice@example.org\n", "", 1},
+		{"empty", "", "CSV is empty", 0},
+		{"unknown column", "type,email,quota\n", "Invalid column \"quota\"", 0},
+		{"duplicate column", "type,email,Email\n", "Duplicate column \"email\"", 0},
+		{"missing type", "email,password\n", "must contain the column \"type\"", 0},
+		{"missing email", "type,destination\n", "must contain the column \"email\"", 0},
+		{"wrong number of fields", "type,email\nuser,alice@example.org,secret123\n", "wrong number of fields", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows, err := readCSVImport(strings.NewReader(tt.csv))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Expected error containing %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Reading failed: %s", err)
+			}
+			if len(rows) != tt.rows {
+				t.Errorf("Expected %d rows, got %d", tt.rows, len(rows))
+			}
+		})
+	}
+}
+
+func TestReadCSVImportRows(t *testing.T) {
+	csv := "Type,email,password-hash,destination\nUSER, alice@example.org ," + testPasswordHash + ",\n# comment\nalias,info@example.org,,alice@example.org\n"
+	rows, err := readCSVImport(strings.NewReader(csv))
+	if err != nil {
+		t.Fatalf("Reading failed: %s", err)
+	}
+	expected := []csvImportRow{
+		{line: 2, rowType: "user", email: "alice@example.org", hash: testPasswordHash},
+		{line: 4, rowType: "alias", email: "info@example.org", destination: "alice@example.org"},
+	}
+	if len(rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got %d", len(expected), len(rows))
+	}
+	for i, row := range rows {
+		if *row != expected[i] {
+			t.Errorf("Row %d: expected %+v, got %+v", i, expected[i], *row)
+		}
+	}
+}
+
+func TestCSVImportRowValidate(t *testing.T) {
+	appContext := &MailAppContext{PasswordPolicy: DefaultPasswordPolicy()}
+	tests := []struct {
+		name string
+		row  csvImportRow
+		// err is a part of the expected error, empty if the row is valid
+		err string
+	}{
+		{"user with password", csvImportRow{rowType: "user", email: "alice@example.org", password: "secret123"}, ""},
+		{"user with hash", csvImportRow{rowType: "user", email: "alice@example.org", hash: testPasswordHash}, ""},
+		{"alias", csvImportRow{rowType: "alias", email: "info@example.org", destination: "alice@example.org"}, ""},
+		{"invalid email", csvImportRow{rowType: "user", email: "alice", password: "secret123"}, "Invalid Email address"},
+		{"password and hash", csvImportRow{rowType: "user", email: "alice@example.org", password: "secret123", hash: testPasswordHash},
+			"either a password or a password-hash"},
+		{"invalid hash", csvImportRow{rowType: "user", email: "alice@example.org", hash: "secret123"}, "must be a {SHA512-CRYPT} hash"},
+		{"weak password", csvImportRow{rowType: "user", email: "alice@example.org", password: "abc"}, "at least"},
+		{"user without password", csvImportRow{rowType: "user", email: "alice@example.org"}, "at least"},
+		{"user with destination", csvImportRow{rowType: "user", email: "alice@example.org", password: "secret123", destination: "bob@example.org"},
+			"Users can't have a destination"},
+		{"alias with password", csvImportRow{rowType: "alias", email: "info@example.org", password: "secret123", destination: "alice@example.org"},
+			"Aliases can't have a password"},
+		{"alias with hash", csvImportRow{rowType: "alias", email: "info@example.org", hash: testPasswordHash, destination: "alice@example.org"},
+			"Aliases can't have a password"},
+		{"alias without destination", csvImportRow{rowType: "alias", email: "info@example.org"}, "Invalid destination"},
+		{"unknown type", csvImportRow{rowType: "group", email: "team@example.org"}, "Invalid type \"group\""},
+		{"missing type", csvImportRow{email: "alice@example.org", password: "secret123"}, "Invalid type \"\""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.row.validate(appContext)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Expected the row to be valid, got %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// testImportCSV contains a user and an alias in example.org.
+const testImportCSV = "type,email,password-hash,destination\n" +
+	"user,alice@example.org," + testPasswordHash + ",\n" +
+	"alias,info@example.org,,alice@example.org\n"
+
+// expectImportRows expects the inserts of the rows of testImportCSV.
+func expectImportRows(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM virtual_domains WHERE name = ?")).
+		WithArgs("example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO virtual_users (domain_id, email, password, password_set)")).
+		WithArgs(1, "alice@example.org", testPasswordHash, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM virtual_aliases WHERE source = ? AND destination = ?")).
+		WithArgs("info@example.org", "alice@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO virtual_aliases (domain_id, source, destination)")).
+		WithArgs(1, "info@example.org", "alice@example.org").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+}
+
+func TestImportCSVRollsBackOnError(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	appContext.PasswordPolicy = DefaultPasswordPolicy()
+	csv := testImportCSV +
+		"alias,sales,,alice@example.org\n" +
+		"alias,info@example.com,,alice@example.org\n"
+	mock.ExpectBegin()
+	expectImportRows(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM virtual_domains WHERE name = ?")).
+		WithArgs("example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectRollback()
+	res, err := ImportCSV(appContext, strings.NewReader(csv), UnrestrictedDomainScope(), false)
+	if err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if len(res.Errors) != 2 || res.Errors[0].Line != 4 || res.Errors[1].Line != 5 ||
+		res.Errors[1].Message != "Domain example.com doesn't exist" {
+		t.Errorf("Expected errors in line 4 and 5, got %+v", res.Errors)
+	}
+	if res.Users != 1 || res.Aliases != 1 {
+		t.Errorf("Expected the valid rows to be counted, got %d users and %d aliases", res.Users, res.Aliases)
+	}
+	if len(res.imported) != 0 {
+		t.Errorf("Nothing must be reported as imported, got %d rows", len(res.imported))
+	}
+}
+
+func TestImportCSVDryRun(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	appContext.PasswordPolicy = DefaultPasswordPolicy()
+	mock.ExpectBegin()
+	expectImportRows(mock)
+	mock.ExpectRollback()
+	res, err := ImportCSV(appContext, strings.NewReader(testImportCSV), UnrestrictedDomainScope(), true)
+	if err != nil {
+		t.Fatalf("Import failed: %s", err)
+	}
+	if !res.DryRun || len(res.Errors) != 0 || res.Users != 1 || res.Aliases != 1 {
+		t.Errorf("Unexpected result %+v", res)
+	}
+	if len(res.imported) != 0 {
+		t.Errorf("Nothing must be reported as imported, got %d rows", len(res.imported))
+	}
+}
+
+func TestImportCSVSyntaxError(t *testing.T) {
+	appContext, _ := newTestContext(t)
+	_, err := ImportCSV(appContext, strings.NewReader("type,mail\n"), UnrestrictedDomainScope(), false)
+	if _, isSyntaxErr := err.(*CSVSyntaxError); !isSyntaxErr {
+		t.Errorf("Expected a CSVSyntaxError, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the delegation of domains to admins: Each admin that is
+// not a superadmin can only see and modify the domains assigned to them in
+// the table admin_domains.
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/FabianWe/goauth"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetAdminDomains returns the ids of all domains assigned to the admin.
+func GetAdminDomains(appContext *MailAppContext, adminID goauth.UserKeyType) ([]int64, error) {
+	rows, err := appContext.DB.Query("SELECT domain_id FROM admin_domains WHERE user_id = ?;", uint64(adminID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]int64, 0)
+	for rows.Next() {
+		var domainID int64
+		if scanErr := rows.Scan(&domainID); scanErr != nil {
+			return nil, scanErr
+		}
+		res = append(res, domainID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ListAdminDomains returns the assigned domains for all admins in the form
+// admin id --> list of domain ids.
+func ListAdminDomains(appContext *MailAppContext) (map[goauth.UserKeyType][]int64, error) {
+	rows, err := appContext.DB.Query("SELECT user_id, domain_id FROM admin_domains;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[goauth.UserKeyType][]int64)
+	for rows.Next() {
+		var adminID uint64
+		var domainID int64
+		if scanErr := rows.Scan(&adminID, &domainID); scanErr != nil {
+			return nil, scanErr
+		}
+		res[goauth.UserKeyType(adminID)] = append(res[goauth.UserKeyType(adminID)], domainID)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// SetAdminDomains replaces the domains assigned to the admin by domainIDs.
+func SetAdminDomains(appContext *MailAppContext, adminID goauth.UserKeyType, domainIDs []int64) error {
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM admin_domains WHERE user_id = ?;", uint64(adminID)); err != nil {
+		return err
+	}
+	for _, domainID := range domainIDs {
+		if _, err := tx.Exec("INSERT INTO admin_domains (user_id, domain_id) VALUES (?, ?);", uint64(adminID), domainID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"admin-id": adminID,
+		"domains":  domainIDs,
+	}).Info("Set admin domains")
+	return nil
+}
+
+// DeleteAdminDomains removes all domain assignments of the admin, this is
+// called when an admin is deleted.
+func DeleteAdminDomains(appContext *MailAppContext, adminID goauth.UserKeyType) error {
+	_, err := appContext.DB.Exec("DELETE FROM admin_domains WHERE user_id = ?;", uint64(adminID))
+	return err
+}
+
+// DomainScope describes the domains an admin is allowed to access.
+type DomainScope struct {
+	// all is true if the admin can access all domains.
+	all bool
+	// domains contains the ids of the accessible domains if all is false.
+	domains map[int64]bool
+}
+
+// UnrestrictedDomainScope returns a scope that allows all domains, it is
+// used by the command line tools.
+func UnrestrictedDomainScope() *DomainScope {
+	return &DomainScope{all: true}
+}
+
+// Unrestricted returns true if all domains can be accessed.
+func (scope *DomainScope) Unrestricted() bool {
+	return scope.all
+}
+
+// Allows checks if the domain with the given id can be accessed.
+func (scope *DomainScope) Allows(domainID int64) bool {
+	return scope.all || scope.domains[domainID]
+}
+
+// domainScopeFromRequest returns the scope of the admin that is logged in
+// (see AdminFromRequest). Superadmins can access all domains, all other
+// admins only the domains assigned to them.
+// If the request has no admin (it didn't pass RoleRequired) no domain can be
+// accessed.
+func domainScopeFromRequest(appContext *MailAppContext, r *http.Request) (*DomainScope, error) {
+	adminID, role, ok := AdminFromRequest(r)
+	if !ok {
+		return &DomainScope{domains: make(map[int64]bool)}, nil
+	}
+	if role == RoleSuperAdmin {
+		return &DomainScope{all: true}, nil
+	}
+	domainIDs, err := GetAdminDomains(appContext, adminID)
+	if err != nil {
+		return nil, err
+	}
+	res := &DomainScope{domains: make(map[int64]bool, len(domainIDs))}
+	for _, domainID := range domainIDs {
+		res.domains[domainID] = true
+	}
+	return res, nil
+}
+
+// requireDomainAccess checks if the admin of the request can access the
+// domain. If not it replies with a 403 and returns false.
+func requireDomainAccess(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, domainID int64) (bool, error) {
+	scope, err := domainScopeFromRequest(appContext, r)
+	if err != nil {
+		return false, err
+	}
+	if !scope.Allows(domainID) {
+		appContext.Logger.WithFields(log.Fields{
+			"domain-id": domainID,
+			"url":       r.URL.Path,
+		}).Warn("Admin tried to access a domain not assigned to them")
+		http.Error(w, "Forbidden", 403)
+		return false, nil
+	}
+	return true, nil
+}
+
+// Tables that have a domain_id column, used for requireRowAccess.
+const (
+	usersTable   = "virtual_users"
+	aliasesTable = "virtual_aliases"
+	trashTable   = "trash_users"
+)
+
+// requireRowAccess checks if the admin of the request can access the row
+// with the given id in table (one of usersTable, aliasesTable or trashTable).
+// For restricted admins it looks up the domain of the row and replies with
+// a 404 if the row doesn't exist or a 403 if the domain is not allowed.
+func requireRowAccess(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, table string, id int64) (bool, error) {
+	scope, err := domainScopeFromRequest(appContext, r)
+	if err != nil {
+		return false, err
+	}
+	if scope.Unrestricted() {
+		return true, nil
+	}
+	var domainID int64
+	query := fmt.Sprintf("SELECT domain_id FROM %s WHERE id = ?;", table)
+	switch scanErr := appContext.DB.QueryRow(query, id).Scan(&domainID); {
+	case scanErr == sql.ErrNoRows:
+		http.NotFound(w, r)
+		return false, nil
+	case scanErr != nil:
+		return false, scanErr
+	}
+	if !scope.Allows(domainID) {
+		appContext.Logger.WithFields(log.Fields{
+			"domain-id": domainID,
+			"url":       r.URL.Path,
+		}).Warn("Admin tried to access a domain not assigned to them")
+		http.Error(w, "Forbidden", 403)
+		return false, nil
+	}
+	return true, nil
+}
+
+// domainFromQuery parses the query parameter domain=DOMAIN-ID, it returns
+// -1 if no domain is given.
+// For admins that can't access all domains the parameter is required and
+// must be a domain assigned to the admin.
+// If the parameter is invalid or not allowed it replies with an error and
+// returns false.
+func domainFromQuery(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) (int64, bool, error) {
+	var domainID int64 = -1
+	queryArgs := r.URL.Query()
+	if domainValues, has := queryArgs["domain"]; has {
+		if len(domainValues) != 1 {
+			http.Error(w, "Invalid GET request. query params must contain at most one domain=DOMAIN-ID", 400)
+			return -1, false, nil
+		}
+		// get first element and try to parse it as an int
+		var parseErr error
+		if domainID, parseErr = strconv.ParseInt(domainValues[0], 10, 64); parseErr != nil {
+			http.Error(w, "Invalid GET request. query params must contain at most one domain=DOMAIN-ID. DOMAIN-ID must be an int.", 400)
+			return -1, false, nil
+		}
+	}
+	scope, err := domainScopeFromRequest(appContext, r)
+	if err != nil {
+		return -1, false, err
+	}
+	if scope.Unrestricted() {
+		return domainID, true, nil
+	}
+	if domainID < 0 {
+		http.Error(w, "Invalid GET request. query params must contain domain=DOMAIN-ID", 400)
+		return -1, false, nil
+	}
+	if !scope.Allows(domainID) {
+		http.Error(w, "Forbidden", 403)
+		return -1, false, nil
+	}
+	return domainID, true, nil
+}
+
+// requireMailAccess checks if the admin of the request can access the domain
+// of the given mail address, it is used before new users or aliases are
+// created. Restricted admins get a 403 if the domain doesn't exist.
+func requireMailAccess(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, mail string) (bool, error) {
+	scope, err := domainScopeFromRequest(appContext, r)
+	if err != nil {
+		return false, err
+	}
+	if scope.Unrestricted() {
+		return true, nil
+	}
+	_, domain, partsErr := ParseMailParts(mail)
+	if partsErr != nil {
+		http.Error(w, partsErr.Error(), 400)
+		return false, nil
+	}
+	domainID, lookupErr := getDomainID(appContext, domain)
+	switch {
+	case lookupErr == sql.ErrNoRows:
+		http.Error(w, "Forbidden", 403)
+		return false, nil
+	case lookupErr != nil:
+		return false, lookupErr
+	}
+	if !scope.Allows(domainID) {
+		appContext.Logger.WithFields(log.Fields{
+			"domain-id": domainID,
+			"url":       r.URL.Path,
+		}).Warn("Admin tried to access a domain not assigned to them")
+		http.Error(w, "Forbidden", 403)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,176 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/csrf"
+)
+
+// This file contains the detailed information about a single domain, user
+// or alias returned by GET /api/domains/<id>, /api/users/<id> and
+// /api/aliases/<id> (and the same resources in /api/v2/).
+
+// DomainDetails is the information about a single domain.
+type DomainDetails struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	UserCount  int64  `json:"user-count"`
+	AliasCount int64  `json:"alias-count"`
+}
+
+// GetDomainDetails returns the details of the domain, it returns
+// sql.ErrNoRows if the domain doesn't exist.
+func GetDomainDetails(appContext *MailAppContext, domainID int64) (*DomainDetails, error) {
+	res := &DomainDetails{ID: domainID}
+	query := `SELECT d.name,
+		(SELECT COUNT(*) FROM virtual_users WHERE domain_id = d.id),
+		(SELECT COUNT(*) FROM virtual_aliases WHERE domain_id = d.id)
+		FROM virtual_domains d WHERE d.id = ?;`
+	if err := appContext.DB.QueryRow(query, domainID).Scan(&res.Name, &res.UserCount, &res.AliasCount); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// MailUserStatus is the status of a mail user.
+type MailUserStatus struct {
+	// PasswordSet is the time the password was set, nil if unknown.
+	PasswordSet *time.Time `json:"password-set"`
+	// PasswordExpired is true if the login is denied until the password is
+	// changed, see UpdateExpiredPasswords.
+	PasswordExpired bool `json:"password-expired"`
+	// Locked is true if password changes are locked because of failed
+	// attempts, see CheckLockout.
+	Locked      bool       `json:"locked"`
+	LockedUntil *time.Time `json:"locked-until,omitempty"`
+}
+
+// UserDetails is the information about a single mail user.
+// Aliases are the aliases with the user as destination and Forwards are the
+// aliases with the user as source, both in the form id --> address.
+// Quota is nil if it can't be read.
+type UserDetails struct {
+	ID           int64            `json:"id"`
+	Email        string           `json:"email"`
+	DomainID     int64            `json:"domain-id"`
+	DomainName   string           `json:"domain-name"`
+	Aliases      map[int64]string `json:"aliases"`
+	Forwards     map[int64]string `json:"forwards"`
+	RecoveryMail string           `json:"recovery-mail"`
+	Quota        *MailQuota       `json:"quota"`
+	Status       *MailUserStatus  `json:"status"`
+}
+
+// GetUserDetails returns the details of the mail user, it returns
+// sql.ErrNoRows if the user doesn't exist.
+func GetUserDetails(appContext *MailAppContext, userID int64) (*UserDetails, error) {
+	res := &UserDetails{ID: userID, Status: &MailUserStatus{}}
+	var passwordSet sqlTime
+	query := `SELECT u.email, u.domain_id, d.name, u.password_set, u.password_expired
+		FROM virtual_users u JOIN virtual_domains d ON u.domain_id = d.id WHERE u.id = ?;`
+	err := appContext.DB.QueryRow(query, userID).Scan(&res.Email, &res.DomainID, &res.DomainName,
+		&passwordSet, &res.Status.PasswordExpired)
+	if err != nil {
+		return nil, err
+	}
+	if !passwordSet.IsZero() {
+		res.Status.PasswordSet = &passwordSet.Time
+	}
+	if res.Aliases, res.Forwards, err = listPortalAliases(appContext, res.Email); err != nil {
+		return nil, err
+	}
+	if res.RecoveryMail, err = GetRecoveryMail(appContext, userID); err != nil {
+		return nil, err
+	}
+	lockedUntil, locked, lockErr := CheckLockout(appContext, LockoutScopeMail, res.Email)
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	if locked {
+		res.Status.Locked = true
+		res.Status.LockedUntil = &lockedUntil
+	}
+	quota, quotaErr := GetMailQuota(appContext, res.Email)
+	if quotaErr != nil {
+		appContext.Logger.WithError(quotaErr).WithField("mail", res.Email).Warn("Can't get quota of mail user")
+	} else {
+		res.Quota = quota
+	}
+	return res, nil
+}
+
+// AliasDetails is the information about a single alias.
+// DestinationUserID is the id of the virtual user the alias delivers to, or
+// -1 if the destination is not a virtual user.
+type AliasDetails struct {
+	ID                int64  `json:"id"`
+	Source            string `json:"source"`
+	Destination       string `json:"destination"`
+	DomainID          int64  `json:"domain-id"`
+	DomainName        string `json:"domain-name"`
+	DestinationUserID int64  `json:"destination-user-id"`
+}
+
+// GetAliasDetails returns the details of the alias, it returns
+// sql.ErrNoRows if the alias doesn't exist.
+func GetAliasDetails(appContext *MailAppContext, aliasID int64) (*AliasDetails, error) {
+	res := &AliasDetails{ID: aliasID}
+	var userID sql.NullInt64
+	query := `SELECT a.source, a.destination, a.domain_id, d.name, u.id
+		FROM virtual_aliases a JOIN virtual_domains d ON a.domain_id = d.id
+		LEFT JOIN virtual_users u ON u.email = a.destination WHERE a.id = ?;`
+	err := appContext.DB.QueryRow(query, aliasID).Scan(&res.Source, &res.Destination, &res.DomainID, &res.DomainName, &userID)
+	if err != nil {
+		return nil, err
+	}
+	res.DestinationUserID = -1
+	if userID.Valid {
+		res.DestinationUserID = userID.Int64
+	}
+	return res, nil
+}
+
+// writeDetails writes the details returned by one of the Get...Details
+// functions as JSON. It replies with a 404 if err is sql.ErrNoRows.
+func writeDetails(w http.ResponseWriter, r *http.Request, details interface{}, err error) error {
+	switch {
+	case err == sql.ErrNoRows:
+		http.NotFound(w, r)
+		return nil
+	case err != nil:
+		return err
+	}
+	// set csrf header
+	w.Header().Set("X-CSRF-Token", csrf.Token(r))
+	jsonEnc, jsonErr := json.Marshal(details)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	w.Write(jsonEnc)
+	return nil
+}
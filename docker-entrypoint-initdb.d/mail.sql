@@ -12,6 +12,8 @@ CREATE TABLE IF NOT EXISTS virtual_users (
     domain_id INT NOT NULL,
     email VARCHAR(100),
     password varchar(150) NOT NULL,
+    password_set DATETIME NULL,
+    password_expired BOOLEAN NOT NULL DEFAULT FALSE,
     PRIMARY KEY(id),
     UNIQUE KEY email (email),
     FOREIGN KEY (domain_id) REFERENCES virtual_domains(id) ON DELETE CASCADE);
@@ -0,0 +1,350 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+// Password expiry: virtual_users stores the time the password was set in
+// password_set, each domain can have a max age for passwords (stored in
+// domain_password_expiry). If enforce is set for the domain the daemon
+// started by ParseConfig sets password_expired for all users with an expired
+// password. Dovecot can query this flag to deny the login until the user
+// changes the password in the portal (or at /password/), for example with the
+// following password_query:
+//
+//	SELECT email AS user, password FROM virtual_users
+//	WHERE email = '%u' AND NOT password_expired;
+//
+// Changing the password resets password_set and password_expired.
+// The trash doesn't keep password_set, so users restored from the trash get
+// the time of the restore. Users without a password_set never expire.
+
+// PasswordExpiry is the password expiry setting of a domain.
+type PasswordExpiry struct {
+	DomainID int64 `json:"domain-id"`
+	// MaxAgeDays is the maximal age of a password in days.
+	MaxAgeDays int `json:"max-age-days"`
+	// Enforce is true if the password_expired flag should be set for users
+	// with an expired password.
+	Enforce bool `json:"enforce"`
+}
+
+// ListPasswordExpiry returns the settings of all domains that have a max age,
+// the keys are the domain ids.
+func ListPasswordExpiry(appContext *MailAppContext) (map[int64]*PasswordExpiry, error) {
+	rows, err := appContext.DB.Query("SELECT domain_id, max_age_days, enforce FROM domain_password_expiry;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int64]*PasswordExpiry)
+	for rows.Next() {
+		expiry := &PasswordExpiry{}
+		if scanErr := rows.Scan(&expiry.DomainID, &expiry.MaxAgeDays, &expiry.Enforce); scanErr != nil {
+			return nil, scanErr
+		}
+		res[expiry.DomainID] = expiry
+	}
+	return res, rows.Err()
+}
+
+// GetPasswordExpiry returns the setting of the domain, nil if the passwords
+// in the domain don't expire.
+func GetPasswordExpiry(appContext *MailAppContext, domainID int64) (*PasswordExpiry, error) {
+	expiry := &PasswordExpiry{DomainID: domainID}
+	query := "SELECT max_age_days, enforce FROM domain_password_expiry WHERE domain_id = ?;"
+	err := appContext.DB.QueryRow(query, domainID).Scan(&expiry.MaxAgeDays, &expiry.Enforce)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	return expiry, nil
+}
+
+// SetPasswordExpiry sets the max age of passwords in the domain, a maxAgeDays
+// of 0 disables the expiry. The password_expired flags are updated
+// immediately.
+func SetPasswordExpiry(appContext *MailAppContext, domainID int64, maxAgeDays int, enforce bool) error {
+	if maxAgeDays <= 0 {
+		if _, err := appContext.DB.Exec("DELETE FROM domain_password_expiry WHERE domain_id = ?;", domainID); err != nil {
+			return err
+		}
+	} else {
+		query := `INSERT INTO domain_password_expiry (domain_id, max_age_days, enforce) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE max_age_days = VALUES(max_age_days), enforce = VALUES(enforce);`
+		if _, err := appContext.DB.Exec(query, domainID, maxAgeDays, enforce); err != nil {
+			return err
+		}
+	}
+	_, err := UpdateExpiredPasswords(appContext)
+	return err
+}
+
+// ExpiredPassword describes a mail user with an expired password.
+type ExpiredPassword struct {
+	UserID      int64     `json:"user-id"`
+	Mail        string    `json:"mail"`
+	DomainID    int64     `json:"domain-id"`
+	PasswordSet time.Time `json:"password-set"`
+	Expired     time.Time `json:"expired"`
+	// Locked is true if the password_expired flag is set, i.e. the login is
+	// denied until the password is changed.
+	Locked bool `json:"locked"`
+}
+
+// ListExpiredPasswords returns all users with an expired password. If
+// domainID is >= 0 only the users of this domain are returned.
+func ListExpiredPasswords(appContext *MailAppContext, domainID int64) ([]*ExpiredPassword, error) {
+	query := `SELECT u.id, u.email, u.domain_id, u.password_set, u.password_expired, e.max_age_days
+		FROM virtual_users u JOIN domain_password_expiry e ON u.domain_id = e.domain_id
+		WHERE u.password_set IS NOT NULL AND u.password_set <= DATE_SUB(?, INTERVAL e.max_age_days DAY)`
+	args := []interface{}{time.Now().UTC()}
+	if domainID >= 0 {
+		query += " AND u.domain_id = ?"
+		args = append(args, domainID)
+	}
+	rows, err := appContext.DB.Query(query+" ORDER BY u.password_set;", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*ExpiredPassword, 0)
+	for rows.Next() {
+		expired := &ExpiredPassword{}
+		var passwordSet sqlTime
+		var maxAge int
+		if scanErr := rows.Scan(&expired.UserID, &expired.Mail, &expired.DomainID, &passwordSet, &expired.Locked, &maxAge); scanErr != nil {
+			return nil, scanErr
+		}
+		expired.PasswordSet = passwordSet.Time
+		expired.Expired = passwordSet.AddDate(0, 0, maxAge)
+		res = append(res, expired)
+	}
+	return res, rows.Err()
+}
+
+// PasswordExpired returns true if the password_expired flag of the user is
+// set.
+func PasswordExpired(appContext *MailAppContext, userID int64) (bool, error) {
+	var expired bool
+	err := appContext.DB.QueryRow("SELECT password_expired FROM virtual_users WHERE id = ?;", userID).Scan(&expired)
+	return expired, err
+}
+
+// UpdateExpiredPasswords sets the password_expired flag for all users with an
+// expired password in a domain that enforces the expiry. It also clears the
+// flag of users whose domain no longer enforces the expiry.
+// It returns the number of users that were flagged.
+func UpdateExpiredPasswords(appContext *MailAppContext) (int64, error) {
+	now := time.Now().UTC()
+	clearQuery := `UPDATE virtual_users u LEFT JOIN domain_password_expiry e ON u.domain_id = e.domain_id
+		SET u.password_expired = FALSE
+		WHERE u.password_expired AND (e.domain_id IS NULL OR NOT e.enforce
+		OR u.password_set IS NULL OR u.password_set > DATE_SUB(?, INTERVAL e.max_age_days DAY));`
+	if _, err := appContext.DB.Exec(clearQuery, now); err != nil {
+		return -1, err
+	}
+	setQuery := `UPDATE virtual_users u JOIN domain_password_expiry e ON u.domain_id = e.domain_id
+		SET u.password_expired = TRUE
+		WHERE e.enforce AND NOT u.password_expired AND u.password_set IS NOT NULL
+		AND u.password_set <= DATE_SUB(?, INTERVAL e.max_age_days DAY);`
+	res, err := appContext.DB.Exec(setQuery, now)
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+// UpdateExpiredPasswordsDaemon runs UpdateExpiredPasswords every sleep
+// duration. It runs in a new goroutine until something is written to stop.
+func UpdateExpiredPasswordsDaemon(appContext *MailAppContext, sleep time.Duration, stop chan bool) {
+	ticker := time.NewTicker(sleep)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				num, err := UpdateExpiredPasswords(appContext)
+				if err != nil {
+					appContext.Logger.WithError(err).Error("Can't update expired passwords")
+				} else if num > 0 {
+					appContext.Logger.WithField("num-expired", num).Info("Flagged users with expired passwords")
+				}
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// passwordExpiryRegex matches /api/password-expiry/<domain-id> and
+// /api/password-expiry/expired.
+var passwordExpiryRegex = regexp.MustCompile(`^/api/password-expiry/((\d+|expired)/?)?$`)
+
+// parsePasswordExpiryURL returns the domain id from the url, expired is true
+// for /api/password-expiry/expired.
+func parsePasswordExpiryURL(url string) (domainID int64, expired bool, err error) {
+	match := passwordExpiryRegex.FindStringSubmatch(url)
+	switch {
+	case match == nil:
+		return -1, false, fmt.Errorf("Invalid url %s", url)
+	case match[2] == "":
+		return -1, false, errNoID
+	case match[2] == "expired":
+		return -1, true, nil
+	}
+	domainID, err = strconv.ParseInt(match[2], 10, 64)
+	return domainID, false, err
+}
+
+// PasswordExpiryJSON is the main handler for /api/password-expiry.
+// GET /api/password-expiry/ returns the settings of all domains in the form
+// {<domain-id>: <PasswordExpiry>}, GET /api/password-expiry/expired returns
+// a list of ExpiredPassword (the query parameter domain restricts the list to
+// a domain). UPDATE /api/password-expiry/<domain-id> changes the setting of
+// the domain, the body must be of the form
+// {"max-age-days": <days>, "enforce": <bool>}, a max age of 0 disables the
+// expiry.
+// Admins only see and change the domains they are allowed to access.
+func PasswordExpiryJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	domainID, expired, parseErr := parsePasswordExpiryURL(r.URL.Path)
+	if parseErr != nil && parseErr != errNoID {
+		http.NotFound(w, r)
+		return nil
+	}
+	scope, scopeErr := domainScopeFromRequest(appcontext, r)
+	if scopeErr != nil {
+		return scopeErr
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/password-expiry/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		if domainID >= 0 {
+			http.Error(w, "Invalid GET request. Must be GET /api/password-expiry/ or /api/password-expiry/expired", 400)
+			return nil
+		}
+		var res interface{}
+		if expired {
+			filter := int64(-1)
+			if domainParam := r.URL.Query().Get("domain"); domainParam != "" {
+				var convErr error
+				filter, convErr = strconv.ParseInt(domainParam, 10, 64)
+				if convErr != nil {
+					http.Error(w, "Invalid domain id", 400)
+					return nil
+				}
+			}
+			list, err := ListExpiredPasswords(appcontext, filter)
+			if err != nil {
+				return err
+			}
+			visible := make([]*ExpiredPassword, 0, len(list))
+			for _, entry := range list {
+				if scope.Allows(entry.DomainID) {
+					visible = append(visible, entry)
+				}
+			}
+			res = visible
+		} else {
+			settings, err := ListPasswordExpiry(appcontext)
+			if err != nil {
+				return err
+			}
+			for id := range settings {
+				if !scope.Allows(id) {
+					delete(settings, id)
+				}
+			}
+			res = settings
+		}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		// create json encoding
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case updateMethod:
+		if domainID < 0 {
+			http.Error(w, "Invalid UPDATE request to /api/password-expiry/: No domain id given.", 400)
+			return nil
+		}
+		if ok, err := requireDomainAccess(appcontext, w, r, domainID); !ok {
+			return err
+		}
+		body, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		var data struct {
+			MaxAgeDays int  `json:"max-age-days"`
+			Enforce    bool `json:"enforce"`
+		}
+		if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		if data.MaxAgeDays < 0 {
+			http.Error(w, "max-age-days must not be negative", 400)
+			return nil
+		}
+		old, getErr := GetPasswordExpiry(appcontext, domainID)
+		if getErr != nil {
+			return getErr
+		}
+		if setErr := SetPasswordExpiry(appcontext, domainID, data.MaxAgeDays, data.Enforce); setErr != nil {
+			return setErr
+		}
+		appcontext.Logger.WithFields(log.Fields{
+			"domain-id":    domainID,
+			"max-age-days": data.MaxAgeDays,
+			"enforce":      data.Enforce,
+		}).Info("Changed password expiry of domain")
+		var oldValue AuditValues
+		if old != nil {
+			oldValue = AuditValues{"max-age-days": old.MaxAgeDays, "enforce": old.Enforce}
+		}
+		recordAudit(appcontext, r, AuditSetPasswordExpiry, AuditTargetDomain, domainID, oldValue,
+			AuditValues{"max-age-days": data.MaxAgeDays, "enforce": data.Enforce})
+		return nil
+	}
+}
@@ -0,0 +1,240 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains functions to export the mails of a user, either as
+// zip archive of the Maildir or as zip archive containing a mbox file for
+// each folder.
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maildirFolders returns all folders of the Maildir++ directory root in the
+// form folder name --> path. The root directory itself is the folder INBOX,
+// all subdirectories starting with a dot are folders as well (.Sent becomes
+// Sent, .Lists.Go becomes Lists.Go).
+func maildirFolders(root string) (map[string]string, error) {
+	res := map[string]string{"INBOX": root}
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.HasPrefix(name, ".") || name == "." || name == ".." {
+			continue
+		}
+		res[strings.TrimPrefix(name, ".")] = filepath.Join(root, name)
+	}
+	return res, nil
+}
+
+// maildirMessages returns the paths of all messages in the Maildir folder
+// (messages in cur and new), sorted by file name. Maildir file names start
+// with the delivery timestamp, so this is roughly the delivery order.
+func maildirMessages(folder string) ([]string, error) {
+	res := make([]string, 0)
+	for _, sub := range []string{"cur", "new"} {
+		entries, err := ioutil.ReadDir(filepath.Join(folder, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() {
+				res = append(res, filepath.Join(folder, sub, entry.Name()))
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return filepath.Base(res[i]) < filepath.Base(res[j])
+	})
+	return res, nil
+}
+
+// mboxFromRegex matches lines that must be quoted in mboxrd format.
+var mboxFromRegex = regexp.MustCompile(`^>*From `)
+
+// writeMboxMessage appends the message stored in the file path to w in
+// mboxrd format.
+func writeMboxMessage(path string, w io.Writer) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = fmt.Fprintf(w, "From MAILER-DAEMON %s\n", info.ModTime().UTC().Format(time.ANSIC)); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+			if mboxFromRegex.Match(line) {
+				if _, err = w.Write([]byte(">")); err != nil {
+					return err
+				}
+			}
+			if _, err = w.Write(append(line, '\n')); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	// messages are separated by an empty line
+	_, err = w.Write([]byte("\n"))
+	return err
+}
+
+// writeMboxZip writes a zip archive to w that contains a file <folder>.mbox
+// for each folder in the Maildir root.
+func writeMboxZip(root string, w io.Writer) error {
+	folders, err := maildirFolders(root)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(folders))
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	archive := zip.NewWriter(w)
+	defer archive.Close()
+	for _, name := range names {
+		messages, listErr := maildirMessages(folders[name])
+		if listErr != nil {
+			return listErr
+		}
+		header := &zip.FileHeader{Name: name + ".mbox", Method: zip.Deflate}
+		header.SetModTime(time.Now())
+		writer, createErr := archive.CreateHeader(header)
+		if createErr != nil {
+			return createErr
+		}
+		for _, message := range messages {
+			if msgErr := writeMboxMessage(message, writer); msgErr != nil {
+				return msgErr
+			}
+		}
+	}
+	return archive.Close()
+}
+
+// exportUserRegex is the regex for parsing the id from /api/users/<id>/export.
+var exportUserRegex = regexp.MustCompile(`^/api/users/(\d+)/export/?$`)
+
+// parseExportUserURL parses the id from /api/users/<id>/export.
+// It returns -1 and errNoID if the URL is not an export URL.
+func parseExportUserURL(url string) (int64, error) {
+	res := exportUserRegex.FindStringSubmatch(url)
+	if res == nil {
+		return -1, errNoID
+	}
+	return strconv.ParseInt(res[1], 10, 64)
+}
+
+// exportMail streams an archive of the mail directory of the user with the
+// given id to the response.
+// By default the archive is a zip of the Maildir (as created by writeZip for
+// backups), if the query parameter format=mbox is given it contains a mbox
+// file for each folder instead.
+// It replies with a 404 if the user or the mail directory doesn't exist.
+func exportMail(userID int64, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "maildir" && format != "mbox" {
+		http.Error(w, "Invalid format, must be either \"maildir\" or \"mbox\"", 400)
+		return nil
+	}
+	mail, domain, lookupErr := getUserName(appContext, userID)
+	if lookupErr == sql.ErrNoRows {
+		appContext.Logger.WithField("user-id", userID).Warn("Export for unknown user")
+		http.NotFound(w, r)
+		return nil
+	}
+	if lookupErr != nil {
+		return lookupErr
+	}
+	if containsErr := containsInvalidParts(domain); containsErr != nil {
+		return containsErr
+	}
+	if containsErr := containsInvalidParts(mail); containsErr != nil {
+		return containsErr
+	}
+	source := getSourcePath(appContext.MailDir, domain, mail)
+	if _, statErr := os.Stat(source); os.IsNotExist(statErr) {
+		http.Error(w, "User has no mail directory", 404)
+		return nil
+	}
+	fileName := filepath.Base(getDestPath("", domain, mail, false))
+	if format == "mbox" {
+		fileName = strings.TrimSuffix(fileName, ".zip") + "-mbox.zip"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", fileName))
+	var exportErr error
+	if format == "mbox" {
+		exportErr = writeMboxZip(source, w)
+	} else {
+		_, exportErr = writeZip(source, filepath.Base(source), w)
+	}
+	// the response is already (partially) written, so we can't report an
+	// internal server error anymore
+	if exportErr != nil {
+		appContext.Logger.WithError(exportErr).WithField("user-id", userID).Error("Export of mail directory failed")
+		return nil
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"user-id": userID,
+		"format":  format,
+	}).Info("Exported mail directory")
+	return nil
+}
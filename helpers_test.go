@@ -0,0 +1,127 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains helpers shared by the tests: An appContext backed by
+// go-sqlmock and an in memory goauth.UserHandler.
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FabianWe/goauth"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestContext returns an appContext with a mocked database. The
+// expectations of the mock are checked when the test finishes.
+func newTestContext(t *testing.T) (*MailAppContext, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Can't create database mock: %s", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return &MailAppContext{DB: db, Logger: logger}, mock
+}
+
+// memoryUserHandler is a goauth.UserHandler that stores the admins in
+// memory. Only the methods used by mailwebadmin are implemented.
+type memoryUserHandler struct {
+	goauth.UserHandler
+	ids       map[string]goauth.UserKeyType
+	passwords map[string]string
+	nextID    goauth.UserKeyType
+}
+
+// newMemoryUserHandler returns a memoryUserHandler with the given admins in
+// the form username --> password.
+func newMemoryUserHandler(admins map[string]string) *memoryUserHandler {
+	res := &memoryUserHandler{
+		ids:       make(map[string]goauth.UserKeyType),
+		passwords: make(map[string]string),
+		nextID:    1,
+	}
+	for userName, password := range admins {
+		res.Insert(userName, "", "", "", []byte(password))
+	}
+	return res
+}
+
+func (h *memoryUserHandler) Insert(userName, firstName, lastName, email string, plainPW []byte) (goauth.UserKeyType, error) {
+	id := h.nextID
+	h.nextID++
+	h.ids[userName] = id
+	h.passwords[userName] = string(plainPW)
+	return id, nil
+}
+
+func (h *memoryUserHandler) Validate(userName string, cleartextPwCheck []byte) (goauth.UserKeyType, error) {
+	id, has := h.ids[userName]
+	if !has {
+		return goauth.NoUserID, goauth.ErrUserNotFound
+	}
+	if h.passwords[userName] != string(cleartextPwCheck) {
+		return goauth.NoUserID, nil
+	}
+	return id, nil
+}
+
+func (h *memoryUserHandler) GetUserID(userName string) (goauth.UserKeyType, error) {
+	id, has := h.ids[userName]
+	if !has {
+		return goauth.NoUserID, goauth.ErrUserNotFound
+	}
+	return id, nil
+}
+
+func (h *memoryUserHandler) GetUserName(id goauth.UserKeyType) (string, error) {
+	for userName, userID := range h.ids {
+		if userID == id {
+			return userName, nil
+		}
+	}
+	return "", goauth.ErrUserNotFound
+}
+
+func (h *memoryUserHandler) DeleteUser(userName string) error {
+	delete(h.ids, userName)
+	delete(h.passwords, userName)
+	return nil
+}
+
+func (h *memoryUserHandler) ListUsers() (map[goauth.UserKeyType]string, error) {
+	res := make(map[goauth.UserKeyType]string, len(h.ids))
+	for userName, id := range h.ids {
+		res[id] = userName
+	}
+	return res, nil
+}
@@ -0,0 +1,485 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains functions to import an existing Maildir for a user,
+// either from a local directory or from an archive (zip, tar or tar.gz).
+// Imported mails are merged into the mail directory of the user, existing
+// files are never overwritten.
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoMaildir is the error returned if the import source doesn't contain a
+// Maildir, i.e. a directory with the subdirectories cur, new and tmp.
+var ErrNoMaildir = errors.New("Import source doesn't contain a Maildir (directory with cur, new and tmp)")
+
+// Limits for the archives imported by ImportArchive, they protect the mail
+// volume against archive bombs.
+const (
+	// MaxMailImportSize is the maximal size of the archive for
+	// POST /api/users/<id>/import.
+	MaxMailImportSize = 1 << 30
+	// MaxImportExtractedSize is the maximal size of all extracted files.
+	MaxImportExtractedSize = 4 << 30
+	// MaxImportEntries is the maximal number of entries in the archive.
+	MaxImportEntries = 100000
+)
+
+// ErrArchiveTooLarge is the error returned if an archive exceeds
+// MaxImportExtractedSize or MaxImportEntries.
+var ErrArchiveTooLarge = errors.New("Archive is too large: it contains too many entries or too much data")
+
+// ArchiveError is returned by ImportArchive if the archive is malformed or
+// exceeds the import limits, other errors are errors on the server side.
+type ArchiveError struct {
+	Err error
+}
+
+func (err *ArchiveError) Error() string {
+	return fmt.Sprintf("Invalid archive: %s", err.Err)
+}
+
+// newArchiveError wraps err in an ArchiveError (if it isn't one already).
+func newArchiveError(err error) error {
+	if _, isArchiveErr := err.(*ArchiveError); isArchiveErr {
+		return err
+	}
+	return &ArchiveError{Err: err}
+}
+
+// archiveSourceReader wraps the archive given to ImportArchive such that read
+// errors, for example an upload exceeding MaxMailImportSize, are returned as
+// ArchiveError.
+type archiveSourceReader struct {
+	r io.Reader
+}
+
+func (ar *archiveSourceReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if err != nil && err != io.EOF {
+		return n, newArchiveError(err)
+	}
+	return n, err
+}
+
+// archiveLimits stores the number of entries and bytes that may still be
+// extracted from an archive. A nil *archiveLimits means no limits.
+type archiveLimits struct {
+	entries int
+	size    int64
+}
+
+// newImportLimits returns the limits for ImportArchive.
+func newImportLimits() *archiveLimits {
+	return &archiveLimits{entries: MaxImportEntries, size: MaxImportExtractedSize}
+}
+
+// entry must be called for each entry of the archive, it returns an
+// ArchiveError wrapping ErrArchiveTooLarge if there are too many entries.
+func (limits *archiveLimits) entry() error {
+	if limits == nil {
+		return nil
+	}
+	limits.entries--
+	if limits.entries < 0 {
+		return &ArchiveError{Err: ErrArchiveTooLarge}
+	}
+	return nil
+}
+
+// reader wraps the reader of an archive entry such that reading fails with
+// an ArchiveError wrapping ErrArchiveTooLarge once the size limit is exceeded.
+// Other read errors (the entry is corrupt) are returned as ArchiveError too.
+func (limits *archiveLimits) reader(r io.Reader) io.Reader {
+	if limits == nil {
+		return r
+	}
+	return &limitedArchiveReader{r: r, limits: limits}
+}
+
+// limitedArchiveReader is the reader returned by archiveLimits.reader.
+type limitedArchiveReader struct {
+	r      io.Reader
+	limits *archiveLimits
+}
+
+func (lr *limitedArchiveReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.limits.size -= int64(n)
+	if lr.limits.size < 0 {
+		return n, &ArchiveError{Err: ErrArchiveTooLarge}
+	}
+	if err != nil && err != io.EOF {
+		return n, newArchiveError(err)
+	}
+	return n, err
+}
+
+// ImportResult stores the number of files imported and the number of files
+// skipped because they already existed.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// isMaildir checks if dir contains the directories cur, new and tmp.
+func isMaildir(dir string) bool {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		info, err := os.Stat(filepath.Join(dir, sub))
+		if err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// findMaildir returns the topmost Maildir in root (root itself if it is a
+// Maildir). It returns ErrNoMaildir if no Maildir was found.
+func findMaildir(root string) (string, error) {
+	res := ""
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if res != "" && len(strings.Split(path, string(os.PathSeparator))) >= len(strings.Split(res, string(os.PathSeparator))) {
+			return filepath.SkipDir
+		}
+		if isMaildir(path) {
+			res = path
+			// everything below belongs to this Maildir
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if res == "" {
+		return "", ErrNoMaildir
+	}
+	return res, nil
+}
+
+// ownerOf returns the owner of the given path, ok is false if it can't be
+// determined.
+func ownerOf(path string) (uid, gid int, ok bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1, -1, false
+	}
+	stat, isStat := info.Sys().(*syscall.Stat_t)
+	if !isStat {
+		return -1, -1, false
+	}
+	return int(stat.Uid), int(stat.Gid), true
+}
+
+// mailOwnerOf returns the owner of the closest existing ancestor of target.
+// Imported files get this owner, so that dovecot is able to access them.
+func mailOwnerOf(target string) (uid, gid int, ok bool) {
+	for dir := filepath.Clean(target); ; dir = filepath.Dir(dir) {
+		if uid, gid, ok = ownerOf(dir); ok {
+			return
+		}
+		if dir == filepath.Dir(dir) {
+			return -1, -1, false
+		}
+	}
+}
+
+// mergeDir copies all files from source to target, files that already exist
+// in target are skipped. Symlinks and other special files are ignored.
+// If ok is true all created files and directories get the owner uid / gid.
+func mergeDir(source, target string, uid, gid int, ok bool, res *ImportResult) error {
+	source = filepath.Clean(source)
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(target, strings.TrimPrefix(path, source))
+		switch {
+		case info.IsDir():
+			if _, statErr := os.Stat(dest); os.IsNotExist(statErr) {
+				if mkErr := os.MkdirAll(dest, 0700); mkErr != nil {
+					return mkErr
+				}
+				if ok {
+					return os.Lchown(dest, uid, gid)
+				}
+			}
+			return nil
+		case info.Mode().IsRegular():
+			file, openErr := os.Open(path)
+			if openErr != nil {
+				return openErr
+			}
+			defer file.Close()
+			written, writeErr := writeNewFile(dest, 0600, file)
+			if writeErr != nil {
+				return writeErr
+			}
+			if !written {
+				res.Skipped++
+				return nil
+			}
+			res.Imported++
+			if ok {
+				return os.Lchown(dest, uid, gid)
+			}
+			return nil
+		default:
+			return nil
+		}
+	})
+}
+
+// ImportMaildir imports the Maildir found in source (see findMaildir) into
+// the mail directory of the given user.
+// Existing files are not overwritten.
+func ImportMaildir(appContext *MailAppContext, source, domain, user string) (*ImportResult, error) {
+	if containsErr := containsInvalidParts(domain); containsErr != nil {
+		return nil, containsErr
+	}
+	if containsErr := containsInvalidParts(user); containsErr != nil {
+		return nil, containsErr
+	}
+	maildir, findErr := findMaildir(source)
+	if findErr != nil {
+		return nil, findErr
+	}
+	target := filepath.Clean(getSourcePath(appContext.MailDir, domain, user))
+	uid, gid, ok := mailOwnerOf(target)
+	res := &ImportResult{}
+	if mergeErr := mergeDir(maildir, target, uid, gid, ok, res); mergeErr != nil {
+		return res, mergeErr
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"domain":   domain,
+		"user":     user,
+		"imported": res.Imported,
+		"skipped":  res.Skipped,
+	}).Info("Imported Maildir")
+	return res, nil
+}
+
+// extractTar extracts all directories and regular files from the tar
+// archive to destination, respecting the limits.
+func extractTar(r io.Reader, destination string, limits *archiveLimits) error {
+	destination = filepath.Clean(destination)
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newArchiveError(err)
+		}
+		if err = limits.entry(); err != nil {
+			return err
+		}
+		target, pathErr := archivePath(destination, header.Name)
+		if pathErr != nil {
+			return &ArchiveError{Err: pathErr}
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			if _, err = writeNewFile(target, 0600, limits.reader(reader)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Supported archive formats for ImportArchive.
+const (
+	importZip   = "zip"
+	importTar   = "tar"
+	importTarGz = "tar.gz"
+)
+
+// ImportFormatFromName returns the archive format given the file name.
+func ImportFormatFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return importTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return importTar
+	default:
+		return importZip
+	}
+}
+
+// ImportArchive extracts the archive (format must be one of "zip", "tar" or
+// "tar.gz") to a temporary directory and imports the Maildir from it with
+// ImportMaildir.
+// Malformed archives and archives exceeding MaxImportEntries or
+// MaxImportExtractedSize (ErrArchiveTooLarge) are rejected with an
+// ArchiveError, as are archives without a Maildir (ErrNoMaildir).
+func ImportArchive(appContext *MailAppContext, archive io.Reader, format, domain, user string) (*ImportResult, error) {
+	archive = &archiveSourceReader{r: archive}
+	tmpDir, tmpErr := ioutil.TempDir("", "mailwebadmin-import-")
+	if tmpErr != nil {
+		return nil, tmpErr
+	}
+	defer os.RemoveAll(tmpDir)
+	extractDir := filepath.Join(tmpDir, "extract")
+	if err := os.Mkdir(extractDir, 0700); err != nil {
+		return nil, err
+	}
+	limits := newImportLimits()
+	switch format {
+	case importZip:
+		// zip requires random access, so store it first
+		zipPath := filepath.Join(tmpDir, "import.zip")
+		zipFile, createErr := os.Create(zipPath)
+		if createErr != nil {
+			return nil, createErr
+		}
+		_, copyErr := io.Copy(zipFile, archive)
+		zipFile.Close()
+		if copyErr != nil {
+			return nil, copyErr
+		}
+		reader, openErr := zip.OpenReader(zipPath)
+		if openErr != nil {
+			return nil, newArchiveError(openErr)
+		}
+		extractErr := extractZip(&reader.Reader, extractDir, limits)
+		reader.Close()
+		if extractErr != nil {
+			return nil, extractErr
+		}
+	case importTar:
+		if err := extractTar(archive, extractDir, limits); err != nil {
+			return nil, err
+		}
+	case importTarGz:
+		gzipReader, gzipErr := gzip.NewReader(archive)
+		if gzipErr != nil {
+			return nil, newArchiveError(gzipErr)
+		}
+		defer gzipReader.Close()
+		if err := extractTar(gzipReader, extractDir, limits); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Invalid archive format, must be \"zip\", \"tar\" or \"tar.gz\"")
+	}
+	res, importErr := ImportMaildir(appContext, extractDir, domain, user)
+	if importErr == ErrNoMaildir {
+		return nil, &ArchiveError{Err: importErr}
+	}
+	return res, importErr
+}
+
+// importUserRegex is the regex for parsing the id from /api/users/<id>/import.
+var importUserRegex = regexp.MustCompile(`^/api/users/(\d+)/import/?$`)
+
+// parseImportUserURL parses the id from /api/users/<id>/import.
+// It returns -1 and errNoID if the URL is not an import URL.
+func parseImportUserURL(url string) (int64, error) {
+	res := importUserRegex.FindStringSubmatch(url)
+	if res == nil {
+		return -1, errNoID
+	}
+	return strconv.ParseInt(res[1], 10, 64)
+}
+
+// importMail imports the archive in the request body into the mail directory
+// of the user with the given id.
+// The format is determined by the Content-Type header: application/zip,
+// application/x-tar or application/gzip (tar.gz). The body may be at most
+// MaxMailImportSize bytes.
+// On success it writes the following JSON to the response:
+// {"imported": <number of files>, "skipped": <number of existing files>}.
+func importMail(userID int64, appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	var format string
+	switch r.Header.Get("Content-Type") {
+	case "application/zip":
+		format = importZip
+	case "application/x-tar":
+		format = importTar
+	case "application/gzip", "application/x-gzip":
+		format = importTarGz
+	default:
+		http.Error(w, "Invalid Content-Type, must be application/zip, application/x-tar or application/gzip", 400)
+		return nil
+	}
+	mail, domain, lookupErr := getUserName(appContext, userID)
+	if lookupErr == sql.ErrNoRows {
+		appContext.Logger.WithField("user-id", userID).Warn("Import for unknown user")
+		http.NotFound(w, r)
+		return nil
+	}
+	if lookupErr != nil {
+		return lookupErr
+	}
+	res, importErr := ImportArchive(appContext, http.MaxBytesReader(w, r.Body, MaxMailImportSize), format, domain, mail)
+	if importErr != nil {
+		if _, isArchiveErr := importErr.(*ArchiveError); isArchiveErr {
+			appContext.Logger.WithError(importErr).WithField("user-id", userID).Warn("Import of Maildir failed")
+			http.Error(w, importErr.Error(), 400)
+			return nil
+		}
+		return importErr
+	}
+	recordAudit(appContext, r, AuditImportMail, AuditTargetUser, userID, nil, AuditValues{"imported": res.Imported, "skipped": res.Skipped})
+	jsonEnc, jsonErr := json.Marshal(res)
+	if jsonErr != nil {
+		// just log the error, but the import took place, so we return nil
+		appContext.Logger.WithField("result", res).WithError(jsonErr).Warn("Can't enocode import result to JSON")
+		return nil
+	}
+	w.Write(jsonEnc)
+	return nil
+}
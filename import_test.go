@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// testTar returns a tar archive containing the given files.
+func testTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// expectImportUser expects the lookup of the user with id 1 done by
+// importMail.
+func expectImportUser(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT email FROM virtual_users WHERE id = ?")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("alice@example.org"))
+}
+
+func TestImportMailInvalidArchive(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+	}{
+		{"corrupt zip", "application/zip", []byte("not a zip")},
+		{"corrupt gzip", "application/gzip", []byte("not a gzip")},
+		{"truncated tar", "application/x-tar", testTar(t, map[string]string{"Maildir/cur/1": "mail"})[:600]},
+		{"path outside", "application/x-tar", testTar(t, map[string]string{"../escape": "mail"})},
+		{"no maildir", "application/x-tar", testTar(t, map[string]string{"notes.txt": "no mails"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appContext, mock := newTestContext(t)
+			appContext.MailDir = t.TempDir()
+			expectImportUser(mock)
+			r := httptest.NewRequest(http.MethodPost, "/api/users/1/import", bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := httptest.NewRecorder()
+			if err := importMail(1, appContext, w, r); err != nil {
+				t.Fatalf("expected a 400 reply, got error %v", err)
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+			if !strings.HasPrefix(w.Body.String(), "Invalid archive") {
+				t.Errorf("unexpected reply %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestImportMailServerError(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	appContext.MailDir = t.TempDir()
+	// the temporary directory for the extraction can't be created
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+	expectImportUser(mock)
+	body := testTar(t, map[string]string{"Maildir/cur/1": "mail"})
+	r := httptest.NewRequest(http.MethodPost, "/api/users/1/import", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-tar")
+	w := httptest.NewRecorder()
+	err := importMail(1, appContext, w, r)
+	if err == nil {
+		t.Fatalf("expected an error, got status %d", w.Code)
+	}
+	if _, isArchiveErr := err.(*ArchiveError); isArchiveErr {
+		t.Errorf("server error reported as ArchiveError: %v", err)
+	}
+}
+
+func TestImportMail(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	appContext.MailDir = t.TempDir()
+	expectImportUser(mock)
+	body := testTar(t, map[string]string{"Maildir/cur/1": "mail", "Maildir/new/2": "mail", "Maildir/tmp/.keep": ""})
+	r := httptest.NewRequest(http.MethodPost, "/api/users/1/import", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-tar")
+	w := httptest.NewRecorder()
+	if err := importMail(1, appContext, w, r); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,347 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the authentication of admins against an LDAP server
+// (for example OpenLDAP or Active Directory). LDAPUserHandler implements
+// goauth.UserHandler, only Validate talks to the LDAP server. Each admin
+// that logs in via LDAP still has a local user (that's where the id used for
+// sessions, roles, domains etc. comes from), it can be created on the first
+// login (auto provisioning). The role of the admin can be derived from the
+// groups in LDAP.
+//
+// To try it out point the url in the [ldap] section of mailconf to a local
+// LDAP test server, for example an OpenLDAP or glauth container.
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// LDAPConfig is the configuration of the LDAP authentication, it is read
+// from the [ldap] section of mailconf.
+type LDAPConfig struct {
+	// URL is the url of the server, for example ldap://localhost:389 or
+	// ldaps://ldap.example.org.
+	URL string
+	// StartTLS is set to true if StartTLS should be used on ldap:// urls.
+	StartTLS bool
+	// InsecureSkipVerify disables the verification of the server certificate,
+	// only use it for testing.
+	InsecureSkipVerify bool
+	// BindDN and BindPassword are used to search for the user, if BindDN is
+	// empty an anonymous search is done.
+	BindDN, BindPassword string
+	// BaseDN is the base of the user search.
+	BaseDN string
+	// UserFilter is the filter to find the user, %s is replaced by the
+	// (escaped) username. For example "(uid=%s)" or, for Active Directory,
+	// "(sAMAccountName=%s)".
+	UserFilter string
+	// GroupAttribute is the attribute of the user entry that contains the
+	// DNs of the groups, usually memberOf.
+	GroupAttribute string
+	// GroupRoles maps group DNs to roles. If it is not empty the role of an
+	// admin is updated on each login, admins in none of the groups can't log
+	// in. If an admin is in several groups the most powerful role is used.
+	GroupRoles map[string]Role
+	// DefaultRole is the role of auto provisioned admins if GroupRoles is
+	// empty.
+	DefaultRole Role
+	// AutoProvision is set to true if a local admin should be created on the
+	// first successful login. Otherwise the admin must already exist.
+	AutoProvision bool
+	// FallbackLocal is set to true if users that are not found in LDAP are
+	// validated against the local password, for example the admin_user from
+	// the config.
+	FallbackLocal bool
+	// Timeout is the timeout for connecting to and queries to the server.
+	Timeout time.Duration
+}
+
+// ldapConn is the part of *ldap.Conn used by LDAPUserHandler.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+// LDAPUserHandler is a goauth.UserHandler that validates passwords against
+// an LDAP server. All other methods are passed to the local user handler,
+// so changing the password of an admin only changes the local password
+// (which is only used if FallbackLocal is set).
+type LDAPUserHandler struct {
+	goauth.UserHandler
+	Config     LDAPConfig
+	appContext *MailAppContext
+	// dial connects to the server, it can be replaced to use another
+	// connection.
+	dial func() (ldapConn, error)
+}
+
+// NewLDAPUserHandler returns a new LDAPUserHandler that uses local for the
+// local admin users.
+func NewLDAPUserHandler(appContext *MailAppContext, local goauth.UserHandler, config LDAPConfig) *LDAPUserHandler {
+	res := &LDAPUserHandler{UserHandler: local, Config: config, appContext: appContext}
+	res.dial = res.dialServer
+	return res
+}
+
+// dialServer connects to the server in the config.
+func (h *LDAPUserHandler) dialServer() (ldapConn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: h.Config.InsecureSkipVerify}
+	// required for StartTLS, ldaps:// would set it on its own
+	if u, parseErr := url.Parse(h.Config.URL); parseErr == nil {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	conn, err := ldap.DialURL(h.Config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: h.Config.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(h.Config.Timeout)
+	if h.Config.StartTLS {
+		if tlsErr := conn.StartTLS(tlsConfig); tlsErr != nil {
+			conn.Close()
+			return nil, tlsErr
+		}
+	}
+	return conn, nil
+}
+
+// rolePriority lists the roles from the most powerful to the least
+// powerful one.
+var rolePriority = []Role{RoleSuperAdmin, RoleDomainAdmin, RoleHelpDesk, RoleReadOnly}
+
+// roleForGroups returns the most powerful role of all groups, ok is false
+// if none of the groups has a role.
+func (h *LDAPUserHandler) roleForGroups(groups []string) (role Role, ok bool) {
+	found := make(map[Role]bool)
+	for groupDN, groupRole := range h.Config.GroupRoles {
+		for _, group := range groups {
+			if strings.EqualFold(strings.TrimSpace(group), strings.TrimSpace(groupDN)) {
+				found[groupRole] = true
+			}
+		}
+	}
+	for _, role := range rolePriority {
+		if found[role] {
+			return role, true
+		}
+	}
+	return "", false
+}
+
+// findUser searches for the user and returns its entry, the entry is nil if
+// the user doesn't exist.
+func (h *LDAPUserHandler) findUser(conn ldapConn, userName string) (*ldap.Entry, error) {
+	if h.Config.BindDN != "" {
+		if err := conn.Bind(h.Config.BindDN, h.Config.BindPassword); err != nil {
+			return nil, fmt.Errorf("Can't bind to LDAP with the search user: %s", err.Error())
+		}
+	}
+	request := ldap.NewSearchRequest(h.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(h.Config.Timeout/time.Second), false,
+		fmt.Sprintf(h.Config.UserFilter, ldap.EscapeFilter(userName)),
+		[]string{h.Config.GroupAttribute}, nil)
+	result, err := conn.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	switch len(result.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return result.Entries[0], nil
+	default:
+		return nil, fmt.Errorf("LDAP search for user \"%s\" returned more than one entry", userName)
+	}
+}
+
+// Validate checks the password by binding with the DN of the user.
+// It returns goauth.NoUserID if the password is wrong or the admin is not
+// allowed to log in and goauth.ErrUserNotFound if the user doesn't exist
+// (neither in LDAP nor locally if FallbackLocal is set).
+func (h *LDAPUserHandler) Validate(userName string, cleartextPwCheck []byte) (goauth.UserKeyType, error) {
+	// never try to bind with an empty password, many servers consider this
+	// an unauthenticated bind and report success
+	if len(cleartextPwCheck) == 0 {
+		return goauth.NoUserID, nil
+	}
+	conn, dialErr := h.dial()
+	if dialErr != nil {
+		return goauth.NoUserID, dialErr
+	}
+	defer conn.Close()
+	entry, findErr := h.findUser(conn, userName)
+	if findErr != nil {
+		return goauth.NoUserID, findErr
+	}
+	if entry == nil {
+		if h.Config.FallbackLocal {
+			return h.UserHandler.Validate(userName, cleartextPwCheck)
+		}
+		return goauth.NoUserID, goauth.ErrUserNotFound
+	}
+	if bindErr := conn.Bind(entry.DN, string(cleartextPwCheck)); bindErr != nil {
+		if ldap.IsErrorWithCode(bindErr, ldap.LDAPResultInvalidCredentials) {
+			return goauth.NoUserID, nil
+		}
+		return goauth.NoUserID, bindErr
+	}
+	role := h.Config.DefaultRole
+	if len(h.Config.GroupRoles) > 0 {
+		var hasRole bool
+		role, hasRole = h.roleForGroups(entry.GetAttributeValues(h.Config.GroupAttribute))
+		if !hasRole {
+			h.appContext.Logger.WithField("username", userName).Warn("LDAP user is in none of the groups with a role, login denied")
+			return goauth.NoUserID, nil
+		}
+	}
+	adminID, created, provisionErr := h.localUser(userName)
+	if provisionErr != nil {
+		return goauth.NoUserID, provisionErr
+	}
+	if adminID == goauth.NoUserID {
+		h.appContext.Logger.WithField("username", userName).Warn("LDAP user has no local admin and auto provisioning is disabled, login denied")
+		return goauth.NoUserID, nil
+	}
+	if created || len(h.Config.GroupRoles) > 0 {
+		if roleErr := SetAdminRole(h.appContext, adminID, role); roleErr != nil {
+			return goauth.NoUserID, roleErr
+		}
+	}
+	return adminID, nil
+}
+
+// localUser returns the id of the local admin with the given name. If it
+// doesn't exist and AutoProvision is set it gets created (created is true in
+// this case), otherwise goauth.NoUserID is returned.
+func (h *LDAPUserHandler) localUser(userName string) (adminID goauth.UserKeyType, created bool, err error) {
+	adminID, err = h.UserHandler.GetUserID(userName)
+	switch {
+	case err == nil:
+		return adminID, false, nil
+	case err != goauth.ErrUserNotFound:
+		return goauth.NoUserID, false, err
+	case !h.Config.AutoProvision:
+		return goauth.NoUserID, false, nil
+	}
+	// the local password is random, the admin logs in via LDAP
+	buf := make([]byte, 32)
+	if _, randErr := rand.Read(buf); randErr != nil {
+		return goauth.NoUserID, false, randErr
+	}
+	adminID, err = h.UserHandler.Insert(userName, "", "", "", []byte(hex.EncodeToString(buf)))
+	if err != nil {
+		return goauth.NoUserID, false, err
+	}
+	h.appContext.Logger.WithFields(log.Fields{
+		"username": userName,
+		"admin-id": adminID,
+	}).Info("Created admin for LDAP user")
+	return adminID, true, nil
+}
+
+// ldapInfo is used in the server config in the [ldap] section.
+type ldapInfo struct {
+	URL                string            `toml:"url"`
+	StartTLS           bool              `toml:"start_tls"`
+	InsecureSkipVerify bool              `toml:"insecure_skip_verify"`
+	BindDN             string            `toml:"bind_dn"`
+	BindPassword       string            `toml:"bind_password"`
+	BaseDN             string            `toml:"base_dn"`
+	UserFilter         string            `toml:"user_filter"`
+	GroupAttribute     string            `toml:"group_attribute"`
+	GroupRoles         map[string]string `toml:"group_roles"`
+	DefaultRole        string            `toml:"default_role"`
+	AutoProvision      bool              `toml:"auto_provision"`
+	FallbackLocal      bool              `toml:"fallback_local"`
+	Timeout            duration          `toml:"timeout"`
+}
+
+// parseLDAPConfig creates the LDAPConfig from the config file and sets the
+// default values.
+func parseLDAPConfig(info ldapInfo) (LDAPConfig, error) {
+	res := LDAPConfig{
+		URL:                info.URL,
+		StartTLS:           info.StartTLS,
+		InsecureSkipVerify: info.InsecureSkipVerify,
+		BindDN:             info.BindDN,
+		BindPassword:       info.BindPassword,
+		BaseDN:             info.BaseDN,
+		UserFilter:         info.UserFilter,
+		GroupAttribute:     info.GroupAttribute,
+		GroupRoles:         make(map[string]Role, len(info.GroupRoles)),
+		AutoProvision:      info.AutoProvision,
+		FallbackLocal:      info.FallbackLocal,
+		Timeout:            info.Timeout.Duration,
+	}
+	if _, err := url.Parse(res.URL); err != nil {
+		return res, fmt.Errorf("Invalid ldap url: %s", err.Error())
+	}
+	if res.BaseDN == "" {
+		return res, errors.New("Invalid ldap config: base_dn is required")
+	}
+	if res.UserFilter == "" {
+		res.UserFilter = "(uid=%s)"
+	}
+	if strings.Count(res.UserFilter, "%s") != 1 {
+		return res, errors.New("Invalid ldap config: user_filter must contain %s exactly once")
+	}
+	if res.GroupAttribute == "" {
+		res.GroupAttribute = "memberOf"
+	}
+	if res.Timeout == time.Duration(0) {
+		res.Timeout = 10 * time.Second
+	}
+	if info.DefaultRole == "" {
+		res.DefaultRole = RoleReadOnly
+	} else {
+		role, err := ParseRole(info.DefaultRole)
+		if err != nil {
+			return res, err
+		}
+		res.DefaultRole = role
+	}
+	for group, roleName := range info.GroupRoles {
+		role, err := ParseRole(roleName)
+		if err != nil {
+			return res, fmt.Errorf("Invalid role for LDAP group \"%s\": %s", group, err.Error())
+		}
+		res.GroupRoles[group] = role
+	}
+	return res, nil
+}
@@ -0,0 +1,235 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FabianWe/goauth"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// fakeLDAPConn is an ldapConn that serves a fixed directory.
+type fakeLDAPConn struct {
+	// passwords maps DNs to passwords.
+	passwords map[string]string
+	// groups maps DNs to the values of memberOf.
+	groups map[string][]string
+	closed bool
+}
+
+func (conn *fakeLDAPConn) Bind(username, password string) error {
+	if pw, has := conn.passwords[username]; !has || pw != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	}
+	return nil
+}
+
+// Search only supports the filter (uid=<name>) below dc=example,dc=org.
+func (conn *fakeLDAPConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	var uid string
+	if _, err := fmt.Sscanf(searchRequest.Filter, "(uid=%s", &uid); err != nil {
+		return nil, fmt.Errorf("unsupported filter %s", searchRequest.Filter)
+	}
+	dn := fmt.Sprintf("uid=%s,dc=example,dc=org", uid[:len(uid)-1])
+	res := &ldap.SearchResult{}
+	if _, has := conn.passwords[dn]; has {
+		res.Entries = append(res.Entries, ldap.NewEntry(dn, map[string][]string{"memberOf": conn.groups[dn]}))
+	}
+	return res, nil
+}
+
+func (conn *fakeLDAPConn) Close() error {
+	conn.closed = true
+	return nil
+}
+
+const (
+	ldapAdminsGroup   = "cn=admins,ou=groups,dc=example,dc=org"
+	ldapHelpDeskGroup = "cn=helpdesk,ou=groups,dc=example,dc=org"
+)
+
+// newTestLDAPHandler returns an LDAPUserHandler with the directory
+// alice (admins and helpdesk), bob (no groups) and the local admins given.
+func newTestLDAPHandler(t *testing.T, config LDAPConfig, localAdmins map[string]string) (*LDAPUserHandler, *memoryUserHandler, *fakeLDAPConn, sqlmock.Sqlmock) {
+	appContext, mock := newTestContext(t)
+	local := newMemoryUserHandler(localAdmins)
+	conn := &fakeLDAPConn{
+		passwords: map[string]string{
+			"cn=search,dc=example,dc=org": "search-secret",
+			"uid=alice,dc=example,dc=org": "alice-secret",
+			"uid=bob,dc=example,dc=org":   "bob-secret",
+		},
+		groups: map[string][]string{
+			"uid=alice,dc=example,dc=org": {ldapHelpDeskGroup, ldapAdminsGroup},
+		},
+	}
+	config.BindDN, config.BindPassword = "cn=search,dc=example,dc=org", "search-secret"
+	config.BaseDN = "dc=example,dc=org"
+	config.UserFilter = "(uid=%s)"
+	config.GroupAttribute = "memberOf"
+	if config.DefaultRole == "" {
+		config.DefaultRole = RoleReadOnly
+	}
+	h := NewLDAPUserHandler(appContext, local, config)
+	h.dial = func() (ldapConn, error) {
+		return conn, nil
+	}
+	return h, local, conn, mock
+}
+
+// expectSetRole expects a call of SetAdminRole with the given role.
+func expectSetRole(mock sqlmock.Sqlmock, role Role) {
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO admin_roles")).
+		WithArgs(sqlmock.AnyArg(), string(role)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestLDAPBindFailure(t *testing.T) {
+	h, local, conn, _ := newTestLDAPHandler(t, LDAPConfig{AutoProvision: true}, nil)
+	id, err := h.Validate("alice", []byte("wrong"))
+	if err != nil || id != goauth.NoUserID {
+		t.Errorf("Expected login to fail without error, got id %d and error %v", id, err)
+	}
+	if len(local.ids) != 0 {
+		t.Error("Admin was provisioned although the bind failed")
+	}
+	if !conn.closed {
+		t.Error("Connection was not closed")
+	}
+	// an empty password must never reach the server
+	h.dial = func() (ldapConn, error) {
+		t.Fatal("Server contacted for an empty password")
+		return nil, nil
+	}
+	if id, err := h.Validate("alice", nil); err != nil || id != goauth.NoUserID {
+		t.Errorf("Expected login with empty password to fail, got id %d and error %v", id, err)
+	}
+}
+
+func TestLDAPSearchBindFailure(t *testing.T) {
+	h, _, _, _ := newTestLDAPHandler(t, LDAPConfig{}, nil)
+	h.Config.BindPassword = "wrong"
+	if _, err := h.Validate("alice", []byte("alice-secret")); err == nil {
+		t.Error("Expected an error if the search user can't bind")
+	}
+}
+
+func TestLDAPGroupRoles(t *testing.T) {
+	groupRoles := map[string]Role{
+		ldapHelpDeskGroup: RoleHelpDesk,
+		ldapAdminsGroup:   RoleSuperAdmin,
+	}
+	h, local, _, mock := newTestLDAPHandler(t, LDAPConfig{GroupRoles: groupRoles},
+		map[string]string{"alice": "local", "bob": "local"})
+	// the most powerful role of all groups is used
+	expectSetRole(mock, RoleSuperAdmin)
+	id, err := h.Validate("alice", []byte("alice-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != local.ids["alice"] {
+		t.Errorf("Expected id %d for alice, got %d", local.ids["alice"], id)
+	}
+	// bob is in no group with a role
+	if id, err := h.Validate("bob", []byte("bob-secret")); err != nil || id != goauth.NoUserID {
+		t.Errorf("Expected bob to be denied, got id %d and error %v", id, err)
+	}
+}
+
+func TestRoleForGroups(t *testing.T) {
+	h := &LDAPUserHandler{Config: LDAPConfig{GroupRoles: map[string]Role{
+		"cn=help,dc=example,dc=org": RoleHelpDesk,
+		"cn=dom,dc=example,dc=org":  RoleDomainAdmin,
+	}}}
+	tests := []struct {
+		groups []string
+		role   Role
+		ok     bool
+	}{
+		{nil, "", false},
+		{[]string{"cn=other,dc=example,dc=org"}, "", false},
+		{[]string{"CN=Help,DC=example,DC=org"}, RoleHelpDesk, true},
+		{[]string{"cn=help,dc=example,dc=org", " cn=dom,dc=example,dc=org"}, RoleDomainAdmin, true},
+	}
+	for _, test := range tests {
+		role, ok := h.roleForGroups(test.groups)
+		if role != test.role || ok != test.ok {
+			t.Errorf("Groups %v: expected (%s, %v), got (%s, %v)", test.groups, test.role, test.ok, role, ok)
+		}
+	}
+}
+
+func TestLDAPAutoProvision(t *testing.T) {
+	h, local, _, mock := newTestLDAPHandler(t, LDAPConfig{AutoProvision: true, DefaultRole: RoleHelpDesk}, nil)
+	expectSetRole(mock, RoleHelpDesk)
+	id, err := h.Validate("bob", []byte("bob-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	localID, has := local.ids["bob"]
+	if !has {
+		t.Fatal("No local admin was created for bob")
+	}
+	if id != localID {
+		t.Errorf("Expected id %d, got %d", localID, id)
+	}
+	// the second login uses the existing admin and doesn't change the role
+	if id, err := h.Validate("bob", []byte("bob-secret")); err != nil || id != localID {
+		t.Errorf("Expected id %d on second login, got %d and error %v", localID, id, err)
+	}
+}
+
+func TestLDAPWithoutAutoProvision(t *testing.T) {
+	h, local, _, _ := newTestLDAPHandler(t, LDAPConfig{}, nil)
+	if id, err := h.Validate("bob", []byte("bob-secret")); err != nil || id != goauth.NoUserID {
+		t.Errorf("Expected login without local admin to fail, got id %d and error %v", id, err)
+	}
+	if len(local.ids) != 0 {
+		t.Error("Admin was provisioned although AutoProvision is disabled")
+	}
+}
+
+func TestLDAPFallbackLocal(t *testing.T) {
+	localAdmins := map[string]string{"root": "root-secret"}
+	h, local, _, _ := newTestLDAPHandler(t, LDAPConfig{FallbackLocal: true}, localAdmins)
+	if id, err := h.Validate("root", []byte("root-secret")); err != nil || id != local.ids["root"] {
+		t.Errorf("Expected local login of root, got id %d and error %v", id, err)
+	}
+	if id, err := h.Validate("root", []byte("wrong")); err != nil || id != goauth.NoUserID {
+		t.Errorf("Expected local login with wrong password to fail, got id %d and error %v", id, err)
+	}
+	// users in LDAP never use the local password
+	local.Insert("bob", "", "", "", []byte("local"))
+	if id, err := h.Validate("bob", []byte("local")); err != nil || id != goauth.NoUserID {
+		t.Errorf("Expected local password of LDAP user to be rejected, got id %d and error %v", id, err)
+	}
+	h.Config.FallbackLocal = false
+	if _, err := h.Validate("root", []byte("root-secret")); err != goauth.ErrUserNotFound {
+		t.Errorf("Expected ErrUserNotFound without FallbackLocal, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the brute-force protection for the admin login and the
+// mail password change (/password/). Failed attempts are counted per remote
+// address and per account in the table login_failures. After a number of
+// failures the remote address / account gets locked with an exponentially
+// growing delay, see LockoutPolicy.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+// Scopes for failed attempts, the subject of a failure is interpreted
+// depending on the scope.
+const (
+	// LockoutScopeIP is used for remote addresses.
+	LockoutScopeIP = "ip"
+	// LockoutScopeAdmin is used for admin user names.
+	LockoutScopeAdmin = "admin"
+	// LockoutScopeMail is used for mail users (email addresses).
+	LockoutScopeMail = "mail"
+)
+
+// LockoutPolicy describes when remote addresses and accounts get locked.
+// After Threshold failed attempts for an account (IPThreshold for a remote
+// address) it gets locked for BaseDelay, each further failure doubles the
+// delay up to MaxDelay. Failures are forgotten after ResetAfter without a
+// new failure and after a successful login.
+type LockoutPolicy struct {
+	Threshold   int
+	IPThreshold int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	ResetAfter  time.Duration
+}
+
+// threshold returns the threshold for the given scope.
+func (policy *LockoutPolicy) threshold(scope string) int {
+	if scope == LockoutScopeIP {
+		return policy.IPThreshold
+	}
+	return policy.Threshold
+}
+
+// delay returns the time a subject gets locked after failures failed
+// attempts, 0 if it is not locked.
+func (policy *LockoutPolicy) delay(scope string, failures int) time.Duration {
+	exceeded := failures - policy.threshold(scope)
+	if exceeded < 0 {
+		return 0
+	}
+	res := policy.BaseDelay
+	for i := 0; i < exceeded && res < policy.MaxDelay; i++ {
+		res *= 2
+	}
+	if res > policy.MaxDelay {
+		res = policy.MaxDelay
+	}
+	return res
+}
+
+// Lockout stores the failed attempts for a subject.
+type Lockout struct {
+	Scope       string    `json:"scope"`
+	Subject     string    `json:"subject"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last-failure"`
+	// LockedUntil is the zero time if the subject is not locked.
+	LockedUntil time.Time `json:"locked-until"`
+}
+
+// normalizeSubject converts email addresses and user names to lower case so
+// that they can't bypass the lockout by changing the case.
+func normalizeSubject(scope, subject string) string {
+	if scope == LockoutScopeIP {
+		return subject
+	}
+	return strings.ToLower(strings.TrimSpace(subject))
+}
+
+// CheckLockout returns the time until the subject is locked and true if it
+// is currently locked.
+func CheckLockout(appContext *MailAppContext, scope, subject string) (time.Time, bool, error) {
+	var lockedUntil sqlTime
+	query := "SELECT locked_until FROM login_failures WHERE scope = ? AND subject = ?;"
+	err := appContext.DB.QueryRow(query, scope, normalizeSubject(scope, subject)).Scan(&lockedUntil)
+	switch {
+	case err == sql.ErrNoRows:
+		return time.Time{}, false, nil
+	case err != nil:
+		return time.Time{}, false, err
+	}
+	if lockedUntil.IsZero() || !time.Now().UTC().Before(lockedUntil.Time) {
+		return time.Time{}, false, nil
+	}
+	return lockedUntil.Time, true, nil
+}
+
+// RecordFailure counts a failed attempt for the subject and locks it if the
+// threshold of the policy is exceeded.
+func RecordFailure(appContext *MailAppContext, scope, subject string) error {
+	subject = normalizeSubject(scope, subject)
+	now := time.Now().UTC()
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	var failures int
+	var lastFailure sqlTime
+	query := "SELECT failures, last_failure FROM login_failures WHERE scope = ? AND subject = ? FOR UPDATE;"
+	err := tx.QueryRow(query, scope, subject).Scan(&failures, &lastFailure)
+	switch {
+	case err == sql.ErrNoRows:
+		failures = 0
+	case err != nil:
+		return err
+	}
+	// forget old failures
+	if now.Sub(lastFailure.Time) > appContext.Lockout.ResetAfter {
+		failures = 0
+	}
+	failures++
+	var lockedUntil interface{}
+	if delay := appContext.Lockout.delay(scope, failures); delay > 0 {
+		lockedUntil = now.Add(delay)
+		appContext.Logger.WithFields(log.Fields{
+			"scope":   scope,
+			"subject": subject,
+			"until":   now.Add(delay),
+		}).Warn("Locked after too many failed attempts")
+	}
+	upsert := `INSERT INTO login_failures (scope, subject, failures, last_failure, locked_until) VALUES (?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE failures = VALUES(failures), last_failure = VALUES(last_failure), locked_until = VALUES(locked_until);`
+	if _, err := tx.Exec(upsert, scope, subject, failures, now, lockedUntil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClearFailures removes all failed attempts for the subject.
+func ClearFailures(appContext *MailAppContext, scope, subject string) error {
+	_, err := appContext.DB.Exec("DELETE FROM login_failures WHERE scope = ? AND subject = ?;", scope, normalizeSubject(scope, subject))
+	return err
+}
+
+// ListLockouts returns all subjects with failed attempts that are not yet
+// forgotten (see LockoutPolicy.ResetAfter).
+func ListLockouts(appContext *MailAppContext) ([]*Lockout, error) {
+	query := `SELECT scope, subject, failures, last_failure, locked_until FROM login_failures
+	WHERE last_failure >= ? ORDER BY last_failure DESC;`
+	rows, err := appContext.DB.Query(query, time.Now().UTC().Add(-appContext.Lockout.ResetAfter))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]*Lockout, 0)
+	for rows.Next() {
+		var lockout Lockout
+		var lastFailure, lockedUntil sqlTime
+		if scanErr := rows.Scan(&lockout.Scope, &lockout.Subject, &lockout.Failures, &lastFailure, &lockedUntil); scanErr != nil {
+			return nil, scanErr
+		}
+		lockout.LastFailure = lastFailure.Time
+		lockout.LockedUntil = lockedUntil.Time
+		res = append(res, &lockout)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteExpiredFailures removes all entries that are forgotten according to
+// LockoutPolicy.ResetAfter.
+func DeleteExpiredFailures(appContext *MailAppContext) (int64, error) {
+	query := "DELETE FROM login_failures WHERE last_failure < ? AND (locked_until IS NULL OR locked_until < ?);"
+	now := time.Now().UTC()
+	res, err := appContext.DB.Exec(query, now.Add(-appContext.Lockout.ResetAfter), now)
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredFailuresDaemon runs DeleteExpiredFailures every sleep
+// duration. It runs in a new goroutine until something is written to stop.
+func DeleteExpiredFailuresDaemon(appContext *MailAppContext, sleep time.Duration, stop chan bool) {
+	ticker := time.NewTicker(sleep)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if num, err := DeleteExpiredFailures(appContext); err != nil {
+					appContext.Logger.WithError(err).Error("Error deleting expired login failures")
+				} else if num > 0 {
+					appContext.Logger.WithField("num-deleted", num).Info("Deleted expired login failures")
+				}
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// checkAttemptAllowed checks if the remote address of the request and the
+// account are locked. If one of them is it replies with a 429 and sets the
+// Retry-After header. It returns true if the attempt is allowed.
+func checkAttemptAllowed(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, scope, subject string) (bool, error) {
+	ipUntil, ipLocked, ipErr := CheckLockout(appContext, LockoutScopeIP, remoteHost(r))
+	if ipErr != nil {
+		return false, ipErr
+	}
+	accountUntil, accountLocked, accountErr := CheckLockout(appContext, scope, subject)
+	if accountErr != nil {
+		return false, accountErr
+	}
+	if !ipLocked && !accountLocked {
+		return true, nil
+	}
+	until := ipUntil
+	if accountUntil.After(until) {
+		until = accountUntil
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"scope":   scope,
+		"subject": subject,
+		"remote":  r.RemoteAddr,
+	}).Warn("Attempt while locked")
+	seconds := int(time.Until(until)/time.Second) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds), 429)
+	return false, nil
+}
+
+// attemptFailed records a failure for the remote address and the account.
+// Errors are only logged.
+func attemptFailed(appContext *MailAppContext, r *http.Request, scope, subject string) {
+	if err := RecordFailure(appContext, LockoutScopeIP, remoteHost(r)); err != nil {
+		appContext.Logger.WithError(err).Error("Can't record failed attempt")
+	}
+	if err := RecordFailure(appContext, scope, subject); err != nil {
+		appContext.Logger.WithError(err).Error("Can't record failed attempt")
+	}
+}
+
+// attemptSucceeded removes the failures of the account, the failures of the
+// remote address are kept (otherwise one valid account could be used to
+// reset the counter). Errors are only logged.
+func attemptSucceeded(appContext *MailAppContext, scope, subject string) {
+	if err := ClearFailures(appContext, scope, subject); err != nil {
+		appContext.Logger.WithError(err).Error("Can't clear failed attempts")
+	}
+}
+
+// lockoutRegex matches /api/lockouts/<scope>/<subject>.
+var lockoutRegex = regexp.MustCompile(`^/api/lockouts/(ip|admin|mail)/([^/]+)/?$`)
+
+// parseLockoutURL returns scope and subject from the url, "" if the url is
+// /api/lockouts/ and an error if the url is invalid.
+func parseLockoutURL(url string) (string, string, error) {
+	if url == "/api/lockouts/" || url == "/api/lockouts" {
+		return "", "", errNoID
+	}
+	match := lockoutRegex.FindStringSubmatch(url)
+	if match == nil {
+		return "", "", fmt.Errorf("Invalid lockout URL \"%s\"", url)
+	}
+	return match[1], match[2], nil
+}
+
+// ListLockoutsJSON is the main handler for /api/lockouts.
+// GET returns a JSON list of Lockout, DELETE /api/lockouts/<scope>/<subject>
+// clears the failures (and thus the lock) of the subject.
+func ListLockoutsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	scope, subject, parseErr := parseLockoutURL(r.URL.Path)
+	if parseErr != nil && parseErr != errNoID {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/lockouts/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		if subject != "" {
+			http.Error(w, "Invalid GET request. Must be GET /api/lockouts/", 400)
+			return nil
+		}
+		res, err := ListLockouts(appcontext)
+		if err != nil {
+			return err
+		}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		// create json encoding
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case deleteMethod:
+		if subject == "" {
+			http.Error(w, "Invalid DELETE request to /api/lockouts/: No subject given.", 400)
+			return nil
+		}
+		if err := ClearFailures(appcontext, scope, subject); err != nil {
+			return err
+		}
+		appcontext.Logger.WithFields(log.Fields{
+			"scope":   scope,
+			"subject": subject,
+		}).Info("Cleared lockout")
+		recordAudit(appcontext, r, AuditClearLockout, AuditTargetLockout, 0, AuditValues{"scope": scope, "subject": subject}, nil)
+		return nil
+	}
+}
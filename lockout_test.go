@@ -0,0 +1,120 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLockoutPolicyDelay(t *testing.T) {
+	policy := &LockoutPolicy{
+		Threshold:   3,
+		IPThreshold: 10,
+		BaseDelay:   time.Minute,
+		MaxDelay:    10 * time.Minute,
+	}
+	tests := []struct {
+		scope    string
+		failures int
+		expected time.Duration
+	}{
+		{LockoutScopeAdmin, 0, 0},
+		{LockoutScopeAdmin, 2, 0},
+		{LockoutScopeAdmin, 3, time.Minute},
+		{LockoutScopeAdmin, 4, 2 * time.Minute},
+		{LockoutScopeAdmin, 6, 8 * time.Minute},
+		{LockoutScopeAdmin, 7, 10 * time.Minute},
+		{LockoutScopeAdmin, 1000, 10 * time.Minute},
+		{LockoutScopeMail, 3, time.Minute},
+		{LockoutScopeIP, 9, 0},
+		{LockoutScopeIP, 10, time.Minute},
+		{LockoutScopeIP, 14, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.delay(tt.scope, tt.failures); got != tt.expected {
+			t.Errorf("delay(%s, %d): expected %s, got %s", tt.scope, tt.failures, tt.expected, got)
+		}
+	}
+}
+
+// lockedUntilArg matches the locked_until argument of RecordFailure: NULL if
+// locked is false, a time otherwise.
+type lockedUntilArg struct {
+	locked bool
+}
+
+func (a lockedUntilArg) Match(v driver.Value) bool {
+	if !a.locked {
+		return v == nil
+	}
+	_, isTime := v.(time.Time)
+	return isTime
+}
+
+func TestRecordFailure(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name        string
+		failures    int
+		lastFailure time.Time
+		expected    int
+		locked      bool
+	}{
+		{"first failure", 0, time.Time{}, 1, false},
+		{"below threshold", 1, now.Add(-time.Minute), 2, false},
+		{"at threshold", 2, now.Add(-time.Minute), 3, true},
+		{"reset after", 5, now.Add(-2 * time.Hour), 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appContext, mock := newTestContext(t)
+			appContext.Lockout = LockoutPolicy{
+				Threshold:   3,
+				IPThreshold: 10,
+				BaseDelay:   time.Minute,
+				MaxDelay:    time.Hour,
+				ResetAfter:  time.Hour,
+			}
+			mock.ExpectBegin()
+			query := mock.ExpectQuery(regexp.QuoteMeta("SELECT failures, last_failure FROM login_failures WHERE scope = ? AND subject = ? FOR UPDATE;")).
+				WithArgs(LockoutScopeAdmin, "admin")
+			if tt.failures == 0 {
+				query.WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure"}))
+			} else {
+				query.WillReturnRows(sqlmock.NewRows([]string{"failures", "last_failure"}).AddRow(tt.failures, tt.lastFailure))
+			}
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO login_failures")).
+				WithArgs(LockoutScopeAdmin, "admin", tt.expected, sqlmock.AnyArg(), lockedUntilArg{tt.locked}).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			if err := RecordFailure(appContext, LockoutScopeAdmin, " Admin"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
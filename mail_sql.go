@@ -25,6 +25,7 @@ package mailwebadmin
 // This file contains SQL commands.
 
 import (
+	"database/sql"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -32,6 +33,7 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	crypt "github.com/amoghe/go-crypt"
 	"github.com/gorilla/securecookie"
@@ -155,6 +157,17 @@ func getUserName(appContext *MailAppContext, userID int64) (string, string, erro
 	return ParseMailParts(email)
 }
 
+// getVirtualUser returns the user with the given id.
+// It returns sql.ErrNoRows if the user doesn't exist.
+func getVirtualUser(appContext *MailAppContext, userID int64) (*VirtualUser, error) {
+	query := "SELECT email, domain_id FROM virtual_users WHERE id = ?;"
+	var res VirtualUser
+	if err := appContext.DB.QueryRow(query, userID).Scan(&res.Mail, &res.DomainID); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
 // getUserPassword returns the password as stored in the database for the given
 // mail.
 // It also returns the id of the user.
@@ -187,34 +200,67 @@ func getPWParts(pwString string) (string, string, string, error) {
 	return res[0], res[1], res[2], nil
 }
 
+// checkMailPassword checks the password of the mail user. It returns the id
+// and the stored password of the user and true if the password is correct.
+// If the user doesn't exist false is returned as well, all other database
+// errors are returned (they must not count as failed login attempts).
+func checkMailPassword(appContext *MailAppContext, mail, password string) (int64, string, bool, error) {
+	id, storedPW, getErr := getUserPassword(appContext, mail)
+	if getErr == sql.ErrNoRows {
+		return -1, "", false, nil
+	}
+	if getErr != nil {
+		appContext.Logger.WithError(getErr).WithField("mail", mail).Error("Error receiving user to check password.")
+		return -1, "", false, getErr
+	}
+	enc, salt, _, parseErr := getPWParts(storedPW)
+	if parseErr != nil {
+		return -1, "", false, parseErr
+	}
+	equal, encErr := comparePasswords(password, salt, enc)
+	if encErr != nil {
+		return -1, "", false, encErr
+	}
+	return id, storedPW, equal, nil
+}
+
 // AddMailUser adds a new mail user.
 // On success it returns the insert id and nil, on failure -1 and an
 // error != nil.
 func AddMailUser(appContext *MailAppContext, email, plaintextPW string) (int64, error) {
+	// encrypt the password
+	pwHash, pwErr := GenDovecotSHA512(plaintextPW)
+	if pwErr != nil {
+		appContext.Logger.WithError(pwErr).Error("Error while encrypting password")
+		return -1, pwErr
+	}
+	return AddMailUserHash(appContext, email, pwHash)
+}
+
+// AddMailUserHash adds a new mail user with a password that is already
+// encrypted (a {SHA512-CRYPT} hash as created by GenDovecotSHA512).
+func AddMailUserHash(appContext *MailAppContext, email, pwHash string) (int64, error) {
 	// first validate the email address, this pretty much makes the next test
 	// useless, but ok...
 	if validMail := emailValid(email); validMail != nil {
 		return -1, validMail
 	}
+	if _, _, _, hashErr := getPWParts(pwHash); hashErr != nil {
+		return -1, hashErr
+	}
 	// get the mail domain
 	_, domain, parseErr := ParseMailParts(email)
 	if parseErr != nil {
 		return -1, parseErr
 	}
-	// encrypt the password
-	pwHash, pwErr := GenDovecotSHA512(plaintextPW)
-	if pwErr != nil {
-		appContext.Logger.WithError(pwErr).Error("Error while encrypting password")
-		return -1, pwErr
-	}
 	// get the domain id
 	domainID, domainErr := getDomainID(appContext, domain)
 	if domainErr != nil {
 		return -1, domainErr
 	}
 	// now insert the user
-	query := "INSERT INTO virtual_users (domain_id, email, password) VALUES(?, ?, ?);"
-	res, insertErr := appContext.DB.Exec(query, domainID, email, pwHash)
+	query := "INSERT INTO virtual_users (domain_id, email, password, password_set) VALUES(?, ?, ?, ?);"
+	res, insertErr := appContext.DB.Exec(query, domainID, email, pwHash, time.Now().UTC())
 	if insertErr != nil {
 		appContext.Logger.WithError(insertErr).WithField("email", email).Error("Error inserting email into database")
 		return -1, insertErr
@@ -226,15 +272,25 @@ func AddMailUser(appContext *MailAppContext, email, plaintextPW string) (int64,
 
 // ChangeUserPassword changes the password for the user with the given id,
 // it returns an error != nil if something went wrong.
+// It also resets the password expiry of the user.
 func ChangeUserPassword(appContext *MailAppContext, emailID int64, plaintextPW string) error {
 	// encrypt the password
 	pwHash, pwErr := GenDovecotSHA512(plaintextPW)
 	if pwErr != nil {
 		return pwErr
 	}
+	return SetUserPasswordHash(appContext, emailID, pwHash)
+}
+
+// SetUserPasswordHash works as ChangeUserPassword but with a password that is
+// already encrypted (see AddMailUserHash).
+func SetUserPasswordHash(appContext *MailAppContext, emailID int64, pwHash string) error {
+	if _, _, _, hashErr := getPWParts(pwHash); hashErr != nil {
+		return hashErr
+	}
 	// update the entry
-	query := "UPDATE virtual_users SET password = ? WHERE id = ?;"
-	res, updateErr := appContext.DB.Exec(query, pwHash, emailID)
+	query := "UPDATE virtual_users SET password = ?, password_set = ?, password_expired = FALSE WHERE id = ?;"
+	res, updateErr := appContext.DB.Exec(query, pwHash, time.Now().UTC(), emailID)
 	if updateErr != nil {
 		return updateErr
 	}
@@ -307,6 +363,52 @@ func AddAlias(appContext *MailAppContext, source, destination string) (int64, er
 	return id, nil
 }
 
+// getAlias returns the alias with the given id.
+func getAlias(appContext *MailAppContext, aliasID int64) (*Alias, error) {
+	query := "SELECT domain_id, source, destination FROM virtual_aliases WHERE id = ?;"
+	row := appContext.DB.QueryRow(query, aliasID)
+	var res Alias
+	err := row.Scan(&res.DomainID, &res.Source, &res.Dest)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// UpdateAlias changes source and destination of the alias with the given id,
+// the checks are the same as in AddAlias.
+// It returns sql.ErrNoRows if the alias doesn't exist.
+func UpdateAlias(appContext *MailAppContext, aliasID int64, source, destination string) error {
+	_, domain, sourceParseErr := ParseMailParts(source)
+	if sourceParseErr != nil {
+		return sourceParseErr
+	}
+	if validMail := emailValid(destination); validMail != nil {
+		return validMail
+	}
+	domainID, domainErr := getDomainID(appContext, domain)
+	if domainErr != nil {
+		return domainErr
+	}
+	query := "UPDATE virtual_aliases SET domain_id = ?, source = ?, destination = ? WHERE id = ?;"
+	res, updateErr := appContext.DB.Exec(query, domainID, source, destination, aliasID)
+	if updateErr != nil {
+		return updateErr
+	}
+	// RowsAffected is 0 if nothing changed, so check if the alias exists
+	if num, _ := res.RowsAffected(); num == 0 {
+		if _, getErr := getAlias(appContext, aliasID); getErr != nil {
+			return getErr
+		}
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"alias-id": aliasID,
+		"source":   source,
+		"dest":     destination,
+	}).Info("Updated alias")
+	return nil
+}
+
 // DelAlias deletes the alias with the given id.
 func DelAlias(appContext *MailAppContext, aliasID int64) error {
 	query := "DELETE FROM virtual_aliases WHERE id = ?;"
@@ -535,3 +637,210 @@ func ListAllUsers(appContext *MailAppContext, domainID int64) (map[string]*ListU
 	}
 	return res, nil
 }
+
+// VirtualUserEntry is a virtual user together with its id, used in ListPage.
+type VirtualUserEntry struct {
+	ID int64
+	*VirtualUser
+}
+
+// AliasEntry is an alias together with its id, used in ListPage.
+type AliasEntry struct {
+	ID int64
+	*Alias
+}
+
+// ListUserEntry is a ListUserResult together with the mail, used in
+// ListPage.
+type ListUserEntry struct {
+	Mail string
+	*ListUserResult
+}
+
+// Fields that can be used for sorting the lists.
+var (
+	VirtualUserSortColumns = map[string]string{"id": "id", "email": "email"}
+	AliasSortColumns       = map[string]string{"id": "id", "source": "source", "destination": "destination"}
+	AllUsersSortColumns    = map[string]string{"email": "email"}
+)
+
+// ListVirtualUsersPage returns a page of the virtual users (as
+// []*VirtualUserEntry), the search compares the email.
+// Again a domainID < 0 means "all domains".
+func ListVirtualUsersPage(appContext *MailAppContext, domainID int64, opts *ListOptions) (*ListPage, error) {
+	query := &pageQuery{from: "virtual_users", columns: "id, email, domain_id", idColumn: "id",
+		sortColumns: VirtualUserSortColumns, searchColumns: []string{"email"}}
+	if domainID >= 0 {
+		query.filter("domain_id = ?", domainID)
+	}
+	total, countErr := query.count(appContext, opts)
+	if countErr != nil {
+		return nil, countErr
+	}
+	rows, err := query.rows(appContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*VirtualUserEntry, 0, opts.Limit)
+	for rows.Next() {
+		user := &VirtualUser{}
+		var id int64
+		if scanErr := rows.Scan(&id, &user.Mail, &user.DomainID); scanErr != nil {
+			return nil, scanErr
+		}
+		entries = append(entries, &VirtualUserEntry{ID: id, VirtualUser: user})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	res := &ListPage{Total: total}
+	if len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := entries[len(entries)-1]
+		res.NextCursor = encodeCursor(last.Mail, last.ID)
+	}
+	res.Items = entries
+	return res, nil
+}
+
+// ListVirtualAliasesPage returns a page of the virtual aliases (as
+// []*AliasEntry), the search compares source and destination.
+// Again a domainID < 0 means "all domains".
+func ListVirtualAliasesPage(appContext *MailAppContext, domainID int64, opts *ListOptions) (*ListPage, error) {
+	query := &pageQuery{from: "virtual_aliases", columns: "id, domain_id, source, destination", idColumn: "id",
+		sortColumns: AliasSortColumns, searchColumns: []string{"source", "destination"}}
+	if domainID >= 0 {
+		query.filter("domain_id = ?", domainID)
+	}
+	total, countErr := query.count(appContext, opts)
+	if countErr != nil {
+		return nil, countErr
+	}
+	rows, err := query.rows(appContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make([]*AliasEntry, 0, opts.Limit)
+	for rows.Next() {
+		alias := &Alias{}
+		var id int64
+		if scanErr := rows.Scan(&id, &alias.DomainID, &alias.Source, &alias.Dest); scanErr != nil {
+			return nil, scanErr
+		}
+		entries = append(entries, &AliasEntry{ID: id, Alias: alias})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	res := &ListPage{Total: total}
+	if len(entries) > opts.Limit {
+		entries = entries[:opts.Limit]
+		last := entries[len(entries)-1]
+		value := last.Source
+		if opts.Sort == "destination" {
+			value = last.Dest
+		}
+		res.NextCursor = encodeCursor(value, last.ID)
+	}
+	res.Items = entries
+	return res, nil
+}
+
+// ListAllUsersPage returns a page of ListAllUsers (as []*ListUserEntry),
+// the search compares the email.
+// It first selects a page of the mails of virtual users and alias sources
+// (without catch all aliases) and then loads the users and aliases for these
+// mails only.
+// Again a domainID < 0 means "all domains".
+func ListAllUsersPage(appContext *MailAppContext, domainID int64, opts *ListOptions) (*ListPage, error) {
+	usersQuery := "SELECT email FROM virtual_users"
+	aliasesQuery := "SELECT source FROM virtual_aliases WHERE source NOT LIKE '@%'"
+	var args []interface{}
+	if domainID >= 0 {
+		usersQuery += " WHERE domain_id = ?"
+		aliasesQuery += " AND domain_id = ?"
+		args = append(args, domainID, domainID)
+	}
+	query := &pageQuery{from: "(" + usersQuery + " UNION " + aliasesQuery + ") AS entries", columns: "email",
+		sortColumns: AllUsersSortColumns, searchColumns: []string{"email"}, args: args}
+	total, countErr := query.count(appContext, opts)
+	if countErr != nil {
+		return nil, countErr
+	}
+	rows, err := query.rows(appContext, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	mails := make([]string, 0, opts.Limit)
+	for rows.Next() {
+		var mail string
+		if scanErr := rows.Scan(&mail); scanErr != nil {
+			return nil, scanErr
+		}
+		mails = append(mails, mail)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	res := &ListPage{Total: total}
+	if len(mails) > opts.Limit {
+		mails = mails[:opts.Limit]
+		res.NextCursor = encodeCursor(mails[len(mails)-1], 0)
+	}
+	entries := make([]*ListUserEntry, len(mails))
+	byMail := make(map[string]*ListUserEntry, len(mails))
+	for i, mail := range mails {
+		entries[i] = &ListUserEntry{Mail: mail, ListUserResult: NewListResultForVirtualAlias()}
+		byMail[mail] = entries[i]
+	}
+	res.Items = entries
+	if len(mails) == 0 {
+		return res, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(mails)), ", ")
+	mailArgs := make([]interface{}, len(mails))
+	for i, mail := range mails {
+		mailArgs[i] = mail
+	}
+	userRows, usersErr := appContext.DB.Query("SELECT id, email, domain_id FROM virtual_users WHERE email IN ("+placeholders+");", mailArgs...)
+	if usersErr != nil {
+		return nil, usersErr
+	}
+	defer userRows.Close()
+	for userRows.Next() {
+		user := &VirtualUser{}
+		var id int64
+		if scanErr := userRows.Scan(&id, &user.Mail, &user.DomainID); scanErr != nil {
+			return nil, scanErr
+		}
+		if entry, has := byMail[user.Mail]; has {
+			entry.VirtualUser = user
+			entry.VirtualUserID = id
+		}
+	}
+	if usersErr = userRows.Err(); usersErr != nil {
+		return nil, usersErr
+	}
+	aliasRows, aliasErr := appContext.DB.Query("SELECT id, domain_id, source, destination FROM virtual_aliases WHERE source IN ("+placeholders+");", mailArgs...)
+	if aliasErr != nil {
+		return nil, aliasErr
+	}
+	defer aliasRows.Close()
+	for aliasRows.Next() {
+		alias := &Alias{}
+		var id int64
+		if scanErr := aliasRows.Scan(&id, &alias.DomainID, &alias.Source, &alias.Dest); scanErr != nil {
+			return nil, scanErr
+		}
+		if entry, has := byMail[alias.Source]; has {
+			entry.AliasFor[id] = alias
+		}
+	}
+	if aliasErr = aliasRows.Err(); aliasErr != nil {
+		return nil, aliasErr
+	}
+	return res, nil
+}
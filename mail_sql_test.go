@@ -0,0 +1,53 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestCheckMailPasswordUnknownUser(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, password FROM virtual_users")).
+		WithArgs("nobody@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}))
+	_, _, equal, err := checkMailPassword(appContext, "nobody@example.org", "secret")
+	if err != nil || equal {
+		t.Errorf("Expected unknown user to be a wrong password, got %v and error %v", equal, err)
+	}
+}
+
+func TestCheckMailPasswordDatabaseError(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	dbErr := errors.New("connection refused")
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, password FROM virtual_users")).
+		WithArgs("user@example.org").
+		WillReturnError(dbErr)
+	if _, _, _, err := checkMailPassword(appContext, "user@example.org", "secret"); err != dbErr {
+		t.Errorf("Expected the database error to be returned, got %v", err)
+	}
+}
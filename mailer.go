@@ -0,0 +1,206 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains a simple mailer that sends mails via an SMTP relay, it
+// is used to send password reset links. For testing it can be pointed to a
+// local fake SMTP server (with tls = "none").
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Modes for the connection to the SMTP server.
+const (
+	// SMTPStartTLS connects without TLS and then uses STARTTLS.
+	SMTPStartTLS = "starttls"
+	// SMTPTLS uses TLS from the start (usually on port 465).
+	SMTPTLS = "tls"
+	// SMTPNoTLS never uses TLS, only use it for local servers.
+	SMTPNoTLS = "none"
+)
+
+// Mailer sends mails via SMTP.
+type Mailer struct {
+	// Host and Port of the SMTP server.
+	Host string
+	Port int
+	// Username and Password are used for authentication, no authentication
+	// is done if Username is empty.
+	Username, Password string
+	// From is the sender address.
+	From string
+	// TLS is one of SMTPStartTLS, SMTPTLS or SMTPNoTLS.
+	TLS string
+	// InsecureSkipVerify disables the verification of the server certificate.
+	InsecureSkipVerify bool
+	// Timeout is the timeout for connecting to the server.
+	Timeout time.Duration
+}
+
+// smtpInfo is used in the server config in the [smtp] section.
+type smtpInfo struct {
+	Host               string   `toml:"host"`
+	Port               int      `toml:"port"`
+	Username           string   `toml:"username"`
+	Password           string   `toml:"password"`
+	From               string   `toml:"from"`
+	TLS                string   `toml:"tls"`
+	InsecureSkipVerify bool     `toml:"insecure_skip_verify"`
+	Timeout            duration `toml:"timeout"`
+}
+
+// parseMailer creates the Mailer from the config file and sets the default
+// values. It returns nil if no host is given.
+func parseMailer(info smtpInfo) (*Mailer, error) {
+	if info.Host == "" {
+		return nil, nil
+	}
+	res := &Mailer{
+		Host:               info.Host,
+		Port:               info.Port,
+		Username:           info.Username,
+		Password:           info.Password,
+		From:               info.From,
+		TLS:                strings.ToLower(info.TLS),
+		InsecureSkipVerify: info.InsecureSkipVerify,
+		Timeout:            info.Timeout.Duration,
+	}
+	if res.TLS == "" {
+		res.TLS = SMTPStartTLS
+	}
+	if res.TLS != SMTPStartTLS && res.TLS != SMTPTLS && res.TLS != SMTPNoTLS {
+		return nil, fmt.Errorf("Invalid smtp config: tls must be starttls, tls or none, got \"%s\"", info.TLS)
+	}
+	if res.Port == 0 {
+		if res.TLS == SMTPTLS {
+			res.Port = 465
+		} else {
+			res.Port = 587
+		}
+	}
+	if emailErr := emailValid(res.From); emailErr != nil {
+		return nil, fmt.Errorf("Invalid smtp config: from must be a valid email address: %s", emailErr.Error())
+	}
+	if res.Timeout == time.Duration(0) {
+		res.Timeout = 30 * time.Second
+	}
+	return res, nil
+}
+
+// connect opens the connection to the server and authenticates.
+func (m *Mailer) connect() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+	tlsConfig := &tls.Config{ServerName: m.Host, InsecureSkipVerify: m.InsecureSkipVerify}
+	dialer := &net.Dialer{Timeout: m.Timeout}
+	var conn net.Conn
+	var err error
+	if m.TLS == SMTPTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(m.Timeout))
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m.TLS == SMTPStartTLS {
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	if m.Username != "" {
+		// smtp.PlainAuth refuses to send the password without TLS except to
+		// localhost
+		if err = client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// messageID returns a new value for the Message-ID header.
+func (m *Mailer) messageID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	_, domain, _ := ParseMailParts(m.From)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(buf), domain)
+}
+
+// SendMail sends a plain text mail.
+func (m *Mailer) SendMail(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") {
+		return errors.New("Invalid recipient")
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: %s\r\n", m.messageID())
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	client, err := m.connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err = client.Mail(m.From); err != nil {
+		return err
+	}
+	if err = client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,231 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains functions for creating and verifying the manifests
+// written next to each backup.
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"filippo.io/age"
+)
+
+// ManifestEntry describes a single file in a backup.
+type ManifestEntry struct {
+	// Path is the name of the file inside the zip archive.
+	Path string `json:"path"`
+	// Size is the size of the (uncompressed) file in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 sum of the file.
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifest describes the content of a backup, it is stored as JSON
+// in the file <archive>.manifest.json.
+type BackupManifest struct {
+	// Created is the time the backup was created.
+	Created time.Time `json:"created"`
+	// Source is the directory that was backed up.
+	Source string `json:"source"`
+	// Encrypted is true if the archive is encrypted with age.
+	Encrypted bool `json:"encrypted"`
+	// ArchiveSHA256 is the hex encoded SHA-256 sum of the archive file
+	// (after encryption).
+	ArchiveSHA256 string `json:"archive-sha256"`
+	// Files contains an entry for each file in the archive.
+	Files []ManifestEntry `json:"files"`
+}
+
+// manifestPath returns the path of the manifest for the given archive.
+func manifestPath(archive string) string {
+	return archive + ".manifest.json"
+}
+
+// writeManifest writes the manifest as JSON to the given path.
+func writeManifest(manifest *BackupManifest, path string) error {
+	jsonEnc, jsonErr := json.MarshalIndent(manifest, "", "  ")
+	if jsonErr != nil {
+		return jsonErr
+	}
+	return ioutil.WriteFile(path, jsonEnc, 0600)
+}
+
+// ReadManifest reads the manifest for the given archive.
+func ReadManifest(archive string) (*BackupManifest, error) {
+	content, readErr := ioutil.ReadFile(manifestPath(archive))
+	if readErr != nil {
+		return nil, readErr
+	}
+	var manifest BackupManifest
+	if jsonErr := json.Unmarshal(content, &manifest); jsonErr != nil {
+		return nil, jsonErr
+	}
+	return &manifest, nil
+}
+
+// hashReader returns the hex encoded SHA-256 sum of everything read from r
+// and the number of bytes read.
+func hashReader(r io.Reader) (string, int64, error) {
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return "", -1, err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), size, nil
+}
+
+// hashFile returns the hex encoded SHA-256 sum and the size of the file.
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", -1, err
+	}
+	defer file.Close()
+	return hashReader(bufio.NewReader(file))
+}
+
+// verifyArchiveChecksum checks that the SHA-256 sum of the archive file is
+// the one stored in the manifest.
+func verifyArchiveChecksum(archive string, manifest *BackupManifest) error {
+	sum, _, err := hashFile(archive)
+	if err != nil {
+		return err
+	}
+	if sum != manifest.ArchiveSHA256 {
+		return fmt.Errorf("Checksum mismatch for archive \"%s\": expected %s, got %s", archive, manifest.ArchiveSHA256, sum)
+	}
+	return nil
+}
+
+// compareEntries checks that the entries found are exactly those described
+// in the manifest. where is used in error messages.
+func compareEntries(manifest *BackupManifest, found map[string]ManifestEntry, where string) error {
+	if len(found) != len(manifest.Files) {
+		return fmt.Errorf("Manifest lists %d files, but %s contains %d files", len(manifest.Files), where, len(found))
+	}
+	for _, expected := range manifest.Files {
+		entry, has := found[expected.Path]
+		if !has {
+			return fmt.Errorf("File \"%s\" from manifest not found in %s", expected.Path, where)
+		}
+		if entry.Size != expected.Size || entry.SHA256 != expected.SHA256 {
+			return fmt.Errorf("File \"%s\" in %s doesn't match the manifest", expected.Path, where)
+		}
+	}
+	return nil
+}
+
+// verifyArchiveEntries checks that the files in the (unencrypted) zip
+// archive are exactly those described in the manifest.
+func verifyArchiveEntries(archive *zip.Reader, manifest *BackupManifest) error {
+	found := make(map[string]ManifestEntry, len(archive.File))
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		in, err := file.Open()
+		if err != nil {
+			return err
+		}
+		sum, size, hashErr := hashReader(in)
+		in.Close()
+		if hashErr != nil {
+			return hashErr
+		}
+		found[file.Name] = ManifestEntry{Path: file.Name, Size: size, SHA256: sum}
+	}
+	return compareEntries(manifest, found, "archive")
+}
+
+// verifySource checks that the files in the source directory are exactly
+// those described in the manifest, baseName is the top directory in the
+// archive (see writeZip).
+// This is used before deleting a directory to ensure that the backup
+// contains every file, for example no new mail arrived in the meantime.
+func verifySource(sourcePath, baseName string, manifest *BackupManifest) error {
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	var baseDir string
+	if info.IsDir() {
+		baseDir = baseName
+	}
+	found := make(map[string]ManifestEntry)
+	err = filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		sum, size, hashErr := hashFile(path)
+		if hashErr != nil {
+			return hashErr
+		}
+		name := zipEntryName(sourcePath, baseDir, path, info)
+		found[name] = ManifestEntry{Path: name, Size: size, SHA256: sum}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return compareEntries(manifest, found, "source directory")
+}
+
+// VerifyBackup verifies an existing backup against its manifest.
+// It always checks the checksum of the archive file. If the archive is not
+// encrypted or identities to decrypt it are given all files in the archive
+// are verified as well.
+// If the archive is encrypted and no identities are given it returns
+// ErrNoIdentities after the checksum was verified successfully, thus the
+// archive was not modified but its content wasn't checked.
+func VerifyBackup(archive string, identities []age.Identity) (*BackupManifest, error) {
+	manifest, err := ReadManifest(archive)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyArchiveChecksum(archive, manifest); err != nil {
+		return manifest, err
+	}
+	if manifest.Encrypted && len(identities) == 0 {
+		return manifest, ErrNoIdentities
+	}
+	reader, cleanup, openErr := openBackup(archive, identities)
+	if openErr != nil {
+		return manifest, openErr
+	}
+	defer cleanup()
+	return manifest, verifyArchiveEntries(&reader.Reader, manifest)
+}
@@ -0,0 +1,413 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the single sign-on for the admin interface with
+// OpenID Connect. The login page links to /login/oidc/ which redirects to
+// the provider (authorization code flow with PKCE). The provider redirects
+// back to /login/oidc/callback/, there the ID token is verified and the
+// value of a claim (by default email) is mapped to an existing admin with the
+// same username. On this first login the subject (sub claim) of the identity
+// is stored for the admin, later logins are mapped by the subject only (see
+// oidcAdmin). Admins are never created on SSO login.
+//
+// The provider is discovered on the first login, any provider that supports
+// discovery works, including local mock providers (plain http issuers are
+// allowed for this).
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/coreos/go-oidc/v3/oidc"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// oidcFlowSession is the name of the session that stores the state of a
+	// running SSO login.
+	oidcFlowSession = "mailwebadmin-oidc"
+	// oidcFlowLifespan is the time an admin has to log in at the provider.
+	oidcFlowLifespan = 10 * time.Minute
+	// oidcTimeout is the timeout for requests to the provider.
+	oidcTimeout = 30 * time.Second
+)
+
+// OIDCConfig is the configuration of the SSO login, it is read from the
+// [oidc] section of mailconf.
+type OIDCConfig struct {
+	// Issuer is the url of the provider, the configuration is discovered
+	// from Issuer/.well-known/openid-configuration.
+	Issuer string
+	// ClientID and ClientSecret are the credentials of mailwebadmin at the
+	// provider. The secret may be empty for public clients.
+	ClientID, ClientSecret string
+	// RedirectURL is the url of the callback, it must end with
+	// /login/oidc/callback/ and must be registered at the provider.
+	RedirectURL string
+	// Scopes are the requested scopes, openid is always added.
+	Scopes []string
+	// Claim is the claim of the ID token that contains the username of the
+	// admin, it is only used on the first SSO login of an admin. Only use
+	// claims the users can't change at the provider. For email the provider
+	// must report the address as verified.
+	Claim string
+	// ButtonText is the text of the SSO button on the login page.
+	ButtonText string
+}
+
+// OIDCAuth performs the SSO login, use NewOIDCAuth to create it.
+type OIDCAuth struct {
+	Config OIDCConfig
+	// mutex protects provider
+	mutex    sync.Mutex
+	provider *oidc.Provider
+}
+
+// NewOIDCAuth returns a new OIDCAuth, the provider is discovered when it's
+// needed for the first time.
+func NewOIDCAuth(config OIDCConfig) *OIDCAuth {
+	return &OIDCAuth{Config: config}
+}
+
+// discover returns the provider and the oauth2 config. If the discovery
+// fails it is tried again on the next call.
+func (auth *OIDCAuth) discover(ctx context.Context) (*oidc.Provider, *oauth2.Config, error) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	if auth.provider == nil {
+		provider, err := oidc.NewProvider(ctx, auth.Config.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		auth.provider = provider
+	}
+	scopes := []string{oidc.ScopeOpenID}
+	for _, scope := range auth.Config.Scopes {
+		if scope != oidc.ScopeOpenID {
+			scopes = append(scopes, scope)
+		}
+	}
+	config := &oauth2.Config{
+		ClientID:     auth.Config.ClientID,
+		ClientSecret: auth.Config.ClientSecret,
+		RedirectURL:  auth.Config.RedirectURL,
+		Endpoint:     auth.provider.Endpoint(),
+		Scopes:       scopes,
+	}
+	return auth.provider, config, nil
+}
+
+// randomOIDCValue returns a random value for the state and nonce.
+func randomOIDCValue() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// ssoFailed redirects to the login page which shows the error.
+func ssoFailed(w http.ResponseWriter, r *http.Request, reason string) {
+	http.Redirect(w, r, "/login/?sso-error="+url.QueryEscape(reason), 302)
+}
+
+// OIDCLoginHandler handles GET /login/oidc/, it starts the SSO login and
+// redirects to the provider.
+func OIDCLoginHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if appcontext.OIDC == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	if r.Method != getMethod {
+		http.Error(w, "Invalid method for /login/oidc/: "+r.Method, 400)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+	defer cancel()
+	_, config, discoverErr := appcontext.OIDC.discover(ctx)
+	if discoverErr != nil {
+		appcontext.Logger.WithError(discoverErr).WithField("issuer", appcontext.OIDC.Config.Issuer).Error("Can't discover OIDC provider")
+		ssoFailed(w, r, "provider")
+		return nil
+	}
+	state, stateErr := randomOIDCValue()
+	if stateErr != nil {
+		return stateErr
+	}
+	nonce, nonceErr := randomOIDCValue()
+	if nonceErr != nil {
+		return nonceErr
+	}
+	verifier := oauth2.GenerateVerifier()
+	session, _ := appcontext.Store.Get(r, oidcFlowSession)
+	session.Values["state"] = state
+	session.Values["nonce"] = nonce
+	session.Values["verifier"] = verifier
+	session.Values["created"] = time.Now().Unix()
+	session.Options.MaxAge = int(oidcFlowLifespan / time.Second)
+	if saveErr := session.Save(r, w); saveErr != nil {
+		return saveErr
+	}
+	http.Redirect(w, r, config.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), 302)
+	return nil
+}
+
+// oidcFlow returns nonce and verifier of the running SSO login if the state
+// matches and the login is not expired. It removes the flow session.
+func oidcFlow(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, state string) (nonce, verifier string, ok bool) {
+	session, err := appContext.Store.Get(r, oidcFlowSession)
+	if err != nil {
+		return "", "", false
+	}
+	sessionState, _ := session.Values["state"].(string)
+	nonce, _ = session.Values["nonce"].(string)
+	verifier, _ = session.Values["verifier"].(string)
+	created, createdOk := session.Values["created"].(int64)
+	// the state can only be used once
+	session.Options.MaxAge = -1
+	if saveErr := session.Save(r, w); saveErr != nil {
+		appContext.Logger.WithError(saveErr).Error("Saving session failed")
+	}
+	if sessionState == "" || !createdOk || subtle.ConstantTimeCompare([]byte(sessionState), []byte(state)) != 1 {
+		return "", "", false
+	}
+	if time.Since(time.Unix(created, 0)) > oidcFlowLifespan {
+		return "", "", false
+	}
+	return nonce, verifier, true
+}
+
+// oidcIdentity is the identity from a verified ID token.
+type oidcIdentity struct {
+	// Subject is the sub claim, it's unique at the provider and never
+	// reassigned.
+	Subject string
+	// UserName is the value of the configured claim.
+	UserName string
+}
+
+// oidcIdentity exchanges the code, verifies the ID token and returns the
+// subject and the value of the configured claim.
+func (auth *OIDCAuth) oidcIdentity(ctx context.Context, code, nonce, verifier string) (*oidcIdentity, error) {
+	provider, config, discoverErr := auth.discover(ctx)
+	if discoverErr != nil {
+		return nil, discoverErr
+	}
+	token, exchangeErr := config.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if exchangeErr != nil {
+		return nil, exchangeErr
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("Token response contains no id_token")
+	}
+	idToken, verifyErr := provider.Verifier(&oidc.Config{ClientID: auth.Config.ClientID}).Verify(ctx, rawIDToken)
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+	if subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("Invalid nonce in ID token")
+	}
+	if idToken.Subject == "" {
+		return nil, errors.New("ID token doesn't contain the claim sub")
+	}
+	var claims map[string]interface{}
+	if claimsErr := idToken.Claims(&claims); claimsErr != nil {
+		return nil, claimsErr
+	}
+	// don't trust email addresses the provider hasn't verified, a missing
+	// email_verified counts as not verified
+	if auth.Config.Claim == "email" {
+		if verified, _ := claims["email_verified"].(bool); !verified {
+			return nil, errors.New("Email address in ID token is not verified")
+		}
+	}
+	userName, _ := claims[auth.Config.Claim].(string)
+	if userName == "" {
+		return nil, errors.New("ID token doesn't contain the claim " + auth.Config.Claim)
+	}
+	return &oidcIdentity{Subject: idToken.Subject, UserName: userName}, nil
+}
+
+// oidcAdmin returns the admin for the SSO identity, goauth.NoUserID if there
+// is none.
+// An admin is bound to an identity on its first SSO login: The admin is
+// found by the configured claim and the subject of the identity is stored in
+// admin_oidc_subjects. From then on only the subject is used, so changing the
+// claim at the provider doesn't give access to another admin, and an admin
+// that is bound can't be taken over by another identity with the same claim
+// value. To bind an admin to another identity delete its entry from
+// admin_oidc_subjects.
+func oidcAdmin(appContext *MailAppContext, identity *oidcIdentity) (goauth.UserKeyType, error) {
+	var boundID uint64
+	query := "SELECT user_id FROM admin_oidc_subjects WHERE subject = ?;"
+	switch err := appContext.DB.QueryRow(query, identity.Subject).Scan(&boundID); {
+	case err == nil:
+		return goauth.UserKeyType(boundID), nil
+	case err != sql.ErrNoRows:
+		return goauth.NoUserID, err
+	}
+	adminID, idErr := appContext.UserHandler.GetUserID(identity.UserName)
+	if idErr == goauth.ErrUserNotFound {
+		return goauth.NoUserID, nil
+	}
+	if idErr != nil {
+		return goauth.NoUserID, idErr
+	}
+	// nothing is inserted if the admin is already bound to another subject
+	insert := "INSERT IGNORE INTO admin_oidc_subjects (user_id, subject) VALUES (?, ?);"
+	res, insertErr := appContext.DB.Exec(insert, uint64(adminID), identity.Subject)
+	if insertErr != nil {
+		return goauth.NoUserID, insertErr
+	}
+	if num, _ := res.RowsAffected(); num != 1 {
+		appContext.Logger.WithFields(log.Fields{
+			"username": identity.UserName,
+			"subject":  identity.Subject,
+		}).Warn("Admin is already bound to another SSO identity")
+		return goauth.NoUserID, nil
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"username": identity.UserName,
+		"subject":  identity.Subject,
+	}).Info("Bound admin to SSO identity")
+	return adminID, nil
+}
+
+// DeleteOIDCSubject removes the SSO identity of the admin, this is called
+// when an admin is deleted.
+func DeleteOIDCSubject(appContext *MailAppContext, adminID goauth.UserKeyType) error {
+	_, err := appContext.DB.Exec("DELETE FROM admin_oidc_subjects WHERE user_id = ?;", uint64(adminID))
+	return err
+}
+
+// OIDCCallbackHandler handles GET /login/oidc/callback/, the redirect from
+// the provider. If the ID token is valid and belongs to an existing admin
+// the auth session is created (or, if the admin uses two-factor
+// authentication, the second step is started, see SecondFactorLoginHandler).
+// Errors are shown on the login page.
+func OIDCCallbackHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if appcontext.OIDC == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		appcontext.Logger.WithFields(log.Fields{
+			"error":       providerErr,
+			"description": query.Get("error_description"),
+			"remote":      r.RemoteAddr,
+		}).Warn("OIDC provider returned an error")
+		ssoFailed(w, r, "provider")
+		return nil
+	}
+	nonce, verifier, ok := oidcFlow(appcontext, w, r, query.Get("state"))
+	if !ok {
+		appcontext.Logger.WithField("remote", r.RemoteAddr).Warn("OIDC callback with invalid or expired state")
+		ssoFailed(w, r, "expired")
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), oidcTimeout)
+	defer cancel()
+	identity, tokenErr := appcontext.OIDC.oidcIdentity(ctx, query.Get("code"), nonce, verifier)
+	if tokenErr != nil {
+		appcontext.Logger.WithError(tokenErr).WithField("remote", r.RemoteAddr).Warn("OIDC login failed")
+		ssoFailed(w, r, "failed")
+		return nil
+	}
+	adminID, idErr := oidcAdmin(appcontext, identity)
+	if idErr != nil {
+		return idErr
+	}
+	if adminID == goauth.NoUserID {
+		appcontext.Logger.WithField("username", identity.UserName).WithField("remote", r.RemoteAddr).Warn("OIDC login for unknown admin")
+		ssoFailed(w, r, "unknown")
+		return nil
+	}
+	appcontext.Logger.WithField("admin-id", adminID).Info("Admin logged in via OIDC")
+	state, stateErr := secondFactorState(appcontext, adminID)
+	if stateErr != nil {
+		return stateErr
+	}
+	if state != "" {
+		if pendingErr := startPendingLogin(appcontext, w, r, adminID, false, state); pendingErr != nil {
+			return pendingErr
+		}
+		http.Redirect(w, r, "/login/?second-factor="+state, 302)
+		return nil
+	}
+	if loginErr := createLoginSession(appcontext, w, r, adminID, false); loginErr != nil {
+		return loginErr
+	}
+	http.Redirect(w, r, "/", 302)
+	return nil
+}
+
+// oidcInfo is used in the server config in the [oidc] section.
+type oidcInfo struct {
+	Issuer       string   `toml:"issuer"`
+	ClientID     string   `toml:"client_id"`
+	ClientSecret string   `toml:"client_secret"`
+	RedirectURL  string   `toml:"redirect_url"`
+	Scopes       []string `toml:"scopes"`
+	Claim        string   `toml:"claim"`
+	ButtonText   string   `toml:"button_text"`
+}
+
+// parseOIDCConfig creates the OIDCConfig from the config file and sets the
+// default values.
+func parseOIDCConfig(info oidcInfo) (OIDCConfig, error) {
+	res := OIDCConfig{
+		Issuer:       info.Issuer,
+		ClientID:     info.ClientID,
+		ClientSecret: info.ClientSecret,
+		RedirectURL:  info.RedirectURL,
+		Scopes:       info.Scopes,
+		Claim:        info.Claim,
+		ButtonText:   info.ButtonText,
+	}
+	if res.ClientID == "" || res.RedirectURL == "" {
+		return res, errors.New("Invalid oidc config: client_id and redirect_url are required")
+	}
+	if len(res.Scopes) == 0 {
+		res.Scopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	if res.Claim == "" {
+		res.Claim = "email"
+	}
+	if res.ButtonText == "" {
+		res.ButtonText = "Sign in with SSO"
+	}
+	return res, nil
+}
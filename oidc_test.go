@@ -0,0 +1,323 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/sessions"
+)
+
+const oidcTestClientID = "mailwebadmin"
+
+// mockOIDCProvider is a minimal OIDC provider: discovery, authorization
+// endpoint (it logs in the identity in claims without asking), token
+// endpoint with PKCE and the keys to verify the ID tokens.
+type mockOIDCProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// claims are added to the ID tokens.
+	claims map[string]interface{}
+	// codes maps the issued codes to nonce and code challenge.
+	codes map[string][2]string
+}
+
+func newMockOIDCProvider(t *testing.T, claims map[string]interface{}) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &mockOIDCProvider{key: key, claims: claims, codes: make(map[string][2]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("/auth", provider.authorize)
+	mux.HandleFunc("/token", provider.token)
+	mux.HandleFunc("/keys", provider.keys)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+	return provider
+}
+
+func writeTestJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (provider *mockOIDCProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := provider.server.URL
+	writeTestJSON(w, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/auth",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/keys",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+	})
+}
+
+func (provider *mockOIDCProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != oidcTestClientID || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid request", 400)
+		return
+	}
+	code := fmt.Sprintf("code-%d", len(provider.codes))
+	provider.codes[code] = [2]string{query.Get("nonce"), query.Get("code_challenge")}
+	redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, 302)
+}
+
+func (provider *mockOIDCProvider) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	flow, has := provider.codes[r.Form.Get("code")]
+	delete(provider.codes, r.Form.Get("code"))
+	challenge := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !has || base64.RawURLEncoding.EncodeToString(challenge[:]) != flow[1] {
+		w.WriteHeader(400)
+		writeTestJSON(w, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   provider.server.URL,
+		"aud":   oidcTestClientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": flow[0],
+	}
+	for key, value := range provider.claims {
+		claims[key] = value
+	}
+	writeTestJSON(w, map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     provider.sign(claims),
+	})
+}
+
+// sign returns the claims as JWT signed with RS256.
+func (provider *mockOIDCProvider) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, provider.key, crypto.SHA256, digest[:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (provider *mockOIDCProvider) keys(w http.ResponseWriter, r *http.Request) {
+	writeTestJSON(w, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(provider.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.key.E)).Bytes()),
+		}},
+	})
+}
+
+// newOIDCTestContext returns an appContext that uses the provider, the only
+// local admin is admin@example.org.
+func newOIDCTestContext(t *testing.T, provider *mockOIDCProvider) (*MailAppContext, sqlmock.Sqlmock) {
+	appContext, mock := newTestContext(t)
+	appContext.Store = sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+	appContext.UserHandler = newMemoryUserHandler(map[string]string{"admin@example.org": "secret"})
+	config, err := parseOIDCConfig(oidcInfo{
+		Issuer:      provider.server.URL,
+		ClientID:    oidcTestClientID,
+		RedirectURL: "http://admin.example.org/login/oidc/callback/",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appContext.OIDC = NewOIDCAuth(config)
+	return appContext, mock
+}
+
+// runOIDCLogin runs the SSO login: It starts the login, lets the provider
+// redirect back and calls the callback with the given state (the state from
+// the provider if empty). It returns the redirect of the callback.
+func runOIDCLogin(t *testing.T, appContext *MailAppContext, provider *mockOIDCProvider, state string) string {
+	start := httptest.NewRecorder()
+	if err := OIDCLoginHandler(appContext, start, httptest.NewRequest("GET", "/login/oidc/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if start.Code != 302 {
+		t.Fatalf("Expected redirect to provider, got %d: %s", start.Code, start.Body.String())
+	}
+	client := provider.server.Client()
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	authResp, authErr := client.Get(start.Header().Get("Location"))
+	if authErr != nil {
+		t.Fatal(authErr)
+	}
+	authResp.Body.Close()
+	callbackURL, parseErr := url.Parse(authResp.Header.Get("Location"))
+	if parseErr != nil || authResp.StatusCode != 302 {
+		t.Fatalf("Provider didn't redirect back: %d", authResp.StatusCode)
+	}
+	if state != "" {
+		query := callbackURL.Query()
+		query.Set("state", state)
+		callbackURL.RawQuery = query.Encode()
+	}
+	callback := httptest.NewRequest("GET", callbackURL.RequestURI(), nil)
+	for _, cookie := range start.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	res := httptest.NewRecorder()
+	if err := OIDCCallbackHandler(appContext, res, callback); err != nil {
+		t.Fatal(err)
+	}
+	return res.Header().Get("Location")
+}
+
+// expectTOTPEnabled expects the lookup of the second factor of the admin,
+// the admins in the tests use TOTP so the login ends in the pending login.
+func expectTOTPEnabled(mock sqlmock.Sqlmock, adminID uint64) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT enabled FROM admin_totp")).
+		WithArgs(adminID).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+}
+
+const oidcSubjectQuery = "SELECT user_id FROM admin_oidc_subjects"
+const oidcSubjectInsert = "INSERT IGNORE INTO admin_oidc_subjects"
+
+func TestOIDCLoginBindsSubject(t *testing.T) {
+	provider := newMockOIDCProvider(t, map[string]interface{}{
+		"sub":            "subject-1",
+		"email":          "admin@example.org",
+		"email_verified": true,
+	})
+	appContext, mock := newOIDCTestContext(t, provider)
+	mock.ExpectQuery(regexp.QuoteMeta(oidcSubjectQuery)).WithArgs("subject-1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectExec(regexp.QuoteMeta(oidcSubjectInsert)).WithArgs(uint64(1), "subject-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectTOTPEnabled(mock, 1)
+	if location := runOIDCLogin(t, appContext, provider, ""); location != "/login/?second-factor=totp" {
+		t.Errorf("Expected second factor login, got redirect to %s", location)
+	}
+}
+
+func TestOIDCLoginUsesBoundSubject(t *testing.T) {
+	// the claim was changed at the provider, the subject still identifies
+	// the admin
+	provider := newMockOIDCProvider(t, map[string]interface{}{
+		"sub":            "subject-1",
+		"email":          "changed@example.org",
+		"email_verified": true,
+	})
+	appContext, mock := newOIDCTestContext(t, provider)
+	mock.ExpectQuery(regexp.QuoteMeta(oidcSubjectQuery)).WithArgs("subject-1").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	expectTOTPEnabled(mock, 1)
+	if location := runOIDCLogin(t, appContext, provider, ""); location != "/login/?second-factor=totp" {
+		t.Errorf("Expected second factor login, got redirect to %s", location)
+	}
+}
+
+func TestOIDCLoginAdminBoundToOtherSubject(t *testing.T) {
+	provider := newMockOIDCProvider(t, map[string]interface{}{
+		"sub":            "attacker",
+		"email":          "admin@example.org",
+		"email_verified": true,
+	})
+	appContext, mock := newOIDCTestContext(t, provider)
+	mock.ExpectQuery(regexp.QuoteMeta(oidcSubjectQuery)).WithArgs("attacker").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectExec(regexp.QuoteMeta(oidcSubjectInsert)).WithArgs(uint64(1), "attacker").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if location := runOIDCLogin(t, appContext, provider, ""); location != "/login/?sso-error=unknown" {
+		t.Errorf("Expected login to be denied, got redirect to %s", location)
+	}
+}
+
+func TestOIDCLoginUnknownAdmin(t *testing.T) {
+	provider := newMockOIDCProvider(t, map[string]interface{}{
+		"sub":            "subject-2",
+		"email":          "someone@example.org",
+		"email_verified": true,
+	})
+	appContext, mock := newOIDCTestContext(t, provider)
+	mock.ExpectQuery(regexp.QuoteMeta(oidcSubjectQuery)).WithArgs("subject-2").
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	if location := runOIDCLogin(t, appContext, provider, ""); location != "/login/?sso-error=unknown" {
+		t.Errorf("Expected login to be denied, got redirect to %s", location)
+	}
+}
+
+func TestOIDCLoginUnverifiedEmail(t *testing.T) {
+	for _, verified := range []interface{}{nil, false, "true"} {
+		claims := map[string]interface{}{"sub": "subject-1", "email": "admin@example.org"}
+		if verified != nil {
+			claims["email_verified"] = verified
+		}
+		provider := newMockOIDCProvider(t, claims)
+		appContext, _ := newOIDCTestContext(t, provider)
+		if location := runOIDCLogin(t, appContext, provider, ""); location != "/login/?sso-error=failed" {
+			t.Errorf("email_verified %v: expected login to fail, got redirect to %s", verified, location)
+		}
+	}
+}
+
+func TestOIDCLoginInvalidState(t *testing.T) {
+	provider := newMockOIDCProvider(t, map[string]interface{}{
+		"sub":            "subject-1",
+		"email":          "admin@example.org",
+		"email_verified": true,
+	})
+	appContext, _ := newOIDCTestContext(t, provider)
+	if location := runOIDCLogin(t, appContext, provider, "forged"); !strings.HasSuffix(location, "sso-error=expired") {
+		t.Errorf("Expected login with forged state to fail, got redirect to %s", location)
+	}
+}
+
+func TestOIDCDefaultClaim(t *testing.T) {
+	config, err := parseOIDCConfig(oidcInfo{ClientID: "id", RedirectURL: "http://localhost/login/oidc/callback/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Claim != "email" {
+		t.Errorf("Expected default claim email, got %s", config.Claim)
+	}
+}
@@ -0,0 +1,559 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FabianWe/goauth"
+)
+
+// This file generates the OpenAPI 3 document served at /api/openapi.json.
+// The operations are listed in apiOperations (openapi_test.go checks them
+// against the handlers of apiRoutes), everything else is generated
+// from the handlers: the schemas of the request and response bodies are
+// generated (with reflection, following the rules of encoding/json) from the
+// Go types the handlers use and the permission required for an operation
+// is computed by calling the PermissionFunc of the route.
+// The first version of the API uses the non-standard method UPDATE which
+// can't be expressed in OpenAPI, these operations are added to the path with
+// the extension x-update.
+
+// apiOperation describes an operation of the API.
+type apiOperation struct {
+	// Path is the path in OpenAPI syntax, the path parameters are {id},
+	// {username}, {scope} and {subject}, see openAPIPathParameters.
+	Path    string
+	Method  string
+	Summary string
+	// Permission is the PermissionFunc of the route, nil for the operations
+	// of the user portal.
+	Permission PermissionFunc
+	// Query are the query parameters, see openAPIQueryParameters.
+	Query []string
+	// Request is a value of the type of the request body, nil if there is no
+	// body. RequestTypes are the media types, the default is
+	// application/json.
+	Request      interface{}
+	RequestTypes []string
+	// Status is the status of a successful reply.
+	Status int
+	// Response is a value of the type of the response body, nil if there is
+	// no body. ResponseType is the media type, the default is
+	// application/json.
+	Response     interface{}
+	ResponseType string
+	// Page is a value of the type of the items if the list can be paginated
+	// (see pagination.go), Sort are the sort fields then.
+	Page interface{}
+	Sort map[string]string
+	// V2 is true for the operations of /api/v2/.
+	V2 bool
+}
+
+// idResponse returns a value of the type of the replies to POST in the first
+// version of the API, for example {"domain-id": <id>}.
+func idResponse(key string) interface{} {
+	return reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "ID", Type: reflect.TypeOf(int64(0)), Tag: reflect.StructTag(fmt.Sprintf(`json:"%s"`, key))},
+	})).Interface()
+}
+
+// apiOperations are all operations described in the OpenAPI document.
+var apiOperations = []*apiOperation{
+	{Path: "/api/domains/", Method: getMethod, Summary: "List all domains in the form id --> name",
+		Permission: DomainsPermission, Status: 200, Response: map[int64]string{}},
+	{Path: "/api/domains/", Method: postMethod, Summary: "Add a domain",
+		Permission: DomainsPermission, Request: &DomainRequest{}, Status: 200, Response: idResponse("domain-id")},
+	{Path: "/api/domains/{id}", Method: getMethod, Summary: "Get a domain",
+		Permission: DomainsPermission, Status: 200, Response: &DomainDetails{}},
+	{Path: "/api/domains/{id}", Method: deleteMethod, Summary: "Delete a domain with all users and aliases",
+		Permission: DomainsPermission, Status: 200},
+	{Path: "/api/users", Method: getMethod, Summary: "List all users and addresses that are only an alias in the form mail --> user",
+		Permission: UsersPermission, Query: []string{"domain"}, Status: 200, Response: map[string]*ListUserResult{},
+		Page: []*ListUserEntry{}, Sort: AllUsersSortColumns},
+	{Path: "/api/users", Method: postMethod, Summary: "Add a user, the password is returned if it was generated",
+		Permission: UsersPermission, Request: &UserRequest{}, Status: 200, Response: &struct {
+			UserID   int64  `json:"user-id"`
+			Password string `json:"password,omitempty"`
+		}{}},
+	{Path: "/api/users/{id}", Method: getMethod, Summary: "Get a user",
+		Permission: UsersPermission, Status: 200, Response: &UserDetails{}},
+	{Path: "/api/users/{id}", Method: updateMethod, Summary: "Change the password and / or recovery address of a user",
+		Permission: UsersPermission, Request: &PasswordRequest{}, Status: 200, Response: &struct {
+			Password string `json:"password,omitempty"`
+		}{}},
+	{Path: "/api/users/{id}", Method: deleteMethod, Summary: "Delete a user",
+		Permission: UsersPermission, Status: 200},
+	{Path: "/api/users/{id}/export", Method: getMethod, Summary: "Download an archive of the mail directory",
+		Permission: UsersPermission, Query: []string{"format"}, Status: 200, Response: []byte{}, ResponseType: "application/zip"},
+	{Path: "/api/users/{id}/import", Method: postMethod, Summary: "Import an archive into the mail directory",
+		Permission: UsersPermission, Request: []byte{}, RequestTypes: []string{"application/zip", "application/x-tar", "application/gzip"},
+		Status: 200, Response: &ImportResult{}},
+	{Path: "/api/aliases/", Method: getMethod, Summary: "List all aliases in the form id --> alias",
+		Permission: AliasesPermission, Query: []string{"domain"}, Status: 200, Response: map[int64]*Alias{},
+		Page: []*AliasEntry{}, Sort: AliasSortColumns},
+	{Path: "/api/aliases/", Method: postMethod, Summary: "Add an alias",
+		Permission: AliasesPermission, Request: &AliasRequest{}, Status: 200, Response: idResponse("alias-id")},
+	{Path: "/api/aliases/{id}", Method: getMethod, Summary: "Get an alias",
+		Permission: AliasesPermission, Status: 200, Response: &AliasDetails{}},
+	{Path: "/api/aliases/{id}", Method: deleteMethod, Summary: "Delete an alias",
+		Permission: AliasesPermission, Status: 200},
+	{Path: "/api/import", Method: postMethod, Summary: "Import users and aliases from CSV in one transaction",
+		Permission: ImportPermission, Query: []string{"dry-run"}, Request: []byte{}, RequestTypes: []string{"text/csv"},
+		Status: 200, Response: &CSVImportResult{}},
+	{Path: "/api/admins/", Method: getMethod, Summary: "List all admins in the form id --> admin",
+		Permission: AdminsPermission, Status: 200, Response: map[goauth.UserKeyType]*AdminInfo{}},
+	{Path: "/api/admins/", Method: postMethod, Summary: "Add an admin",
+		Permission: AdminsPermission, Request: &AdminRequest{}, Status: 200, Response: idResponse("admin-id")},
+	{Path: "/api/admins/{username}", Method: updateMethod, Summary: "Change password, role and / or domains of an admin",
+		Permission: AdminsPermission, Request: &AdminUpdateRequest{}, Status: 200},
+	{Path: "/api/admins/{username}", Method: deleteMethod, Summary: "Delete an admin",
+		Permission: AdminsPermission, Status: 200},
+	{Path: "/api/trash/", Method: getMethod, Summary: "List all users in the trash in the form id --> entry",
+		Permission: TrashPermission, Status: 200, Response: map[int64]*TrashEntry{}},
+	{Path: "/api/trash/{id}", Method: postMethod, Summary: "Restore a user from the trash, the password expiry starts again",
+		Permission: TrashPermission, Status: 200},
+	{Path: "/api/trash/{id}", Method: deleteMethod, Summary: "Purge a user from the trash",
+		Permission: TrashPermission, Status: 200},
+	{Path: "/api/audit/", Method: getMethod, Summary: "List the audit log, newest first",
+		Permission: AuditPermission, Query: []string{"admin", "operation", "target-type", "target-id", "since", "until", "audit-limit"},
+		Status: 200, Response: []*AuditEntry{}},
+	{Path: "/api/password-expiry/", Method: getMethod, Summary: "List the password expiry of all domains in the form domain id --> setting",
+		Permission: PasswordExpiryPermission, Status: 200, Response: map[int64]*PasswordExpiry{}},
+	{Path: "/api/password-expiry/expired", Method: getMethod, Summary: "List all users with an expired password",
+		Permission: PasswordExpiryPermission, Query: []string{"domain"}, Status: 200, Response: []*ExpiredPassword{}},
+	{Path: "/api/password-expiry/{id}", Method: updateMethod, Summary: "Change the password expiry of a domain, a max age of 0 disables it",
+		Permission: PasswordExpiryPermission, Request: &struct {
+			MaxAgeDays int  `json:"max-age-days"`
+			Enforce    bool `json:"enforce"`
+		}{}, Status: 200},
+	{Path: "/api/lockouts/", Method: getMethod, Summary: "List all locked addresses and accounts",
+		Permission: LockoutsPermission, Status: 200, Response: []*Lockout{}},
+	{Path: "/api/lockouts/{scope}/{subject}", Method: deleteMethod, Summary: "Clear the failed attempts (and thus the lock) of an address or account",
+		Permission: LockoutsPermission, Status: 200},
+	{Path: "/api/tokens/", Method: getMethod, Summary: "List the API tokens in the form id --> token",
+		Permission: TokensPermission, Status: 200, Response: map[int64]*APIToken{}},
+	{Path: "/api/tokens/", Method: postMethod, Summary: "Create an API token, the token is only returned here",
+		Permission: TokensPermission, Request: &struct {
+			Name      string   `json:"name"`
+			Scopes    []string `json:"scopes"`
+			ExpiresIn string   `json:"expires-in"`
+		}{}, Status: 200, Response: &struct {
+			TokenID int64  `json:"token-id"`
+			Token   string `json:"token"`
+		}{}},
+	{Path: "/api/tokens/{id}", Method: deleteMethod, Summary: "Revoke an API token",
+		Permission: TokensPermission, Status: 200},
+	{Path: "/api/sessions/", Method: getMethod, Summary: "List the active sessions of the admin in the form id --> session",
+		Permission: SessionsPermission, Status: 200, Response: map[int64]*AdminSession{}},
+	{Path: "/api/sessions/", Method: deleteMethod, Summary: "Revoke all sessions of the admin except the current one",
+		Permission: SessionsPermission, Status: 200},
+	{Path: "/api/sessions/{id}", Method: deleteMethod, Summary: "Revoke a session",
+		Permission: SessionsPermission, Status: 200},
+	{Path: "/api/2fa/", Method: getMethod, Summary: "Get the state of the two-factor authentication of the admin",
+		Permission: TwoFactorPermission, Status: 200, Response: &struct {
+			Enabled       bool `json:"enabled"`
+			Required      bool `json:"required"`
+			RecoveryCodes int  `json:"recovery-codes"`
+		}{}},
+	{Path: "/api/2fa/", Method: postMethod, Summary: "Start the enrollment of TOTP",
+		Permission: TwoFactorPermission, Status: 200, Response: &struct {
+			Secret string `json:"secret"`
+			URI    string `json:"uri"`
+			QR     string `json:"qr"`
+		}{}},
+	{Path: "/api/2fa/", Method: updateMethod, Summary: "Confirm the enrollment of TOTP with a code, returns the recovery codes",
+		Permission: TwoFactorPermission, Request: &totpCodeRequest{}, Status: 200, Response: &struct {
+			RecoveryCodes []string `json:"recovery-codes"`
+		}{}},
+	{Path: "/api/2fa/", Method: deleteMethod, Summary: "Disable TOTP, requires a valid code",
+		Permission: TwoFactorPermission, Request: &totpCodeRequest{}, Status: 200},
+	{Path: "/api/portal/", Method: getMethod, Summary: "Get the account of the mail user logged in to the portal",
+		Status: 200, Response: &PortalInfo{}},
+	{Path: "/api/portal/", Method: updateMethod, Summary: "Change password and / or recovery address of the mail user",
+		Request: &struct {
+			Password     string  `json:"password"`
+			RecoveryMail *string `json:"recovery-mail"`
+		}{}, Status: 200},
+	{Path: "/api/portal/aliases/", Method: postMethod, Summary: "Add an alias (source) or forward (destination) of the mail user",
+		Request: &struct {
+			Source      string `json:"source,omitempty"`
+			Destination string `json:"destination,omitempty"`
+		}{}, Status: 200, Response: idResponse("alias-id")},
+	{Path: "/api/portal/aliases/{id}", Method: deleteMethod, Summary: "Delete an alias or forward of the mail user",
+		Status: 200},
+
+	{Path: "/api/v2/domains", Method: getMethod, Summary: "List all domains", V2: true,
+		Permission: APIv2Permission, Status: 200, Response: []*DomainV2{}},
+	{Path: "/api/v2/domains", Method: postMethod, Summary: "Add a domain", V2: true,
+		Permission: APIv2Permission, Request: &DomainRequestV2{}, Status: 201, Response: &DomainV2{}},
+	{Path: "/api/v2/domains/{id}", Method: getMethod, Summary: "Get a domain", V2: true,
+		Permission: APIv2Permission, Status: 200, Response: &DomainDetails{}},
+	{Path: "/api/v2/domains/{id}", Method: deleteMethod, Summary: "Delete a domain with all users and aliases", V2: true,
+		Permission: APIv2Permission, Status: 204},
+	{Path: "/api/v2/users", Method: getMethod, Summary: "List all users", V2: true,
+		Permission: APIv2Permission, Query: []string{"domain"}, Status: 200, Response: []*UserV2{},
+		Page: []*UserV2{}, Sort: VirtualUserSortColumns},
+	{Path: "/api/v2/users", Method: postMethod, Summary: "Add a user, the password is returned if it was generated", V2: true,
+		Permission: APIv2Permission, Request: &UserRequestV2{}, Status: 201, Response: &UserV2{}},
+	{Path: "/api/v2/users/{id}", Method: getMethod, Summary: "Get a user", V2: true,
+		Permission: APIv2Permission, Status: 200, Response: &UserDetails{}},
+	{Path: "/api/v2/users/{id}", Method: putMethod, Summary: "Replace password and recovery address of a user", V2: true,
+		Permission: APIv2Permission, Request: &UserUpdateRequestV2{}, Status: 200, Response: &UserV2{}},
+	{Path: "/api/v2/users/{id}", Method: patchMethod, Summary: "Change password and / or recovery address of a user", V2: true,
+		Permission: APIv2Permission, Request: &UserUpdateRequestV2{}, Status: 200, Response: &UserV2{}},
+	{Path: "/api/v2/users/{id}", Method: deleteMethod, Summary: "Delete a user", V2: true,
+		Permission: APIv2Permission, Status: 204},
+	{Path: "/api/v2/aliases", Method: getMethod, Summary: "List all aliases", V2: true,
+		Permission: APIv2Permission, Query: []string{"domain"}, Status: 200, Response: []*AliasV2{},
+		Page: []*AliasV2{}, Sort: AliasSortColumns},
+	{Path: "/api/v2/aliases", Method: postMethod, Summary: "Add an alias", V2: true,
+		Permission: APIv2Permission, Request: &AliasRequestV2{}, Status: 201, Response: &AliasV2{}},
+	{Path: "/api/v2/aliases/{id}", Method: getMethod, Summary: "Get an alias", V2: true,
+		Permission: APIv2Permission, Status: 200, Response: &AliasDetails{}},
+	{Path: "/api/v2/aliases/{id}", Method: putMethod, Summary: "Replace an alias", V2: true,
+		Permission: APIv2Permission, Request: &AliasRequestV2{}, Status: 200, Response: &AliasV2{}},
+	{Path: "/api/v2/aliases/{id}", Method: patchMethod, Summary: "Change source and / or destination of an alias", V2: true,
+		Permission: APIv2Permission, Request: &AliasRequestV2{}, Status: 200, Response: &AliasV2{}},
+	{Path: "/api/v2/aliases/{id}", Method: deleteMethod, Summary: "Delete an alias", V2: true,
+		Permission: APIv2Permission, Status: 204},
+	{Path: "/api/v2/admins", Method: getMethod, Summary: "List all admins", V2: true,
+		Permission: APIv2Permission, Status: 200, Response: []*AdminV2{}},
+	{Path: "/api/v2/admins", Method: postMethod, Summary: "Add an admin", V2: true,
+		Permission: APIv2Permission, Request: &AdminRequestV2{}, Status: 201, Response: &AdminV2{}},
+	{Path: "/api/v2/admins/{id}", Method: getMethod, Summary: "Get an admin", V2: true,
+		Permission: APIv2Permission, Status: 200, Response: &AdminV2{}},
+	{Path: "/api/v2/admins/{id}", Method: putMethod, Summary: "Replace role and domains (and optionally the password) of an admin", V2: true,
+		Permission: APIv2Permission, Request: &AdminRequestV2{}, Status: 200, Response: &AdminV2{}},
+	{Path: "/api/v2/admins/{id}", Method: patchMethod, Summary: "Change password, role and / or domains of an admin", V2: true,
+		Permission: APIv2Permission, Request: &AdminRequestV2{}, Status: 200, Response: &AdminV2{}},
+	{Path: "/api/v2/admins/{id}", Method: deleteMethod, Summary: "Delete an admin", V2: true,
+		Permission: APIv2Permission, Status: 204},
+
+	{Path: "/api/openapi.json", Method: getMethod, Summary: "Get this document",
+		Permission: OpenAPIPermission, Status: 200, Response: map[string]interface{}{}},
+}
+
+// totpCodeRequest is the body of the requests to /api/2fa/ that need a code.
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// openAPIPathParameters are the path parameters that can be used in
+// apiOperation.Path together with an example value.
+var openAPIPathParameters = []struct {
+	Name    string
+	Schema  map[string]interface{}
+	Example string
+}{
+	{"id", map[string]interface{}{"type": "integer", "format": "int64"}, "1"},
+	{"username", map[string]interface{}{"type": "string"}, "admin"},
+	{"scope", map[string]interface{}{"type": "string", "enum": []string{LockoutScopeIP, LockoutScopeAdmin, LockoutScopeMail}}, LockoutScopeIP},
+	{"subject", map[string]interface{}{"type": "string"}, "192.0.2.1"},
+}
+
+// openAPIQueryParameters are the query parameters that can be used in
+// apiOperation.Query.
+var openAPIQueryParameters = map[string]map[string]interface{}{
+	"domain": {"name": "domain", "in": "query", "schema": map[string]interface{}{"type": "integer", "format": "int64"},
+		"description": "Only list the entries of the domain with this id, required for admins that can't access all domains."},
+	"dry-run": {"name": "dry-run", "in": "query", "schema": map[string]interface{}{"type": "boolean", "default": false},
+		"description": "Only validate, the transaction is always rolled back."},
+	"format": {"name": "format", "in": "query", "schema": map[string]interface{}{"type": "string", "enum": []string{"maildir", "mbox"}},
+		"description": "maildir (the default) for a zip of the Maildir, mbox for a zip with a mbox file for each folder."},
+	"admin": {"name": "admin", "in": "query", "schema": map[string]interface{}{"type": "integer", "format": "int64"},
+		"description": "Only list the entries of the admin with this id."},
+	"operation": {"name": "operation", "in": "query", "schema": map[string]interface{}{"type": "string"},
+		"description": "Only list the entries with this operation."},
+	"target-type": {"name": "target-type", "in": "query", "schema": map[string]interface{}{"type": "string"},
+		"description": "Only list the entries with this type of target."},
+	"target-id": {"name": "target-id", "in": "query", "schema": map[string]interface{}{"type": "integer", "format": "int64"},
+		"description": "Only list the entries with this target id."},
+	"since": {"name": "since", "in": "query", "schema": map[string]interface{}{"type": "string", "format": "date-time"},
+		"description": "Only list the entries created at or after this time."},
+	"until": {"name": "until", "in": "query", "schema": map[string]interface{}{"type": "string", "format": "date-time"},
+		"description": "Only list the entries created before this time."},
+	"audit-limit": {"name": "limit", "in": "query", "schema": map[string]interface{}{"type": "integer", "minimum": 1},
+		"description": "Maximal number of entries."},
+}
+
+// schemaGenerator generates JSON schemas from Go types, named structs are
+// added to components and referenced.
+type schemaGenerator struct {
+	components map[string]interface{}
+}
+
+var (
+	timeType = reflect.TypeOf(time.Time{})
+	roleType = reflect.TypeOf(Role(""))
+)
+
+// schema returns the schema for values of type t.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case roleType:
+		roles := make([]string, 0, len(rolePermissions))
+		for role := range rolePermissions {
+			roles = append(roles, string(role))
+		}
+		sort.Strings(roles)
+		return map[string]interface{}{"type": "string", "enum": roles}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "binary"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, has := g.components[t.Name()]; !has {
+			// add a placeholder first for recursive types
+			g.components[t.Name()] = nil
+			g.components[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// interface{}, any value
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema returns the schema of a struct, fields of embedded structs
+// are added to the struct as done by encoding/json.
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	g.addFields(t, properties)
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, properties map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if field.Anonymous && name == "" && fieldType.Kind() == reflect.Struct {
+			g.addFields(fieldType, properties)
+			continue
+		}
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = g.schema(field.Type)
+	}
+}
+
+// openAPIExamplePath replaces the parameters in path by their example
+// values.
+func openAPIExamplePath(path string) string {
+	for _, param := range openAPIPathParameters {
+		path = strings.Replace(path, "{"+param.Name+"}", param.Example, -1)
+	}
+	return path
+}
+
+// openAPIOperation returns the operation object for op.
+func (g *schemaGenerator) openAPIOperation(op *apiOperation) map[string]interface{} {
+	parameters := make([]interface{}, 0)
+	for _, param := range openAPIPathParameters {
+		if strings.Contains(op.Path, "{"+param.Name+"}") {
+			parameters = append(parameters, map[string]interface{}{"name": param.Name, "in": "path", "required": true, "schema": param.Schema})
+		}
+	}
+	for _, name := range op.Query {
+		parameters = append(parameters, openAPIQueryParameters[name])
+	}
+	if op.Page != nil {
+		sortFields := make([]string, 0, 2*len(op.Sort))
+		for field := range op.Sort {
+			sortFields = append(sortFields, field, "-"+field)
+		}
+		sort.Strings(sortFields)
+		parameters = append(parameters,
+			map[string]interface{}{"name": "limit", "in": "query",
+				"schema":      map[string]interface{}{"type": "integer", "minimum": 1, "maximum": MaxListLimit, "default": DefaultListLimit},
+				"description": "Maximal number of entries on a page."},
+			map[string]interface{}{"name": "cursor", "in": "query", "schema": map[string]interface{}{"type": "string"},
+				"description": "The next-cursor of the previous page."},
+			map[string]interface{}{"name": "sort", "in": "query", "schema": map[string]interface{}{"type": "string", "enum": sortFields},
+				"description": "The field to sort by, prefixed with - for descending order."},
+			map[string]interface{}{"name": "q", "in": "query", "schema": map[string]interface{}{"type": "string"},
+				"description": "Search string."},
+			map[string]interface{}{"name": "match", "in": "query",
+				"schema":      map[string]interface{}{"type": "string", "enum": []string{"substring", "prefix"}, "default": "substring"},
+				"description": "Whether q is a substring or a prefix."})
+	}
+	res := map[string]interface{}{
+		"operationId": strings.ToLower(op.Method) + strings.NewReplacer("/", "-", "{", "", "}", "", ".", "-").Replace(strings.TrimSuffix(op.Path, "/")),
+		"summary":     op.Summary,
+		"parameters":  parameters,
+	}
+	if op.Permission == nil {
+		res["description"] = "Requires a login to the user portal, API tokens can't be used."
+	} else {
+		// compute the permission from the PermissionFunc of the route
+		permission := op.Permission(&http.Request{Method: op.Method, URL: &url.URL{Path: openAPIExamplePath(op.Path)}})
+		res["description"] = fmt.Sprintf("Requires the permission %s.", permission)
+		res["x-permission"] = permission.String()
+	}
+	if op.Request != nil {
+		content := make(map[string]interface{})
+		requestTypes := op.RequestTypes
+		if len(requestTypes) == 0 {
+			requestTypes = []string{"application/json"}
+		}
+		for _, mediaType := range requestTypes {
+			content[mediaType] = map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.Request))}
+		}
+		res["requestBody"] = map[string]interface{}{"required": true, "content": content}
+	}
+	success := map[string]interface{}{"description": http.StatusText(op.Status)}
+	if op.Response != nil {
+		responseSchema := g.schema(reflect.TypeOf(op.Response))
+		if op.Page != nil {
+			pageSchema := map[string]interface{}{"type": "object", "properties": map[string]interface{}{
+				"total":       map[string]interface{}{"type": "integer", "format": "int64"},
+				"next-cursor": map[string]interface{}{"type": "string"},
+				"items":       g.schema(reflect.TypeOf(op.Page)),
+			}}
+			responseSchema = map[string]interface{}{"oneOf": []interface{}{responseSchema, pageSchema}}
+		}
+		responseType := op.ResponseType
+		if responseType == "" {
+			responseType = "application/json"
+		}
+		success["content"] = map[string]interface{}{responseType: map[string]interface{}{"schema": responseSchema}}
+	}
+	var failure map[string]interface{}
+	if op.V2 {
+		failure = map[string]interface{}{"description": "Error",
+			"content": map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(&APIErrorResponse{}))}}}
+	} else {
+		failure = map[string]interface{}{"description": "Error, a plain text message (or a JSON object for violations of the password policy)",
+			"content": map[string]interface{}{
+				"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(&struct {
+					Error      string               `json:"error"`
+					Violations []*PasswordViolation `json:"violations"`
+				}{}))},
+			}}
+	}
+	res["responses"] = map[string]interface{}{fmt.Sprintf("%d", op.Status): success, "default": failure}
+	return res
+}
+
+// OpenAPIDocument generates the OpenAPI document for apiOperations.
+func OpenAPIDocument() map[string]interface{} {
+	g := &schemaGenerator{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+	for _, op := range apiOperations {
+		if _, has := paths[op.Path]; !has {
+			paths[op.Path] = make(map[string]interface{})
+		}
+		method := strings.ToLower(op.Method)
+		if op.Method == updateMethod {
+			method = "x-update"
+		}
+		paths[op.Path][method] = g.openAPIOperation(op)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "mailwebadmin API",
+			"version": "2",
+			"description": "The API to manage the virtual domains, users and aliases of a mail server. " +
+				"Requests are authenticated either with the session cookie of the web interface " +
+				"(state-changing requests then need the X-CSRF-Token header returned by GET requests) " +
+				"or with an API token. Operations of the first API version that use the method UPDATE " +
+				"are described with the extension x-update.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.components,
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var (
+	openAPIOnce    sync.Once
+	openAPIEncoded []byte
+	openAPIErr     error
+)
+
+// OpenAPIJSON is the handler for /api/openapi.json.
+func OpenAPIJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != getMethod {
+		http.Error(w, fmt.Sprintf("Invalid method for /api/openapi.json: %s", r.Method), 400)
+		return nil
+	}
+	// the document never changes, so generate it only once
+	openAPIOnce.Do(func() {
+		openAPIEncoded, openAPIErr = json.Marshal(OpenAPIDocument())
+	})
+	if openAPIErr != nil {
+		return openAPIErr
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIEncoded)
+	return nil
+}
@@ -0,0 +1,813 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file checks that the OpenAPI document matches the routes registered
+// by RegisterAPIRoutes: Each operation in apiOperations is called with a
+// fixture from operationFixtures, the reply must have the documented status
+// and shape. Each method a handler accepts must be described in
+// apiOperations.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FabianWe/goauth"
+	"github.com/gorilla/sessions"
+)
+
+// probeMethods are the methods tried on each path.
+var probeMethods = []string{getMethod, postMethod, putMethod, patchMethod, deleteMethod, updateMethod}
+
+// newRouteTestContext returns an appContext for calling the handlers, see
+// newTestContext. The admin "admin" has the id 1.
+// The sessions of goauth are stored in a second database: Its queries are
+// not part of this package, so they always succeed and are not checked.
+func newRouteTestContext(t *testing.T) (*MailAppContext, sqlmock.Sqlmock) {
+	t.Helper()
+	appContext, mock := newTestContext(t)
+	sessionDB, sessionMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Can't create database mock: %s", err)
+	}
+	t.Cleanup(func() { sessionDB.Close() })
+	sessionMock.MatchExpectationsInOrder(false)
+	for i := 0; i < 10; i++ {
+		sessionMock.ExpectExec(".*").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	appContext.Store = sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+	appContext.SessionController = goauth.NewMySQLSessionController(sessionDB, "", "")
+	appContext.UserHandler = newMemoryUserHandler(map[string]string{"admin": "secret"})
+	appContext.PasswordPolicy = DefaultPasswordPolicy()
+	return appContext, mock
+}
+
+// routeForPath returns the route of apiRoutes that serves path.
+func routeForPath(t *testing.T, mux *http.ServeMux, path string) (apiRoute, bool) {
+	t.Helper()
+	_, pattern := mux.Handler(httptest.NewRequest(getMethod, path, nil))
+	for _, route := range apiRoutes {
+		if route.Pattern == pattern {
+			return route, true
+		}
+	}
+	return apiRoute{}, false
+}
+
+// apiRequest returns a request for the handler of a route: A superadmin and a
+// mail user of the portal are logged in.
+func apiRequest(method, path, contentType, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	ctx := context.WithValue(r.Context(), adminIDKey, goauth.UserKeyType(1))
+	ctx = context.WithValue(ctx, adminRoleKey, RoleSuperAdmin)
+	ctx = context.WithValue(ctx, portalUserKey, &PortalUser{ID: 1, Mail: "user@example.org"})
+	return r.WithContext(ctx)
+}
+
+// callRoute calls the handler of the route (without the login check) and
+// returns the reply and the error returned by the handler.
+func callRoute(appContext *MailAppContext, route apiRoute, r *http.Request) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	handler := route.Handler
+	if route.V2 {
+		handler = APIErrors(handler)
+	}
+	err := handler(appContext, w, r)
+	return w, err
+}
+
+// methodAccepted calls the handler of the route with a method that is not
+// documented. No database calls are expected: the handler must reject the
+// method or path before. It returns false if the handler rejected the
+// request.
+func methodAccepted(t *testing.T, route apiRoute, method, path string) bool {
+	appContext, _ := newRouteTestContext(t)
+	w, err := callRoute(appContext, route, apiRequest(method, path, "", ""))
+	if err != nil {
+		// the handler got as far as the database
+		return true
+	}
+	switch w.Code {
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return false
+	case http.StatusBadRequest:
+		body := w.Body.String()
+		return !strings.HasPrefix(body, "Invalid method") && !strings.HasPrefix(body, "Invalid "+method+" request")
+	}
+	return true
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	appContext, _ := newRouteTestContext(t)
+	mux := http.NewServeMux()
+	RegisterAPIRoutes(appContext, mux)
+	documented := make(map[string]bool)
+	for _, op := range apiOperations {
+		path := openAPIExamplePath(op.Path)
+		route, ok := routeForPath(t, mux, path)
+		if !ok {
+			t.Errorf("%s %s is documented but no route serves it", op.Method, op.Path)
+			continue
+		}
+		documented[route.Pattern] = true
+		if (op.Permission == nil) != (route.Permission == nil) {
+			t.Errorf("%s %s: the documented login doesn't match the route %s", op.Method, op.Path, route.Pattern)
+			continue
+		}
+		if op.Permission != nil {
+			r := httptest.NewRequest(op.Method, path, nil)
+			if documentedPerm, routePerm := op.Permission(r), route.Permission(r); documentedPerm != routePerm {
+				t.Errorf("%s %s: documented permission is %s, the route requires %s", op.Method, op.Path, documentedPerm, routePerm)
+			}
+		}
+		if op.V2 != route.V2 {
+			t.Errorf("%s %s: V2 doesn't match the route %s", op.Method, op.Path, route.Pattern)
+		}
+	}
+	for _, route := range apiRoutes {
+		if !documented[route.Pattern] {
+			t.Errorf("The route %s has no documented operation", route.Pattern)
+		}
+	}
+}
+
+func TestOpenAPIMethods(t *testing.T) {
+	appContext, _ := newRouteTestContext(t)
+	mux := http.NewServeMux()
+	RegisterAPIRoutes(appContext, mux)
+	// path --> documented methods
+	methods := make(map[string]map[string]bool)
+	for _, op := range apiOperations {
+		if methods[op.Path] == nil {
+			methods[op.Path] = make(map[string]bool)
+		}
+		methods[op.Path][op.Method] = true
+	}
+	for opPath, documented := range methods {
+		path := openAPIExamplePath(opPath)
+		route, ok := routeForPath(t, mux, path)
+		if !ok {
+			// reported by TestOpenAPIRoutes
+			continue
+		}
+		// the documented methods are checked by TestOpenAPIOperations
+		for _, method := range probeMethods {
+			if !documented[method] && methodAccepted(t, route, method, path) {
+				t.Errorf("%s %s is accepted by the handler but not documented", method, opPath)
+			}
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := OpenAPIDocument()
+	paths := doc["paths"].(map[string]map[string]interface{})
+	operationIDs := make(map[string]bool)
+	for path, operations := range paths {
+		for method, value := range operations {
+			op := value.(map[string]interface{})
+			id := op["operationId"].(string)
+			if operationIDs[id] {
+				t.Errorf("Duplicate operationId %s (%s %s)", id, method, path)
+			}
+			operationIDs[id] = true
+		}
+	}
+}
+
+// operationFixture is a successful request for an operation of
+// apiOperations.
+type operationFixture struct {
+	// query is appended to the example path of the operation.
+	query string
+	// contentType of the body, the default is application/json.
+	contentType string
+	body        string
+	// adminID is the id of the logged in admin, the default is 1.
+	adminID goauth.UserKeyType
+	// setup prepares the appContext, for example the mail directory.
+	setup func(t *testing.T, appContext *MailAppContext)
+	// expect adds the database calls of the request to the mock.
+	expect func(mock sqlmock.Sqlmock)
+}
+
+// expectAudit expects an entry in the audit log.
+func expectAudit(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("INSERT INTO audit_log").WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+// expectUserName expects the lookup of the address of the user with id 1,
+// user@example.org.
+func expectUserName(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT email FROM virtual_users WHERE id").
+		WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow("user@example.org"))
+}
+
+// expectUserDetails expects the queries of GetUserDetails for the user with
+// id 1.
+func expectUserDetails(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT u.email, u.domain_id, d.name").
+		WillReturnRows(sqlmock.NewRows([]string{"email", "domain_id", "name", "password_set", "password_expired"}).
+			AddRow("user@example.org", 1, "example.org", nil, false))
+	mock.ExpectQuery("SELECT id, source, destination FROM virtual_aliases").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "source", "destination"}).AddRow(1, "info@example.org", "user@example.org"))
+	mock.ExpectQuery("SELECT recovery_mail FROM recovery_mails").
+		WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}))
+	mock.ExpectQuery("SELECT locked_until FROM login_failures").
+		WillReturnRows(sqlmock.NewRows([]string{"locked_until"}))
+}
+
+// expectAliasDetails expects the query of GetAliasDetails for the alias with
+// id 1.
+func expectAliasDetails(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT a.source, a.destination, a.domain_id, d.name, u.id").
+		WillReturnRows(sqlmock.NewRows([]string{"source", "destination", "domain_id", "name", "id"}).
+			AddRow("info@example.org", "user@example.org", 1, "example.org", 1))
+}
+
+// expectDomainID expects the lookup of the id of example.org.
+func expectDomainID(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT id FROM virtual_domains WHERE name").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+}
+
+// expectVirtualUser expects the lookup of the user with id 1,
+// user@example.org.
+func expectVirtualUser(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT email, domain_id FROM virtual_users WHERE id").
+		WillReturnRows(sqlmock.NewRows([]string{"email", "domain_id"}).AddRow("user@example.org", 1))
+}
+
+// expectAlias expects the lookup of the alias with id 1 from
+// info@example.org to destination.
+func expectAlias(mock sqlmock.Sqlmock, destination string) {
+	mock.ExpectQuery("SELECT domain_id, source, destination FROM virtual_aliases WHERE id").
+		WillReturnRows(sqlmock.NewRows([]string{"domain_id", "source", "destination"}).AddRow(1, "info@example.org", destination))
+}
+
+// expectAliasCount expects the check that an alias doesn't exist yet.
+func expectAliasCount(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM virtual_aliases").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+}
+
+// expectUpdateAlias expects the change of the destination of the alias with
+// id 1 to admin@example.org.
+func expectUpdateAlias(mock sqlmock.Sqlmock) {
+	expectAlias(mock, "user@example.org")
+	expectAliasCount(mock)
+	expectDomainID(mock)
+	mock.ExpectExec("UPDATE virtual_aliases").WillReturnResult(sqlmock.NewResult(0, 1))
+	expectAudit(mock)
+	expectAlias(mock, "admin@example.org")
+}
+
+// expectAdminV2 expects the queries of getAdminV2 for an admin with the
+// given role and no domains.
+func expectAdminV2(mock sqlmock.Sqlmock, role Role) {
+	mock.ExpectQuery("SELECT role FROM admin_roles").
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(string(role)))
+	mock.ExpectQuery("SELECT domain_id FROM admin_domains").
+		WillReturnRows(sqlmock.NewRows([]string{"domain_id"}))
+}
+
+// expectDeleteAdmin expects the queries of deleteAdmin, the sessions are
+// deleted in the session database.
+func expectDeleteAdmin(mock sqlmock.Sqlmock) {
+	mock.ExpectExec("DELETE FROM admin_sessions").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM admin_roles").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM admin_domains").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM admin_totp").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM admin_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	mock.ExpectExec("DELETE FROM api_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM admin_oidc_subjects").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectAudit(mock)
+}
+
+// setupPortalAliases allows mail users to manage their aliases.
+func setupPortalAliases(t *testing.T, appContext *MailAppContext) {
+	appContext.Portal.ManageAliases = true
+}
+
+// operationFixtures returns the fixtures for apiOperations, the key is
+// "<method> <path>".
+func operationFixtures(t *testing.T) map[string]operationFixture {
+	return map[string]operationFixture{
+		"GET /api/domains/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, name FROM virtual_domains").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "example.org"))
+		}},
+		"POST /api/domains/": {body: `{"domain-name": "example.org"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("INSERT INTO virtual_domains").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/domains/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT d.name").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "users", "aliases"}).AddRow("example.org", 1, 1))
+		}},
+		"DELETE /api/domains/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT name FROM virtual_domains WHERE id").
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("example.org"))
+			mock.ExpectExec("DELETE FROM virtual_domains").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/users": {expect: func(mock sqlmock.Sqlmock) {
+			// users and aliases are queried concurrently
+			mock.MatchExpectationsInOrder(false)
+			mock.ExpectQuery("SELECT id, email, domain_id FROM virtual_users").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "email", "domain_id"}).AddRow(1, "user@example.org", 1))
+			mock.ExpectQuery("SELECT id, domain_id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "domain_id", "source", "destination"}).AddRow(1, 1, "info@example.org", "user@example.org"))
+		}},
+		"POST /api/users": {body: `{"mail": "user@example.org", "generate": "random"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectDomainID(mock)
+			mock.ExpectExec("INSERT INTO virtual_users").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/users/{id}": {expect: expectUserDetails},
+		"UPDATE /api/users/{id}": {body: `{"generate": "random", "recovery-mail": "backup@example.com"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectUserName(mock)
+			mock.ExpectQuery("SELECT recovery_mail FROM recovery_mails").
+				WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}))
+			mock.ExpectExec("INSERT INTO recovery_mails").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+			mock.ExpectExec("UPDATE virtual_users SET password").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"DELETE /api/users/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			expectUserName(mock)
+			mock.ExpectExec("DELETE FROM virtual_users").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/users/{id}/export": {setup: func(t *testing.T, appContext *MailAppContext) {
+			appContext.MailDir = filepath.Join(t.TempDir(), "%d", "%n")
+			writeTestFile(t, getSourcePath(appContext.MailDir, "example.org", "user")+"/Maildir/cur/1", "mail")
+		}, expect: expectUserName},
+		"POST /api/users/{id}/import": {contentType: "application/x-tar",
+			body: string(testTar(t, map[string]string{"Maildir/cur/1": "mail", "Maildir/new/2": "mail", "Maildir/tmp/.keep": ""})),
+			setup: func(t *testing.T, appContext *MailAppContext) {
+				appContext.MailDir = filepath.Join(t.TempDir(), "%d", "%n")
+			}, expect: func(mock sqlmock.Sqlmock) {
+				expectUserName(mock)
+				expectAudit(mock)
+			}},
+		"GET /api/aliases/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, domain_id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "domain_id", "source", "destination"}).AddRow(1, 1, "info@example.org", "user@example.org"))
+		}},
+		"POST /api/aliases/": {body: `{"source": "info@example.org", "dest": "user@example.org"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectDomainID(mock)
+			mock.ExpectExec("INSERT INTO virtual_aliases").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/aliases/{id}": {expect: expectAliasDetails},
+		"DELETE /api/aliases/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT domain_id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"domain_id", "source", "destination"}).AddRow(1, "info@example.org", "user@example.org"))
+			mock.ExpectExec("DELETE FROM virtual_aliases").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"POST /api/import": {contentType: "text/csv", body: "type,email,destination\nalias,info@example.org,user@example.org\n",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id FROM virtual_domains WHERE name").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM virtual_aliases").
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+				mock.ExpectExec("INSERT INTO virtual_aliases").WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectCommit()
+				expectAudit(mock)
+			}},
+		"GET /api/admins/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT user_id, role FROM admin_roles").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "role"}).AddRow(1, string(RoleSuperAdmin)))
+			mock.ExpectQuery("SELECT user_id, domain_id FROM admin_domains").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "domain_id"}))
+		}},
+		"POST /api/admins/": {body: `{"username": "helpdesk", "password": "Correct-Horse-42", "role": "helpdesk"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("INSERT INTO admin_roles").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"UPDATE /api/admins/{username}": {adminID: 2, body: `{"role": "domainadmin", "domains": [1]}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT role FROM admin_roles").
+					WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(string(RoleHelpDesk)))
+				mock.ExpectExec("INSERT INTO admin_roles").WillReturnResult(sqlmock.NewResult(0, 1))
+				expectAudit(mock)
+				mock.ExpectQuery("SELECT domain_id FROM admin_domains").
+					WillReturnRows(sqlmock.NewRows([]string{"domain_id"}))
+				mock.ExpectBegin()
+				mock.ExpectExec("DELETE FROM admin_domains").WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec("INSERT INTO admin_domains").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+				expectAudit(mock)
+			}},
+		"DELETE /api/admins/{username}": {adminID: 2, expect: expectDeleteAdmin},
+		"GET /api/trash/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, domain_id, email, trash_path, deleted FROM trash_users").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "domain_id", "email", "trash_path", "deleted"}).
+					AddRow(1, 1, "user@example.org", "", time.Now()))
+		}},
+		"POST /api/trash/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectBegin()
+			mock.ExpectQuery("SELECT domain_id, email, password, trash_path FROM trash_users").
+				WillReturnRows(sqlmock.NewRows([]string{"domain_id", "email", "password", "trash_path"}).
+					AddRow(1, "user@example.org", "{SHA512-CRYPT}", ""))
+			mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM virtual_domains").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM virtual_users").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectExec("INSERT INTO virtual_users").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("DELETE FROM trash_users").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			expectAudit(mock)
+		}},
+		"DELETE /api/trash/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT email, trash_path FROM trash_users").
+				WillReturnRows(sqlmock.NewRows([]string{"email", "trash_path"}).AddRow("user@example.org", ""))
+			mock.ExpectExec("DELETE FROM trash_users").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/audit/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, admin_id, operation, target_type, target_id, old_value, new_value, created, remote_addr FROM audit_log").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "admin_id", "operation", "target_type", "target_id", "old_value", "new_value", "created", "remote_addr"}).
+					AddRow(1, 1, string(AuditAddDomain), AuditTargetDomain, 1, nil, `{"domain-name":"example.org"}`, time.Now(), "192.0.2.1"))
+		}},
+		"GET /api/password-expiry/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT domain_id, max_age_days, enforce FROM domain_password_expiry").
+				WillReturnRows(sqlmock.NewRows([]string{"domain_id", "max_age_days", "enforce"}).AddRow(1, 90, true))
+		}},
+		"GET /api/password-expiry/expired": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT u.id, u.email, u.domain_id, u.password_set, u.password_expired, e.max_age_days").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "email", "domain_id", "password_set", "password_expired", "max_age_days"}).
+					AddRow(1, "user@example.org", 1, time.Now().AddDate(0, 0, -100), true, 90))
+		}},
+		"UPDATE /api/password-expiry/{id}": {body: `{"max-age-days": 90, "enforce": true}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT max_age_days, enforce FROM domain_password_expiry").
+				WillReturnRows(sqlmock.NewRows([]string{"max_age_days", "enforce"}))
+			mock.ExpectExec("INSERT INTO domain_password_expiry").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("UPDATE virtual_users u LEFT JOIN domain_password_expiry").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("UPDATE virtual_users u JOIN domain_password_expiry").WillReturnResult(sqlmock.NewResult(0, 0))
+			expectAudit(mock)
+		}},
+		"GET /api/lockouts/": {expect: func(mock sqlmock.Sqlmock) {
+			now := time.Now()
+			mock.ExpectQuery("SELECT scope, subject, failures, last_failure, locked_until FROM login_failures").
+				WillReturnRows(sqlmock.NewRows([]string{"scope", "subject", "failures", "last_failure", "locked_until"}).
+					AddRow(LockoutScopeIP, "192.0.2.1", 5, now, now.Add(time.Minute)))
+		}},
+		"DELETE /api/lockouts/{scope}/{subject}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("DELETE FROM login_failures").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/tokens/": {expect: func(mock sqlmock.Sqlmock) {
+			now := time.Now()
+			mock.ExpectQuery("SELECT id, user_id, name, scopes, created, expires, last_used FROM api_tokens").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "scopes", "created", "expires", "last_used"}).
+					AddRow(1, 1, "ci", encodeScopes([]Permission{PermissionRead}), now, now.Add(time.Hour), nil))
+		}},
+		"POST /api/tokens/": {body: `{"name": "ci", "scopes": ["read"], "expires-in": "24h"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("INSERT INTO api_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+		}},
+		"DELETE /api/tokens/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			now := time.Now()
+			mock.ExpectQuery("SELECT id, user_id, name, scopes, created, expires, last_used FROM api_tokens WHERE id").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "scopes", "created", "expires", "last_used"}).
+					AddRow(1, 1, "ci", encodeScopes([]Permission{PermissionRead}), now, now.Add(time.Hour), nil))
+			mock.ExpectExec("DELETE FROM api_tokens WHERE id").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/sessions/": {expect: func(mock sqlmock.Sqlmock) {
+			now := time.Now()
+			mock.ExpectQuery("SELECT id, user_id, session_key, created, last_seen, expires, remote_addr, user_agent").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "session_key", "created", "last_seen", "expires", "remote_addr", "user_agent"}).
+					AddRow(1, 1, "key", now, now, now.Add(time.Hour), "192.0.2.1", "curl"))
+		}},
+		"DELETE /api/sessions/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, session_key FROM admin_sessions").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "session_key"}).AddRow(2, "other"))
+			mock.ExpectExec("DELETE FROM admin_sessions WHERE id").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"DELETE /api/sessions/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			now := time.Now()
+			mock.ExpectQuery("SELECT id, user_id, session_key, created, last_seen, expires, remote_addr, user_agent").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "session_key", "created", "last_seen", "expires", "remote_addr", "user_agent"}).
+					AddRow(1, 1, "key", now, now, now.Add(time.Hour), "192.0.2.1", "curl"))
+			mock.ExpectExec("DELETE FROM admin_sessions WHERE id").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/2fa/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT enabled FROM admin_totp").
+				WillReturnRows(sqlmock.NewRows([]string{"enabled"}).AddRow(true))
+			mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM admin_recovery_codes").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(10))
+		}},
+		"POST /api/2fa/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT enabled FROM admin_totp").
+				WillReturnRows(sqlmock.NewRows([]string{"enabled"}))
+			mock.ExpectExec("INSERT INTO admin_totp").WillReturnResult(sqlmock.NewResult(0, 1))
+		}},
+		"UPDATE /api/2fa/": {body: `{"code": "` + testTOTPCode(t, time.Now().Unix()/totpPeriod) + `"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT secret, last_step FROM admin_totp").
+				WithArgs(1, false).
+				WillReturnRows(sqlmock.NewRows([]string{"secret", "last_step"}).AddRow(testTOTPSecret, 0))
+			mock.ExpectExec("UPDATE admin_totp SET last_step").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectBegin()
+			mock.ExpectExec("UPDATE admin_totp SET enabled").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM admin_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 0))
+			for i := 0; i < recoveryCodeCount; i++ {
+				mock.ExpectExec("INSERT INTO admin_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+			expectAudit(mock)
+		}},
+		"DELETE /api/2fa/": {body: `{"code": "abcde-fghij"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("DELETE FROM admin_recovery_codes WHERE user_id = \\? AND code_hash").
+				WithArgs(1, hashRecoveryCode("abcde-fghij")).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM admin_totp").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM admin_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 9))
+			mock.ExpectCommit()
+			expectAudit(mock)
+		}},
+		"GET /api/portal/": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "source", "destination"}).AddRow(1, "info@example.org", "user@example.org"))
+			mock.ExpectQuery("SELECT recovery_mail FROM recovery_mails").
+				WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}).AddRow("backup@example.com"))
+			mock.ExpectQuery("SELECT password_expired FROM virtual_users").
+				WillReturnRows(sqlmock.NewRows([]string{"password_expired"}).AddRow(false))
+		}},
+		"UPDATE /api/portal/": {body: `{"recovery-mail": "backup@example.com"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT recovery_mail FROM recovery_mails").
+				WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}))
+			mock.ExpectExec("INSERT INTO recovery_mails").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"POST /api/portal/aliases/": {body: `{"source": "info@example.org"}`, setup: setupPortalAliases, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "source", "destination"}))
+			mock.ExpectQuery("SELECT \\(SELECT COUNT\\(\\*\\) FROM virtual_users").
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			expectDomainID(mock)
+			mock.ExpectExec("INSERT INTO virtual_aliases").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+		}},
+		"DELETE /api/portal/aliases/{id}": {setup: setupPortalAliases, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT domain_id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"domain_id", "source", "destination"}).AddRow(1, "info@example.org", "user@example.org"))
+			mock.ExpectExec("DELETE FROM virtual_aliases").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/v2/domains": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, name FROM virtual_domains").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "example.org"))
+		}},
+		"POST /api/v2/domains": {body: `{"name": "example.org"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("INSERT INTO virtual_domains").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/v2/domains/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT d.name").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "users", "aliases"}).AddRow("example.org", 1, 1))
+		}},
+		"DELETE /api/v2/domains/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT d.name").
+				WillReturnRows(sqlmock.NewRows([]string{"name", "users", "aliases"}).AddRow("example.org", 1, 1))
+			mock.ExpectQuery("SELECT name FROM virtual_domains WHERE id").
+				WillReturnRows(sqlmock.NewRows([]string{"name"}).AddRow("example.org"))
+			mock.ExpectExec("DELETE FROM virtual_domains").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/v2/users": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, email, domain_id FROM virtual_users").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "email", "domain_id"}).AddRow(1, "user@example.org", 1))
+		}},
+		"POST /api/v2/users": {body: `{"email": "user@example.org", "generate": "random"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectDomainID(mock)
+			mock.ExpectExec("INSERT INTO virtual_users").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+			expectVirtualUser(mock)
+		}},
+		"GET /api/v2/users/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			expectVirtualUser(mock)
+			expectUserDetails(mock)
+		}},
+		"PUT /api/v2/users/{id}": {body: `{"generate": "random"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectVirtualUser(mock)
+			mock.ExpectQuery("SELECT recovery_mail FROM recovery_mails").
+				WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}).AddRow("backup@example.com"))
+			mock.ExpectExec("DELETE FROM recovery_mails").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+			mock.ExpectExec("UPDATE virtual_users SET password").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"PATCH /api/v2/users/{id}": {body: `{"recovery-mail": "backup@example.com"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectVirtualUser(mock)
+			mock.ExpectQuery("SELECT recovery_mail FROM recovery_mails").
+				WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}))
+			mock.ExpectExec("INSERT INTO recovery_mails").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"DELETE /api/v2/users/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			expectVirtualUser(mock)
+			expectUserName(mock)
+			mock.ExpectExec("DELETE FROM virtual_users").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/v2/aliases": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, domain_id, source, destination FROM virtual_aliases").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "domain_id", "source", "destination"}).AddRow(1, 1, "info@example.org", "user@example.org"))
+		}},
+		"POST /api/v2/aliases": {body: `{"source": "info@example.org", "destination": "user@example.org"}`, expect: func(mock sqlmock.Sqlmock) {
+			expectAliasCount(mock)
+			expectDomainID(mock)
+			mock.ExpectExec("INSERT INTO virtual_aliases").WillReturnResult(sqlmock.NewResult(1, 1))
+			expectAudit(mock)
+			expectAlias(mock, "user@example.org")
+		}},
+		"GET /api/v2/aliases/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			expectAlias(mock, "user@example.org")
+			expectAliasDetails(mock)
+		}},
+		"PUT /api/v2/aliases/{id}":   {body: `{"source": "info@example.org", "destination": "admin@example.org"}`, expect: expectUpdateAlias},
+		"PATCH /api/v2/aliases/{id}": {body: `{"destination": "admin@example.org"}`, expect: expectUpdateAlias},
+		"DELETE /api/v2/aliases/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			expectAlias(mock, "user@example.org")
+			expectAlias(mock, "user@example.org")
+			mock.ExpectExec("DELETE FROM virtual_aliases").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"GET /api/v2/admins": {expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT user_id, role FROM admin_roles").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "role"}).AddRow(1, string(RoleSuperAdmin)))
+			mock.ExpectQuery("SELECT user_id, domain_id FROM admin_domains").
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "domain_id"}))
+		}},
+		"POST /api/v2/admins": {body: `{"username": "helpdesk", "password": "Correct-Horse-42", "role": "helpdesk"}`, expect: func(mock sqlmock.Sqlmock) {
+			mock.ExpectExec("INSERT INTO admin_roles").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+			expectAdminV2(mock, RoleHelpDesk)
+		}},
+		"GET /api/v2/admins/{id}": {expect: func(mock sqlmock.Sqlmock) {
+			expectAdminV2(mock, RoleSuperAdmin)
+		}},
+		"PUT /api/v2/admins/{id}": {adminID: 2, body: `{"role": "domainadmin", "domains": [1]}`, expect: func(mock sqlmock.Sqlmock) {
+			expectAdminV2(mock, RoleHelpDesk)
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM admin_domains").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO admin_domains").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+			expectAudit(mock)
+			mock.ExpectExec("INSERT INTO admin_roles").WillReturnResult(sqlmock.NewResult(0, 1))
+			expectAudit(mock)
+		}},
+		"PATCH /api/v2/admins/{id}": {adminID: 2, body: `{"reset-2fa": true}`, expect: func(mock sqlmock.Sqlmock) {
+			expectAdminV2(mock, RoleHelpDesk)
+			mock.ExpectBegin()
+			mock.ExpectExec("DELETE FROM admin_totp").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec("DELETE FROM admin_recovery_codes").WillReturnResult(sqlmock.NewResult(0, 10))
+			mock.ExpectCommit()
+			expectAudit(mock)
+		}},
+		"DELETE /api/v2/admins/{id}": {adminID: 2, expect: func(mock sqlmock.Sqlmock) {
+			expectAdminV2(mock, RoleHelpDesk)
+			expectDeleteAdmin(mock)
+		}},
+		"GET /api/openapi.json": {},
+	}
+}
+
+// checkResponseShape checks the reply against the schema of the documented
+// response: The media type, the top-level JSON type and, for objects with
+// documented properties, the keys of the reply.
+func checkResponseShape(t *testing.T, op *apiOperation, w *httptest.ResponseRecorder) {
+	t.Helper()
+	body := bytes.TrimSpace(w.Body.Bytes())
+	if op.Response == nil {
+		if len(body) != 0 {
+			t.Errorf("No response is documented, got %s", body)
+		}
+		return
+	}
+	if op.ResponseType != "" {
+		if contentType := w.Header().Get("Content-Type"); contentType != op.ResponseType {
+			t.Errorf("Expected Content-Type %s, got %s", op.ResponseType, contentType)
+		}
+		return
+	}
+	var reply interface{}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		t.Fatalf("Reply is not JSON: %s: %s", err, body)
+	}
+	g := &schemaGenerator{components: make(map[string]interface{})}
+	schema := g.schema(reflect.TypeOf(op.Response))
+	if ref, isRef := schema["$ref"].(string); isRef {
+		schema = g.components[strings.TrimPrefix(ref, "#/components/schemas/")].(map[string]interface{})
+	}
+	switch schema["type"] {
+	case "array":
+		if _, isArray := reply.([]interface{}); !isArray {
+			t.Errorf("Expected an array, got %s", body)
+		}
+	case "object":
+		object, isObject := reply.(map[string]interface{})
+		if !isObject {
+			t.Errorf("Expected an object, got %s", body)
+			return
+		}
+		properties, hasProperties := schema["properties"].(map[string]interface{})
+		if !hasProperties {
+			return
+		}
+		for key := range object {
+			if _, documented := properties[key]; !documented {
+				t.Errorf("The key %s of the reply is not documented", key)
+			}
+		}
+	default:
+		t.Fatalf("Unexpected schema for the response: %v", schema)
+	}
+}
+
+func TestOpenAPIOperations(t *testing.T) {
+	appContext, _ := newRouteTestContext(t)
+	mux := http.NewServeMux()
+	RegisterAPIRoutes(appContext, mux)
+	fixtures := operationFixtures(t)
+	for _, op := range apiOperations {
+		op := op
+		key := op.Method + " " + op.Path
+		t.Run(key, func(t *testing.T) {
+			fixture, hasFixture := fixtures[key]
+			if !hasFixture {
+				t.Fatalf("No fixture for %s", key)
+			}
+			path := openAPIExamplePath(op.Path)
+			route, ok := routeForPath(t, mux, path)
+			if !ok {
+				t.Fatalf("No route serves %s", path)
+			}
+			appContext, mock := newRouteTestContext(t)
+			if fixture.setup != nil {
+				fixture.setup(t, appContext)
+			}
+			if fixture.expect != nil {
+				fixture.expect(mock)
+			}
+			contentType := fixture.contentType
+			if contentType == "" && fixture.body != "" {
+				contentType = "application/json"
+			}
+			r := apiRequest(op.Method, path+fixture.query, contentType, fixture.body)
+			if fixture.adminID != 0 {
+				r = r.WithContext(context.WithValue(r.Context(), adminIDKey, fixture.adminID))
+			}
+			w, err := callRoute(appContext, route, r)
+			if err != nil {
+				t.Fatalf("Handler returned an error: %s", err)
+			}
+			if w.Code != op.Status {
+				t.Fatalf("Expected status %d, got %d: %s", op.Status, w.Code, w.Body.String())
+			}
+			checkResponseShape(t, op, w)
+		})
+	}
+}
@@ -0,0 +1,267 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// This file contains the pagination, sorting and searching for the list
+// endpoints. Lists accept the following query parameters:
+//
+//	limit:  maximal number of entries (default DefaultListLimit, at most MaxListLimit)
+//	cursor: the next-cursor of the previous page
+//	sort:   the field to sort by, prefixed with "-" for descending order
+//	q:      search string, by default a substring search
+//	match:  "prefix" for a prefix search instead of a substring search
+//
+// If at least one of these parameters is given the list is returned as a
+// ListPage, otherwise the endpoints return the whole list as before.
+// Everything is done in SQL so only one page is loaded per request.
+// The cursor encodes the sort value and id of the last entry (keyset
+// pagination), so pages remain consistent if entries are added or removed.
+
+// Limits for the number of entries on a page.
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// listParams are the query parameters that enable pagination.
+var listParams = []string{"limit", "cursor", "sort", "q", "match"}
+
+// ListOptions describe the requested page of a list.
+type ListOptions struct {
+	// Limit is the maximal number of entries.
+	Limit int
+	// Sort is the field to sort by, Desc is true for descending order.
+	Sort string
+	Desc bool
+	// Query is the search string, Prefix is true for a prefix search.
+	Query  string
+	Prefix bool
+	// cursor is the decoded cursor, nil for the first page.
+	cursor *listCursor
+}
+
+// ListPage is one page of a list.
+// NextCursor is empty if this is the last page.
+type ListPage struct {
+	Total      int64       `json:"total"`
+	NextCursor string      `json:"next-cursor,omitempty"`
+	Items      interface{} `json:"items"`
+}
+
+// listCursor is the content of a cursor: the sort value and the id of the
+// last entry on the previous page.
+type listCursor struct {
+	Value string `json:"v"`
+	ID    int64  `json:"id"`
+}
+
+// errInvalidCursor is returned if a cursor can't be decoded.
+var errInvalidCursor = errors.New("Invalid cursor")
+
+func encodeCursor(value string, id int64) string {
+	jsonEnc, _ := json.Marshal(&listCursor{Value: value, ID: id})
+	return base64.RawURLEncoding.EncodeToString(jsonEnc)
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var res listCursor
+	if jsonErr := json.Unmarshal(decoded, &res); jsonErr != nil {
+		return nil, errInvalidCursor
+	}
+	return &res, nil
+}
+
+// wantsListPage returns true if the request contains any of the pagination
+// parameters.
+func wantsListPage(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, param := range listParams {
+		if _, has := query[param]; has {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseListOptions parses the pagination parameters from the request.
+// sortColumns are the fields that can be used for sorting (see pageQuery),
+// defaultSort is used if no sort parameter is given.
+// The returned error should be reported as a bad request.
+func ParseListOptions(r *http.Request, sortColumns map[string]string, defaultSort string) (*ListOptions, error) {
+	query := r.URL.Query()
+	res := &ListOptions{Limit: DefaultListLimit, Sort: defaultSort}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > MaxListLimit {
+			return nil, fmt.Errorf("limit must be a number between 1 and %d", MaxListLimit)
+		}
+		res.Limit = limit
+	}
+	if sort := query.Get("sort"); sort != "" {
+		if strings.HasPrefix(sort, "-") {
+			res.Desc = true
+			sort = sort[1:]
+		}
+		if _, valid := sortColumns[sort]; !valid {
+			return nil, fmt.Errorf("Can't sort by %s", sort)
+		}
+		res.Sort = sort
+	}
+	res.Query = query.Get("q")
+	switch query.Get("match") {
+	case "", "substring":
+	case "prefix":
+		res.Prefix = true
+	default:
+		return nil, errors.New("match must be either substring or prefix")
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		var err error
+		if res.cursor, err = decodeCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// pageQuery builds the SQL queries for a page of a list.
+type pageQuery struct {
+	// from is the table (or subquery) to select from.
+	from string
+	// columns are the selected columns.
+	columns string
+	// idColumn is the unique id column used to break ties when sorting, it
+	// is empty if the sort columns are unique.
+	idColumn string
+	// sortColumns maps the sort fields to their columns.
+	sortColumns map[string]string
+	// searchColumns are the columns compared with the search string.
+	searchColumns []string
+	// conditions and args are additional conditions, args also contains the
+	// arguments for from.
+	conditions []string
+	args       []interface{}
+}
+
+// filter adds an additional condition.
+func (q *pageQuery) filter(condition string, args ...interface{}) {
+	q.conditions = append(q.conditions, condition)
+	q.args = append(q.args, args...)
+}
+
+// where returns the WHERE clause and all arguments, the cursor is only
+// used if withCursor is true.
+func (q *pageQuery) where(opts *ListOptions, withCursor bool) (string, []interface{}) {
+	conditions := append([]string{}, q.conditions...)
+	args := append([]interface{}{}, q.args...)
+	if opts.Query != "" {
+		pattern := "%" + escapeLike(opts.Query) + "%"
+		if opts.Prefix {
+			pattern = escapeLike(opts.Query) + "%"
+		}
+		parts := make([]string, len(q.searchColumns))
+		for i, column := range q.searchColumns {
+			parts[i] = column + " LIKE ?"
+			args = append(args, pattern)
+		}
+		conditions = append(conditions, "("+strings.Join(parts, " OR ")+")")
+	}
+	if withCursor && opts.cursor != nil {
+		op := ">"
+		if opts.Desc {
+			op = "<"
+		}
+		column := q.sortColumns[opts.Sort]
+		switch {
+		case column == q.idColumn:
+			conditions = append(conditions, fmt.Sprintf("%s %s ?", column, op))
+			args = append(args, opts.cursor.ID)
+		case q.idColumn == "":
+			conditions = append(conditions, fmt.Sprintf("%s %s ?", column, op))
+			args = append(args, opts.cursor.Value)
+		default:
+			conditions = append(conditions, fmt.Sprintf("(%s %s ? OR (%s = ? AND %s %s ?))", column, op, column, q.idColumn, op))
+			args = append(args, opts.cursor.Value, opts.cursor.Value, opts.cursor.ID)
+		}
+	}
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// count returns the number of all entries matching the search, independent
+// of the cursor.
+func (q *pageQuery) count(appContext *MailAppContext, opts *ListOptions) (int64, error) {
+	where, args := q.where(opts, false)
+	var res int64
+	err := appContext.DB.QueryRow("SELECT COUNT(*) FROM "+q.from+where+";", args...).Scan(&res)
+	return res, err
+}
+
+// rows returns the entries of the page. It selects one entry more than
+// opts.Limit to find out if there is a next page.
+func (q *pageQuery) rows(appContext *MailAppContext, opts *ListOptions) (*sql.Rows, error) {
+	where, args := q.where(opts, true)
+	direction := "ASC"
+	if opts.Desc {
+		direction = "DESC"
+	}
+	column := q.sortColumns[opts.Sort]
+	order := fmt.Sprintf(" ORDER BY %s %s", column, direction)
+	if q.idColumn != "" && column != q.idColumn {
+		order += fmt.Sprintf(", %s %s", q.idColumn, direction)
+	}
+	args = append(args, opts.Limit+1)
+	return appContext.DB.Query("SELECT "+q.columns+" FROM "+q.from+where+order+" LIMIT ?;", args...)
+}
+
+// writeListPage writes the page as JSON.
+func writeListPage(w http.ResponseWriter, page *ListPage) error {
+	jsonEnc, jsonErr := json.Marshal(page)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	w.Write(jsonEnc)
+	return nil
+}
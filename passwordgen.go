@@ -0,0 +1,170 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// wordlistFile is the BIP39 list of 2048 english words, it is used to
+// generate diceware passphrases.
+//
+//go:embed wordlist.txt
+var wordlistFile string
+
+// wordlist contains the words from wordlistFile.
+var wordlist = strings.Fields(wordlistFile)
+
+const (
+	// GenerateRandom generates a password of random characters.
+	GenerateRandom = "random"
+	// GenerateDiceware generates a passphrase of random words.
+	GenerateDiceware = "diceware"
+)
+
+const (
+	passwordLower   = "abcdefghijklmnopqrstuvwxyz"
+	passwordUpper   = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordDigits  = "0123456789"
+	passwordSymbols = "!#$%&*+-=?@^_"
+	// randomPasswordLength is the length of random passwords unless the
+	// policy requires longer ones.
+	randomPasswordLength = 20
+	// dicewareWords is the number of words in a passphrase unless the policy
+	// requires longer ones, with 2048 words this gives 66 bits of entropy.
+	dicewareWords = 6
+	// maxGenerateAttempts is the number of passwords generated before giving
+	// up on finding one that the policy accepts.
+	maxGenerateAttempts = 100
+)
+
+// ErrInvalidGenerator is returned by GeneratePassword if the generator is
+// neither GenerateRandom nor GenerateDiceware.
+var ErrInvalidGenerator = errors.New("Invalid password generator, must be either \"random\" or \"diceware\"")
+
+// randomInt returns a uniform random number in [0, n).
+func randomInt(n int) (int, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return -1, err
+	}
+	return int(i.Int64()), nil
+}
+
+// GeneratePassword generates a password with the given generator
+// (GenerateRandom or GenerateDiceware) that is accepted by the policy.
+// username is passed to PasswordPolicy.Check.
+func (policy *PasswordPolicy) GeneratePassword(generator, username string) (string, error) {
+	var generate func() (string, error)
+	switch generator {
+	case GenerateRandom:
+		generate = policy.randomPassword
+	case GenerateDiceware:
+		generate = policy.dicewarePassword
+	default:
+		return "", ErrInvalidGenerator
+	}
+	for i := 0; i < maxGenerateAttempts; i++ {
+		password, err := generate()
+		if err != nil {
+			return "", err
+		}
+		if policy.Check(password, username) == nil {
+			return password, nil
+		}
+	}
+	return "", errors.New("Can't generate a password that matches the password policy")
+}
+
+// randomPassword returns a password of random lower and upper case letters,
+// digits and symbols.
+func (policy *PasswordPolicy) randomPassword() (string, error) {
+	length := randomPasswordLength
+	if length < policy.MinLength {
+		length = policy.MinLength
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		length = policy.MaxLength
+	}
+	chars := passwordLower + passwordUpper + passwordDigits + passwordSymbols
+	res := make([]byte, length)
+	for i := range res {
+		n, err := randomInt(len(chars))
+		if err != nil {
+			return "", err
+		}
+		res[i] = chars[n]
+	}
+	return string(res), nil
+}
+
+// dicewarePassword returns a passphrase of words from wordlist separated by
+// "-". If the policy requires upper case letters the words are capitalized,
+// if it requires digits a random digit is appended.
+// If the policy has a MaxLength that doesn't allow dicewareWords words the
+// passphrase contains fewer words.
+func (policy *PasswordPolicy) dicewarePassword() (string, error) {
+	// the words are lower case and the separator is a symbol, so there are
+	// two classes
+	upper := policy.RequireUpper || policy.MinClasses > 2
+	digit := policy.RequireDigit || policy.MinClasses > 3
+	// length is the length of the passphrase including the digit and its
+	// separator
+	length := 0
+	if digit {
+		length = 2
+	}
+	words := make([]string, 0, dicewareWords)
+	for len(words) < dicewareWords || length < policy.MinLength {
+		n, err := randomInt(len(wordlist))
+		if err != nil {
+			return "", err
+		}
+		word := wordlist[n]
+		if upper {
+			word = strings.ToUpper(word[:1]) + word[1:]
+		}
+		wordLength := len(word)
+		if len(words) > 0 {
+			wordLength++
+		}
+		if policy.MaxLength > 0 && length+wordLength > policy.MaxLength {
+			// GeneratePassword tries again if the passphrase is too short
+			break
+		}
+		words = append(words, word)
+		length += wordLength
+	}
+	if digit {
+		n, err := randomInt(len(passwordDigits))
+		if err != nil {
+			return "", err
+		}
+		words = append(words, passwordDigits[n:n+1])
+	}
+	return strings.Join(words, "-"), nil
+}
@@ -0,0 +1,58 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDicewarePasswordDefault(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+	password, err := policy.GeneratePassword(GenerateDiceware, "user@example.org")
+	if err != nil {
+		t.Fatalf("Generating passphrase failed: %s", err)
+	}
+	if words := strings.Split(password, "-"); len(words) < dicewareWords {
+		t.Errorf("Expected at least %d words, got \"%s\"", dicewareWords, password)
+	}
+}
+
+func TestDicewarePasswordMaxLength(t *testing.T) {
+	for _, maxLength := range []int{12, 20, 30, 40} {
+		policy := DefaultPasswordPolicy()
+		policy.MinLength = 8
+		policy.MaxLength = maxLength
+		policy.RequireUpper = true
+		policy.RequireDigit = true
+		for i := 0; i < 20; i++ {
+			password, err := policy.GeneratePassword(GenerateDiceware, "user@example.org")
+			if err != nil {
+				t.Fatalf("Generating passphrase with max_length %d failed: %s", maxLength, err)
+			}
+			if len(password) > maxLength {
+				t.Errorf("Passphrase \"%s\" is longer than max_length %d", password, maxLength)
+			}
+		}
+	}
+}
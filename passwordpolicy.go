@@ -0,0 +1,280 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy describes the rules passwords of mail users and admins must
+// follow. It is configured in the [password_policy] section of mailconf.
+type PasswordPolicy struct {
+	// MinLength and MaxLength are the bounds for the number of characters
+	// (runes) in a password.
+	MinLength, MaxLength int
+	// RequireLower, RequireUpper, RequireDigit and RequireSymbol require at
+	// least one character of the class.
+	RequireLower, RequireUpper, RequireDigit, RequireSymbol bool
+	// MinClasses is the number of different character classes (lower, upper,
+	// digit, symbol) a password must contain, 0 means no restriction.
+	MinClasses int
+	// DisallowUsername rejects passwords that contain the local part of the
+	// mail address (or the name of the admin).
+	DisallowUsername bool
+	// blocklist contains all blocked passwords in lower case, blockedHashes
+	// contains upper case hex encoded SHA-1 hashes of blocked passwords (as
+	// found in breached password lists).
+	blocklist     map[string]struct{}
+	blockedHashes map[string]struct{}
+}
+
+// DefaultPasswordPolicy returns the policy used if nothing is configured.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: 6, MaxLength: 128, DisallowUsername: true}
+}
+
+// PasswordViolation describes a single rule a password doesn't follow.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// PasswordPolicyError is returned by PasswordPolicy.Check and contains all
+// rules the password violates.
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+// Error joins the messages of all violations.
+func (err *PasswordPolicyError) Error() string {
+	messages := make([]string, len(err.Violations))
+	for i, violation := range err.Violations {
+		messages[i] = violation.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (err *PasswordPolicyError) add(rule, format string, args ...interface{}) {
+	err.Violations = append(err.Violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+}
+
+// Check tests the password against the policy. username is the mail address
+// of a mail user or the name of an admin, for mail addresses only the local
+// part is considered. If the password violates any rule a
+// *PasswordPolicyError is returned.
+func (policy *PasswordPolicy) Check(password, username string) error {
+	res := &PasswordPolicyError{}
+	length := utf8.RuneCountInString(password)
+	if length < policy.MinLength {
+		res.add("min-length", "Password must be at least of length %d", policy.MinLength)
+	}
+	if policy.MaxLength > 0 && length > policy.MaxLength {
+		res.add("max-length", "Password length must be at most %d", policy.MaxLength)
+	}
+	var lower, upper, digit, symbol bool
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = true
+		case unicode.IsUpper(c):
+			upper = true
+		case unicode.IsDigit(c):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	if policy.RequireLower && !lower {
+		res.add("lower", "Password must contain a lower case letter")
+	}
+	if policy.RequireUpper && !upper {
+		res.add("upper", "Password must contain an upper case letter")
+	}
+	if policy.RequireDigit && !digit {
+		res.add("digit", "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !symbol {
+		res.add("symbol", "Password must contain a symbol")
+	}
+	if policy.MinClasses > 0 {
+		classes := 0
+		for _, found := range []bool{lower, upper, digit, symbol} {
+			if found {
+				classes++
+			}
+		}
+		if classes < policy.MinClasses {
+			res.add("classes", "Password must contain at least %d of: lower case letters, upper case letters, digits, symbols", policy.MinClasses)
+		}
+	}
+	if policy.blocked(password) {
+		res.add("blocklist", "Password is too common or known from a data breach")
+	}
+	if policy.DisallowUsername {
+		name := username
+		if at := strings.LastIndex(name, "@"); at >= 0 {
+			name = name[:at]
+		}
+		// very short names would reject too many passwords
+		if utf8.RuneCountInString(name) >= 3 && strings.Contains(strings.ToLower(password), strings.ToLower(name)) {
+			res.add("username", "Password must not contain the username")
+		}
+	}
+	if len(res.Violations) > 0 {
+		return res
+	}
+	return nil
+}
+
+// blocked returns true if the password is in the blocklist.
+func (policy *PasswordPolicy) blocked(password string) bool {
+	if _, has := policy.blocklist[strings.ToLower(password)]; has {
+		return true
+	}
+	if len(policy.blockedHashes) > 0 {
+		hash := sha1.Sum([]byte(password))
+		if _, has := policy.blockedHashes[strings.ToUpper(hex.EncodeToString(hash[:]))]; has {
+			return true
+		}
+	}
+	return false
+}
+
+// readBlocklist reads the blocklist file, it contains one password per line.
+// Lines that consist of 40 hex characters are treated as SHA-1 hashes of the
+// password, a ":" and everything after it is ignored so that breached
+// password lists in the "HASH:COUNT" format can be used directly.
+// Empty lines and lines starting with # are ignored.
+func (policy *PasswordPolicy) readBlocklist(configDir, file string) error {
+	if !path.IsAbs(file) {
+		file = path.Join(configDir, file)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	policy.blocklist = make(map[string]struct{})
+	policy.blockedHashes = make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if hash := strings.SplitN(line, ":", 2)[0]; isSHA1Hex(hash) {
+			policy.blockedHashes[strings.ToUpper(hash)] = struct{}{}
+			continue
+		}
+		policy.blocklist[strings.ToLower(line)] = struct{}{}
+	}
+	return scanner.Err()
+}
+
+// isSHA1Hex returns true if s is a hex encoded SHA-1 hash.
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// passwordPolicyInfo is used in the server config in the [password_policy]
+// section.
+type passwordPolicyInfo struct {
+	MinLength        int    `toml:"min_length"`
+	MaxLength        int    `toml:"max_length"`
+	RequireLower     bool   `toml:"require_lower"`
+	RequireUpper     bool   `toml:"require_upper"`
+	RequireDigit     bool   `toml:"require_digit"`
+	RequireSymbol    bool   `toml:"require_symbol"`
+	MinClasses       int    `toml:"min_classes"`
+	Blocklist        string `toml:"blocklist"`
+	DisallowUsername *bool  `toml:"disallow_username"`
+}
+
+// parsePasswordPolicy creates the policy from the config, values not set are
+// taken from DefaultPasswordPolicy.
+func parsePasswordPolicy(configDir string, info passwordPolicyInfo) (*PasswordPolicy, error) {
+	res := DefaultPasswordPolicy()
+	if info.MinLength > 0 {
+		res.MinLength = info.MinLength
+	}
+	if info.MaxLength > 0 {
+		res.MaxLength = info.MaxLength
+	}
+	if res.MaxLength < res.MinLength {
+		return nil, fmt.Errorf("Invalid password_policy config: max_length %d is smaller than min_length %d", res.MaxLength, res.MinLength)
+	}
+	if info.MinClasses < 0 || info.MinClasses > 4 {
+		return nil, fmt.Errorf("Invalid password_policy config: min_classes must be between 0 and 4, got %d", info.MinClasses)
+	}
+	res.RequireLower = info.RequireLower
+	res.RequireUpper = info.RequireUpper
+	res.RequireDigit = info.RequireDigit
+	res.RequireSymbol = info.RequireSymbol
+	res.MinClasses = info.MinClasses
+	if info.DisallowUsername != nil {
+		res.DisallowUsername = *info.DisallowUsername
+	}
+	if info.Blocklist != "" {
+		if readErr := res.readBlocklist(configDir, info.Blocklist); readErr != nil {
+			return nil, readErr
+		}
+	}
+	return res, nil
+}
+
+// writePasswordError writes the error returned by PasswordPolicy.Check with
+// status 400. Policy violations are written as JSON of the form
+// {"error": <message>, "violations": [{"rule": <rule>, "message": <message>}]}
+// so that clients can show all violations.
+func writePasswordError(w http.ResponseWriter, err error) {
+	policyErr, ok := err.(*PasswordPolicyError)
+	if !ok {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	jsonEnc, jsonErr := json.Marshal(map[string]interface{}{
+		"error":      policyErr.Error(),
+		"violations": policyErr.Violations,
+	})
+	if jsonErr != nil {
+		http.Error(w, policyErr.Error(), 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(400)
+	w.Write(jsonEnc)
+}
@@ -0,0 +1,680 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the self-service portal for mail users. Mail users log
+// in with their mailbox credentials at /portal/ and can change their
+// password, manage their aliases (other addresses of their domain delivered
+// to their mailbox) and forwards (addresses their mail is forwarded to) and
+// view their quota.
+// Portal sessions are stored in PortalStore, they are never valid as admin
+// sessions. A session is bound to the stored password of the user: once
+// the password changes (or the user is deleted) all sessions end.
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// portalSession is the name of the session of logged in mail users.
+	portalSession = "mailwebadmin-portal"
+	// maxPortalAliases is the maximal number of aliases a user can create.
+	maxPortalAliases = 20
+	// maxPortalForwards is the maximal number of forwards a user can create.
+	maxPortalForwards = 10
+)
+
+// PortalConfig is the configuration of the self-service portal, it is read
+// from the [portal] section of mailconf.
+type PortalConfig struct {
+	// Enabled is set to true if the portal is available.
+	Enabled bool
+	// ManageAliases is set to true if users can add and delete aliases.
+	ManageAliases bool
+	// ManageForwards is set to true if users can add and delete forwards.
+	ManageForwards bool
+	// SessionLifespan is the time a user stays logged in.
+	SessionLifespan time.Duration
+}
+
+// portalInfo is used in the server config in the [portal] section.
+type portalInfo struct {
+	Enabled         bool     `toml:"enabled"`
+	ManageAliases   bool     `toml:"manage_aliases"`
+	ManageForwards  bool     `toml:"manage_forwards"`
+	SessionLifespan duration `toml:"session_lifespan"`
+}
+
+// parsePortalConfig creates the PortalConfig from the config file and sets
+// the default values.
+func parsePortalConfig(info portalInfo) PortalConfig {
+	res := PortalConfig{
+		Enabled:         info.Enabled,
+		ManageAliases:   info.ManageAliases,
+		ManageForwards:  info.ManageForwards,
+		SessionLifespan: info.SessionLifespan.Duration,
+	}
+	if res.SessionLifespan == time.Duration(0) {
+		res.SessionLifespan = time.Hour
+	}
+	return res
+}
+
+// PortalUser is the mail user logged in to the portal.
+type PortalUser struct {
+	ID   int64
+	Mail string
+}
+
+// PortalUserFromRequest returns the mail user of the request, ok is false
+// if the request didn't pass PortalLoginRequired.
+func PortalUserFromRequest(r *http.Request) (user *PortalUser, ok bool) {
+	user, ok = r.Context().Value(portalUserKey).(*PortalUser)
+	return
+}
+
+// passwordFingerprint returns a short hash of the stored password, it is
+// stored in the session to end it if the password changes.
+func passwordFingerprint(storedPW string) string {
+	hash := sha256.Sum256([]byte(storedPW))
+	return hex.EncodeToString(hash[:16])
+}
+
+// startPortalSession logs in the mail user.
+func startPortalSession(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, id int64, mail, storedPW string) error {
+	session, _ := appContext.PortalStore.Get(r, portalSession)
+	session.Values["mail-id"] = id
+	session.Values["mail"] = mail
+	session.Values["password"] = passwordFingerprint(storedPW)
+	session.Values["created"] = time.Now().Unix()
+	session.Options.MaxAge = int(appContext.Portal.SessionLifespan / time.Second)
+	return session.Save(r, w)
+}
+
+// portalUser returns the mail user of the portal session, ok is false if
+// there is no valid session.
+func portalUser(appContext *MailAppContext, r *http.Request) (*PortalUser, bool, error) {
+	session, sessionErr := appContext.PortalStore.Get(r, portalSession)
+	if sessionErr != nil {
+		return nil, false, nil
+	}
+	id, idOk := session.Values["mail-id"].(int64)
+	mail, mailOk := session.Values["mail"].(string)
+	fingerprint, _ := session.Values["password"].(string)
+	created, createdOk := session.Values["created"].(int64)
+	if !idOk || !mailOk || !createdOk {
+		return nil, false, nil
+	}
+	if time.Since(time.Unix(created, 0)) > appContext.Portal.SessionLifespan {
+		return nil, false, nil
+	}
+	storedID, storedPW, getErr := getUserPassword(appContext, mail)
+	switch {
+	case getErr == sql.ErrNoRows:
+		return nil, false, nil
+	case getErr != nil:
+		return nil, false, getErr
+	}
+	if storedID != id || passwordFingerprint(storedPW) != fingerprint {
+		return nil, false, nil
+	}
+	return &PortalUser{ID: id, Mail: mail}, true, nil
+}
+
+// PortalLoginRequired takes a handler function and returns a new handler
+// function that first checks if a mail user is logged in to the portal.
+// If not API requests get a 401, all other requests are redirected to the
+// portal login page. The user is stored in the request context, see
+// PortalUserFromRequest.
+// If the portal is disabled it replies with a 404.
+func PortalLoginRequired(f AppHandleFunc) AppHandleFunc {
+	return func(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+		if !appcontext.Portal.Enabled {
+			http.NotFound(w, r)
+			return nil
+		}
+		// the CSRF check is skipped for bearer tokens, but they're not valid
+		// here
+		if _, isBearer := bearerToken(r); isBearer {
+			http.Error(w, "API tokens can't be used for the portal", 401)
+			return nil
+		}
+		user, ok, err := portalUser(appcontext, r)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				http.Error(w, "Login required", 401)
+			} else {
+				http.Redirect(w, r, "/portal/login/", 302)
+			}
+			return nil
+		}
+		ctx := context.WithValue(r.Context(), portalUserKey, user)
+		return f(appcontext, w, r.WithContext(ctx))
+	}
+}
+
+// BootstrapPortalLoginTemplate is the template for the portal login page.
+func BootstrapPortalLoginTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/portal_login.html"))
+}
+
+// BootstrapPortalTemplate is the template for the portal page.
+func BootstrapPortalTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/portal.html"))
+}
+
+// RenderPortalTemplate renders the template appContext.Templates["portal"].
+func RenderPortalTemplate(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	return appContext.Templates["portal"].ExecuteTemplate(w, "layout", nil)
+}
+
+// PortalLoginHandler returns on GET the login page of the portal and on
+// POST checks the credentials. The body must be a JSON object of the form
+// {"mail": <mail>, "password": <password>}. It replies with a 400 if the
+// login fails, failures are counted as for ChangeSinglePw.
+func PortalLoginHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if !appcontext.Portal.Enabled {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for \"/portal/login/\": %s", r.Method), 400)
+		return nil
+	case getMethod:
+		values := map[string]interface{}{
+			csrf.TemplateTag: csrf.TemplateField(r)}
+		return appcontext.Templates["portal-login"].ExecuteTemplate(w, "layout", values)
+	case postMethod:
+	}
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		appcontext.Logger.Info("Invalid request syntax for portal login.")
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	var loginData struct {
+		Mail, Password string
+	}
+	if jsonErr := json.Unmarshal(body, &loginData); jsonErr != nil {
+		appcontext.Logger.Info("Invalid request syntax for portal login.")
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	if emailErr := emailValid(loginData.Mail); emailErr != nil {
+		http.Error(w, emailErr.Error(), 400)
+		return nil
+	}
+	if allowed, lockErr := checkAttemptAllowed(appcontext, w, r, LockoutScopeMail, loginData.Mail); !allowed {
+		return lockErr
+	}
+	id, storedPW, equal, checkErr := checkMailPassword(appcontext, loginData.Mail, loginData.Password)
+	if checkErr != nil {
+		return checkErr
+	}
+	if !equal {
+		appcontext.Logger.WithFields(log.Fields{
+			"mail":   loginData.Mail,
+			"remote": r.RemoteAddr,
+		}).Warn("Failed portal log in attempt")
+		attemptFailed(appcontext, r, LockoutScopeMail, loginData.Mail)
+		http.Error(w, "Login failed", 400)
+		return nil
+	}
+	attemptSucceeded(appcontext, LockoutScopeMail, loginData.Mail)
+	return startPortalSession(appcontext, w, r, id, loginData.Mail, storedPW)
+}
+
+// PortalLogoutHandler ends the portal session.
+func PortalLogoutHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	session, _ := appcontext.PortalStore.Get(r, portalSession)
+	session.Options.MaxAge = -1
+	if saveErr := session.Save(r, w); saveErr != nil {
+		appcontext.Logger.WithError(saveErr).Error("Failed to save session")
+	}
+	http.Redirect(w, r, "/portal/login/", 302)
+	return nil
+}
+
+// MailQuota is the storage used by a mail user. The limits are 0 if they're
+// unknown or unlimited.
+type MailQuota struct {
+	UsedBytes     int64 `json:"used-bytes"`
+	UsedMessages  int64 `json:"used-messages"`
+	LimitBytes    int64 `json:"limit-bytes"`
+	LimitMessages int64 `json:"limit-messages"`
+}
+
+// maildirSizeLimitRegex matches a limit in the first line of a maildirsize
+// file, for example 1000000S or 1000C.
+var maildirSizeLimitRegex = regexp.MustCompile(`^(\d+)([SC])$`)
+
+// readMaildirSize reads the Maildir++ quota file maildirsize (as written by
+// Dovecot with the maildir quota backend).
+func readMaildirSize(fileName string) (*MailQuota, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	res := &MailQuota{}
+	scanner := bufio.NewScanner(file)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			// the first line contains the limits
+			first = false
+			for _, limit := range strings.Split(line, ",") {
+				match := maildirSizeLimitRegex.FindStringSubmatch(strings.TrimSpace(limit))
+				if match == nil {
+					continue
+				}
+				value, _ := strconv.ParseInt(match[1], 10, 64)
+				if match[2] == "S" {
+					res.LimitBytes = value
+				} else {
+					res.LimitMessages = value
+				}
+			}
+			continue
+		}
+		// all other lines contain the changes in bytes and messages
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		bytes, bytesErr := strconv.ParseInt(fields[0], 10, 64)
+		messages, messagesErr := strconv.ParseInt(fields[1], 10, 64)
+		if bytesErr != nil || messagesErr != nil {
+			continue
+		}
+		res.UsedBytes += bytes
+		res.UsedMessages += messages
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// GetMailQuota returns the quota of the user. It uses the maildirsize file
+// in the mail directory (or the Maildir inside it) if it exists, otherwise
+// it computes the size of the mail directory (limits are unknown then).
+func GetMailQuota(appContext *MailAppContext, mail string) (*MailQuota, error) {
+	user, domain, parseErr := ParseMailParts(mail)
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	dir := getSourcePath(appContext.MailDir, domain, user)
+	for _, candidate := range []string{filepath.Join(dir, "maildirsize"), filepath.Join(dir, "Maildir", "maildirsize")} {
+		res, err := readMaildirSize(candidate)
+		if err == nil {
+			return res, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	res := &MailQuota{}
+	walkErr := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		res.UsedBytes += info.Size()
+		// messages are stored in cur and new
+		if parent := filepath.Base(filepath.Dir(path)); parent == "cur" || parent == "new" {
+			res.UsedMessages++
+		}
+		return nil
+	})
+	if walkErr != nil && !os.IsNotExist(walkErr) {
+		return nil, walkErr
+	}
+	return res, nil
+}
+
+// listPortalAliases returns the aliases (other addresses delivered to mail)
+// and forwards (addresses mail is forwarded to) of the mail user in the form
+// id --> address.
+func listPortalAliases(appContext *MailAppContext, mail string) (aliases, forwards map[int64]string, err error) {
+	query := "SELECT id, source, destination FROM virtual_aliases WHERE destination = ? OR source = ?;"
+	rows, err := appContext.DB.Query(query, mail, mail)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	aliases = make(map[int64]string)
+	forwards = make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var source, dest string
+		if scanErr := rows.Scan(&id, &source, &dest); scanErr != nil {
+			return nil, nil, scanErr
+		}
+		if source == mail {
+			forwards[id] = dest
+		} else {
+			aliases[id] = source
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, nil, err
+	}
+	return aliases, forwards, nil
+}
+
+// PortalInfo is the information about a mail user returned by /api/portal/.
+type PortalInfo struct {
+	Mail           string           `json:"mail"`
+	Aliases        map[int64]string `json:"aliases"`
+	Forwards       map[int64]string `json:"forwards"`
+	Quota          *MailQuota       `json:"quota"`
+	RecoveryMail   string           `json:"recovery-mail"`
+	ManageAliases  bool             `json:"manage-aliases"`
+	ManageForwards bool             `json:"manage-forwards"`
+	// PasswordExpired is true if the password expired and the user must
+	// change it, see UpdateExpiredPasswords.
+	PasswordExpired bool `json:"password-expired"`
+}
+
+// PortalJSON is the handler for /api/portal/. GET returns the PortalInfo of
+// the logged in user, UPDATE changes the password and / or the recovery
+// address, the body must be a JSON object of the form
+// {"password": <new password>, "recovery-mail": <mail>} (both are optional).
+// It must be wrapped by PortalLoginRequired.
+func PortalJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	user, ok := PortalUserFromRequest(r)
+	if !ok {
+		http.Error(w, "Login required", 401)
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/portal/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		aliases, forwards, listErr := listPortalAliases(appcontext, user.Mail)
+		if listErr != nil {
+			return listErr
+		}
+		recovery, recoveryErr := GetRecoveryMail(appcontext, user.ID)
+		if recoveryErr != nil {
+			return recoveryErr
+		}
+		quota, quotaErr := GetMailQuota(appcontext, user.Mail)
+		if quotaErr != nil {
+			appcontext.Logger.WithError(quotaErr).WithField("mail", user.Mail).Warn("Can't get quota of mail user")
+		}
+		expired, expiredErr := PasswordExpired(appcontext, user.ID)
+		if expiredErr != nil {
+			return expiredErr
+		}
+		res := PortalInfo{Mail: user.Mail, Aliases: aliases, Forwards: forwards, Quota: quota, RecoveryMail: recovery,
+			ManageAliases: appcontext.Portal.ManageAliases, ManageForwards: appcontext.Portal.ManageForwards,
+			PasswordExpired: expired}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case updateMethod:
+		body, readErr := ioutil.ReadAll(r.Body)
+		if readErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		var pwData struct {
+			Password     string
+			RecoveryMail *string `json:"recovery-mail"`
+		}
+		if jsonErr := json.Unmarshal(body, &pwData); jsonErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		if pwData.RecoveryMail != nil {
+			if *pwData.RecoveryMail != "" {
+				if emailErr := emailValid(*pwData.RecoveryMail); emailErr != nil {
+					http.Error(w, emailErr.Error(), 400)
+					return nil
+				}
+			}
+			if recoveryErr := setRecoveryMailAudited(appcontext, r, user.ID, *pwData.RecoveryMail); recoveryErr != nil {
+				return recoveryErr
+			}
+			if pwData.Password == "" {
+				return nil
+			}
+		}
+		if pwErr := appcontext.PasswordPolicy.Check(pwData.Password, user.Mail); pwErr != nil {
+			writePasswordError(w, pwErr)
+			return nil
+		}
+		if changeErr := ChangeUserPassword(appcontext, user.ID, pwData.Password); changeErr != nil {
+			return changeErr
+		}
+		recordAudit(appcontext, r, AuditChangePassword, AuditTargetUser, user.ID, nil, AuditValues{"mail": user.Mail, "self-service": true})
+		// the password changed, so renew the session
+		_, storedPW, getErr := getUserPassword(appcontext, user.Mail)
+		if getErr != nil {
+			return getErr
+		}
+		return startPortalSession(appcontext, w, r, user.ID, user.Mail, storedPW)
+	}
+}
+
+// portalAliasRegex matches /api/portal/aliases/<id>.
+var portalAliasRegex = regexp.MustCompile(`^/api/portal/aliases/((\d+)/?)?$`)
+
+// parsePortalAliasURL returns the id from the url.
+func parsePortalAliasURL(url string) (int64, error) {
+	if url == "/api/portal/aliases/" || url == "/api/portal/aliases" {
+		return -1, errNoID
+	}
+	return parseIDFromURL(portalAliasRegex, url)
+}
+
+// addressExists checks if the address is a mail user or the source of an
+// alias.
+func addressExists(appContext *MailAppContext, address string) (bool, error) {
+	query := "SELECT (SELECT COUNT(*) FROM virtual_users WHERE email = ?) + (SELECT COUNT(*) FROM virtual_aliases WHERE source = ?);"
+	var count int
+	if err := appContext.DB.QueryRow(query, address, address).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// addPortalAlias handles POST /api/portal/aliases/. The body is either
+// {"source": <address>} to add an alias for the user or
+// {"destination": <address>} to add a forward.
+// Aliases must be in the domain of the user and must not exist yet, so
+// users can't take over addresses.
+func addPortalAlias(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request, user *PortalUser) error {
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	var aliasData struct {
+		Source, Destination string
+	}
+	if jsonErr := json.Unmarshal(body, &aliasData); jsonErr != nil {
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	aliases, forwards, listErr := listPortalAliases(appcontext, user.Mail)
+	if listErr != nil {
+		return listErr
+	}
+	var source, dest string
+	switch {
+	case aliasData.Source != "" && aliasData.Destination == "":
+		if !appcontext.Portal.ManageAliases {
+			http.Error(w, "Forbidden", 403)
+			return nil
+		}
+		if len(aliases) >= maxPortalAliases {
+			http.Error(w, fmt.Sprintf("You can't have more than %d aliases", maxPortalAliases), 400)
+			return nil
+		}
+		if emailErr := emailValid(aliasData.Source); emailErr != nil {
+			http.Error(w, emailErr.Error(), 400)
+			return nil
+		}
+		_, userDomain, _ := ParseMailParts(user.Mail)
+		if _, domain, _ := ParseMailParts(aliasData.Source); !strings.EqualFold(domain, userDomain) {
+			http.Error(w, "The alias must be in the domain "+userDomain, 400)
+			return nil
+		}
+		exists, existsErr := addressExists(appcontext, aliasData.Source)
+		if existsErr != nil {
+			return existsErr
+		}
+		if exists {
+			http.Error(w, "The address is already in use", 400)
+			return nil
+		}
+		source, dest = aliasData.Source, user.Mail
+	case aliasData.Destination != "" && aliasData.Source == "":
+		if !appcontext.Portal.ManageForwards {
+			http.Error(w, "Forbidden", 403)
+			return nil
+		}
+		if len(forwards) >= maxPortalForwards {
+			http.Error(w, fmt.Sprintf("You can't have more than %d forwards", maxPortalForwards), 400)
+			return nil
+		}
+		if emailErr := emailValid(aliasData.Destination); emailErr != nil {
+			http.Error(w, emailErr.Error(), 400)
+			return nil
+		}
+		for _, forward := range forwards {
+			if strings.EqualFold(forward, aliasData.Destination) {
+				http.Error(w, "The forward exists already", 400)
+				return nil
+			}
+		}
+		source, dest = user.Mail, aliasData.Destination
+	default:
+		http.Error(w, "Either source or destination must be given", 400)
+		return nil
+	}
+	id, addErr := AddAlias(appcontext, source, dest)
+	if addErr != nil {
+		return addErr
+	}
+	recordAudit(appcontext, r, AuditAddAlias, AuditTargetAlias, id, nil,
+		AuditValues{"source": source, "destination": dest, "self-service": true})
+	jsonEnc, jsonErr := json.Marshal(map[string]int64{"alias-id": id})
+	if jsonErr != nil {
+		return jsonErr
+	}
+	w.Write(jsonEnc)
+	return nil
+}
+
+// PortalAliasesJSON is the handler for /api/portal/aliases/.
+// POST adds an alias or forward (see addPortalAlias), DELETE
+// /api/portal/aliases/<id> deletes an alias or forward of the user.
+// It must be wrapped by PortalLoginRequired.
+func PortalAliasesJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	user, ok := PortalUserFromRequest(r)
+	if !ok {
+		http.Error(w, "Login required", 401)
+		return nil
+	}
+	aliasID, parseErr := parsePortalAliasURL(r.URL.Path)
+	if parseErr != nil && parseErr != errNoID {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/portal/aliases/: %s", r.Method), 400)
+		return nil
+	case postMethod:
+		if aliasID >= 0 {
+			http.Error(w, "Invalid POST request to /api/portal/aliases/.", 400)
+			return nil
+		}
+		return addPortalAlias(appcontext, w, r, user)
+	case deleteMethod:
+		if aliasID < 0 {
+			http.Error(w, "Invalid DELETE request to /api/portal/aliases/: No id given.", 400)
+			return nil
+		}
+		alias, getErr := getAlias(appcontext, aliasID)
+		if getErr == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return nil
+		}
+		if getErr != nil {
+			return getErr
+		}
+		isForward := alias.Source == user.Mail
+		isAlias := !isForward && alias.Dest == user.Mail
+		switch {
+		case !isForward && !isAlias:
+			http.NotFound(w, r)
+			return nil
+		case isForward && !appcontext.Portal.ManageForwards, isAlias && !appcontext.Portal.ManageAliases:
+			http.Error(w, "Forbidden", 403)
+			return nil
+		}
+		if delErr := DelAlias(appcontext, aliasID); delErr != nil {
+			return delErr
+		}
+		recordAudit(appcontext, r, AuditDeleteAlias, AuditTargetAlias, aliasID,
+			AuditValues{"source": alias.Source, "destination": alias.Dest, "self-service": true}, nil)
+		return nil
+	}
+}
@@ -0,0 +1,392 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the password reset for mail users. Each user can store
+// a recovery address (see SetRecoveryMail). On /password/reset/ a user can
+// request a reset link that is sent to this address, the link contains a
+// single-use token that expires after some time. Only the sha256 of the
+// token is stored.
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+// resetRequestInterval is the minimal time between two reset mails for the
+// same user.
+const resetRequestInterval = 5 * time.Minute
+
+// PasswordResetConfig is the configuration of the password reset, it is read
+// from the [password_reset] section of mailconf. The reset also requires the
+// [smtp] section.
+type PasswordResetConfig struct {
+	// BaseURL is the url of mailwebadmin used in the reset links, for
+	// example https://mail.example.org.
+	BaseURL string
+	// Lifespan is the time a reset link is valid.
+	Lifespan time.Duration
+}
+
+// passwordResetInfo is used in the server config in the [password_reset]
+// section.
+type passwordResetInfo struct {
+	BaseURL  string   `toml:"base_url"`
+	Lifespan duration `toml:"lifespan"`
+}
+
+// parsePasswordResetConfig creates the PasswordResetConfig from the config
+// file and sets the default values.
+func parsePasswordResetConfig(info passwordResetInfo) (PasswordResetConfig, error) {
+	res := PasswordResetConfig{
+		BaseURL:  strings.TrimRight(info.BaseURL, "/"),
+		Lifespan: info.Lifespan.Duration,
+	}
+	if res.BaseURL != "" {
+		if u, err := url.Parse(res.BaseURL); err != nil || u.Host == "" {
+			return res, fmt.Errorf("Invalid password_reset config: base_url \"%s\" is not a valid url", info.BaseURL)
+		}
+	}
+	if res.Lifespan == time.Duration(0) {
+		res.Lifespan = time.Hour
+	}
+	return res, nil
+}
+
+// passwordResetEnabled returns true if the password reset is configured.
+func passwordResetEnabled(appContext *MailAppContext) bool {
+	return appContext.Mailer != nil && appContext.PasswordReset.BaseURL != ""
+}
+
+// GetRecoveryMail returns the recovery address of the user, the empty string
+// if none is set.
+func GetRecoveryMail(appContext *MailAppContext, userID int64) (string, error) {
+	var mail string
+	err := appContext.DB.QueryRow("SELECT recovery_mail FROM recovery_mails WHERE user_id = ?;", userID).Scan(&mail)
+	switch {
+	case err == sql.ErrNoRows:
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	return mail, nil
+}
+
+// SetRecoveryMail sets the recovery address of the user, the empty string
+// removes it.
+func SetRecoveryMail(appContext *MailAppContext, userID int64, mail string) error {
+	if mail == "" {
+		_, err := appContext.DB.Exec("DELETE FROM recovery_mails WHERE user_id = ?;", userID)
+		return err
+	}
+	if emailErr := emailValid(mail); emailErr != nil {
+		return emailErr
+	}
+	query := "INSERT INTO recovery_mails (user_id, recovery_mail) VALUES (?, ?) ON DUPLICATE KEY UPDATE recovery_mail = VALUES(recovery_mail);"
+	_, err := appContext.DB.Exec(query, userID, mail)
+	return err
+}
+
+// setRecoveryMailAudited calls SetRecoveryMail and records the change in
+// the audit log.
+func setRecoveryMailAudited(appContext *MailAppContext, r *http.Request, userID int64, mail string) error {
+	old, getErr := GetRecoveryMail(appContext, userID)
+	if getErr != nil {
+		return getErr
+	}
+	if setErr := SetRecoveryMail(appContext, userID, mail); setErr != nil {
+		return setErr
+	}
+	recordAudit(appContext, r, AuditSetRecoveryMail, AuditTargetUser, userID,
+		AuditValues{"recovery-mail": old}, AuditValues{"recovery-mail": mail})
+	return nil
+}
+
+// CreateResetToken creates a new reset token for the user and returns it.
+// The token is only returned here, it can't be retrieved later.
+func CreateResetToken(appContext *MailAppContext, userID int64) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now().UTC()
+	query := "INSERT INTO password_resets (token_hash, user_id, created, expires) VALUES (?, ?, ?, ?);"
+	if _, err := appContext.DB.Exec(query, hashToken(token), userID, now, now.Add(appContext.PasswordReset.Lifespan)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// recentResetRequest checks if a reset token for the user was created within
+// resetRequestInterval.
+func recentResetRequest(appContext *MailAppContext, userID int64) (bool, error) {
+	query := "SELECT COUNT(*) FROM password_resets WHERE user_id = ? AND created > ?;"
+	var count int
+	if err := appContext.DB.QueryRow(query, userID, time.Now().UTC().Add(-resetRequestInterval)).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ConsumeResetToken checks the token and returns the id of the user. All
+// tokens of the user are deleted, so the token can only be used once.
+// It returns sql.ErrNoRows if the token doesn't exist or is expired.
+func ConsumeResetToken(appContext *MailAppContext, token string) (int64, error) {
+	tx, err := appContext.DB.Begin()
+	if err != nil {
+		return -1, err
+	}
+	var userID int64
+	var expires sqlTime
+	query := "SELECT user_id, expires FROM password_resets WHERE token_hash = ? FOR UPDATE;"
+	if scanErr := tx.QueryRow(query, hashToken(token)).Scan(&userID, &expires); scanErr != nil {
+		tx.Rollback()
+		return -1, scanErr
+	}
+	if _, delErr := tx.Exec("DELETE FROM password_resets WHERE user_id = ?;", userID); delErr != nil {
+		tx.Rollback()
+		return -1, delErr
+	}
+	if commitErr := tx.Commit(); commitErr != nil {
+		return -1, commitErr
+	}
+	if !time.Now().UTC().Before(expires.Time) {
+		return -1, sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+// resetTokenUser returns the mail address of the user the token belongs to
+// without consuming the token. It returns sql.ErrNoRows if the token is
+// invalid or expired.
+func resetTokenUser(appContext *MailAppContext, token string) (string, error) {
+	var userID int64
+	query := "SELECT user_id FROM password_resets WHERE token_hash = ? AND expires > ?;"
+	if err := appContext.DB.QueryRow(query, hashToken(token), time.Now().UTC()).Scan(&userID); err != nil {
+		return "", err
+	}
+	user, domain, nameErr := getUserName(appContext, userID)
+	if nameErr != nil {
+		return "", nameErr
+	}
+	return user + "@" + domain, nil
+}
+
+// DeleteExpiredResetTokens removes all expired reset tokens.
+func DeleteExpiredResetTokens(appContext *MailAppContext) (int64, error) {
+	res, err := appContext.DB.Exec("DELETE FROM password_resets WHERE expires <= ?;", time.Now().UTC())
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredResetTokensDaemon runs DeleteExpiredResetTokens every sleep
+// duration. It runs in a new goroutine until something is written to stop.
+func DeleteExpiredResetTokensDaemon(appContext *MailAppContext, sleep time.Duration, stop chan bool) {
+	ticker := time.NewTicker(sleep)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if num, err := DeleteExpiredResetTokens(appContext); err != nil {
+					appContext.Logger.WithError(err).Error("Error deleting expired password reset tokens")
+				} else if num > 0 {
+					appContext.Logger.WithField("num-deleted", num).Info("Deleted expired password reset tokens")
+				}
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// resetMailBody is the text of the reset mail, the placeholders are the
+// mail address, the link and the lifespan.
+const resetMailBody = `Hello,
+
+someone (hopefully you) requested to reset the password of the mail account
+%s.
+
+To choose a new password open the following link:
+
+%s
+
+The link is valid for %s and can only be used once. If you didn't request
+the reset you can ignore this mail, your password will not be changed.
+`
+
+// requestPasswordReset creates a reset token for the user and sends the
+// link to the recovery address. Nothing happens if the user doesn't exist,
+// has no recovery address or requested a reset recently.
+// The mail is sent in a new goroutine, so the response time doesn't reveal
+// whether the user exists.
+func requestPasswordReset(appContext *MailAppContext, r *http.Request, mail string) error {
+	id, _, getErr := getUserPassword(appContext, mail)
+	if getErr == sql.ErrNoRows {
+		appContext.Logger.WithField("mail", mail).WithField("remote", r.RemoteAddr).Info("Password reset requested for unknown user")
+		return nil
+	}
+	if getErr != nil {
+		return getErr
+	}
+	recovery, recoveryErr := GetRecoveryMail(appContext, id)
+	if recoveryErr != nil {
+		return recoveryErr
+	}
+	if recovery == "" {
+		appContext.Logger.WithField("mail", mail).Info("Password reset requested for user without recovery address")
+		return nil
+	}
+	recent, recentErr := recentResetRequest(appContext, id)
+	if recentErr != nil {
+		return recentErr
+	}
+	if recent {
+		appContext.Logger.WithField("mail", mail).Info("Password reset requested again too soon, ignoring it")
+		return nil
+	}
+	token, tokenErr := CreateResetToken(appContext, id)
+	if tokenErr != nil {
+		return tokenErr
+	}
+	link := appContext.PasswordReset.BaseURL + "/password/reset/?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(resetMailBody, mail, link, appContext.PasswordReset.Lifespan)
+	go func() {
+		if sendErr := appContext.Mailer.SendMail(recovery, "Reset your mail password", body); sendErr != nil {
+			appContext.Logger.WithError(sendErr).WithField("mail", mail).Error("Can't send password reset mail")
+			return
+		}
+		appContext.Logger.WithField("mail", mail).Info("Sent password reset mail")
+	}()
+	return nil
+}
+
+// resetPassword sets the new password of the user the token belongs to.
+// The password is checked before the token is consumed such that the user can
+// retry with another password.
+func resetPassword(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, token, password string) error {
+	tokenUser, lookupErr := resetTokenUser(appContext, token)
+	if lookupErr == sql.ErrNoRows {
+		appContext.Logger.WithField("remote", r.RemoteAddr).Warn("Password reset with invalid or expired token")
+		http.Error(w, "The reset link is invalid or expired", 400)
+		return nil
+	}
+	if lookupErr != nil {
+		return lookupErr
+	}
+	if pwErr := appContext.PasswordPolicy.Check(password, tokenUser); pwErr != nil {
+		writePasswordError(w, pwErr)
+		return nil
+	}
+	userID, consumeErr := ConsumeResetToken(appContext, token)
+	if consumeErr == sql.ErrNoRows {
+		appContext.Logger.WithField("remote", r.RemoteAddr).Warn("Password reset with invalid or expired token")
+		http.Error(w, "The reset link is invalid or expired", 400)
+		return nil
+	}
+	if consumeErr != nil {
+		return consumeErr
+	}
+	if changeErr := ChangeUserPassword(appContext, userID, password); changeErr != nil {
+		return changeErr
+	}
+	user, domain, nameErr := getUserName(appContext, userID)
+	if nameErr != nil {
+		return nameErr
+	}
+	mail := user + "@" + domain
+	// the user proved access, so forget failed attempts to change the password
+	attemptSucceeded(appContext, LockoutScopeMail, mail)
+	recordAudit(appContext, r, AuditChangePassword, AuditTargetUser, userID, nil, AuditValues{"mail": mail, "reset": true})
+	appContext.Logger.WithFields(log.Fields{
+		"mail":   mail,
+		"remote": r.RemoteAddr,
+	}).Info("Password reset via recovery address")
+	return nil
+}
+
+// PasswordResetHandler handles /password/reset/.
+// GET returns the page to enter the new password (the token is in the query
+// of the link).
+// POST accepts JSON requests of the form {"mail": <mail>} to request a reset
+// link (it always replies with a 200, so it doesn't reveal if the user
+// exists) or {"token": <token>, "password": <new password>} to set the new
+// password.
+// If the password reset is not configured it replies with a 404.
+func PasswordResetHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if !passwordResetEnabled(appcontext) {
+		http.NotFound(w, r)
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for \"/password/reset/\": %s", r.Method), 400)
+		return nil
+	case getMethod:
+		values := map[string]interface{}{
+			csrf.TemplateTag: csrf.TemplateField(r)}
+		return appcontext.Templates["reset-pw"].ExecuteTemplate(w, "layout", values)
+	case postMethod:
+	}
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	var resetData struct {
+		Mail, Token, Password string
+	}
+	if jsonErr := json.Unmarshal(body, &resetData); jsonErr != nil {
+		appcontext.Logger.Info("Invalid request syntax for password reset.")
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	if resetData.Token != "" {
+		return resetPassword(appcontext, w, r, resetData.Token, resetData.Password)
+	}
+	if emailErr := emailValid(resetData.Mail); emailErr != nil {
+		http.Error(w, emailErr.Error(), 400)
+		return nil
+	}
+	return requestPasswordReset(appcontext, r, resetData.Mail)
+}
+
+// BootstrapResetPWTemplate is the template for the password reset page.
+func BootstrapResetPWTemplate() *template.Template {
+	return template.Must(template.ParseFiles("templates/default/base.html", "templates/default/reset_pw.html"))
+}
@@ -0,0 +1,302 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file tests the password reset against a fake SMTP server that
+// listens on localhost.
+
+import (
+	"bufio"
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// smtpMessage is a mail received by the fakeSMTPServer.
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTPServer accepts all mails and writes them to messages. It doesn't
+// support TLS or authentication.
+type fakeSMTPServer struct {
+	listener net.Listener
+	messages chan smtpMessage
+}
+
+// newFakeSMTPServer starts the server, it is closed when the test finishes.
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Can't start fake SMTP server: %s", err)
+	}
+	s := &fakeSMTPServer{listener: listener, messages: make(chan smtpMessage, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// mailer returns a Mailer that sends to the server.
+func (s *fakeSMTPServer) mailer() *Mailer {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return &Mailer{
+		Host:    "127.0.0.1",
+		Port:    addr.Port,
+		From:    "webadmin@example.org",
+		TLS:     SMTPNoTLS,
+		Timeout: 5 * time.Second,
+	}
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+	reply("220 localhost fake SMTP")
+	var msg smtpMessage
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = smtpMessage{from: strings.Trim(line[len("MAIL FROM:"):], "<> ")}
+			reply("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[len("RCPT TO:"):], "<> "))
+			reply("250 OK")
+		case cmd == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data bytes.Buffer
+			for {
+				dataLine, dataErr := reader.ReadString('\n')
+				if dataErr != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(dataLine, "."))
+			}
+			msg.data = data.String()
+			s.messages <- msg
+			reply("250 OK")
+		case cmd == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+// receive waits for the next mail.
+func (s *fakeSMTPServer) receive(t *testing.T) smtpMessage {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No mail received by the fake SMTP server")
+	}
+	return smtpMessage{}
+}
+
+func TestSendMail(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	if err := server.mailer().SendMail("user@example.org", "Hello", "first line\nsecond line"); err != nil {
+		t.Fatalf("Sending mail failed: %s", err)
+	}
+	msg := server.receive(t)
+	if msg.from != "webadmin@example.org" || len(msg.to) != 1 || msg.to[0] != "user@example.org" {
+		t.Errorf("Invalid envelope: from %s to %v", msg.from, msg.to)
+	}
+	parsed, err := mail.ReadMessage(strings.NewReader(msg.data))
+	if err != nil {
+		t.Fatalf("Can't parse mail: %s", err)
+	}
+	if subject := parsed.Header.Get("Subject"); subject != "Hello" {
+		t.Errorf("Expected subject \"Hello\", got \"%s\"", subject)
+	}
+	var body bytes.Buffer
+	body.ReadFrom(parsed.Body)
+	// the SMTP client terminates the data with a line break
+	if body.String() != "first line\r\nsecond line\r\n" {
+		t.Errorf("Invalid body: %q", body.String())
+	}
+}
+
+func TestSendMailInvalidRecipient(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	if err := server.mailer().SendMail("user@example.org\r\nBcc: other@example.org", "Hello", "body"); err == nil {
+		t.Error("Expected recipient with a newline to be rejected")
+	}
+}
+
+// tokenArg matches the hash of a reset token and remembers it.
+type tokenArg struct {
+	hash string
+}
+
+func (a *tokenArg) Match(v driver.Value) bool {
+	hash, ok := v.(string)
+	a.hash = hash
+	return ok
+}
+
+// expectConsume adds the queries of ConsumeResetToken for a token that
+// exists and expires at the given time.
+func expectConsume(mock sqlmock.Sqlmock, token string, userID int64, expires time.Time) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, expires FROM password_resets WHERE token_hash = ?")).
+		WithArgs(hashToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "expires"}).AddRow(userID, expires))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM password_resets WHERE user_id = ?")).
+		WithArgs(userID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestPasswordResetTokenSingleUse(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	appContext, mock := newTestContext(t)
+	appContext.Mailer = server.mailer()
+	appContext.PasswordReset = PasswordResetConfig{BaseURL: "https://mail.example.org", Lifespan: time.Hour}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, password FROM virtual_users")).
+		WithArgs("user@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}).AddRow(42, "{SHA512-CRYPT}"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT recovery_mail FROM recovery_mails")).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}).AddRow("recovery@example.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM password_resets")).
+		WithArgs(42, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	inserted := &tokenArg{}
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO password_resets")).
+		WithArgs(inserted, 42, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req := httptest.NewRequest(postMethod, "/password/reset/", strings.NewReader(`{"mail": "user@example.org"}`))
+	rec := httptest.NewRecorder()
+	if err := PasswordResetHandler(appContext, rec, req); err != nil {
+		t.Fatalf("Requesting the reset failed: %s", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rec.Code)
+	}
+	msg := server.receive(t)
+	if len(msg.to) != 1 || msg.to[0] != "recovery@example.com" {
+		t.Fatalf("Expected the mail to be sent to the recovery address, got %v", msg.to)
+	}
+	match := regexp.MustCompile(`https://mail\.example\.org/password/reset/\?token=(\S+)`).FindStringSubmatch(msg.data)
+	if match == nil {
+		t.Fatalf("No reset link in mail:\n%s", msg.data)
+	}
+	token := match[1]
+	if hashToken(token) != inserted.hash {
+		t.Fatal("The token in the mail is not the one stored in the database")
+	}
+
+	expectConsume(mock, token, 42, time.Now().UTC().Add(time.Hour))
+	userID, err := ConsumeResetToken(appContext, token)
+	if err != nil || userID != 42 {
+		t.Fatalf("Expected token to belong to user 42, got %d and error %v", userID, err)
+	}
+
+	// the token was deleted, so the second use doesn't find it
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, expires FROM password_resets WHERE token_hash = ?")).
+		WithArgs(hashToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "expires"}))
+	mock.ExpectRollback()
+	if _, err := ConsumeResetToken(appContext, token); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a used token, got %v", err)
+	}
+}
+
+func TestPasswordResetTokenExpired(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	token := "expired-token"
+	// the expired token is deleted anyway
+	expectConsume(mock, token, 42, time.Now().UTC().Add(-time.Minute))
+	if _, err := ConsumeResetToken(appContext, token); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for an expired token, got %v", err)
+	}
+}
+
+func TestPasswordResetRequestTooSoon(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	appContext, mock := newTestContext(t)
+	appContext.Mailer = server.mailer()
+	appContext.PasswordReset = PasswordResetConfig{BaseURL: "https://mail.example.org", Lifespan: time.Hour}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, password FROM virtual_users")).
+		WithArgs("user@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "password"}).AddRow(42, "{SHA512-CRYPT}"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT recovery_mail FROM recovery_mails")).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"recovery_mail"}).AddRow("recovery@example.com"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM password_resets")).
+		WithArgs(42, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	req := httptest.NewRequest(postMethod, "/password/reset/", strings.NewReader(`{"mail": "user@example.org"}`))
+	rec := httptest.NewRecorder()
+	if err := PasswordResetHandler(appContext, rec, req); err != nil {
+		t.Fatalf("Requesting the reset failed: %s", err)
+	}
+	select {
+	case msg := <-server.messages:
+		t.Errorf("Expected no mail, got one to %v", msg.to)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -0,0 +1,372 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the role based access control for admin users.
+// Each admin has a role (stored in the table admin_roles), each role grants
+// a set of permissions. Admins without an entry in admin_roles get
+// DefaultRole (read-only access). Admins created before roles existed are
+// made superadmins once by migrateAdminRoles.
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"github.com/FabianWe/goauth"
+	log "github.com/sirupsen/logrus"
+)
+
+// Role is the role of an admin user.
+type Role string
+
+const (
+	// RoleSuperAdmin has all permissions.
+	RoleSuperAdmin Role = "superadmin"
+	// RoleDomainAdmin can manage users and aliases, but not domains or admins.
+	RoleDomainAdmin Role = "domainadmin"
+	// RoleHelpDesk can view everything and reset passwords of mail users.
+	RoleHelpDesk Role = "helpdesk"
+	// RoleReadOnly can only view domains, users and aliases.
+	RoleReadOnly Role = "readonly"
+)
+
+// DefaultRole is the role of admins without an entry in admin_roles and of
+// new admins if no role is given. It grants as little as possible, so a
+// missing entry never gives an admin more rights.
+const DefaultRole = RoleReadOnly
+
+// Permission is an action an admin can be allowed to perform.
+type Permission int
+
+const (
+	// PermissionRead allows to list domains, users and aliases.
+	PermissionRead Permission = iota
+	// PermissionResetPassword allows to change the password of mail users.
+	PermissionResetPassword
+	// PermissionManageUsers allows to add and delete mail users and aliases
+	// (this includes the trash, import and export of mail directories).
+	PermissionManageUsers
+	// PermissionManageDomains allows to add and delete domains.
+	PermissionManageDomains
+	// PermissionManageAdmins allows to add, update and delete admin users.
+	PermissionManageAdmins
+)
+
+// permissionNames are the names of the permissions, used for the scopes of
+// API tokens.
+var permissionNames = map[Permission]string{
+	PermissionRead:          "read",
+	PermissionResetPassword: "reset-password",
+	PermissionManageUsers:   "manage-users",
+	PermissionManageDomains: "manage-domains",
+	PermissionManageAdmins:  "manage-admins",
+}
+
+// String returns the name of the permission.
+func (perm Permission) String() string {
+	if name, has := permissionNames[perm]; has {
+		return name
+	}
+	return fmt.Sprintf("Permission(%d)", int(perm))
+}
+
+// MarshalText encodes the permission as its name.
+func (perm Permission) MarshalText() ([]byte, error) {
+	return []byte(perm.String()), nil
+}
+
+// ParsePermission returns the permission with the given name.
+func ParsePermission(s string) (Permission, error) {
+	for perm, name := range permissionNames {
+		if name == s {
+			return perm, nil
+		}
+	}
+	return -1, fmt.Errorf("Invalid permission \"%s\", must be one of read, reset-password, manage-users, manage-domains or manage-admins", s)
+}
+
+// rolePermissions maps each role to the permissions it grants.
+var rolePermissions = map[Role][]Permission{
+	RoleSuperAdmin:  {PermissionRead, PermissionResetPassword, PermissionManageUsers, PermissionManageDomains, PermissionManageAdmins},
+	RoleDomainAdmin: {PermissionRead, PermissionResetPassword, PermissionManageUsers},
+	RoleHelpDesk:    {PermissionRead, PermissionResetPassword},
+	RoleReadOnly:    {PermissionRead},
+}
+
+// ParseRole returns the role for the given string and an error if it is
+// not a valid role.
+func ParseRole(s string) (Role, error) {
+	role := Role(s)
+	if _, has := rolePermissions[role]; !has {
+		return "", fmt.Errorf("Invalid role \"%s\", must be one of superadmin, domainadmin, helpdesk or readonly", s)
+	}
+	return role, nil
+}
+
+// HasPermission checks if the role grants the permission.
+func (role Role) HasPermission(perm Permission) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAdminRole returns the role of the admin with the given id.
+// If no role is stored DefaultRole is returned, this only happens if storing
+// the role failed (see AddAdmin and migrateAdminRoles).
+func GetAdminRole(appContext *MailAppContext, adminID goauth.UserKeyType) (Role, error) {
+	query := "SELECT role FROM admin_roles WHERE user_id = ?;"
+	var role string
+	switch err := appContext.DB.QueryRow(query, uint64(adminID)).Scan(&role); {
+	case err == sql.ErrNoRows:
+		return DefaultRole, nil
+	case err != nil:
+		return "", err
+	}
+	return ParseRole(role)
+}
+
+// SetAdminRole sets the role of the admin with the given id.
+func SetAdminRole(appContext *MailAppContext, adminID goauth.UserKeyType, role Role) error {
+	query := "INSERT INTO admin_roles (user_id, role) VALUES (?, ?) ON DUPLICATE KEY UPDATE role = VALUES(role);"
+	if _, err := appContext.DB.Exec(query, uint64(adminID), string(role)); err != nil {
+		return err
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"admin-id": adminID,
+		"role":     role,
+	}).Info("Set admin role")
+	return nil
+}
+
+// AddAdmin creates a new admin with the given role. If the role can't be
+// stored the admin is deleted again, so no admin exists without a role.
+func AddAdmin(appContext *MailAppContext, userName string, password []byte, role Role) (goauth.UserKeyType, error) {
+	adminID, insertErr := appContext.UserHandler.Insert(userName, "", "", "", password)
+	if insertErr != nil {
+		return goauth.NoUserID, insertErr
+	}
+	if roleErr := SetAdminRole(appContext, adminID, role); roleErr != nil {
+		if delErr := appContext.UserHandler.DeleteUser(userName); delErr != nil {
+			appContext.Logger.WithError(delErr).WithField("admin-user", userName).Error("Can't delete new admin after setting its role failed")
+		}
+		return goauth.NoUserID, roleErr
+	}
+	return adminID, nil
+}
+
+// DeleteAdminRole removes the role entry for the admin with the given id,
+// this is called when an admin is deleted.
+func DeleteAdminRole(appContext *MailAppContext, adminID goauth.UserKeyType) error {
+	_, err := appContext.DB.Exec("DELETE FROM admin_roles WHERE user_id = ?;", uint64(adminID))
+	return err
+}
+
+// ListAdminRoles returns all stored roles in the form admin id --> role.
+// Admins without an entry have DefaultRole.
+func ListAdminRoles(appContext *MailAppContext) (map[goauth.UserKeyType]Role, error) {
+	rows, err := appContext.DB.Query("SELECT user_id, role FROM admin_roles;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[goauth.UserKeyType]Role)
+	for rows.Next() {
+		var id uint64
+		var role string
+		if scanErr := rows.Scan(&id, &role); scanErr != nil {
+			return nil, scanErr
+		}
+		res[goauth.UserKeyType(id)] = Role(role)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// contextKey is the type for keys of values stored in the request context.
+type contextKey int
+
+const (
+	// adminIDKey is the key for the id of the logged in admin.
+	adminIDKey contextKey = iota
+	// adminRoleKey is the key for the role of the logged in admin.
+	adminRoleKey
+	// apiTokenKey is the key for the id of the API token used to
+	// authenticate the request.
+	apiTokenKey
+	// portalUserKey is the key for the mail user logged in to the portal.
+	portalUserKey
+)
+
+// AdminFromRequest returns the id and role of the logged in admin, ok is
+// false if the request didn't pass RoleRequired.
+func AdminFromRequest(r *http.Request) (adminID goauth.UserKeyType, role Role, ok bool) {
+	adminID, ok = r.Context().Value(adminIDKey).(goauth.UserKeyType)
+	if !ok {
+		return goauth.NoUserID, "", false
+	}
+	role, ok = r.Context().Value(adminRoleKey).(Role)
+	return
+}
+
+// PermissionFunc returns the permission required for a request.
+type PermissionFunc func(r *http.Request) Permission
+
+// RequirePermission returns a PermissionFunc that always requires perm.
+func RequirePermission(perm Permission) PermissionFunc {
+	return func(r *http.Request) Permission {
+		return perm
+	}
+}
+
+// RoleRequired is the permission-aware variant of LoginRequired.
+// It first checks the login as LoginRequired does, then looks up the role
+// of the admin and checks if it grants the permission returned by perm.
+// If not it replies with a 403 Forbidden.
+// Requests with a bearer token are authenticated with the token only (see
+// APIToken), the scopes of the token must include the permission as well.
+// The id and role of the admin are stored in the request context, see
+// AdminFromRequest.
+func RoleRequired(perm PermissionFunc, f AppHandleFunc) AppHandleFunc {
+	return func(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+		var adminID goauth.UserKeyType
+		var token *APIToken
+		var tokenID int64
+		if bearer, isBearer := bearerToken(r); isBearer {
+			var ok bool
+			var err error
+			tokenID, token, ok, err = authenticateToken(appcontext, w, r, bearer)
+			if err != nil || !ok {
+				return err
+			}
+			adminID = token.AdminID
+		} else {
+			var ok bool
+			var err error
+			adminID, ok, err = validateLogin(appcontext, w, r)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		role, roleErr := GetAdminRole(appcontext, adminID)
+		if roleErr != nil {
+			return roleErr
+		}
+		required := perm(r)
+		if !role.HasPermission(required) || (token != nil && !token.HasScope(required)) {
+			appcontext.Logger.WithFields(log.Fields{
+				"admin-id": adminID,
+				"role":     role,
+				"url":      r.URL.Path,
+				"method":   r.Method,
+			}).Warn("Admin lacks permission for request")
+			http.Error(w, "Forbidden", 403)
+			return nil
+		}
+		ctx := context.WithValue(r.Context(), adminIDKey, adminID)
+		ctx = context.WithValue(ctx, adminRoleKey, role)
+		if token != nil {
+			ctx = context.WithValue(ctx, apiTokenKey, tokenID)
+		}
+		return f(appcontext, w, r.WithContext(ctx))
+	}
+}
+
+// readOrManage returns a PermissionFunc that requires PermissionRead for GET
+// requests and manage for all other requests.
+func readOrManage(manage Permission) PermissionFunc {
+	return func(r *http.Request) Permission {
+		if r.Method == getMethod {
+			return PermissionRead
+		}
+		return manage
+	}
+}
+
+// DomainsPermission is the PermissionFunc for /api/domains/.
+var DomainsPermission = readOrManage(PermissionManageDomains)
+
+// AliasesPermission is the PermissionFunc for /api/aliases/.
+var AliasesPermission = readOrManage(PermissionManageUsers)
+
+// TrashPermission is the PermissionFunc for /api/trash/.
+var TrashPermission = readOrManage(PermissionManageUsers)
+
+// PasswordExpiryPermission is the PermissionFunc for /api/password-expiry/.
+var PasswordExpiryPermission = readOrManage(PermissionManageUsers)
+
+// AdminsPermission is the PermissionFunc for /api/admins/.
+var AdminsPermission = RequirePermission(PermissionManageAdmins)
+
+// AuditPermission is the PermissionFunc for /api/audit/.
+var AuditPermission = RequirePermission(PermissionManageAdmins)
+
+// LockoutsPermission is the PermissionFunc for /api/lockouts/.
+var LockoutsPermission = RequirePermission(PermissionManageAdmins)
+
+// ImportPermission is the PermissionFunc for /api/import.
+var ImportPermission = RequirePermission(PermissionManageUsers)
+
+// OpenAPIPermission is the PermissionFunc for /api/openapi.json, all admins
+// can read the API description.
+var OpenAPIPermission = RequirePermission(PermissionRead)
+
+// TokensPermission is the PermissionFunc for /api/tokens/, all admins can
+// manage their own tokens.
+// API tokens can only read it, see rejectTokenWrite.
+var TokensPermission = RequirePermission(PermissionRead)
+
+// SessionsPermission is the PermissionFunc for /api/sessions/, all admins
+// can manage their own sessions.
+// API tokens can only read it, see rejectTokenWrite.
+var SessionsPermission = RequirePermission(PermissionRead)
+
+// TwoFactorPermission is the PermissionFunc for /api/2fa/, all admins can
+// manage their own two-factor authentication.
+// API tokens can only read it, see rejectTokenWrite.
+var TwoFactorPermission = RequirePermission(PermissionRead)
+
+// UsersPermission is the PermissionFunc for /api/users.
+// Listing requires PermissionRead, changing a password requires
+// PermissionResetPassword and everything else (including export and import
+// of mail directories) PermissionManageUsers.
+func UsersPermission(r *http.Request) Permission {
+	if _, exportErr := parseExportUserURL(r.URL.Path); exportErr == nil {
+		return PermissionManageUsers
+	}
+	switch r.Method {
+	case getMethod:
+		return PermissionRead
+	case updateMethod:
+		return PermissionResetPassword
+	default:
+		return PermissionManageUsers
+	}
+}
@@ -0,0 +1,80 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"net/http"
+)
+
+// apiRoute is a route below /api/, see RegisterAPIRoutes.
+type apiRoute struct {
+	// Pattern is the pattern of the route in the http.ServeMux.
+	Pattern string
+	// Permission is the PermissionFunc passed to RoleRequired. The routes of
+	// the user portal have no Permission, they're wrapped by
+	// PortalLoginRequired instead.
+	Permission PermissionFunc
+	Handler    AppHandleFunc
+	// V2 is true for /api/v2/, the handler is wrapped by APIErrors as well.
+	V2 bool
+}
+
+// apiRoutes are all routes below /api/. Each operation of the routes must be
+// described in apiOperations, openapi_test.go checks that both match.
+var apiRoutes = []apiRoute{
+	{Pattern: "/api/domains/", Permission: DomainsPermission, Handler: ListDomainsJSON},
+	// really annoying, but I see no other way around this...
+	// we want both /users and /users/
+	{Pattern: "/api/users", Permission: UsersPermission, Handler: ListUsersJSON},
+	{Pattern: "/api/users/", Permission: UsersPermission, Handler: ListUsersJSON},
+	{Pattern: "/api/trash/", Permission: TrashPermission, Handler: ListTrashJSON},
+	{Pattern: "/api/aliases/", Permission: AliasesPermission, Handler: ListAliasesJSON},
+	{Pattern: "/api/admins/", Permission: AdminsPermission, Handler: ListAdminsJSON},
+	{Pattern: "/api/audit/", Permission: AuditPermission, Handler: ListAuditJSON},
+	{Pattern: "/api/import", Permission: ImportPermission, Handler: ImportCSVJSON},
+	{Pattern: "/api/openapi.json", Permission: OpenAPIPermission, Handler: OpenAPIJSON},
+	{Pattern: "/api/v2/", Permission: APIv2Permission, Handler: APIv2, V2: true},
+	{Pattern: "/api/password-expiry/", Permission: PasswordExpiryPermission, Handler: PasswordExpiryJSON},
+	{Pattern: "/api/lockouts/", Permission: LockoutsPermission, Handler: ListLockoutsJSON},
+	{Pattern: "/api/tokens/", Permission: TokensPermission, Handler: ListTokensJSON},
+	{Pattern: "/api/sessions/", Permission: SessionsPermission, Handler: ListSessionsJSON},
+	{Pattern: "/api/2fa/", Permission: TwoFactorPermission, Handler: TwoFactorJSON},
+	{Pattern: "/api/portal/", Handler: PortalJSON},
+	{Pattern: "/api/portal/aliases/", Handler: PortalAliasesJSON},
+}
+
+// RegisterAPIRoutes registers the handlers of all routes below /api/ on mux.
+func RegisterAPIRoutes(appContext *MailAppContext, mux *http.ServeMux) {
+	for _, route := range apiRoutes {
+		var handler AppHandleFunc
+		switch {
+		case route.Permission == nil:
+			handler = PortalLoginRequired(route.Handler)
+		case route.V2:
+			handler = APIErrors(RoleRequired(route.Permission, route.Handler))
+		default:
+			handler = RoleRequired(route.Permission, route.Handler)
+		}
+		mux.Handle(route.Pattern, NewMailAppHandler(appContext, handler))
+	}
+}
@@ -0,0 +1,307 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the tables used by mailwebadmin itself (the mail tables
+// virtual_domains, virtual_users and virtual_aliases are created by the
+// mailserver setup, see docker-entrypoint-initdb.d/mail.sql).
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// mailwebadminTables contains the create statements for all tables
+// mailwebadmin requires. They're executed by initTables.
+var mailwebadminTables = []string{
+	// trash_users stores mail users that were deleted but not purged yet, see
+	// SoftDeleteMailUser
+	`CREATE TABLE IF NOT EXISTS trash_users (
+		id INT NOT NULL,
+		domain_id INT NOT NULL,
+		email VARCHAR(100) NOT NULL,
+		password VARCHAR(150) NOT NULL,
+		trash_path VARCHAR(255) NOT NULL,
+		deleted DATETIME NOT NULL,
+		PRIMARY KEY(id)
+	);`,
+	// admin_roles stores the role of each admin user, see GetAdminRole
+	`CREATE TABLE IF NOT EXISTS admin_roles (
+		user_id BIGINT UNSIGNED NOT NULL,
+		role VARCHAR(20) NOT NULL,
+		PRIMARY KEY(user_id)
+	);`,
+	// admin_domains stores the domains assigned to admins, see
+	// GetAdminDomains
+	`CREATE TABLE IF NOT EXISTS admin_domains (
+		user_id BIGINT UNSIGNED NOT NULL,
+		domain_id INT NOT NULL,
+		PRIMARY KEY(user_id, domain_id),
+		FOREIGN KEY (domain_id) REFERENCES virtual_domains(id) ON DELETE CASCADE
+	);`,
+	// admin_oidc_subjects binds admins to the subject of their SSO identity,
+	// see oidcAdmin
+	`CREATE TABLE IF NOT EXISTS admin_oidc_subjects (
+		user_id BIGINT UNSIGNED NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		PRIMARY KEY(user_id),
+		UNIQUE KEY(subject)
+	);`,
+	// audit_log stores all changes made by admins, see AddAuditEntry
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		admin_id BIGINT UNSIGNED NOT NULL,
+		operation VARCHAR(30) NOT NULL,
+		target_type VARCHAR(20) NOT NULL,
+		target_id BIGINT NOT NULL,
+		old_value TEXT,
+		new_value TEXT,
+		created DATETIME NOT NULL,
+		remote_addr VARCHAR(64) NOT NULL,
+		PRIMARY KEY(id),
+		INDEX(created),
+		INDEX(admin_id)
+	);`,
+	// admin_totp stores the TOTP secrets of admins, see StartTOTPEnrollment
+	`CREATE TABLE IF NOT EXISTS admin_totp (
+		user_id BIGINT UNSIGNED NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		last_step BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id)
+	);`,
+	// admin_recovery_codes stores the hashes of unused recovery codes
+	`CREATE TABLE IF NOT EXISTS admin_recovery_codes (
+		user_id BIGINT UNSIGNED NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		PRIMARY KEY(user_id, code_hash)
+	);`,
+	// login_failures stores failed login attempts, see RecordFailure
+	`CREATE TABLE IF NOT EXISTS login_failures (
+		scope VARCHAR(16) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		failures INT NOT NULL,
+		last_failure DATETIME NOT NULL,
+		locked_until DATETIME,
+		PRIMARY KEY(scope, subject)
+	);`,
+	// api_tokens stores the API tokens of admins, see CreateAPIToken
+	`CREATE TABLE IF NOT EXISTS api_tokens (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		user_id BIGINT UNSIGNED NOT NULL,
+		name VARCHAR(100) NOT NULL,
+		token_hash CHAR(64) NOT NULL,
+		scopes VARCHAR(255) NOT NULL,
+		created DATETIME NOT NULL,
+		expires DATETIME NOT NULL,
+		last_used DATETIME,
+		PRIMARY KEY(id),
+		UNIQUE KEY(token_hash),
+		INDEX(user_id)
+	);`,
+	// admin_sessions stores information about the auth sessions of admins,
+	// see TrackSession
+	`CREATE TABLE IF NOT EXISTS admin_sessions (
+		id BIGINT NOT NULL AUTO_INCREMENT,
+		user_id BIGINT UNSIGNED NOT NULL,
+		session_key VARCHAR(255) NOT NULL,
+		created DATETIME NOT NULL,
+		last_seen DATETIME NOT NULL,
+		expires DATETIME NOT NULL,
+		remote_addr VARCHAR(255) NOT NULL,
+		user_agent VARCHAR(255) NOT NULL,
+		PRIMARY KEY(id),
+		UNIQUE KEY(session_key),
+		INDEX(user_id)
+	);`,
+	// recovery_mails stores the recovery addresses of mail users, see
+	// SetRecoveryMail
+	`CREATE TABLE IF NOT EXISTS recovery_mails (
+		user_id INT NOT NULL,
+		recovery_mail VARCHAR(100) NOT NULL,
+		PRIMARY KEY(user_id),
+		FOREIGN KEY (user_id) REFERENCES virtual_users(id) ON DELETE CASCADE
+	);`,
+	// password_resets stores the hashes of password reset tokens, see
+	// CreateResetToken
+	`CREATE TABLE IF NOT EXISTS password_resets (
+		token_hash CHAR(64) NOT NULL,
+		user_id INT NOT NULL,
+		created DATETIME NOT NULL,
+		expires DATETIME NOT NULL,
+		PRIMARY KEY(token_hash),
+		INDEX(user_id),
+		FOREIGN KEY (user_id) REFERENCES virtual_users(id) ON DELETE CASCADE
+	);`,
+	`CREATE TABLE IF NOT EXISTS domain_password_expiry (
+		domain_id INT NOT NULL,
+		max_age_days INT NOT NULL,
+		enforce BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY(domain_id),
+		FOREIGN KEY (domain_id) REFERENCES virtual_domains(id) ON DELETE CASCADE
+	);`,
+}
+
+// columnMigration describes a column mailwebadmin adds to an existing table.
+// If the column doesn't exist it is added with the definition and then init
+// (if not empty) is executed to fill the column for existing rows.
+type columnMigration struct {
+	table, column, definition, init string
+}
+
+// mailwebadminColumns are the columns added to the mail tables, new setups
+// already get them from docker-entrypoint-initdb.d/mail.sql.
+var mailwebadminColumns = []columnMigration{
+	{"virtual_users", "password_set", "DATETIME NULL",
+		"UPDATE virtual_users SET password_set = UTC_TIMESTAMP() WHERE password_set IS NULL;"},
+	{"virtual_users", "password_expired", "BOOLEAN NOT NULL DEFAULT FALSE", ""},
+}
+
+// initTables creates all tables from mailwebadminTables if they don't exist
+// and adds the columns from mailwebadminColumns.
+// If admin_roles gets created the existing admins become superadmins, see
+// migrateAdminRoles.
+func initTables(appContext *MailAppContext) error {
+	rolesExist, existsErr := tableExists(appContext, "admin_roles")
+	if existsErr != nil {
+		return existsErr
+	}
+	for _, query := range mailwebadminTables {
+		if _, err := appContext.DB.Exec(query); err != nil {
+			return err
+		}
+	}
+	if !rolesExist {
+		if err := migrateAdminRoles(appContext); err != nil {
+			return err
+		}
+	}
+	for _, migration := range mailwebadminColumns {
+		if err := addColumnIfNotExists(appContext, migration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tableExists checks if the table exists in the current database.
+func tableExists(appContext *MailAppContext, table string) (bool, error) {
+	var num int
+	query := `SELECT COUNT(*) FROM information_schema.TABLES
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?;`
+	if err := appContext.DB.QueryRow(query, table).Scan(&num); err != nil {
+		return false, err
+	}
+	return num > 0, nil
+}
+
+// migrateAdminRoles is called after admin_roles was created. Admins that
+// existed before had all permissions, so they become superadmins. After that
+// every admin has an entry, admins without one only get DefaultRole.
+// If the migration fails admin_roles is dropped again, so it is retried on
+// the next start.
+func migrateAdminRoles(appContext *MailAppContext) error {
+	admins, err := appContext.UserHandler.ListUsers()
+	if err == nil {
+		for adminID := range admins {
+			if err = SetAdminRole(appContext, adminID, RoleSuperAdmin); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if _, dropErr := appContext.DB.Exec("DROP TABLE admin_roles;"); dropErr != nil {
+			appContext.Logger.WithError(dropErr).Error("Can't drop admin_roles after migrating the roles failed")
+		}
+		return err
+	}
+	appContext.Logger.WithField("admins", len(admins)).Info("Existing admins are now superadmins")
+	return nil
+}
+
+// addColumnIfNotExists applies the migration if the column doesn't exist.
+func addColumnIfNotExists(appContext *MailAppContext, migration columnMigration) error {
+	var num int
+	query := `SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?;`
+	if err := appContext.DB.QueryRow(query, migration.table, migration.column).Scan(&num); err != nil {
+		return err
+	}
+	if num > 0 {
+		return nil
+	}
+	alter := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", migration.table, migration.column, migration.definition)
+	if _, err := appContext.DB.Exec(alter); err != nil {
+		return err
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"table":  migration.table,
+		"column": migration.column,
+	}).Info("Added column")
+	if migration.init != "" {
+		if _, err := appContext.DB.Exec(migration.init); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlDateTimeLayout is the layout of DATETIME columns.
+const sqlDateTimeLayout = "2006-01-02 15:04:05"
+
+// sqlTime is a time that can be scanned from a DATETIME column, it works
+// regardless of whether the connection was opened with parseTime or not.
+// All times are stored in UTC.
+type sqlTime struct {
+	time.Time
+}
+
+// Scan implements the sql.Scanner interface.
+func (t *sqlTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+		return nil
+	case time.Time:
+		t.Time = v
+		return nil
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	default:
+		return fmt.Errorf("Can't scan %T into a time", value)
+	}
+}
+
+// parse parses a DATETIME string.
+func (t *sqlTime) parse(s string) error {
+	parsed, err := time.ParseInLocation(sqlDateTimeLayout, s, time.UTC)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
@@ -0,0 +1,342 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the management of active admin sessions. goauth stores
+// the session keys but nothing else about them, so for each key we also keep
+// an entry in admin_sessions with the time of the login, the time the session
+// was last seen and the remote address and user agent of the last request.
+// The key itself is stored as well (goauth stores it in the same way) because
+// revoking a session requires it, it is never sent to clients.
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxUserAgentLength is the maximal length of a stored user agent, longer
+// ones are truncated.
+const maxUserAgentLength = 255
+
+// AdminSession is the information about an active session of an admin.
+type AdminSession struct {
+	AdminID    goauth.UserKeyType `json:"admin-id"`
+	Created    time.Time          `json:"created"`
+	LastSeen   time.Time          `json:"last-seen"`
+	Expires    time.Time          `json:"expires"`
+	RemoteAddr string             `json:"remote-addr"`
+	UserAgent  string             `json:"user-agent"`
+	// Current is true for the session that made the request.
+	Current bool `json:"current"`
+}
+
+// TrackSession stores the information about the session with the given key
+// or, if it exists already, updates the last seen time, remote address and
+// user agent. It is called on login and for each request with a session.
+func TrackSession(appContext *MailAppContext, r *http.Request, key string, keyData *goauth.SessionKeyData) error {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	query := `INSERT INTO admin_sessions (user_id, session_key, created, last_seen, expires, remote_addr, user_agent)
+	VALUES (?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE last_seen = VALUES(last_seen), expires = VALUES(expires),
+	remote_addr = VALUES(remote_addr), user_agent = VALUES(user_agent);`
+	_, err := appContext.DB.Exec(query, uint64(keyData.User), key, keyData.CreationTime.UTC(),
+		time.Now().UTC(), keyData.ValidUntil.UTC(), remoteHost(r), userAgent)
+	return err
+}
+
+// trackRequestSession calls TrackSession for the session of the request,
+// errors are only logged.
+func trackRequestSession(appcontext *MailAppContext, r *http.Request, keyData *goauth.SessionKeyData) {
+	key, ok := currentSessionKey(appcontext, r)
+	if !ok {
+		return
+	}
+	if err := TrackSession(appcontext, r, key, keyData); err != nil {
+		appcontext.Logger.WithError(err).WithField("admin-id", keyData.User).Warn("Can't update information about admin session")
+	}
+}
+
+// currentSessionKey returns the session key of the request, ok is false if
+// the request has no auth session.
+func currentSessionKey(appcontext *MailAppContext, r *http.Request) (key string, ok bool) {
+	session, sessionErr := appcontext.SessionController.GetSession(r, appcontext.Store)
+	if sessionErr != nil {
+		return "", false
+	}
+	key, keyErr := appcontext.SessionController.GetKey(session)
+	if keyErr != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// scanAdminSession scans a row of the form
+// id, user_id, session_key, created, last_seen, expires, remote_addr, user_agent.
+func scanAdminSession(scanner interface {
+	Scan(dest ...interface{}) error
+}) (int64, string, *AdminSession, error) {
+	var id int64
+	var adminID uint64
+	var key string
+	var created, lastSeen, expires sqlTime
+	res := &AdminSession{}
+	if err := scanner.Scan(&id, &adminID, &key, &created, &lastSeen, &expires, &res.RemoteAddr, &res.UserAgent); err != nil {
+		return -1, "", nil, err
+	}
+	res.AdminID = goauth.UserKeyType(adminID)
+	res.Created = created.Time
+	res.LastSeen = lastSeen.Time
+	res.Expires = expires.Time
+	return id, key, res, nil
+}
+
+// getAdminSession returns the key and information of the session with the
+// given id. It returns sql.ErrNoRows if there is no such session or it
+// is expired.
+func getAdminSession(appContext *MailAppContext, sessionID int64) (string, *AdminSession, error) {
+	query := `SELECT id, user_id, session_key, created, last_seen, expires, remote_addr, user_agent
+	FROM admin_sessions WHERE id = ? AND expires > ?;`
+	_, key, res, err := scanAdminSession(appContext.DB.QueryRow(query, sessionID, time.Now().UTC()))
+	return key, res, err
+}
+
+// ListAdminSessions returns the active sessions of the admin in the form
+// id --> AdminSession. The session with the key current is marked as
+// current.
+func ListAdminSessions(appContext *MailAppContext, adminID goauth.UserKeyType, current string) (map[int64]*AdminSession, error) {
+	query := `SELECT id, user_id, session_key, created, last_seen, expires, remote_addr, user_agent
+	FROM admin_sessions WHERE user_id = ? AND expires > ?;`
+	rows, err := appContext.DB.Query(query, uint64(adminID), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int64]*AdminSession)
+	for rows.Next() {
+		id, key, session, scanErr := scanAdminSession(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		session.Current = current != "" && key == current
+		res[id] = session
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RevokeSession ends the session with the given id and key, the admin has to
+// login again.
+func RevokeSession(appContext *MailAppContext, sessionID int64, key string) error {
+	if err := appContext.SessionController.DeleteKey(key); err != nil && err != goauth.ErrKeyNotFound {
+		return err
+	}
+	if _, err := appContext.DB.Exec("DELETE FROM admin_sessions WHERE id = ?;", sessionID); err != nil {
+		return err
+	}
+	appContext.Logger.WithField("session-id", sessionID).Info("Revoked admin session")
+	return nil
+}
+
+// RevokeOtherSessions ends all sessions of the admin except the one with the
+// key current (all sessions if current is empty). It returns the number of
+// revoked sessions.
+func RevokeOtherSessions(appContext *MailAppContext, adminID goauth.UserKeyType, current string) (int, error) {
+	rows, err := appContext.DB.Query("SELECT id, session_key FROM admin_sessions WHERE user_id = ?;", uint64(adminID))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	keys := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var key string
+		if scanErr := rows.Scan(&id, &key); scanErr != nil {
+			return 0, scanErr
+		}
+		if key != current {
+			keys[id] = key
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	num := 0
+	for id, key := range keys {
+		if revokeErr := RevokeSession(appContext, id, key); revokeErr != nil {
+			return num, revokeErr
+		}
+		num++
+	}
+	return num, nil
+}
+
+// deleteSessionByKey removes the information about the session with the
+// given key, this is called on logout.
+func deleteSessionByKey(appContext *MailAppContext, key string) error {
+	_, err := appContext.DB.Exec("DELETE FROM admin_sessions WHERE session_key = ?;", key)
+	return err
+}
+
+// DeleteSessionsForAdmin removes the information about all sessions of the
+// admin, this is called together with DeleteEntriesForUser of the session
+// controller.
+func DeleteSessionsForAdmin(appContext *MailAppContext, adminID goauth.UserKeyType) error {
+	_, err := appContext.DB.Exec("DELETE FROM admin_sessions WHERE user_id = ?;", uint64(adminID))
+	return err
+}
+
+// DeleteExpiredSessions removes the information about all expired sessions.
+func DeleteExpiredSessions(appContext *MailAppContext) (int64, error) {
+	res, err := appContext.DB.Exec("DELETE FROM admin_sessions WHERE expires <= ?;", time.Now().UTC())
+	if err != nil {
+		return -1, err
+	}
+	return res.RowsAffected()
+}
+
+// DeleteExpiredSessionsDaemon runs DeleteExpiredSessions every sleep
+// duration. It runs in a new goroutine until something is written to stop.
+func DeleteExpiredSessionsDaemon(appContext *MailAppContext, sleep time.Duration, stop chan bool) {
+	ticker := time.NewTicker(sleep)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if num, err := DeleteExpiredSessions(appContext); err != nil {
+					appContext.Logger.WithError(err).Error("Error deleting expired admin sessions")
+				} else if num > 0 {
+					appContext.Logger.WithField("num-deleted", num).Info("Deleted expired admin sessions")
+				}
+			case <-stop:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// listSessionsRegex matches /api/sessions/<id>.
+var listSessionsRegex = regexp.MustCompile(`^/api/sessions/((\d+)/?)?$`)
+
+// parseListSessionsURL returns the id from the url.
+func parseListSessionsURL(url string) (int64, error) {
+	if url == "/api/sessions/" || url == "/api/sessions" {
+		return -1, errNoID
+	}
+	return parseIDFromURL(listSessionsRegex, url)
+}
+
+// ListSessionsJSON is the main handler for /api/sessions.
+// GET returns the active sessions of the admin in the form
+// {<session-id>: <AdminSession>}, DELETE /api/sessions/<id> revokes a single
+// session and DELETE /api/sessions/ revokes all sessions except the one that
+// made the request. Requests authenticated with an API token can only use
+// GET, see rejectTokenWrite.
+func ListSessionsJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	sessionID, parseErr := parseListSessionsURL(r.URL.Path)
+	if parseErr != nil && parseErr != errNoID {
+		http.NotFound(w, r)
+		return nil
+	}
+	adminID, _, ok := AdminFromRequest(r)
+	if !ok {
+		http.Error(w, "Forbidden", 403)
+		return nil
+	}
+	if rejectTokenWrite(w, r) {
+		return nil
+	}
+	// requests with an API token have no current session
+	current := ""
+	if _, isToken := APITokenFromRequest(r); !isToken {
+		current, _ = currentSessionKey(appcontext, r)
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/sessions/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		if sessionID >= 0 {
+			http.Error(w, "Invalid GET request. Must be GET /api/sessions/", 400)
+			return nil
+		}
+		res, err := ListAdminSessions(appcontext, adminID, current)
+		if err != nil {
+			return err
+		}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		// create json encoding
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case deleteMethod:
+		if sessionID < 0 {
+			num, err := RevokeOtherSessions(appcontext, adminID, current)
+			if err != nil {
+				return err
+			}
+			appcontext.Logger.WithFields(log.Fields{
+				"admin-id":    adminID,
+				"num-revoked": num,
+			}).Info("Revoked other sessions of admin")
+			if num > 0 {
+				recordAudit(appcontext, r, AuditRevokeSession, AuditTargetSession, 0,
+					AuditValues{"admin-id": adminID, "num-revoked": num}, nil)
+			}
+			return nil
+		}
+		key, session, err := getAdminSession(appcontext, sessionID)
+		if err == sql.ErrNoRows || (err == nil && session.AdminID != adminID) {
+			http.NotFound(w, r)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if revokeErr := RevokeSession(appcontext, sessionID, key); revokeErr != nil {
+			return revokeErr
+		}
+		recordAudit(appcontext, r, AuditRevokeSession, AuditTargetSession, sessionID,
+			AuditValues{"admin-id": adminID, "remote-addr": session.RemoteAddr, "user-agent": session.UserAgent}, nil)
+		return nil
+	}
+}
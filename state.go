@@ -0,0 +1,680 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the export of the whole configuration (domains, users,
+// aliases and admins) and the declarative apply of such an export: The file
+// describes the desired state, PlanState computes the changes required to get
+// from the state in the database to the desired state and ApplyStatePlan
+// performs them.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FabianWe/goauth"
+	"gopkg.in/yaml.v2"
+)
+
+// MailState describes the whole configuration, it can be stored as YAML or
+// JSON.
+type MailState struct {
+	Domains []*DomainState `json:"domains" yaml:"domains"`
+	// Admins is nil if the file doesn't contain an admins entry, in this case
+	// the admins are not changed by ApplyStatePlan.
+	Admins []*AdminState `json:"admins,omitempty" yaml:"admins,omitempty"`
+}
+
+// DomainState is a domain together with its users and aliases. Like
+// MailState.Admins, Users and Aliases are nil if the entry is missing (or
+// null), in this case the users or aliases of the domain are not changed by
+// ApplyStatePlan. An empty list deletes all of them.
+type DomainState struct {
+	Name    string        `json:"name" yaml:"name"`
+	Users   []*UserState  `json:"users" yaml:"users"`
+	Aliases []*AliasState `json:"aliases" yaml:"aliases"`
+}
+
+// UserState is a mail user, the password is stored as hash.
+type UserState struct {
+	Email        string `json:"email" yaml:"email"`
+	PasswordHash string `json:"password-hash" yaml:"password-hash"`
+}
+
+// AliasState is an alias, the source may be a catch all alias (@domain).
+type AliasState struct {
+	Source      string `json:"source" yaml:"source"`
+	Destination string `json:"destination" yaml:"destination"`
+}
+
+// AdminState is an admin with its role and the names of the domains assigned
+// to it. Admin passwords are not part of the state, so admins can't be
+// created by ApplyStatePlan.
+type AdminState struct {
+	Username string   `json:"username" yaml:"username"`
+	Role     Role     `json:"role" yaml:"role"`
+	Domains  []string `json:"domains" yaml:"domains"`
+}
+
+// State formats supported by WriteMailState and ReadMailState.
+const (
+	StateFormatYAML = "yaml"
+	StateFormatJSON = "json"
+)
+
+// StateFormatFromPath returns the state format for a file name, files ending
+// with .json are JSON, all other files YAML.
+func StateFormatFromPath(path string) string {
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		return StateFormatJSON
+	}
+	return StateFormatYAML
+}
+
+// WriteMailState writes the state in the given format.
+func WriteMailState(state *MailState, format string, w io.Writer) error {
+	switch format {
+	case StateFormatJSON:
+		enc, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(enc, '\n'))
+		return err
+	case StateFormatYAML:
+		enc, err := yaml.Marshal(state)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(enc)
+		return err
+	default:
+		return fmt.Errorf("Invalid state format \"%s\", must be yaml or json", format)
+	}
+}
+
+// ReadMailState reads a state in the given format.
+func ReadMailState(r io.Reader, format string) (*MailState, error) {
+	data, readErr := ioutil.ReadAll(r)
+	if readErr != nil {
+		return nil, readErr
+	}
+	var res MailState
+	switch format {
+	case StateFormatJSON:
+		if err := json.Unmarshal(data, &res); err != nil {
+			return nil, err
+		}
+	case StateFormatYAML:
+		if err := yaml.UnmarshalStrict(data, &res); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("Invalid state format \"%s\", must be yaml or json", format)
+	}
+	return &res, nil
+}
+
+// stateUser is a user as stored in the database.
+type stateUser struct {
+	id       int64
+	domainID int64
+	email    string
+	password string
+}
+
+// dbState is the state in the database together with the ids of all
+// entries. All map keys are in lower case, as the database compares names
+// case insensitive.
+type dbState struct {
+	domainIDs   map[string]int64
+	domainNames map[int64]string
+	users       map[string]*stateUser
+	aliases     map[string]int64
+	aliasValues map[int64]*Alias
+	admins      map[string]goauth.UserKeyType
+	adminInfos  map[goauth.UserKeyType]*AdminInfo
+}
+
+// aliasKey is the key of an alias in dbState.aliases.
+func aliasKey(source, destination string) string {
+	return strings.ToLower(source) + " " + strings.ToLower(destination)
+}
+
+// loadDBState reads all domains, users and aliases from the database. The
+// admins are only loaded if withAdmins is true.
+func loadDBState(appContext *MailAppContext, withAdmins bool) (*dbState, error) {
+	res := &dbState{
+		domainIDs:  make(map[string]int64),
+		users:      make(map[string]*stateUser),
+		aliases:    make(map[string]int64),
+		admins:     make(map[string]goauth.UserKeyType),
+		adminInfos: make(map[goauth.UserKeyType]*AdminInfo),
+	}
+	domains, domainsErr := ListVirtualDomains(appContext)
+	if domainsErr != nil {
+		return nil, domainsErr
+	}
+	res.domainNames = domains
+	for id, name := range domains {
+		res.domainIDs[strings.ToLower(name)] = id
+	}
+	query := "SELECT id, domain_id, email, password FROM virtual_users;"
+	rows, queryErr := appContext.DB.Query(query)
+	if queryErr != nil {
+		return nil, queryErr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user stateUser
+		if scanErr := rows.Scan(&user.id, &user.domainID, &user.email, &user.password); scanErr != nil {
+			return nil, scanErr
+		}
+		res.users[strings.ToLower(user.email)] = &user
+	}
+	if rowsErr := rows.Err(); rowsErr != nil {
+		return nil, rowsErr
+	}
+	aliases, aliasesErr := ListVirtualAliases(appContext, -1)
+	if aliasesErr != nil {
+		return nil, aliasesErr
+	}
+	res.aliasValues = aliases
+	for id, alias := range aliases {
+		res.aliases[aliasKey(alias.Source, alias.Dest)] = id
+	}
+	if withAdmins {
+		admins, adminsErr := listAdmins(appContext)
+		if adminsErr != nil {
+			return nil, adminsErr
+		}
+		res.adminInfos = admins
+		for id, info := range admins {
+			res.admins[info.Username] = id
+		}
+	}
+	return res, nil
+}
+
+// adminDomainNames returns the sorted names of the domains of an admin.
+func (state *dbState) adminDomainNames(info *AdminInfo) []string {
+	res := make([]string, 0, len(info.Domains))
+	for _, domainID := range info.Domains {
+		if name, has := state.domainNames[domainID]; has {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// ExportState returns the whole configuration. Everything is sorted, so
+// the output of two exports can be compared with diff.
+func ExportState(appContext *MailAppContext) (*MailState, error) {
+	current, err := loadDBState(appContext, true)
+	if err != nil {
+		return nil, err
+	}
+	domains := make(map[int64]*DomainState, len(current.domainNames))
+	res := &MailState{
+		Domains: make([]*DomainState, 0, len(current.domainNames)),
+		Admins:  make([]*AdminState, 0, len(current.adminInfos)),
+	}
+	for id, name := range current.domainNames {
+		domain := &DomainState{Name: name, Users: make([]*UserState, 0), Aliases: make([]*AliasState, 0)}
+		domains[id] = domain
+		res.Domains = append(res.Domains, domain)
+	}
+	for _, user := range current.users {
+		if domain, has := domains[user.domainID]; has {
+			domain.Users = append(domain.Users, &UserState{Email: user.email, PasswordHash: user.password})
+		}
+	}
+	for _, alias := range current.aliasValues {
+		if domain, has := domains[alias.DomainID]; has {
+			domain.Aliases = append(domain.Aliases, &AliasState{Source: alias.Source, Destination: alias.Dest})
+		}
+	}
+	sort.Slice(res.Domains, func(i, j int) bool { return res.Domains[i].Name < res.Domains[j].Name })
+	for _, domain := range res.Domains {
+		users, aliases := domain.Users, domain.Aliases
+		sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+		sort.Slice(aliases, func(i, j int) bool {
+			if aliases[i].Source != aliases[j].Source {
+				return aliases[i].Source < aliases[j].Source
+			}
+			return aliases[i].Destination < aliases[j].Destination
+		})
+	}
+	for _, info := range current.adminInfos {
+		res.Admins = append(res.Admins, &AdminState{
+			Username: info.Username,
+			Role:     info.Role,
+			Domains:  current.adminDomainNames(info),
+		})
+	}
+	sort.Slice(res.Admins, func(i, j int) bool { return res.Admins[i].Username < res.Admins[j].Username })
+	return res, nil
+}
+
+// Actions of a StateChange.
+const (
+	StateCreate = "create"
+	StateUpdate = "update"
+	StateDelete = "delete"
+)
+
+// StateChange is a single change computed by PlanState.
+type StateChange struct {
+	Action string `json:"action"`
+	// Kind is one of the audit target types domain, user, alias or admin.
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	// Details describes an update or the entries deleted together with a
+	// domain.
+	Details string `json:"details,omitempty"`
+	apply   func(appContext *MailAppContext) error
+}
+
+// String returns a line as printed by diff: + for create, ~ for update and -
+// for delete.
+func (change *StateChange) String() string {
+	prefix := map[string]string{StateCreate: "+", StateUpdate: "~", StateDelete: "-"}[change.Action]
+	res := fmt.Sprintf("%s %s %s", prefix, change.Kind, change.Name)
+	if change.Details != "" {
+		res += " (" + change.Details + ")"
+	}
+	return res
+}
+
+// StatePlan is the result of PlanState. If Errors is not empty the desired
+// state is invalid and the plan must not be applied.
+type StatePlan struct {
+	Changes []*StateChange `json:"changes"`
+	Errors  []string       `json:"errors"`
+}
+
+// errorf adds an error to the plan.
+func (plan *StatePlan) errorf(format string, args ...interface{}) {
+	plan.Errors = append(plan.Errors, fmt.Sprintf(format, args...))
+}
+
+// add adds a change to the plan.
+func (plan *StatePlan) add(action, kind, name, details string, apply func(appContext *MailAppContext) error) {
+	plan.Changes = append(plan.Changes, &StateChange{
+		Action:  action,
+		Kind:    kind,
+		Name:    name,
+		Details: details,
+		apply:   apply,
+	})
+}
+
+// validateState checks the desired state and adds all errors to the plan.
+func validateState(desired *MailState, plan *StatePlan) {
+	domains := make(map[string]bool)
+	users := make(map[string]bool)
+	aliases := make(map[string]bool)
+	for _, domain := range desired.Domains {
+		lowerDomain := strings.ToLower(domain.Name)
+		if domainErr := domainNameValid(domain.Name); domain.Name == "" || domainErr != nil {
+			plan.errorf("domain \"%s\": invalid name", domain.Name)
+		}
+		if domains[lowerDomain] {
+			plan.errorf("domain \"%s\": listed more than once", domain.Name)
+		}
+		domains[lowerDomain] = true
+		for _, user := range domain.Users {
+			if mailErr := emailValid(user.Email); mailErr != nil {
+				plan.errorf("user \"%s\": %s", user.Email, mailErr.Error())
+				continue
+			}
+			if _, userDomain, _ := ParseMailParts(user.Email); strings.ToLower(userDomain) != lowerDomain {
+				plan.errorf("user \"%s\": not in domain %s", user.Email, domain.Name)
+			}
+			if users[strings.ToLower(user.Email)] {
+				plan.errorf("user \"%s\": listed more than once", user.Email)
+			}
+			users[strings.ToLower(user.Email)] = true
+			if _, _, _, hashErr := getPWParts(user.PasswordHash); hashErr != nil {
+				plan.errorf("user \"%s\": invalid password hash: %s", user.Email, hashErr.Error())
+			}
+		}
+		for _, alias := range domain.Aliases {
+			name := alias.Source + " -> " + alias.Destination
+			_, sourceDomain, sourceErr := ParseMailParts(alias.Source)
+			if sourceErr != nil {
+				plan.errorf("alias \"%s\": %s", name, sourceErr.Error())
+				continue
+			}
+			if strings.ToLower(sourceDomain) != lowerDomain {
+				plan.errorf("alias \"%s\": source not in domain %s", name, domain.Name)
+			}
+			if destErr := emailValid(alias.Destination); destErr != nil {
+				plan.errorf("alias \"%s\": invalid destination: %s", name, destErr.Error())
+			}
+			key := aliasKey(alias.Source, alias.Destination)
+			if aliases[key] {
+				plan.errorf("alias \"%s\": listed more than once", name)
+			}
+			aliases[key] = true
+		}
+	}
+	if desired.Admins == nil {
+		return
+	}
+	admins := make(map[string]bool)
+	superAdmins := 0
+	for _, admin := range desired.Admins {
+		if nameErr := adminNameValid(admin.Username); admin.Username == "" || nameErr != nil {
+			plan.errorf("admin \"%s\": invalid username", admin.Username)
+		}
+		if admins[admin.Username] {
+			plan.errorf("admin \"%s\": listed more than once", admin.Username)
+		}
+		admins[admin.Username] = true
+		if _, roleErr := ParseRole(string(admin.Role)); roleErr != nil {
+			plan.errorf("admin \"%s\": %s", admin.Username, roleErr.Error())
+		}
+		if admin.Role == RoleSuperAdmin {
+			superAdmins++
+		}
+		for _, domain := range admin.Domains {
+			if !domains[strings.ToLower(domain)] {
+				plan.errorf("admin \"%s\": unknown domain \"%s\"", admin.Username, domain)
+			}
+		}
+	}
+	// don't lock everyone out
+	if superAdmins == 0 {
+		plan.errorf("admins must contain at least one superadmin")
+	}
+}
+
+// PlanState computes the changes required to get from the state in the
+// database to the desired state. The changes are ordered such that they can
+// be applied one after another: Domains are created first, then users and
+// aliases. Users and aliases of a domain that gets deleted are not deleted
+// on their own, they're removed together with the domain. If the Users or
+// Aliases of a domain are nil they're not changed.
+//
+// If desired.Admins is nil the admins are not changed. Otherwise all admins
+// not in the desired state are deleted and the role and domains of the other
+// admins are updated. Admins that don't exist yet are reported as error, they
+// must be created with a password first.
+func PlanState(appContext *MailAppContext, desired *MailState) (*StatePlan, error) {
+	plan := &StatePlan{Changes: make([]*StateChange, 0), Errors: make([]string, 0)}
+	validateState(desired, plan)
+	if len(plan.Errors) > 0 {
+		return plan, nil
+	}
+	current, loadErr := loadDBState(appContext, desired.Admins != nil)
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	desiredDomains := make(map[string]bool)
+	desiredUsers := make(map[string]bool)
+	desiredAliases := make(map[string]bool)
+	// the domains with a users or aliases entry
+	managedUsers := make(map[string]bool)
+	managedAliases := make(map[string]bool)
+	// creates and updates
+	for _, domain := range desired.Domains {
+		desiredDomains[strings.ToLower(domain.Name)] = true
+		managedUsers[strings.ToLower(domain.Name)] = domain.Users != nil
+		managedAliases[strings.ToLower(domain.Name)] = domain.Aliases != nil
+		if _, has := current.domainIDs[strings.ToLower(domain.Name)]; !has {
+			name := domain.Name
+			plan.add(StateCreate, AuditTargetDomain, name, "", func(appContext *MailAppContext) error {
+				domainID, err := AddVirtualDomain(appContext, name)
+				if err != nil {
+					return err
+				}
+				recordAudit(appContext, nil, AuditAddDomain, AuditTargetDomain, domainID, nil, AuditValues{"domain-name": name})
+				return nil
+			})
+		}
+	}
+	for _, domain := range desired.Domains {
+		for _, user := range domain.Users {
+			desiredUsers[strings.ToLower(user.Email)] = true
+			email, hash := user.Email, user.PasswordHash
+			existing, has := current.users[strings.ToLower(email)]
+			switch {
+			case !has:
+				plan.add(StateCreate, AuditTargetUser, email, "", func(appContext *MailAppContext) error {
+					userID, err := AddMailUserHash(appContext, email, hash)
+					if err != nil {
+						return err
+					}
+					recordAudit(appContext, nil, AuditAddUser, AuditTargetUser, userID, nil, AuditValues{"mail": email})
+					return nil
+				})
+			case existing.password != hash:
+				userID := existing.id
+				plan.add(StateUpdate, AuditTargetUser, email, "password", func(appContext *MailAppContext) error {
+					if err := SetUserPasswordHash(appContext, userID, hash); err != nil {
+						return err
+					}
+					recordAudit(appContext, nil, AuditChangePassword, AuditTargetUser, userID, nil, nil)
+					return nil
+				})
+			}
+		}
+	}
+	for _, domain := range desired.Domains {
+		for _, alias := range domain.Aliases {
+			key := aliasKey(alias.Source, alias.Destination)
+			desiredAliases[key] = true
+			if _, has := current.aliases[key]; has {
+				continue
+			}
+			source, dest := alias.Source, alias.Destination
+			plan.add(StateCreate, AuditTargetAlias, source+" -> "+dest, "", func(appContext *MailAppContext) error {
+				aliasID, err := AddAlias(appContext, source, dest)
+				if err != nil {
+					return err
+				}
+				recordAudit(appContext, nil, AuditAddAlias, AuditTargetAlias, aliasID, nil, AuditValues{"source": source, "dest": dest})
+				return nil
+			})
+		}
+	}
+	// deletes, sorted to get the same plan every time
+	deletedDomains := make(map[int64]bool)
+	aliasDeletes := make([]*Alias, 0)
+	aliasIDs := make(map[*Alias]int64)
+	for id, alias := range current.aliasValues {
+		if desiredAliases[aliasKey(alias.Source, alias.Dest)] {
+			continue
+		}
+		if !managedAliases[strings.ToLower(current.domainNames[alias.DomainID])] {
+			continue
+		}
+		aliasDeletes = append(aliasDeletes, alias)
+		aliasIDs[alias] = id
+	}
+	sort.Slice(aliasDeletes, func(i, j int) bool {
+		return aliasKey(aliasDeletes[i].Source, aliasDeletes[i].Dest) < aliasKey(aliasDeletes[j].Source, aliasDeletes[j].Dest)
+	})
+	for _, alias := range aliasDeletes {
+		aliasID, oldValue := aliasIDs[alias], AuditValues{"source": alias.Source, "dest": alias.Dest}
+		plan.add(StateDelete, AuditTargetAlias, alias.Source+" -> "+alias.Dest, "", func(appContext *MailAppContext) error {
+			if err := DelAlias(appContext, aliasID); err != nil {
+				return err
+			}
+			recordAudit(appContext, nil, AuditDeleteAlias, AuditTargetAlias, aliasID, oldValue, nil)
+			return nil
+		})
+	}
+	userDeletes := make([]*stateUser, 0)
+	for key, user := range current.users {
+		if !desiredUsers[key] && managedUsers[strings.ToLower(current.domainNames[user.domainID])] {
+			userDeletes = append(userDeletes, user)
+		}
+	}
+	sort.Slice(userDeletes, func(i, j int) bool { return userDeletes[i].email < userDeletes[j].email })
+	for _, user := range userDeletes {
+		userID, oldValue := user.id, AuditValues{"mail": user.email}
+		plan.add(StateDelete, AuditTargetUser, user.email, "", func(appContext *MailAppContext) error {
+			if err := DelMailUser(appContext, userID); err != nil {
+				return err
+			}
+			recordAudit(appContext, nil, AuditDeleteUser, AuditTargetUser, userID, oldValue, nil)
+			return nil
+		})
+	}
+	domainDeletes := make([]string, 0)
+	for key, domainID := range current.domainIDs {
+		if !desiredDomains[key] {
+			domainDeletes = append(domainDeletes, current.domainNames[domainID])
+			deletedDomains[domainID] = true
+		}
+	}
+	sort.Strings(domainDeletes)
+	for _, name := range domainDeletes {
+		domainID := current.domainIDs[strings.ToLower(name)]
+		numUsers, numAliases := 0, 0
+		for _, user := range current.users {
+			if user.domainID == domainID {
+				numUsers++
+			}
+		}
+		for _, alias := range current.aliasValues {
+			if alias.DomainID == domainID {
+				numAliases++
+			}
+		}
+		details := fmt.Sprintf("with %d users and %d aliases", numUsers, numAliases)
+		oldValue := AuditValues{"domain-name": name}
+		plan.add(StateDelete, AuditTargetDomain, name, details, func(appContext *MailAppContext) error {
+			if err := DeleteVirtualDomain(appContext, domainID); err != nil {
+				return err
+			}
+			recordAudit(appContext, nil, AuditDeleteDomain, AuditTargetDomain, domainID, oldValue, nil)
+			return nil
+		})
+	}
+	if desired.Admins != nil {
+		planAdmins(current, desired.Admins, deletedDomains, plan)
+	}
+	return plan, nil
+}
+
+// planAdmins adds the changes of the admins to the plan. deletedDomains are
+// the domains deleted by the plan, they're removed from the admins
+// automatically and don't need an update.
+func planAdmins(current *dbState, desired []*AdminState, deletedDomains map[int64]bool, plan *StatePlan) {
+	desiredAdmins := make(map[string]bool)
+	for _, admin := range desired {
+		desiredAdmins[admin.Username] = true
+		adminID, has := current.admins[admin.Username]
+		if !has {
+			plan.errorf("admin \"%s\": doesn't exist, admins must be created with a password first", admin.Username)
+			continue
+		}
+		info := current.adminInfos[adminID]
+		userName, role := admin.Username, admin.Role
+		if info.Role != role {
+			oldRole := info.Role
+			plan.add(StateUpdate, AuditTargetAdmin, userName, fmt.Sprintf("role %s -> %s", oldRole, role), func(appContext *MailAppContext) error {
+				if err := SetAdminRole(appContext, adminID, role); err != nil {
+					return err
+				}
+				recordAudit(appContext, nil, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID),
+					AuditValues{"username": userName, "role": oldRole}, AuditValues{"username": userName, "role": role})
+				return nil
+			})
+		}
+		oldDomains := make([]string, 0, len(info.Domains))
+		for _, name := range current.adminDomainNames(info) {
+			if !deletedDomains[current.domainIDs[strings.ToLower(name)]] {
+				oldDomains = append(oldDomains, name)
+			}
+		}
+		newDomains := make([]string, len(admin.Domains))
+		copy(newDomains, admin.Domains)
+		sort.Strings(newDomains)
+		if strings.ToLower(strings.Join(oldDomains, ",")) == strings.ToLower(strings.Join(newDomains, ",")) {
+			continue
+		}
+		details := fmt.Sprintf("domains [%s] -> [%s]", strings.Join(oldDomains, ", "), strings.Join(newDomains, ", "))
+		plan.add(StateUpdate, AuditTargetAdmin, userName, details, func(appContext *MailAppContext) error {
+			// the ids are looked up now, the domains might have been created by
+			// the plan
+			domainIDs := make([]int64, 0, len(newDomains))
+			for _, name := range newDomains {
+				domainID, err := getDomainID(appContext, name)
+				if err != nil {
+					return fmt.Errorf("Can't get id of domain \"%s\": %s", name, err.Error())
+				}
+				domainIDs = append(domainIDs, domainID)
+			}
+			oldDomainIDs, oldErr := GetAdminDomains(appContext, adminID)
+			if oldErr != nil {
+				return oldErr
+			}
+			if err := SetAdminDomains(appContext, adminID, domainIDs); err != nil {
+				return err
+			}
+			recordAudit(appContext, nil, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID),
+				AuditValues{"username": userName, "domains": oldDomainIDs}, AuditValues{"username": userName, "domains": domainIDs})
+			return nil
+		})
+	}
+	adminDeletes := make([]string, 0)
+	for userName := range current.admins {
+		if !desiredAdmins[userName] {
+			adminDeletes = append(adminDeletes, userName)
+		}
+	}
+	sort.Strings(adminDeletes)
+	for _, userName := range adminDeletes {
+		userName, adminID := userName, current.admins[userName]
+		plan.add(StateDelete, AuditTargetAdmin, userName, "", func(appContext *MailAppContext) error {
+			return deleteAdmin(userName, adminID, appContext, nil)
+		})
+	}
+}
+
+// ApplyStatePlan performs all changes of the plan in the order computed by
+// PlanState. It stops on the first error and returns the number of changes
+// applied, the changes are not performed in a transaction.
+// Only the database is changed: Mail directories of deleted users and domains
+// are not removed, no matter what the Delete and Trash options say.
+func ApplyStatePlan(appContext *MailAppContext, plan *StatePlan) (int, error) {
+	if len(plan.Errors) > 0 {
+		return 0, fmt.Errorf("Can't apply invalid state: %s", strings.Join(plan.Errors, "; "))
+	}
+	for i, change := range plan.Changes {
+		if err := change.apply(appContext); err != nil {
+			return i, fmt.Errorf("%s failed: %s", change.String(), err.Error())
+		}
+	}
+	return len(plan.Changes), nil
+}
@@ -0,0 +1,320 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectStateDomains expects the queries of loadDBState without admins.
+// The database contains the domains example.org (1) and old.org (2), the
+// users alice@example.org (1), bob@example.org (2) and carol@old.org (3) and
+// the aliases old@example.org -> alice@example.org (1) and
+// info@old.org -> carol@old.org (2).
+func expectStateDomains(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, name FROM virtual_domains;")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "example.org").AddRow(2, "old.org"))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, domain_id, email, password FROM virtual_users;")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "domain_id", "email", "password"}).
+			AddRow(1, 1, "alice@example.org", testPasswordHash).
+			AddRow(2, 1, "bob@example.org", testPasswordHash).
+			AddRow(3, 2, "carol@old.org", testPasswordHash))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, domain_id, source, destination FROM virtual_aliases;")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "domain_id", "source", "destination"}).
+			AddRow(1, 1, "old@example.org", "alice@example.org").
+			AddRow(2, 2, "info@old.org", "carol@old.org"))
+}
+
+// expectStateAdmins expects the queries of loadDBState for the admins of
+// appContext: root (1) is a superadmin, admin (2) a helpdesk admin of
+// example.org.
+func expectStateAdmins(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, role FROM admin_roles;")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "role"}).
+			AddRow(1, string(RoleSuperAdmin)).
+			AddRow(2, string(RoleHelpDesk)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, domain_id FROM admin_domains;")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "domain_id"}).AddRow(2, 1))
+}
+
+// planLines returns the changes of the plan as printed by diff.
+func planLines(plan *StatePlan) []string {
+	res := make([]string, len(plan.Changes))
+	for i, change := range plan.Changes {
+		res[i] = change.String()
+	}
+	return res
+}
+
+// readTestState reads a YAML state.
+func readTestState(t *testing.T, yaml string) *MailState {
+	t.Helper()
+	state, err := ReadMailState(strings.NewReader(yaml), StateFormatYAML)
+	if err != nil {
+		t.Fatalf("Reading the state failed: %s", err)
+	}
+	return state
+}
+
+func TestPlanState(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	expectStateDomains(mock)
+	desired := readTestState(t, `
+domains:
+- name: example.org
+  users:
+  - email: alice@example.org
+    password-hash: "{SHA512-CRYPT}$6$0123456789abcdef$changed"
+  - email: dave@example.org
+    password-hash: "`+testPasswordHash+`"
+  aliases:
+  - source: info@example.org
+    destination: alice@example.org
+- name: new.org
+  users: []
+  aliases: []
+`)
+	plan, err := PlanState(appContext, desired)
+	if err != nil {
+		t.Fatalf("Planning failed: %s", err)
+	}
+	if len(plan.Errors) != 0 {
+		t.Fatalf("Unexpected errors: %v", plan.Errors)
+	}
+	// creates first, the users and aliases of old.org are deleted with the
+	// domain
+	expected := []string{
+		"+ domain new.org",
+		"~ user alice@example.org (password)",
+		"+ user dave@example.org",
+		"+ alias info@example.org -> alice@example.org",
+		"- alias old@example.org -> alice@example.org",
+		"- user bob@example.org",
+		"- domain old.org (with 1 users and 1 aliases)",
+	}
+	if got := planLines(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected plan\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestPlanStateUnmanaged(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		expected []string
+	}{
+		{"users and aliases missing", `
+domains:
+- name: example.org
+- name: old.org
+`, []string{}},
+		{"users and aliases null", `
+domains:
+- name: example.org
+  users:
+  aliases:
+- name: old.org
+`, []string{}},
+		{"aliases missing", `
+domains:
+- name: example.org
+  users: []
+- name: old.org
+`, []string{"- user alice@example.org", "- user bob@example.org"}},
+		{"users missing", `
+domains:
+- name: example.org
+  aliases: []
+- name: old.org
+`, []string{"- alias old@example.org -> alice@example.org"}},
+		{"empty lists", `
+domains:
+- name: example.org
+  users: []
+  aliases: []
+- name: old.org
+`, []string{"- alias old@example.org -> alice@example.org", "- user alice@example.org", "- user bob@example.org"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appContext, mock := newTestContext(t)
+			expectStateDomains(mock)
+			plan, err := PlanState(appContext, readTestState(t, tt.yaml))
+			if err != nil {
+				t.Fatalf("Planning failed: %s", err)
+			}
+			if len(plan.Errors) != 0 {
+				t.Fatalf("Unexpected errors: %v", plan.Errors)
+			}
+			if got := planLines(plan); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Expected plan %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestPlanStateAdmins(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	userHandler := newMemoryUserHandler(nil)
+	userHandler.Insert("root", "", "", "", []byte("secret"))
+	userHandler.Insert("admin", "", "", "", []byte("secret"))
+	userHandler.Insert("old", "", "", "", []byte("secret"))
+	appContext.UserHandler = userHandler
+	expectStateDomains(mock)
+	expectStateAdmins(mock)
+	desired := readTestState(t, `
+domains:
+- name: example.org
+- name: old.org
+admins:
+- username: root
+  role: superadmin
+  domains: []
+- username: admin
+  role: domainadmin
+  domains: [old.org, example.org]
+`)
+	plan, err := PlanState(appContext, desired)
+	if err != nil {
+		t.Fatalf("Planning failed: %s", err)
+	}
+	if len(plan.Errors) != 0 {
+		t.Fatalf("Unexpected errors: %v", plan.Errors)
+	}
+	// old has no entry in admin_roles and thus DefaultRole
+	expected := []string{
+		"~ admin admin (role helpdesk -> domainadmin)",
+		"~ admin admin (domains [example.org] -> [example.org, old.org])",
+		"- admin old",
+	}
+	if got := planLines(plan); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected plan\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestPlanStateUnknownAdmin(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	appContext.UserHandler = newMemoryUserHandler(map[string]string{"root": "secret"})
+	expectStateDomains(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, role FROM admin_roles;")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "role"}).AddRow(1, string(RoleSuperAdmin)))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT user_id, domain_id FROM admin_domains;")).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "domain_id"}))
+	desired := readTestState(t, `
+domains:
+- name: example.org
+- name: old.org
+admins:
+- username: root
+  role: superadmin
+- username: new
+  role: superadmin
+`)
+	plan, err := PlanState(appContext, desired)
+	if err != nil {
+		t.Fatalf("Planning failed: %s", err)
+	}
+	expected := []string{`admin "new": doesn't exist, admins must be created with a password first`}
+	if !reflect.DeepEqual(plan.Errors, expected) {
+		t.Errorf("Expected errors %v, got %v", expected, plan.Errors)
+	}
+	if _, applyErr := ApplyStatePlan(appContext, plan); applyErr == nil {
+		t.Error("Applying a plan with errors must fail")
+	}
+}
+
+func TestPlanStateInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		// err is the expected error of the plan
+		err string
+	}{
+		{"invalid domain", "domains:\n- name: example..org\n", `domain "example..org": invalid name`},
+		{"empty domain", "domains:\n- name: \"\"\n", `domain "": invalid name`},
+		{"duplicate domain", "domains:\n- name: example.org\n- name: Example.org\n", `domain "Example.org": listed more than once`},
+		{"invalid user", "domains:\n- name: example.org\n  users:\n  - email: alice\n    password-hash: \"" + testPasswordHash + "\"\n",
+			`user "alice": Invalid Email address`},
+		{"user in another domain", "domains:\n- name: example.org\n  users:\n  - email: alice@example.com\n    password-hash: \"" + testPasswordHash + "\"\n",
+			`user "alice@example.com": not in domain example.org`},
+		{"duplicate user", "domains:\n- name: example.org\n  users:\n  - email: alice@example.org\n    password-hash: \"" + testPasswordHash + "\"\n" +
+			"  - email: Alice@example.org\n    password-hash: \"" + testPasswordHash + "\"\n",
+			`user "Alice@example.org": listed more than once`},
+		{"invalid hash", "domains:\n- name: example.org\n  users:\n  - email: alice@example.org\n    password-hash: secret\n",
+			`user "alice@example.org": invalid password hash`},
+		{"alias in another domain", "domains:\n- name: example.org\n  aliases:\n  - source: info@example.com\n    destination: alice@example.org\n",
+			`alias "info@example.com -> alice@example.org": source not in domain example.org`},
+		{"invalid destination", "domains:\n- name: example.org\n  aliases:\n  - source: info@example.org\n    destination: alice\n",
+			`alias "info@example.org -> alice": invalid destination`},
+		{"duplicate alias", "domains:\n- name: example.org\n  aliases:\n  - source: info@example.org\n    destination: alice@example.org\n" +
+			"  - source: INFO@example.org\n    destination: alice@example.org\n",
+			`alias "INFO@example.org -> alice@example.org": listed more than once`},
+		{"no superadmin", "domains: []\nadmins:\n- username: admin\n  role: domainadmin\n", "admins must contain at least one superadmin"},
+		{"empty admins", "domains: []\nadmins: []\n", "admins must contain at least one superadmin"},
+		{"invalid role", "domains: []\nadmins:\n- username: root\n  role: superadmin\n- username: admin\n  role: root\n", `admin "admin": `},
+		{"duplicate admin", "domains: []\nadmins:\n- username: root\n  role: superadmin\n- username: root\n  role: superadmin\n",
+			`admin "root": listed more than once`},
+		{"unknown admin domain", "domains: []\nadmins:\n- username: root\n  role: superadmin\n  domains: [example.org]\n",
+			`admin "root": unknown domain "example.org"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the database must not be accessed
+			appContext, _ := newTestContext(t)
+			plan, err := PlanState(appContext, readTestState(t, tt.yaml))
+			if err != nil {
+				t.Fatalf("Planning failed: %s", err)
+			}
+			if len(plan.Changes) != 0 {
+				t.Errorf("An invalid state must not have changes, got %v", planLines(plan))
+			}
+			for _, planErr := range plan.Errors {
+				if strings.HasPrefix(planErr, tt.err) {
+					return
+				}
+			}
+			t.Errorf("Expected an error starting with %q, got %v", tt.err, plan.Errors)
+		})
+	}
+}
+
+func TestReadMailState(t *testing.T) {
+	if _, err := ReadMailState(strings.NewReader("domains: []\nusers: []\n"), StateFormatYAML); err == nil {
+		t.Error("Unknown keys in YAML must be rejected")
+	}
+	if _, err := ReadMailState(strings.NewReader("domains: []\n"), "xml"); err == nil {
+		t.Error("Unknown formats must be rejected")
+	}
+	state, err := ReadMailState(strings.NewReader(`{"domains": [{"name": "example.org", "users": []}]}`), StateFormatJSON)
+	if err != nil {
+		t.Fatalf("Reading the state failed: %s", err)
+	}
+	if domain := state.Domains[0]; domain.Users == nil || domain.Aliases != nil || state.Admins != nil {
+		t.Errorf("Expected users to be empty and aliases and admins to be nil, got %+v and %+v", domain, state.Admins)
+	}
+}
@@ -25,6 +25,24 @@ SOFTWARE.
 // This javascript code might not be nice but it works...
 // TODO document me
 
+function login_error(jqXHR, message) {
+  if (jqXHR.status == 429) {
+    return escapeHtml(jqXHR.responseText);
+  }
+  return password_error(jqXHR, message);
+}
+
+// password_error returns the violations of the password policy if the server
+// rejected a password, otherwise the plain message.
+function password_error(jqXHR, message) {
+  if (jqXHR.status == 400 && jqXHR.responseJSON && jqXHR.responseJSON.violations) {
+    return $.map(jqXHR.responseJSON.violations, function(violation) {
+      return escapeHtml(violation.message);
+    }).join('<br>');
+  }
+  return message;
+}
+
 function post_login() {
   // first post the data
   var destination = location.protocol + "//" + location.host + "/login/";
@@ -40,12 +58,127 @@ function post_login() {
     headers: {
       "X-CSRF-Token": form_data[0]['value'],
     },
+    success: function(data, status) {
+      var second_factor = null;
+      try {
+        second_factor = JSON.parse(data)["second-factor"];
+      }
+      catch(e) {
+        // no JSON, login is complete
+      }
+      if (second_factor == "totp" || second_factor == "enroll") {
+        show_second_factor(second_factor, form_data[0]['value']);
+      } else {
+        window.location.replace(location.protocol + "//" + location.host + "/");
+      }
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+     $('#login-status').addClass('alert-danger').removeClass('alert-info').html(login_error(jqXHR, "Authentication error, username / password wrong."));
+  });
+}
+
+function show_second_factor(second_factor, csrf_token) {
+  $('#login-credentials').addClass('hidden');
+  $('#login-sso').addClass('hidden');
+  if (second_factor == "totp") {
+    $('#login-code').removeClass('hidden');
+    $('#login-status').html("Enter the code from your authenticator app or a recovery code.");
+  } else {
+    start_login_enroll(csrf_token);
+  }
+}
+
+// check_login_query handles the redirects from the SSO login: either an
+// error or the request for a second factor.
+function check_login_query() {
+  var params = new URLSearchParams(window.location.search);
+  var sso_errors = {
+    "provider": "The identity provider reported an error, please try again.",
+    "expired": "The single sign-on took too long or was already used, please try again.",
+    "unknown": "There is no admin account for your single sign-on identity."
+  };
+  if (params.has("sso-error")) {
+    var message = sso_errors[params.get("sso-error")] || "Single sign-on failed.";
+    $('#login-status').addClass('alert-danger').removeClass('alert-info').text(message);
+  }
+  var second_factor = params.get("second-factor");
+  if (second_factor == "totp" || second_factor == "enroll") {
+    show_second_factor(second_factor, $('#login-credentials').serializeArray()[0]['value']);
+  }
+}
+
+function post_login_code() {
+  var destination = location.protocol + "//" + location.host + "/login/2fa/";
+  var csrf_token = $('#login-credentials').serializeArray()[0]['value'];
+  var jqxhr = $.ajax({
+    type: 'POST',
+    url: destination,
+    data: JSON.stringify( { 'code': $('#login-totp-code').val() } ),
+    headers: {
+      "X-CSRF-Token": csrf_token,
+    },
     success: function(data, status) {
       window.location.replace(location.protocol + "//" + location.host + "/");
     }
   })
   .fail(function(jqXHR, textStatus, error) {
-     $('#login-status').addClass('alert-danger').removeClass('alert-info').html("Authentication error, username / password wrong.");
+     $('#login-status').addClass('alert-danger').removeClass('alert-info').html(login_error(jqXHR, "Authentication error, code wrong."));
+  });
+}
+
+function show_totp_setup(container, data) {
+  container.empty()
+    .append( $('<img>').attr('src', data["qr"]).attr('alt', 'QR code') )
+    .append( $('<p></p>').text('Secret: ' + data["secret"]) );
+}
+
+function show_recovery_codes(container, codes) {
+  var list = $('<ul></ul>');
+  for (var i = 0; i < codes.length; i++) {
+    list.append( $('<li></li>').append( $('<code></code>').text(codes[i]) ) );
+  }
+  container.empty()
+    .append( $('<p></p>').text('Store these recovery codes in a safe place, each can be used once instead of a code. They will not be shown again.') )
+    .append(list);
+}
+
+function start_login_enroll(csrf_token) {
+  var destination = location.protocol + "//" + location.host + "/login/2fa/enroll/";
+  var jqxhr = $.ajax({
+    type: 'GET',
+    url: destination,
+    data: "",
+    success: function(data, status) {
+      show_totp_setup($('#login-totp-setup'), JSON.parse(data));
+      $('#login-enroll').removeClass('hidden');
+      $('#login-status').html("Set up two-factor authentication");
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+     $('#login-status').addClass('alert-danger').removeClass('alert-info').html("Error starting two-factor setup: " + error);
+  });
+}
+
+function post_login_enroll() {
+  var destination = location.protocol + "//" + location.host + "/login/2fa/enroll/";
+  var csrf_token = $('#login-credentials').serializeArray()[0]['value'];
+  var jqxhr = $.ajax({
+    type: 'POST',
+    url: destination,
+    data: JSON.stringify( { 'code': $('#login-enroll-code').val() } ),
+    headers: {
+      "X-CSRF-Token": csrf_token,
+    },
+    success: function(data, status) {
+      $('#login-enroll').addClass('hidden');
+      show_recovery_codes($('#login-recovery-codes'), JSON.parse(data)["recovery-codes"]);
+      $('#login-recovery-codes').append( $('<a class="btn btn-primary" href="/">Continue</a>') );
+      $('#login-status').removeClass('alert-danger').addClass('alert-info').html("Two-factor authentication enabled");
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+     $('#login-status').addClass('alert-danger').removeClass('alert-info').html("Error enabling two-factor authentication, code wrong.");
   });
 }
 
@@ -54,8 +187,8 @@ function change_single_pw() {
   var form_data = $('#mail-settings').serializeArray();
   var form_map = {'mail': form_data[1]['value'], 'old_password': form_data[2]['value'],
     'new_password': form_data[3]['value']};
-  if (form_map['new_password'].length < 6) {
-    bootbox.alert("Password must be at least six characters long");
+  if (form_map['new_password'].length == 0) {
+    bootbox.alert("Password must not be empty");
     return
   }
   var repeat = form_data[4]['value'];
@@ -77,7 +210,282 @@ function change_single_pw() {
     }
   })
   .fail(function(jqXHR, textStatus, error) {
-     bootbox.alert('Update failed: ' + error);
+     bootbox.alert('Update failed: ' + login_error(jqXHR, error));
+  });
+}
+
+function portal_login() {
+  var destination = location.protocol + "//" + location.host + "/portal/login/";
+  var form_data = $('#portal-login').serializeArray();
+  var form_map = { 'mail': $('#mail').val(), 'password': $('#password').val() };
+  var jqxhr = $.ajax({
+    type: 'POST',
+    url: destination,
+    data: JSON.stringify(form_map),
+    headers: {
+      "X-CSRF-Token": form_data[0]['value'],
+    },
+    success: function(data, status) {
+      window.location.replace(location.protocol + "//" + location.host + "/portal/");
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+     $('#login-status').addClass('alert-danger').removeClass('alert-info').html(login_error(jqXHR, "Authentication error, email / password wrong."));
+  });
+}
+
+function format_bytes(bytes) {
+  var units = ['B', 'KiB', 'MiB', 'GiB', 'TiB'];
+  var i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return bytes.toFixed(i == 0 ? 0 : 1) + ' ' + units[i];
+}
+
+function show_quota(container, quota) {
+  container.empty();
+  if (!quota) {
+    container.text('Storage information is not available.');
+    return;
+  }
+  var text = format_bytes(quota['used-bytes']);
+  if (quota['limit-bytes'] > 0) {
+    var percent = Math.min(100, Math.round(100 * quota['used-bytes'] / quota['limit-bytes']));
+    text += ' of ' + format_bytes(quota['limit-bytes']) + ' used';
+    container.append($('<div class="progress"></div>')
+      .append($('<div class="progress-bar" role="progressbar"></div>')
+        .attr('aria-valuenow', percent).css('width', percent + '%').text(percent + '%')));
+  } else {
+    text += ' used';
+  }
+  text += ', ' + quota['used-messages'] + ' messages';
+  if (quota['limit-messages'] > 0) {
+    text += ' (at most ' + quota['limit-messages'] + ')';
+  }
+  container.append($('<p></p>').text(text));
+}
+
+function portal_change_password() {
+  var password = $('#new-password').val();
+  if (password.length == 0) {
+    bootbox.alert("Password must not be empty");
+    return
+  }
+  if (password != $('#repeat-password').val()) {
+    bootbox.alert("Passwords don't match.");
+    return
+  }
+  var destination = location.protocol + "//" + location.host + "/api/portal/";
+  var jqxhr = $.ajax({
+    type: 'UPDATE',
+    url: destination,
+    data: JSON.stringify({ 'password': password }),
+    headers: {
+      "X-CSRF-Token": csrf_portal,
+    },
+    success: function(data, status) {
+      $('#portal-password-form')[0].reset();
+      $('#password-expired-alert').addClass('hidden');
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully changed password');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Update failed: ' + login_error(jqXHR, error));
+  });
+}
+
+function portal_set_recovery() {
+  var destination = location.protocol + "//" + location.host + "/api/portal/";
+  var jqxhr = $.ajax({
+    type: 'UPDATE',
+    url: destination,
+    data: JSON.stringify({ 'recovery-mail': $('#recovery-mail').val() }),
+    headers: {
+      "X-CSRF-Token": csrf_portal,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully saved recovery address');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Update failed: ' + escapeHtml(jqXHR.responseText));
+  });
+}
+
+function portal_add_alias(form_map) {
+  var destination = location.protocol + "//" + location.host + "/api/portal/aliases/";
+  var jqxhr = $.ajax({
+    type: 'POST',
+    url: destination,
+    data: JSON.stringify(form_map),
+    headers: {
+      "X-CSRF-Token": csrf_portal,
+    },
+    success: function(data, status) {
+      $('#portal-alias-form')[0].reset();
+      $('#portal-forward-form')[0].reset();
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully added entry');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error adding entry: ' + escapeHtml(jqXHR.responseText));
+  })
+  .always(function() {
+    fill_portal();
+  });
+}
+
+function portal_delete_alias(alias_id) {
+  var destination = location.protocol + "//" + location.host + "/api/portal/aliases/" + alias_id + "/";
+  var jqxhr = $.ajax({
+    type: 'DELETE',
+    url: destination,
+    headers: {
+      "X-CSRF-Token": csrf_portal,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully deleted entry');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error deleting entry: ' + error);
+  })
+  .always(function() {
+    fill_portal();
+  });
+}
+
+function portal_delete_button(alias_id, address, allowed) {
+  var button = $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-remove" style="color:red"></span>') );
+  if (!allowed) {
+    return button.prop('disabled', true);
+  }
+  return button.click(function() {
+            delete_confirm('Delete Entry?',
+              'Are you sure that you want to delete <b>' + escapeHtml(address) + '</b>?',
+              function(result) {
+                if(result) {
+                  portal_delete_alias(alias_id);
+                }
+              }
+            )
+          });
+}
+
+function fill_portal() {
+  var spinner = new Spinner().spin();
+  document.getElementById('aliases').appendChild(spinner.el);
+  $('#get-alert-status').addClass('hidden');
+  aliases_table.clear();
+  forwards_table.clear();
+  var destination = location.protocol + "//" + location.host + "/api/portal/";
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      csrf_portal = request.getResponseHeader("X-CSRF-Token");
+      try {
+        var info = JSON.parse(data);
+        $('#portal-mail').text(info["mail"]);
+        $('#recovery-mail').val(info["recovery-mail"]);
+        show_quota($('#portal-quota'), info["quota"]);
+        $('#password-expired-alert').toggleClass('hidden', !info["password-expired"]);
+        $('#portal-alias-form').toggleClass('hidden', !info["manage-aliases"]);
+        $('#portal-forward-form').toggleClass('hidden', !info["manage-forwards"]);
+        for (var aliasID in info["aliases"]) {
+          if (info["aliases"].hasOwnProperty(aliasID)) {
+            var source = info["aliases"][aliasID];
+            aliases_table.row.add($('<tr></tr>')
+              .append( $('<td></td>').text(source) )
+              .append( $('<td class="datatable-button"></td>').html(portal_delete_button(aliasID, source, info["manage-aliases"])) ));
+          }
+        }
+        for (var forwardID in info["forwards"]) {
+          if (info["forwards"].hasOwnProperty(forwardID)) {
+            var dest = info["forwards"][forwardID];
+            forwards_table.row.add($('<tr></tr>')
+              .append( $('<td></td>').text(dest) )
+              .append( $('<td class="datatable-button"></td>').html(portal_delete_button(forwardID, dest, info["manage-forwards"])) ));
+          }
+        }
+      }
+      catch(e) {
+        set_alert($('#get-alert-status'), 'error', 'Error getting account information: Invalid return syntax');
+      }
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    if (jqXHR.status == 401) {
+      window.location.replace(location.protocol + "//" + location.host + "/portal/login/");
+      return;
+    }
+    set_alert($('#get-alert-status'), 'error', 'Error getting account information: ' + error);
+  })
+  .always(function() {
+    aliases_table.draw();
+    forwards_table.draw();
+    spinner.stop();
+  });
+}
+
+function request_password_reset() {
+  var csrf_token = $('#mail-settings').serializeArray()[0]['value'];
+  bootbox.prompt({
+    title: "Enter your email address, a reset link is sent to your recovery address.",
+    inputType: 'email',
+    callback: function(mail) {
+      if (!mail) {
+        return;
+      }
+      var destination = location.protocol + "//" + location.host + "/password/reset/";
+      var jqxhr = $.ajax({
+        type: 'POST',
+        url: destination,
+        data: JSON.stringify({ 'mail': mail }),
+        headers: {
+          "X-CSRF-Token": csrf_token,
+        },
+        success: function(data, status) {
+          bootbox.alert('If the account exists and has a recovery address a reset link has been sent.');
+        }
+      })
+      .fail(function(jqXHR, textStatus, error) {
+        bootbox.alert('Request failed: ' + login_error(jqXHR, error));
+      });
+    }
+  });
+}
+
+function reset_password() {
+  var form_data = $('#reset-form').serializeArray();
+  var password = $('#new-password').val();
+  if (password.length == 0) {
+    bootbox.alert("Password must not be empty");
+    return
+  }
+  if (password != $('#repeat-password').val()) {
+    bootbox.alert("Passwords don't match.");
+    return
+  }
+  var token = new URLSearchParams(window.location.search).get("token");
+  var destination = location.protocol + "//" + location.host + "/password/reset/";
+  var jqxhr = $.ajax({
+    type: 'POST',
+    url: destination,
+    data: JSON.stringify({ 'token': token, 'password': password }),
+    headers: {
+      "X-CSRF-Token": form_data[0]['value'],
+    },
+    success: function(data, status) {
+      $('#reset-form').addClass('hidden');
+      $('#reset-status').removeClass('alert-info').addClass('alert-success').text('Your password has been changed.');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    $('#reset-status').removeClass('alert-info').addClass('alert-danger').html(login_error(jqXHR, error));
   });
 }
 
@@ -198,6 +606,7 @@ function delete_user(userID) {
   })
   .always(function() {
     fill_users();
+    fill_trash();
     spinner.stop();
   });
 }
@@ -220,9 +629,22 @@ function remove_user_button(user_mail, user_id) {
           });
 }
 
+function export_user_button(user_id) {
+  return $('<a class="btn btn-default"></a>')
+          .attr('href', '/api/users/' + user_id + '/export')
+          .append( $('<span class="glyphicon glyphicon-download-alt" style="color:teal"></span>') );
+}
+
+function show_generated_password(mail, password) {
+  bootbox.alert({
+    title: "Generated Password for <b>" + escapeHtml(mail) + "</b>",
+    message: '<p>The password is shown only once, make sure to store it now.</p><pre>' + escapeHtml(password) + '</pre>'
+  });
+}
+
 function change_password(user_id, password) {
-  if (password.length < 6) {
-    bootbox.alert("Password must be at least six characters long");
+  if (password.length == 0) {
+    bootbox.alert("Password must not be empty");
     return
   }
   var spinner = new Spinner().spin();
@@ -241,7 +663,7 @@ function change_password(user_id, password) {
     }
   })
   .fail(function(jqXHR, textStatus, error) {
-    set_alert($('#manipulate-alert-status'), 'error', 'Error changing password: ' + error);
+    set_alert($('#manipulate-alert-status'), 'error', 'Error changing password: ' + password_error(jqXHR, error));
   })
   .always(function() {
     spinner.stop();
@@ -315,6 +737,50 @@ function delete_alias(alias_id) {
   });
 }
 
+function generate_password(user_mail, user_id, generator) {
+  var spinner = new Spinner().spin();
+  document.getElementById('virtual-users').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/users/" + user_id + "/";
+  var jqxhr = $.ajax({
+    type: "UPDATE",
+    url: destination,
+    data: JSON.stringify( { "generate": generator } ),
+    headers: {
+        "X-CSRF-Token": csrf_listusers,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully changed password');
+      show_generated_password(user_mail, JSON.parse(data)['password']);
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error changing password: ' + escapeHtml(jqXHR.responseText));
+  })
+  .always(function() {
+    spinner.stop();
+  });
+}
+
+function generate_password_button(user_mail, user_id) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-random" style="color:teal"></span>') )
+          .click(function() {
+            bootbox.prompt({
+              title: "Generate new Password for <b>" + escapeHtml(user_mail) + "</b>",
+              inputType: 'select',
+              inputOptions: [
+                { text: 'Random characters', value: 'random' },
+                { text: 'Diceware passphrase', value: 'diceware' }
+              ],
+              callback: function (result) {
+                if (result !== null) {
+                  generate_password(user_mail, user_id, result);
+                }
+              }
+            });
+          });
+}
+
 function change_password_button(user_mail, user_id) {
   return $('<button type="button" class="btn btn-default"></button>')
           .append( $('<span class="glyphicon glyphicon-lock" style="color:teal"></span>') )
@@ -378,10 +844,12 @@ function add_user() {
   document.getElementById('virtual-users').appendChild(spinner.el);
   // var destination = location.protocol + "//" + location.host + "/listusers";
   var destination = location.protocol + "//" + location.host + "/api/users";
-  var form_data = $('#add-user-form').serializeArray();
-  form_map = { 'mail': form_data[0]['value'], 'password': form_data[1]['value'] }
-  if (form_data[1]['value'].length < 6) {
-    bootbox.alert("Password must be at least six characters long");
+  // the password field is disabled (and not serialized) if a password is
+  // generated, so read the fields directly
+  var generator = $('#generate').val();
+  form_map = { 'mail': $('#user-email').val(), 'password': $('#password').val(), 'generate': generator }
+  if (generator == "" && form_map['password'].length == 0) {
+    bootbox.alert("Password must not be empty");
     spinner.stop();
     return
   }
@@ -395,10 +863,15 @@ function add_user() {
     },
     success: function(data, status) {
       set_alert($('#manipulate-alert-status'), 'success', 'Added new user');
+      if (generator != "") {
+        show_generated_password(form_map['mail'], JSON.parse(data)['password']);
+      }
+      $('#add-user-form')[0].reset();
+      $('#password').prop('disabled', false);
     }
   })
   .fail(function(jqXHR, textStatus, error) {
-    set_alert($('#manipulate-alert-status'), 'error', 'Error adding user: ' + error);
+    set_alert($('#manipulate-alert-status'), 'error', 'Error adding user: ' + password_error(jqXHR, error));
   })
   .always(function() {
     spinner.stop();
@@ -406,121 +879,259 @@ function add_user() {
   });
 }
 
-function fill_users() {
+// paged_table creates a DataTable that loads its rows page by page from the
+// list API (see pagination.go) instead of loading the whole list at once.
+// The API only knows cursors, so the cursors of the pages already seen are
+// stored and the table only allows to go to the previous or next page.
+// sort_fields contains the API sort field for each column (null if the column
+// can't be sorted), fill_row(row, entry) fills the cells of a new row and
+// on_response(request) is called after each successful request.
+function paged_table(selector, url, sort_fields, fill_row, on_response) {
+  var cursors = {};
+  var state = null;
+  var columns = [];
+  for (var i = 0; i < sort_fields.length; i++) {
+    columns.push({ "data": null, "defaultContent": "", "orderable": sort_fields[i] != null, "searchable": sort_fields[i] != null });
+  }
+  return $(selector).DataTable( {
+    "serverSide": true,
+    "pagingType": "simple",
+    "searchDelay": 500,
+    "columns": columns,
+    "createdRow": fill_row,
+    "ajax": function(data, callback, settings) {
+      var sort = sort_fields[data.order[0].column];
+      if (data.order[0].dir == "desc") {
+        sort = "-" + sort;
+      }
+      // start at the first page again if sorting, search or page length changed
+      var key = [sort, data.search.value, data.length].join("\n");
+      if (key != state) {
+        state = key;
+        cursors = { 0: "" };
+      }
+      var params = { "limit": data.length, "sort": sort, "q": data.search.value };
+      if (cursors[data.start]) {
+        params["cursor"] = cursors[data.start];
+      }
+      var spinner = new Spinner().spin();
+      document.getElementById(selector.substring(1)).appendChild(spinner.el);
+      var result = { "draw": data.draw, "recordsTotal": 0, "recordsFiltered": 0, "data": [] };
+      var jqxhr = $.ajax({
+        type: "GET",
+        url: location.protocol + "//" + location.host + url + "&" + $.param(params),
+        data: "",
+        success: function(response, status, request) {
+          on_response(request);
+          try {
+            var page = JSON.parse(response);
+            if (page["next-cursor"]) {
+              cursors[data.start + data.length] = page["next-cursor"];
+            }
+            result["recordsTotal"] = page["total"];
+            result["recordsFiltered"] = page["total"];
+            result["data"] = page["items"];
+          }
+          catch(e) {
+            set_alert($('#get-alert-status'), 'error', 'Error getting list: Invalid return syntax');
+          }
+        }
+      }).fail(function(jqXHR, textStatus, error) {
+        set_alert($('#get-alert-status'), 'error', 'Error getting list: ' + error);
+      })
+      .always(function() {
+        callback(result);
+        spinner.stop();
+      });
+    }
+  });
+}
+
+function users_table() {
   var domainID = "-1";
   var urlParam = getUrlParameter('domain')
   if (typeof urlParam != 'undefined') {
     domainID = urlParam
   }
-  var spinner = new Spinner().spin();
-  document.getElementById('virtual-users').appendChild(spinner.el);
+  return paged_table('#virtual-users', "/api/users?domain=" + domainID,
+    ["email", null, null, null, null],
+    function(row, entry) {
+      var mail = entry["Mail"];
+      var aliases = [];
+      var aliasDict = entry['AliasFor'];
+      for (var aliasEntry in aliasDict) {
+        if (aliasDict.hasOwnProperty(aliasEntry)) {
+          aliases.push(aliasDict[aliasEntry]["Dest"]);
+        }
+      }
+      var cells = $('td', row);
+      cells.eq(1).text(aliases.join(', '));
+      if (entry["VirtualUser"]) {
+        var virtualUserID = entry["VirtualUserID"];
+        cells.eq(0).addClass('virtual-user').text(mail);
+        cells.eq(2).addClass('datatable-button').append(change_password_button(mail, virtualUserID), ' ', generate_password_button(mail, virtualUserID));
+        cells.eq(3).addClass('datatable-button').html(export_user_button(virtualUserID));
+        cells.eq(4).addClass('datatable-button').html(remove_user_button(mail, virtualUserID));
+      } else {
+        cells.eq(0).addClass('only-alias').text(mail);
+      }
+    },
+    function(request) {
+      csrf_listusers = request.getResponseHeader("X-CSRF-Token");
+    });
+}
+
+function fill_users() {
   $('#get-alert-status').addClass('hidden');
-  data_table.clear();
-  // var destination = location.protocol + "//" + location.host + "/listusers" + "?domain=" + domainID;
-  var destination = location.protocol + "//" + location.host + "/api/users" + "?domain=" + domainID;
+  data_table.ajax.reload(null, false);
+}
+
+function restore_user(userID) {
+  var spinner = new Spinner().spin();
+  document.getElementById('trash-users').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/trash/" + userID + "/";
   var jqxhr = $.ajax({
-    type: "GET",
+    type: "POST",
     url: destination,
-    data: "",
-    success: function(data, status, request) {
-      csrf_listusers = request.getResponseHeader("X-CSRF-Token");
-      if(data) {
-        try {
-          var jsonDecoded = JSON.parse(data);
-          for(var mail in jsonDecoded) {
-            if (jsonDecoded.hasOwnProperty(mail)) {
-              var entry = jsonDecoded[mail];
-              var aliases = [];
-              var aliasDict = entry['AliasFor'];
-              for (var aliasEntry in aliasDict) {
-                if (aliasDict.hasOwnProperty(aliasEntry)) {
-                  aliases.push(aliasDict[aliasEntry]["Dest"]);
-                }
-              }
-              var virtual_user = entry["VirtualUser"];
-              if (virtual_user) {
-                var virtualUserID = entry["VirtualUserID"];
-                var jqueryRow = $('<tr></tr>')
-                  .append( $('<td class="virtual-user"></td>').text(mail) )
-                  .append( $('<td></td>').text(aliases.join(', ')) )
-                  .append( $('<td class="datatable-button"></td>').html(change_password_button(mail, virtualUserID)) )
-                  .append( $('<td class="datatable-button"></td>').html(remove_user_button(mail, virtualUserID)) );
-                data_table.row.add(jqueryRow);
-              } else {
-                var jqueryRow = $('<tr></tr>')
-                  .append( $('<td class="only-alias"></td>').text(mail) )
-                  .append( $('<td></td>').text(aliases.join(', ')) )
-                  .append( $('<td></td>') )
-                  .append( $('<td></td>') );
-                data_table.row.add(jqueryRow);
-              }
-            }
-          }
-        }
-        catch(e) {
-          set_alert($('#get-alert-status'), 'error', 'Error getting users list: Invalid return syntax');
-        }
-      }
+    headers: {
+        "X-CSRF-Token": csrf_listtrash,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully restored user');
     }
-  }).fail(function(jqXHR, textStatus, error) {
-    set_alert($('#get-alert-status'), 'error', 'Error getting user list: ' + error);
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error restoring user: ' + error);
   })
   .always(function() {
-    data_table.draw();
+    fill_users();
+    fill_trash();
     spinner.stop();
   });
 }
 
-function fill_aliases() {
+function purge_user(userID) {
   var spinner = new Spinner().spin();
-  document.getElementById('aliases').appendChild(spinner.el);
-  $('#get-alert-status').addClass('hidden');
-  data_table.clear();
-  var destination = location.protocol + "//" + location.host + "/api/aliases/";
+  document.getElementById('trash-users').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/trash/" + userID + "/";
+  var jqxhr = $.ajax({
+    type: "DELETE",
+    url: destination,
+    headers: {
+        "X-CSRF-Token": csrf_listtrash,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully purged user');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error purging user: ' + error);
+  })
+  .always(function() {
+    fill_trash();
+    spinner.stop();
+  });
+}
+
+function restore_user_button(user_id) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-repeat" style="color:teal"></span>') )
+          .click(function() {
+            restore_user(user_id);
+          });
+}
+
+function purge_user_button(user_mail, user_id) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-remove" style="color:red"></span>') )
+          .click(function() {
+            delete_confirm('Purge Virtual User?',
+              'Are you sure that you want to purge the virtual user <b>' +
+              escapeHtml(user_mail) +
+              '</b>? The user can\'t be restored afterwards!',
+              function(result) {
+                if(result) {
+                  purge_user(user_id);
+                }
+              }
+            )
+          });
+}
+
+function fill_trash() {
+  var spinner = new Spinner().spin();
+  document.getElementById('trash-users').appendChild(spinner.el);
+  trash_table.clear();
+  var destination = location.protocol + "//" + location.host + "/api/trash/";
   var jqxhr = $.ajax({
     type: "GET",
     url: destination,
     data: "",
     success: function(data, status, request) {
-      csrf_listaliases = request.getResponseHeader("X-CSRF-Token");
+      csrf_listtrash = request.getResponseHeader("X-CSRF-Token");
       if(data) {
         try {
           var jsonDecoded = JSON.parse(data);
-          for(var aliasID in jsonDecoded) {
-            if(jsonDecoded.hasOwnProperty(aliasID)) {
-              var aliasContent = jsonDecoded[aliasID];
-              var source = aliasContent["Source"];
-              var dest = aliasContent["Dest"];
+          for(var userID in jsonDecoded) {
+            if(jsonDecoded.hasOwnProperty(userID)) {
+              var entry = jsonDecoded[userID];
               var jqueryRow = $('<tr></tr>')
-                .append( $('<td></td>').text(source) )
-                .append( $('<td></td>').text(dest) )
-                .append( $('<td class="datatable-button"></td>').html(remove_alias_button(aliasID, source, dest)) );
-              data_table.row.add(jqueryRow);
+                .append( $('<td></td>').text(entry["Mail"]) )
+                .append( $('<td></td>').text(new Date(entry["Deleted"]).toLocaleString()) )
+                .append( $('<td></td>').text(new Date(entry["PurgeAfter"]).toLocaleString()) )
+                .append( $('<td class="datatable-button"></td>').html(restore_user_button(userID)) )
+                .append( $('<td class="datatable-button"></td>').html(purge_user_button(entry["Mail"], userID)) );
+              trash_table.row.add(jqueryRow);
             }
           }
         }
         catch(e) {
-          set_alert($('#get-alert-status'), 'error', 'Error getting alias list: Invalid return syntax');
+          set_alert($('#get-alert-status'), 'error', 'Error getting trash list: Invalid return syntax');
         }
       }
     }
   }).fail(function(jqXHR, textStatus, error) {
-    set_alert($('#get-alert-status'), 'error', 'Error getting alias list: ' + error);
+    set_alert($('#get-alert-status'), 'error', 'Error getting trash list: ' + error);
   })
   .always(function() {
-    data_table.draw();
+    trash_table.draw();
     spinner.stop();
   });
 }
 
+function aliases_table() {
+  var domainID = "-1";
+  var urlParam = getUrlParameter('domain')
+  if (typeof urlParam != 'undefined') {
+    domainID = urlParam
+  }
+  return paged_table('#aliases', "/api/aliases/?domain=" + domainID,
+    ["source", "destination", null],
+    function(row, entry) {
+      var cells = $('td', row);
+      cells.eq(0).text(entry["Source"]);
+      cells.eq(1).text(entry["Dest"]);
+      cells.eq(2).addClass('datatable-button').html(remove_alias_button(entry["ID"], entry["Source"], entry["Dest"]));
+    },
+    function(request) {
+      csrf_listaliases = request.getResponseHeader("X-CSRF-Token");
+    });
+}
+
+function fill_aliases() {
+  $('#get-alert-status').addClass('hidden');
+  data_table.ajax.reload(null, false);
+}
+
 function add_admin() {
   var spinner = new Spinner().spin();
   document.getElementById('admins').appendChild(spinner.el);
   var destination = location.protocol + "//" + location.host + "/api/admins/";
   var form_data = $('#add-admin-form').serializeArray();
-  form_map = { 'username': form_data[0]['value'], 'password': form_data[1]['value'] }
-  if (form_data[1]['value'].length < 6) {
-    bootbox.alert("Password must be at least six characters long");
+  form_map = { 'username': form_data[0]['value'], 'password': form_data[1]['value'],
+    'role': form_data[2]['value'] }
+  if (form_data[1]['value'].length == 0) {
+    bootbox.alert("Password must not be empty");
     spinner.stop();
     return
   }
@@ -537,7 +1148,7 @@ function add_admin() {
     }
   })
   .fail(function(jqXHR, textStatus, error) {
-    set_alert($('#manipulate-alert-status'), 'error', 'Error adding user: ' + error);
+    set_alert($('#manipulate-alert-status'), 'error', 'Error adding user: ' + password_error(jqXHR, error));
   })
   .always(function() {
     spinner.stop();
@@ -586,8 +1197,8 @@ function remove_admin_button(admin_user) {
 }
 
 function change_admin_password(admin_user, password) {
-  if (password.length < 6) {
-    bootbox.alert("Password must be at least six characters long");
+  if (password.length == 0) {
+    bootbox.alert("Password must not be empty");
     return
   }
   var spinner = new Spinner().spin();
@@ -605,7 +1216,7 @@ function change_admin_password(admin_user, password) {
     }
   })
   .fail(function(jqXHR, textStatus, error) {
-    set_alert($('#manipulate-alert-status'), 'error', 'Error changing admin password: ' + error);
+    set_alert($('#manipulate-alert-status'), 'error', 'Error changing admin password: ' + password_error(jqXHR, error));
   })
   .always(function() {
     spinner.stop();
@@ -631,6 +1242,215 @@ function change_admin_password_button(admin_user) {
           });
 }
 
+var admin_roles = ['superadmin', 'domainadmin', 'helpdesk', 'readonly'];
+
+function change_admin_role(admin_user, role) {
+  var spinner = new Spinner().spin();
+  document.getElementById('admins').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/admins/" + admin_user + "/";
+  var jqxhr = $.ajax({
+    type: "UPDATE",
+    url: destination,
+    data: JSON.stringify( { "role": role } ),
+    headers: {
+        "X-CSRF-Token": csrf_listadmins,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully changed admin role');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error changing admin role: ' + error);
+  })
+  .always(function() {
+    fill_admins();
+    spinner.stop();
+  });
+}
+
+function admin_role_select(admin_user, role) {
+  var select = $('<select class="form-control"></select>');
+  for (var i = 0; i < admin_roles.length; i++) {
+    select.append( $('<option></option>').attr('value', admin_roles[i]).text(admin_roles[i]) );
+  }
+  select.val(role);
+  select.change(function() {
+    change_admin_role(admin_user, select.val());
+  });
+  return select;
+}
+
+function change_admin_domains(admin_user, domains) {
+  var spinner = new Spinner().spin();
+  document.getElementById('admins').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/admins/" + admin_user + "/";
+  var jqxhr = $.ajax({
+    type: "UPDATE",
+    url: destination,
+    data: JSON.stringify( { "domains": domains } ),
+    headers: {
+        "X-CSRF-Token": csrf_listadmins,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully changed admin domains');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error changing admin domains: ' + error);
+  })
+  .always(function() {
+    fill_admins();
+    spinner.stop();
+  });
+}
+
+function admin_domains_button(admin_user, domains) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-globe" style="color:teal"></span>') )
+          .click(function() {
+            var destination = location.protocol + "//" + location.host + "/api/domains/";
+            $.ajax({
+              type: "GET",
+              url: destination,
+              data: "",
+              success: function(data, status, request) {
+                var allDomains = JSON.parse(data);
+                var options = [];
+                for(var domainID in allDomains) {
+                  if(allDomains.hasOwnProperty(domainID)) {
+                    options.push( { text: allDomains[domainID], value: domainID } );
+                  }
+                }
+                if (options.length == 0) {
+                  bootbox.alert("There are no domains yet");
+                  return;
+                }
+                bootbox.prompt({
+                  title: "Domains for admin <b>" + escapeHtml(admin_user) + "</b>",
+                  inputType: 'checkbox',
+                  inputOptions: options,
+                  value: domains.map(String),
+                  callback: function (result) {
+                    if (result !== null) {
+                      change_admin_domains(admin_user, result.map(function(id) { return parseInt(id, 10); }));
+                    }
+                  }
+                });
+              }
+            }).fail(function(jqXHR, textStatus, error) {
+              set_alert($('#get-alert-status'), 'error', 'Error getting domain list: ' + error);
+            });
+          });
+}
+
+function reset_admin_2fa(admin_user) {
+  var spinner = new Spinner().spin();
+  document.getElementById('admins').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/admins/" + admin_user + "/";
+  var jqxhr = $.ajax({
+    type: "UPDATE",
+    url: destination,
+    data: JSON.stringify( { "reset-2fa": true } ),
+    headers: {
+        "X-CSRF-Token": csrf_listadmins,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully reset two-factor authentication');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error resetting two-factor authentication: ' + error);
+  })
+  .always(function() {
+    spinner.stop();
+  });
+}
+
+function reset_admin_2fa_button(admin_user) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-phone" style="color:teal"></span>') )
+          .click(function() {
+            delete_confirm('Reset Two-Factor Authentication?',
+              'Are you sure that you want to reset the two-factor authentication of <b>' +
+              escapeHtml(admin_user) + '</b>?',
+              function(result) {
+                if(result) {
+                  reset_admin_2fa(admin_user);
+                }
+              }
+            )
+          });
+}
+
+function clear_lockout(scope, subject) {
+  var destination = location.protocol + "//" + location.host + "/api/lockouts/" + scope + "/" + encodeURIComponent(subject) + "/";
+  var jqxhr = $.ajax({
+    type: "DELETE",
+    url: destination,
+    headers: {
+        "X-CSRF-Token": csrf_lockouts,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully cleared lockout');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error clearing lockout: ' + error);
+  })
+  .always(function() {
+    fill_lockouts();
+  });
+}
+
+function clear_lockout_button(scope, subject) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-remove" style="color:red"></span>') )
+          .click(function() {
+            clear_lockout(scope, subject);
+          });
+}
+
+function fill_lockouts() {
+  lockout_table.clear();
+  var destination = location.protocol + "//" + location.host + "/api/lockouts/";
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      csrf_lockouts = request.getResponseHeader("X-CSRF-Token");
+      if(data) {
+        try {
+          var jsonDecoded = JSON.parse(data);
+          for(var i = 0; i < jsonDecoded.length; i++) {
+            var entry = jsonDecoded[i];
+            var locked_until = entry["locked-until"];
+            if (locked_until.indexOf("0001-") == 0) {
+              locked_until = "";
+            }
+            var jqueryRow = $('<tr></tr>')
+              .append( $('<td></td>').text(entry["scope"]) )
+              .append( $('<td></td>').text(entry["subject"]) )
+              .append( $('<td></td>').text(entry["failures"]) )
+              .append( $('<td></td>').text(entry["last-failure"]) )
+              .append( $('<td></td>').text(locked_until) )
+              .append( $('<td class="datatable-button"></td>').html( clear_lockout_button(entry["scope"], entry["subject"]) ) );
+            lockout_table.row.add(jqueryRow);
+          }
+        }
+        catch(e) {
+          set_alert($('#get-alert-status'), 'error', 'Error getting lockouts: Invalid return syntax');
+        }
+      }
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#get-alert-status'), 'error', 'Error getting lockouts: ' + error);
+  })
+  .always(function() {
+    lockout_table.draw();
+  });
+}
+
 function fill_admins() {
   var spinner = new Spinner().spin();
   document.getElementById('admins').appendChild(spinner.el);
@@ -648,10 +1468,15 @@ function fill_admins() {
           var jsonDecoded = JSON.parse(data);
           for(var adminID in jsonDecoded) {
             if(jsonDecoded.hasOwnProperty(adminID)) {
-              var username = jsonDecoded[adminID];
+              var username = jsonDecoded[adminID]["username"];
+              var role = jsonDecoded[adminID]["role"];
+              var domains = jsonDecoded[adminID]["domains"];
               var jqueryRow = $('<tr></tr>')
                 .append( $('<td></td>').text(username) )
+                .append( $('<td></td>').html( admin_role_select(username, role) ) )
+                .append( $('<td class="datatable-button"></td>').html( admin_domains_button(username, domains) ) )
                 .append( $('<td class="datatable-button"></td>').html( change_admin_password_button(username) ) )
+                .append( $('<td class="datatable-button"></td>').html( reset_admin_2fa_button(username) ) )
                 .append( $('<td class="datatable-button"></td>').html( remove_admin_button(username) ) );
               data_table.row.add(jqueryRow);
             }
@@ -671,6 +1496,449 @@ function fill_admins() {
   });
 }
 
+var csrf_2fa = null;
+
+function fill_2fa() {
+  $('#get-alert-status').addClass('hidden');
+  var destination = location.protocol + "//" + location.host + "/api/2fa/";
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      csrf_2fa = request.getResponseHeader("X-CSRF-Token");
+      try {
+        var jsonDecoded = JSON.parse(data);
+        $('#totp-setup-area').addClass('hidden');
+        if (jsonDecoded["enabled"]) {
+          $('#totp-status').text('Two-factor authentication is enabled, ' + jsonDecoded["recovery-codes"] + ' recovery codes left.');
+          $('#totp-enable-area').addClass('hidden');
+          if (jsonDecoded["required"]) {
+            $('#totp-disable-form').addClass('hidden');
+          } else {
+            $('#totp-disable-form').removeClass('hidden');
+          }
+        } else {
+          $('#totp-status').text('Two-factor authentication is disabled.');
+          $('#totp-enable-area').removeClass('hidden');
+          $('#totp-disable-form').addClass('hidden');
+        }
+      }
+      catch(e) {
+        set_alert($('#get-alert-status'), 'error', 'Error getting two-factor status: Invalid return syntax');
+      }
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#get-alert-status'), 'error', 'Error getting two-factor status: ' + error);
+  });
+}
+
+function start_2fa_enroll() {
+  var destination = location.protocol + "//" + location.host + "/api/2fa/";
+  var jqxhr = $.ajax({
+    type: "POST",
+    url: destination,
+    data: "",
+    headers: {
+      "X-CSRF-Token": csrf_2fa,
+    },
+    success: function(data, status) {
+      show_totp_setup($('#totp-setup'), JSON.parse(data));
+      $('#totp-enable-area').addClass('hidden');
+      $('#totp-setup-area').removeClass('hidden');
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error starting two-factor setup: ' + error);
+  });
+}
+
+function confirm_2fa_enroll() {
+  var destination = location.protocol + "//" + location.host + "/api/2fa/";
+  var jqxhr = $.ajax({
+    type: "UPDATE",
+    url: destination,
+    data: JSON.stringify( { "code": $('#totp-enroll-code').val() } ),
+    headers: {
+      "X-CSRF-Token": csrf_2fa,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Two-factor authentication enabled');
+      show_recovery_codes($('#totp-recovery-codes'), JSON.parse(data)["recovery-codes"]);
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error enabling two-factor authentication: ' + error);
+  }).always(function() {
+    fill_2fa();
+  });
+}
+
+function disable_2fa() {
+  var destination = location.protocol + "//" + location.host + "/api/2fa/";
+  var jqxhr = $.ajax({
+    type: "DELETE",
+    url: destination,
+    data: JSON.stringify( { "code": $('#totp-disable-code').val() } ),
+    headers: {
+      "X-CSRF-Token": csrf_2fa,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Two-factor authentication disabled');
+      $('#totp-recovery-codes').empty();
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error disabling two-factor authentication: ' + error);
+  }).always(function() {
+    fill_2fa();
+  });
+}
+
+function add_token() {
+  var spinner = new Spinner().spin();
+  document.getElementById('tokens').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/tokens/";
+  var scopes = [];
+  $('#add-token-form input[name="scopes"]:checked').each(function() {
+    scopes.push($(this).val());
+  });
+  var form_map = { 'name': $('#token-name').val(), 'scopes': scopes,
+    'expires-in': $('#token-expires').val() };
+  var jqxhr = $.ajax({
+    type: 'POST',
+    url: destination,
+    data: JSON.stringify(form_map),
+    headers: {
+      "X-CSRF-Token": csrf_listtokens,
+    },
+    success: function(data, status) {
+      var token = JSON.parse(data)["token"];
+      bootbox.alert('Your new token is <code>' + escapeHtml(token) + '</code><br>Copy it now, it will not be shown again.');
+      set_alert($('#manipulate-alert-status'), 'success', 'Created new token');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error creating token: ' + escapeHtml(jqXHR.responseText));
+  })
+  .always(function() {
+    spinner.stop();
+    fill_tokens();
+  });
+}
+
+function delete_token(token_id) {
+  var spinner = new Spinner().spin();
+  document.getElementById('tokens').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/tokens/" + token_id + "/";
+  var jqxhr = $.ajax({
+    type: "DELETE",
+    url: destination,
+    headers: {
+        "X-CSRF-Token": csrf_listtokens,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully revoked token');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error revoking token: ' + error);
+  })
+  .always(function() {
+    fill_tokens();
+    spinner.stop();
+  });
+}
+
+function remove_token_button(token_id, name) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-remove" style="color:red"></span>') )
+          .click(function() {
+            delete_confirm('Revoke Token?',
+              'Are you sure that you want to revoke the token <b>' +
+              escapeHtml(name) + '</b>?',
+              function(result) {
+                if(result) {
+                  delete_token(token_id);
+                }
+              }
+            )
+          });
+}
+
+function format_time(value) {
+  if (!value || value.indexOf("0001-") == 0) {
+    return "never";
+  }
+  return value;
+}
+
+function fill_tokens() {
+  var spinner = new Spinner().spin();
+  document.getElementById('tokens').appendChild(spinner.el);
+  $('#get-alert-status').addClass('hidden');
+  data_table.clear();
+  var destination = location.protocol + "//" + location.host + "/api/tokens/";
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      csrf_listtokens = request.getResponseHeader("X-CSRF-Token");
+      if(data) {
+        try {
+          var jsonDecoded = JSON.parse(data);
+          for(var tokenID in jsonDecoded) {
+            if(jsonDecoded.hasOwnProperty(tokenID)) {
+              var token = jsonDecoded[tokenID];
+              var jqueryRow = $('<tr></tr>')
+                .append( $('<td></td>').text(token["name"]) )
+                .append( $('<td></td>').text(token["scopes"].join(", ")) )
+                .append( $('<td></td>').text(format_time(token["created"])) )
+                .append( $('<td></td>').text(format_time(token["expires"])) )
+                .append( $('<td></td>').text(format_time(token["last-used"])) )
+                .append( $('<td class="datatable-button"></td>').html(remove_token_button(tokenID, token["name"])) );
+              data_table.row.add(jqueryRow);
+            }
+          }
+        }
+        catch(e) {
+          set_alert($('#get-alert-status'), 'error', 'Error getting token list: Invalid return syntax');
+        }
+      }
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#get-alert-status'), 'error', 'Error getting token list: ' + error);
+  })
+  .always(function() {
+    data_table.draw();
+    spinner.stop();
+  });
+}
+
+function revoke_session(session_id) {
+  var spinner = new Spinner().spin();
+  document.getElementById('sessions').appendChild(spinner.el);
+  var destination = location.protocol + "//" + location.host + "/api/sessions/" + session_id + "/";
+  var jqxhr = $.ajax({
+    type: "DELETE",
+    url: destination,
+    headers: {
+        "X-CSRF-Token": csrf_listsessions,
+    },
+    success: function(data, status) {
+      set_alert($('#manipulate-alert-status'), 'success', 'Successfully revoked session');
+    }
+  })
+  .fail(function(jqXHR, textStatus, error) {
+    set_alert($('#manipulate-alert-status'), 'error', 'Error revoking session: ' + error);
+  })
+  .always(function() {
+    fill_sessions();
+    spinner.stop();
+  });
+}
+
+function revoke_other_sessions() {
+  delete_confirm('Log Out Other Sessions?',
+    'Are you sure that you want to log out all other sessions?',
+    function(result) {
+      if(!result) {
+        return;
+      }
+      var spinner = new Spinner().spin();
+      document.getElementById('sessions').appendChild(spinner.el);
+      var destination = location.protocol + "//" + location.host + "/api/sessions/";
+      var jqxhr = $.ajax({
+        type: "DELETE",
+        url: destination,
+        headers: {
+            "X-CSRF-Token": csrf_listsessions,
+        },
+        success: function(data, status) {
+          set_alert($('#manipulate-alert-status'), 'success', 'Successfully logged out all other sessions');
+        }
+      })
+      .fail(function(jqXHR, textStatus, error) {
+        set_alert($('#manipulate-alert-status'), 'error', 'Error revoking sessions: ' + error);
+      })
+      .always(function() {
+        fill_sessions();
+        spinner.stop();
+      });
+    }
+  );
+}
+
+function revoke_session_button(session_id, current) {
+  return $('<button type="button" class="btn btn-default"></button>')
+          .append( $('<span class="glyphicon glyphicon-remove" style="color:red"></span>') )
+          .click(function() {
+            var message = 'Are you sure that you want to revoke this session?';
+            if(current) {
+              message = 'This is your current session, you will be logged out. Continue?';
+            }
+            delete_confirm('Revoke Session?', message,
+              function(result) {
+                if(!result) {
+                  return;
+                }
+                if(current) {
+                  window.location.href = "/logout/";
+                } else {
+                  revoke_session(session_id);
+                }
+              }
+            )
+          });
+}
+
+function fill_sessions() {
+  var spinner = new Spinner().spin();
+  document.getElementById('sessions').appendChild(spinner.el);
+  $('#get-alert-status').addClass('hidden');
+  data_table.clear();
+  var destination = location.protocol + "//" + location.host + "/api/sessions/";
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      csrf_listsessions = request.getResponseHeader("X-CSRF-Token");
+      if(data) {
+        try {
+          var jsonDecoded = JSON.parse(data);
+          for(var sessionID in jsonDecoded) {
+            if(jsonDecoded.hasOwnProperty(sessionID)) {
+              var session = jsonDecoded[sessionID];
+              var created = $('<td></td>').text(session["created"]);
+              if(session["current"]) {
+                created.append(' <span class="label label-success">current</span>');
+              }
+              var jqueryRow = $('<tr></tr>')
+                .append( created )
+                .append( $('<td></td>').text(session["last-seen"]) )
+                .append( $('<td></td>').text(session["expires"]) )
+                .append( $('<td></td>').text(session["remote-addr"]) )
+                .append( $('<td></td>').text(session["user-agent"]) )
+                .append( $('<td class="datatable-button"></td>').html(revoke_session_button(sessionID, session["current"])) );
+              data_table.row.add(jqueryRow);
+            }
+          }
+        }
+        catch(e) {
+          set_alert($('#get-alert-status'), 'error', 'Error getting session list: Invalid return syntax');
+        }
+      }
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#get-alert-status'), 'error', 'Error getting session list: ' + error);
+  })
+  .always(function() {
+    data_table.draw();
+    spinner.stop();
+  });
+}
+
+var audit_admin_names = {};
+
+function load_audit_admins() {
+  var destination = location.protocol + "//" + location.host + "/api/admins/";
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      if(data) {
+        try {
+          var jsonDecoded = JSON.parse(data);
+          for(var adminID in jsonDecoded) {
+            if(jsonDecoded.hasOwnProperty(adminID)) {
+              audit_admin_names[adminID] = jsonDecoded[adminID]["username"];
+            }
+          }
+        }
+        catch(e) {
+          // just show the ids
+        }
+      }
+    }
+  })
+  .always(function() {
+    fill_audit();
+  });
+}
+
+function audit_value(value) {
+  if (typeof value == 'undefined' || value === null) {
+    return '';
+  }
+  return JSON.stringify(value);
+}
+
+function fill_audit() {
+  var spinner = new Spinner().spin();
+  document.getElementById('audit').appendChild(spinner.el);
+  $('#get-alert-status').addClass('hidden');
+  data_table.clear();
+  var params = {};
+  var operation = $('#audit-operation').val();
+  if (operation) {
+    params['operation'] = operation;
+  }
+  var target_type = $('#audit-target-type').val();
+  if (target_type) {
+    params['target-type'] = target_type;
+  }
+  var since = $('#audit-since').val();
+  if (since) {
+    params['since'] = since + 'T00:00:00Z';
+  }
+  var until = $('#audit-until').val();
+  if (until) {
+    params['until'] = until + 'T23:59:59Z';
+  }
+  var limit = $('#audit-limit').val();
+  if (limit) {
+    params['limit'] = limit;
+  }
+  var destination = location.protocol + "//" + location.host + "/api/audit/?" + $.param(params);
+  var jqxhr = $.ajax({
+    type: "GET",
+    url: destination,
+    data: "",
+    success: function(data, status, request) {
+      if(data) {
+        try {
+          var jsonDecoded = JSON.parse(data);
+          for(var i = 0; i < jsonDecoded.length; i++) {
+            var entry = jsonDecoded[i];
+            var admin = entry["admin-id"];
+            if (audit_admin_names.hasOwnProperty(admin)) {
+              admin = audit_admin_names[admin];
+            }
+            var jqueryRow = $('<tr></tr>')
+              .append( $('<td></td>').text(entry["time"]) )
+              .append( $('<td></td>').text(admin) )
+              .append( $('<td></td>').text(entry["operation"]) )
+              .append( $('<td></td>').text(entry["target-type"] + ' ' + entry["target-id"]) )
+              .append( $('<td></td>').text(audit_value(entry["old-value"])) )
+              .append( $('<td></td>').text(audit_value(entry["new-value"])) )
+              .append( $('<td></td>').text(entry["remote-addr"]) );
+            data_table.row.add(jqueryRow);
+          }
+        }
+        catch(e) {
+          set_alert($('#get-alert-status'), 'error', 'Error getting audit log: Invalid return syntax');
+        }
+      }
+    }
+  }).fail(function(jqXHR, textStatus, error) {
+    set_alert($('#get-alert-status'), 'error', 'Error getting audit log: ' + error);
+  })
+  .always(function() {
+    data_table.draw();
+    spinner.stop();
+  });
+}
+
 // next stuff is from https://github.com/janl/mustache.js/blob/master/mustache.js
 // TODO use this more!
 var entityMap = {
@@ -0,0 +1,458 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains API tokens for machine clients. An admin can create
+// named tokens that are limited to a set of permissions (the scopes) and
+// expire after some time. Requests to the API with the header
+// "Authorization: Bearer <token>" are authenticated with the token instead
+// of a session cookie (see RoleRequired) and are exempt from the CSRF check
+// (see BearerCSRFExempt). Only the sha256 of a token is stored.
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/gorilla/csrf"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// tokenPrefix is the prefix of all API tokens, it makes them easy to
+	// recognize (for example by secret scanners).
+	tokenPrefix = "mwa_"
+	// defaultTokenLifespan is the lifespan of a token if none is given.
+	defaultTokenLifespan = 90 * 24 * time.Hour
+)
+
+// APIToken is the information about an API token, the token itself is
+// never stored.
+type APIToken struct {
+	AdminID goauth.UserKeyType `json:"admin-id"`
+	Name    string             `json:"name"`
+	Scopes  []Permission       `json:"scopes"`
+	Created time.Time          `json:"created"`
+	Expires time.Time          `json:"expires"`
+	// LastUsed is the zero time if the token was never used.
+	LastUsed time.Time `json:"last-used"`
+}
+
+// HasScope checks if the token grants the permission.
+func (token *APIToken) HasScope(perm Permission) bool {
+	for _, scope := range token.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken returns the hex encoded sha256 of the token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// encodeScopes returns the scopes as a comma separated list.
+func encodeScopes(scopes []Permission) string {
+	names := make([]string, len(scopes))
+	for i, scope := range scopes {
+		names[i] = scope.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// decodeScopes parses a list created by encodeScopes.
+func decodeScopes(s string) ([]Permission, error) {
+	res := make([]Permission, 0)
+	if s == "" {
+		return res, nil
+	}
+	for _, name := range strings.Split(s, ",") {
+		perm, err := ParsePermission(name)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, perm)
+	}
+	return res, nil
+}
+
+// CreateAPIToken creates a new token for the admin and returns the id and
+// the token. The token is only returned here, it can't be retrieved later.
+func CreateAPIToken(appContext *MailAppContext, adminID goauth.UserKeyType, name string, scopes []Permission, lifespan time.Duration) (int64, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return -1, "", err
+	}
+	token := tokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	now := time.Now().UTC()
+	query := `INSERT INTO api_tokens (user_id, name, token_hash, scopes, created, expires)
+	VALUES (?, ?, ?, ?, ?, ?);`
+	res, err := appContext.DB.Exec(query, uint64(adminID), name, hashToken(token), encodeScopes(scopes), now, now.Add(lifespan))
+	if err != nil {
+		return -1, "", err
+	}
+	id, _ := res.LastInsertId()
+	appContext.Logger.WithFields(log.Fields{
+		"admin-id": adminID,
+		"token-id": id,
+		"name":     name,
+	}).Info("Created API token")
+	return id, token, nil
+}
+
+// scanAPIToken scans a row of the form
+// id, user_id, name, scopes, created, expires, last_used.
+func scanAPIToken(scanner interface {
+	Scan(dest ...interface{}) error
+}) (int64, *APIToken, error) {
+	var id int64
+	var adminID uint64
+	var scopes string
+	var created, expires, lastUsed sqlTime
+	res := &APIToken{}
+	if err := scanner.Scan(&id, &adminID, &res.Name, &scopes, &created, &expires, &lastUsed); err != nil {
+		return -1, nil, err
+	}
+	perms, scopesErr := decodeScopes(scopes)
+	if scopesErr != nil {
+		return -1, nil, scopesErr
+	}
+	res.AdminID = goauth.UserKeyType(adminID)
+	res.Scopes = perms
+	res.Created = created.Time
+	res.Expires = expires.Time
+	res.LastUsed = lastUsed.Time
+	return id, res, nil
+}
+
+// GetAPIToken returns the token with the given id.
+func GetAPIToken(appContext *MailAppContext, tokenID int64) (*APIToken, error) {
+	query := "SELECT id, user_id, name, scopes, created, expires, last_used FROM api_tokens WHERE id = ?;"
+	_, res, err := scanAPIToken(appContext.DB.QueryRow(query, tokenID))
+	return res, err
+}
+
+// ListAPITokens returns all tokens in the form id --> APIToken. If adminID
+// is not goauth.NoUserID only the tokens of this admin are returned.
+func ListAPITokens(appContext *MailAppContext, adminID goauth.UserKeyType) (map[int64]*APIToken, error) {
+	query := "SELECT id, user_id, name, scopes, created, expires, last_used FROM api_tokens"
+	queryArgs := make([]interface{}, 0)
+	if adminID != goauth.NoUserID {
+		query += " WHERE user_id = ?"
+		queryArgs = append(queryArgs, uint64(adminID))
+	}
+	rows, err := appContext.DB.Query(query+";", queryArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int64]*APIToken)
+	for rows.Next() {
+		id, token, scanErr := scanAPIToken(rows)
+		if scanErr != nil {
+			return nil, scanErr
+		}
+		res[id] = token
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteAPIToken revokes the token with the given id.
+func DeleteAPIToken(appContext *MailAppContext, tokenID int64) error {
+	res, err := appContext.DB.Exec("DELETE FROM api_tokens WHERE id = ?;", tokenID)
+	if err != nil {
+		return err
+	}
+	deleteNum, _ := res.RowsAffected()
+	if deleteNum != 1 {
+		appContext.Logger.WithField("token-id", tokenID).Warn("API token for delete not found")
+	} else {
+		appContext.Logger.WithField("token-id", tokenID).Info("Revoked API token")
+	}
+	return nil
+}
+
+// DeleteAPITokensForAdmin revokes all tokens of the admin, this is called
+// when an admin is deleted.
+func DeleteAPITokensForAdmin(appContext *MailAppContext, adminID goauth.UserKeyType) error {
+	_, err := appContext.DB.Exec("DELETE FROM api_tokens WHERE user_id = ?;", uint64(adminID))
+	return err
+}
+
+// ValidateAPIToken looks up the token and returns its id and information.
+// It returns sql.ErrNoRows if the token doesn't exist or is expired.
+// On success the last used time is updated.
+func ValidateAPIToken(appContext *MailAppContext, token string) (int64, *APIToken, error) {
+	query := "SELECT id, user_id, name, scopes, created, expires, last_used FROM api_tokens WHERE token_hash = ?;"
+	id, res, err := scanAPIToken(appContext.DB.QueryRow(query, hashToken(token)))
+	if err != nil {
+		return -1, nil, err
+	}
+	now := time.Now().UTC()
+	if !now.Before(res.Expires) {
+		return -1, nil, sql.ErrNoRows
+	}
+	if _, updateErr := appContext.DB.Exec("UPDATE api_tokens SET last_used = ? WHERE id = ?;", now, id); updateErr != nil {
+		appContext.Logger.WithError(updateErr).WithField("token-id", id).Warn("Can't update last used time of API token")
+	}
+	res.LastUsed = now
+	return id, res, nil
+}
+
+// bearerToken returns the token from the Authorization header and true if
+// the header contains a bearer token.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// authenticateToken validates the bearer token of the request. If the token
+// is invalid it replies with a 401 and returns false.
+func authenticateToken(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request, token string) (int64, *APIToken, bool, error) {
+	id, res, err := ValidateAPIToken(appcontext, token)
+	switch {
+	case err == sql.ErrNoRows:
+		appcontext.Logger.WithField("remote", r.RemoteAddr).Warn("Request with invalid API token")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mailwebadmin"`)
+		http.Error(w, "Invalid token", 401)
+		return -1, nil, false, nil
+	case err != nil:
+		return -1, nil, false, err
+	}
+	return id, res, true, nil
+}
+
+// APITokenFromRequest returns the id of the token used to authenticate the
+// request, ok is false if the request was authenticated with a session.
+func APITokenFromRequest(r *http.Request) (tokenID int64, ok bool) {
+	tokenID, ok = r.Context().Value(apiTokenKey).(int64)
+	return
+}
+
+// BearerCSRFExempt is a middleware that disables the CSRF check for
+// requests with a bearer token. It must wrap the csrf.Protect handler.
+// This is safe because browsers never add an Authorization header on their
+// own and RoleRequired only uses the token (not the session cookie) for such
+// requests.
+func BearerCSRFExempt(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, isBearer := bearerToken(r); isBearer {
+			r = csrf.UnsafeSkipCheck(r)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// listTokensRegex matches /api/tokens/<id>.
+var listTokensRegex = regexp.MustCompile(`^/api/tokens/((\d+)/?)?$`)
+
+// parseListTokensURL returns the id from the url.
+func parseListTokensURL(url string) (int64, error) {
+	if url == "/api/tokens/" || url == "/api/tokens" {
+		return -1, errNoID
+	}
+	return parseIDFromURL(listTokensRegex, url)
+}
+
+// addAPIToken creates a new token for the admin of the request. It accepts
+// JSON requests of the form
+// {"name": <name>, "scopes": [<permission>, ...], "expires-in": <duration>}
+// where expires-in is a duration like "720h" (defaults to 90 days).
+// The scopes must be granted by the role of the admin.
+// It writes {"token-id": <id>, "token": <token>} to the response.
+func addAPIToken(appContext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	adminID, role, _ := AdminFromRequest(r)
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		appContext.Logger.WithError(readErr).Info("Invalid request syntax to add an API token")
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	var tokenData struct {
+		Name      string
+		Scopes    []string
+		ExpiresIn string `json:"expires-in"`
+	}
+	if jsonErr := json.Unmarshal(body, &tokenData); jsonErr != nil {
+		appContext.Logger.WithError(jsonErr).Info("Invalid request syntax to add an API token")
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	tokenData.Name = strings.TrimSpace(tokenData.Name)
+	if tokenData.Name == "" || len(tokenData.Name) > 100 {
+		http.Error(w, "Token name must be between 1 and 100 characters long", 400)
+		return nil
+	}
+	if len(tokenData.Scopes) == 0 {
+		http.Error(w, "A token needs at least one scope", 400)
+		return nil
+	}
+	scopes := make([]Permission, 0, len(tokenData.Scopes))
+	for _, name := range tokenData.Scopes {
+		perm, permErr := ParsePermission(name)
+		if permErr != nil {
+			http.Error(w, permErr.Error(), 400)
+			return nil
+		}
+		if !role.HasPermission(perm) {
+			http.Error(w, fmt.Sprintf("Your role doesn't grant the scope \"%s\"", name), 400)
+			return nil
+		}
+		scopes = append(scopes, perm)
+	}
+	lifespan := defaultTokenLifespan
+	if tokenData.ExpiresIn != "" {
+		var parseErr error
+		lifespan, parseErr = time.ParseDuration(tokenData.ExpiresIn)
+		if parseErr != nil || lifespan <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid duration \"%s\"", tokenData.ExpiresIn), 400)
+			return nil
+		}
+	}
+	tokenID, token, err := CreateAPIToken(appContext, adminID, tokenData.Name, scopes, lifespan)
+	if err != nil {
+		return err
+	}
+	recordAudit(appContext, r, AuditAddToken, AuditTargetToken, tokenID, nil,
+		AuditValues{"name": tokenData.Name, "scopes": encodeScopes(scopes), "admin-id": adminID})
+	res := map[string]interface{}{
+		"token-id": tokenID,
+		"token":    token,
+	}
+	jsonEnc, jsonEncErr := json.Marshal(res)
+	if jsonEncErr != nil {
+		return jsonEncErr
+	}
+	w.Write(jsonEnc)
+	return nil
+}
+
+// rejectTokenWrite is called by the handlers that manage the account of the
+// admin itself (/api/tokens/, /api/sessions/ and /api/2fa/). They only
+// require PermissionRead, so requests authenticated with an API token may
+// only read them: Otherwise a read-only token could revoke sessions and
+// tokens or enable two-factor authentication with a secret only the holder of
+// the token knows.
+// It replies with 403 Forbidden and returns true if the request is rejected.
+func rejectTokenWrite(w http.ResponseWriter, r *http.Request) bool {
+	if _, isToken := APITokenFromRequest(r); isToken && r.Method != getMethod {
+		http.Error(w, "API tokens can only read this resource", 403)
+		return true
+	}
+	return false
+}
+
+// ListTokensJSON is the main handler for /api/tokens.
+// GET returns the tokens of the admin (all tokens for admins that can manage
+// admins) in the form {<token-id>: <APIToken>}, POST creates a new token
+// (see addAPIToken) and DELETE /api/tokens/<id> revokes a token.
+// Requests authenticated with a token can only use GET, see
+// rejectTokenWrite.
+func ListTokensJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	tokenID, parseErr := parseListTokensURL(r.URL.Path)
+	if parseErr != nil && parseErr != errNoID {
+		http.NotFound(w, r)
+		return nil
+	}
+	adminID, role, ok := AdminFromRequest(r)
+	if !ok {
+		http.Error(w, "Forbidden", 403)
+		return nil
+	}
+	if rejectTokenWrite(w, r) {
+		return nil
+	}
+	// admins that can manage admins see and revoke all tokens
+	owner := adminID
+	if role.HasPermission(PermissionManageAdmins) {
+		owner = goauth.NoUserID
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/tokens/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		if tokenID >= 0 {
+			http.Error(w, "Invalid GET request. Must be GET /api/tokens/", 400)
+			return nil
+		}
+		res, err := ListAPITokens(appcontext, owner)
+		if err != nil {
+			return err
+		}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		// create json encoding
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case postMethod:
+		if tokenID >= 0 {
+			http.Error(w, "Invalid POST request to /api/tokens/.", 400)
+			return nil
+		}
+		return addAPIToken(appcontext, w, r)
+	case deleteMethod:
+		if tokenID < 0 {
+			http.Error(w, "Invalid DELETE request to /api/tokens/: No id given.", 400)
+			return nil
+		}
+		token, err := GetAPIToken(appcontext, tokenID)
+		if err == sql.ErrNoRows || (err == nil && owner != goauth.NoUserID && token.AdminID != owner) {
+			http.NotFound(w, r)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if delErr := DeleteAPIToken(appcontext, tokenID); delErr != nil {
+			return delErr
+		}
+		recordAudit(appcontext, r, AuditDeleteToken, AuditTargetToken, tokenID,
+			AuditValues{"name": token.Name, "admin-id": token.AdminID}, nil)
+		return nil
+	}
+}
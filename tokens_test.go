@@ -0,0 +1,124 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FabianWe/goauth"
+)
+
+// expectTokenLogin expects the queries of RoleRequired for a request with
+// the bearer token, the token has the given scopes and belongs to a
+// superadmin.
+func expectTokenLogin(mock sqlmock.Sqlmock, token string, scopes []Permission) {
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, user_id, name, scopes, created, expires, last_used FROM api_tokens WHERE token_hash = ?;")).
+		WithArgs(hashToken(token)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "scopes", "created", "expires", "last_used"}).
+			AddRow(2, 1, "ci", encodeScopes(scopes), now.Add(-time.Hour), now.Add(time.Hour), nil))
+	mock.ExpectExec(regexp.QuoteMeta("UPDATE api_tokens SET last_used = ? WHERE id = ?;")).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT role FROM admin_roles WHERE user_id = ?;")).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(string(RoleSuperAdmin)))
+}
+
+func TestRoleRequiredTokenScope(t *testing.T) {
+	token := tokenPrefix + "test"
+	tests := []struct {
+		method   string
+		scopes   []Permission
+		expected int
+	}{
+		{getMethod, []Permission{PermissionRead}, 200},
+		{postMethod, []Permission{PermissionRead}, 403},
+		{postMethod, []Permission{PermissionRead, PermissionManageUsers}, 200},
+		{deleteMethod, []Permission{PermissionManageDomains}, 403},
+	}
+	for _, tt := range tests {
+		appContext, mock := newTestContext(t)
+		expectTokenLogin(mock, token, tt.scopes)
+		called := false
+		handler := RoleRequired(AliasesPermission, func(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+			called = true
+			if tokenID, ok := APITokenFromRequest(r); !ok || tokenID != 2 {
+				t.Errorf("expected token 2 in the request context, got %d", tokenID)
+			}
+			return nil
+		})
+		r := httptest.NewRequest(tt.method, "/api/aliases/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		if err := handler(appContext, w, r); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.expected {
+			t.Errorf("%s with scopes %v: expected status %d, got %d", tt.method, tt.scopes, tt.expected, w.Code)
+		}
+		if called != (tt.expected == 200) {
+			t.Errorf("%s with scopes %v: handler called: %v", tt.method, tt.scopes, called)
+		}
+	}
+}
+
+func TestRejectTokenWrite(t *testing.T) {
+	// no database access is expected: the request must be rejected before
+	tests := []struct {
+		method string
+		path   string
+		h      AppHandleFunc
+	}{
+		{postMethod, "/api/tokens/", ListTokensJSON},
+		{deleteMethod, "/api/tokens/3", ListTokensJSON},
+		{deleteMethod, "/api/sessions/3", ListSessionsJSON},
+		{postMethod, "/api/2fa/", TwoFactorJSON},
+		{deleteMethod, "/api/2fa/", TwoFactorJSON},
+	}
+	for _, tt := range tests {
+		appContext, _ := newTestContext(t)
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		ctx := context.WithValue(r.Context(), adminIDKey, goauth.UserKeyType(1))
+		ctx = context.WithValue(ctx, adminRoleKey, RoleSuperAdmin)
+		ctx = context.WithValue(ctx, apiTokenKey, int64(2))
+		w := httptest.NewRecorder()
+		if err := tt.h(appContext, w, r.WithContext(ctx)); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 403 {
+			t.Errorf("%s %s with token: expected status 403, got %d", tt.method, tt.path, w.Code)
+		}
+	}
+	r := httptest.NewRequest(getMethod, "/api/tokens/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), apiTokenKey, int64(2)))
+	if rejectTokenWrite(httptest.NewRecorder(), r) {
+		t.Error("GET with token rejected")
+	}
+}
@@ -0,0 +1,354 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains functions for soft-deleting mail users: Instead of
+// deleting an user immediately the database entry is moved to the table
+// trash_users and the mail directory is moved to the trash directory.
+// After the configured lifespan the entry gets purged (backup is created
+// if configured and the directory gets removed) by PurgeTrashDaemon.
+// Until then the user can be restored with RestoreMailUser.
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TrashEntry stores information about a deleted user that wasn't purged
+// yet.
+type TrashEntry struct {
+	// DomainID is the id of the domain the user belonged to.
+	DomainID int64
+	// Mail is the user Email.
+	Mail string
+	// Deleted is the time the user was deleted.
+	Deleted time.Time
+	// PurgeAfter is the time after which the user gets purged.
+	PurgeAfter time.Time
+	// HasDir is true if the mail directory was moved to the trash directory.
+	// If the user never received mails there is no directory.
+	HasDir bool
+}
+
+// moveToTrash moves the mail directory of the user to the trash directory.
+// It returns the path of the directory in the trash or the empty string
+// if the user has no mail directory.
+func moveToTrash(appContext *MailAppContext, domain, user string, now time.Time) (string, error) {
+	if containsErr := containsInvalidParts(domain); containsErr != nil {
+		return "", containsErr
+	}
+	if containsErr := containsInvalidParts(user); containsErr != nil {
+		return "", containsErr
+	}
+	source := getSourcePath(appContext.MailDir, domain, user)
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		// no mails there yet, nothing to move
+		return "", nil
+	}
+	if err := os.MkdirAll(appContext.Trash, 0700); err != nil {
+		return "", err
+	}
+	target := filepath.Join(appContext.Trash, fmt.Sprintf("%s-%s-%d", domain, user, now.Unix()))
+	if err := os.Rename(source, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// moveFromTrash moves a directory from the trash back to the mail directory
+// of the user. It returns an error if the mail directory already exists,
+// thus nothing gets overwritten.
+func moveFromTrash(appContext *MailAppContext, trashPath, domain, user string) (string, error) {
+	if containsErr := containsInvalidParts(domain); containsErr != nil {
+		return "", containsErr
+	}
+	if containsErr := containsInvalidParts(user); containsErr != nil {
+		return "", containsErr
+	}
+	target := filepath.Clean(getSourcePath(appContext.MailDir, domain, user))
+	if _, err := os.Stat(target); err == nil {
+		return "", fmt.Errorf("Can't restore mail directory, \"%s\" already exists", target)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Rename(trashPath, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// SoftDeleteMailUser moves the user with the given id to the trash, that is
+// the entry in virtual_users is moved to trash_users and the mail directory
+// is moved to appContext.Trash.
+// If the user was not found no error is returned, but the information gets
+// logged.
+func SoftDeleteMailUser(appContext *MailAppContext, emailID int64) error {
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	var domainID int64
+	var email, password string
+	query := "SELECT domain_id, email, password FROM virtual_users WHERE id = ?;"
+	switch scanErr := tx.QueryRow(query, emailID).Scan(&domainID, &email, &password); {
+	case scanErr == sql.ErrNoRows:
+		appContext.Logger.WithField("email-id", emailID).Warn("Email for delete not found")
+		return nil
+	case scanErr != nil:
+		return scanErr
+	}
+	user, domain, parseErr := ParseMailParts(email)
+	if parseErr != nil {
+		return parseErr
+	}
+	now := time.Now().UTC()
+	trashPath, moveErr := moveToTrash(appContext, domain, user, now)
+	if moveErr != nil {
+		return moveErr
+	}
+	// if something goes wrong from now on we have to move the directory back
+	undoMove := func() {
+		if trashPath == "" {
+			return
+		}
+		if _, undoErr := moveFromTrash(appContext, trashPath, domain, user); undoErr != nil {
+			appContext.Logger.WithError(undoErr).WithField("trash-path", trashPath).Error("Can't move mail directory back from trash")
+		}
+	}
+	insertQuery := "INSERT INTO trash_users (id, domain_id, email, password, trash_path, deleted) VALUES (?, ?, ?, ?, ?, ?);"
+	if _, err := tx.Exec(insertQuery, emailID, domainID, email, password, trashPath, now); err != nil {
+		undoMove()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM virtual_users WHERE id = ?;", emailID); err != nil {
+		undoMove()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		undoMove()
+		return err
+	}
+	appContext.Logger.WithFields(log.Fields{
+		"email-id":   emailID,
+		"trash-path": trashPath,
+	}).Info("Moved email to trash")
+	return nil
+}
+
+// ErrRestoreDomainDeleted is returned by RestoreMailUser if the domain of the
+// user was deleted.
+var ErrRestoreDomainDeleted = errors.New("Can't restore the user: the domain was deleted")
+
+// ErrRestoreMailExists is returned by RestoreMailUser if the address is used
+// by another user.
+var ErrRestoreMailExists = errors.New("Can't restore the user: the address is used by another user")
+
+// RestoreMailUser restores a user from the trash, that is the entry is
+// moved back to virtual_users (with the same id) and the mail directory is
+// moved back. password_set is the time of the restore, so the password
+// expiry (see expiry.go) starts again.
+// It returns sql.ErrNoRows if there is no such entry in the trash,
+// ErrRestoreDomainDeleted if the domain doesn't exist anymore and
+// ErrRestoreMailExists if the address was reused.
+func RestoreMailUser(appContext *MailAppContext, emailID int64) error {
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	var domainID int64
+	var email, password, trashPath string
+	query := "SELECT domain_id, email, password, trash_path FROM trash_users WHERE id = ?;"
+	if scanErr := tx.QueryRow(query, emailID).Scan(&domainID, &email, &password, &trashPath); scanErr != nil {
+		return scanErr
+	}
+	user, domain, parseErr := ParseMailParts(email)
+	if parseErr != nil {
+		return parseErr
+	}
+	var domainCount, mailCount int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM virtual_domains WHERE id = ?;", domainID).Scan(&domainCount); err != nil {
+		return err
+	}
+	if domainCount == 0 {
+		return ErrRestoreDomainDeleted
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM virtual_users WHERE email = ?;", email).Scan(&mailCount); err != nil {
+		return err
+	}
+	if mailCount > 0 {
+		return ErrRestoreMailExists
+	}
+	insertQuery := "INSERT INTO virtual_users (id, domain_id, email, password, password_set) VALUES (?, ?, ?, ?, ?);"
+	if _, err := tx.Exec(insertQuery, emailID, domainID, email, password, time.Now().UTC()); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM trash_users WHERE id = ?;", emailID); err != nil {
+		return err
+	}
+	var restoredPath string
+	if trashPath != "" {
+		var moveErr error
+		if restoredPath, moveErr = moveFromTrash(appContext, trashPath, domain, user); moveErr != nil {
+			return moveErr
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		if restoredPath != "" {
+			if undoErr := os.Rename(restoredPath, trashPath); undoErr != nil {
+				appContext.Logger.WithError(undoErr).WithField("trash-path", trashPath).Error("Can't move mail directory back to trash")
+			}
+		}
+		return err
+	}
+	appContext.Logger.WithField("email-id", emailID).Info("Restored email from trash")
+	return nil
+}
+
+// ListTrash returns all entries from the trash in the form
+// id --> TrashEntry.
+func ListTrash(appContext *MailAppContext) (map[int64]*TrashEntry, error) {
+	query := "SELECT id, domain_id, email, trash_path, deleted FROM trash_users;"
+	rows, err := appContext.DB.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[int64]*TrashEntry)
+	for rows.Next() {
+		var id, domainID int64
+		var email, trashPath string
+		var deleted sqlTime
+		if scanErr := rows.Scan(&id, &domainID, &email, &trashPath, &deleted); scanErr != nil {
+			return nil, scanErr
+		}
+		res[id] = &TrashEntry{DomainID: domainID, Mail: email, Deleted: deleted.Time,
+			PurgeAfter: deleted.Add(appContext.TrashLifespan), HasDir: trashPath != ""}
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// PurgeTrashEntry removes the user with the given id from the trash.
+// If appContext.Backup is set a backup of the mail directory is created
+// first. The directory gets deleted and the entry is removed from
+// trash_users.
+// If the backup fails the directory and entry are not deleted.
+func PurgeTrashEntry(appContext *MailAppContext, emailID int64) error {
+	var email, trashPath string
+	query := "SELECT email, trash_path FROM trash_users WHERE id = ?;"
+	if scanErr := appContext.DB.QueryRow(query, emailID).Scan(&email, &trashPath); scanErr != nil {
+		return scanErr
+	}
+	if trashPath != "" {
+		user, domain, parseErr := ParseMailParts(email)
+		if parseErr != nil {
+			return parseErr
+		}
+		if appContext.Backup != "" {
+			// the directory in the trash has another name, the archive must
+			// have the name of the mail directory such that RestoreUserDir
+			// restores it in the right place
+			baseName := filepath.Base(getSourcePath(appContext.MailDir, domain, user))
+			destPath := getDestPath(appContext.Backup, domain, user, len(appContext.BackupRecipients) > 0)
+			if backupErr := zipToFile(trashPath, baseName, destPath, appContext.BackupRecipients); backupErr != nil {
+				return backupErr
+			}
+			appContext.Logger.WithField("email-id", emailID).Info("Created backup for user.")
+		}
+		if delErr := os.RemoveAll(trashPath); delErr != nil {
+			return delErr
+		}
+	}
+	if _, err := appContext.DB.Exec("DELETE FROM trash_users WHERE id = ?;", emailID); err != nil {
+		return err
+	}
+	appContext.Logger.WithField("email-id", emailID).Info("Purged email from trash")
+	return nil
+}
+
+// PurgeExpiredTrash purges all entries from the trash that were deleted more
+// than appContext.TrashLifespan ago.
+// It returns the number of purged entries. If an entry can't be purged the
+// error gets logged and it is tried again on the next call.
+func PurgeExpiredTrash(appContext *MailAppContext) (int, error) {
+	cutoff := time.Now().UTC().Add(-appContext.TrashLifespan)
+	rows, err := appContext.DB.Query("SELECT id FROM trash_users WHERE deleted < ?;", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if scanErr := rows.Scan(&id); scanErr != nil {
+			rows.Close()
+			return 0, scanErr
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, id := range ids {
+		if purgeErr := PurgeTrashEntry(appContext, id); purgeErr != nil {
+			appContext.Logger.WithError(purgeErr).WithField("email-id", id).Error("Can't purge email from trash")
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeTrashDaemon starts a goroutine that calls PurgeExpiredTrash, sleeps
+// for the given duration and then repeats.
+// If stop is not nil the daemon stops once a value is received on it.
+func PurgeTrashDaemon(appContext *MailAppContext, sleep time.Duration, stop chan bool) {
+	go func() {
+		for {
+			purged, err := PurgeExpiredTrash(appContext)
+			if err != nil {
+				appContext.Logger.WithError(err).Error("Error while purging trash")
+			} else if purged > 0 {
+				appContext.Logger.WithField("purged", purged).Info("Purged expired trash entries")
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(sleep):
+			}
+		}
+	}()
+}
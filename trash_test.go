@@ -0,0 +1,142 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// writeTestFile writes content to path, the directory is created first.
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPurgeTrashEntryBackupRestores(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	root := t.TempDir()
+	appContext.MailDir = filepath.Join(root, "mail", "%d", "%n")
+	appContext.Trash = filepath.Join(root, "trash")
+	appContext.Backup = filepath.Join(root, "backup")
+	if err := os.MkdirAll(appContext.Backup, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, getSourcePath(appContext.MailDir, "example.org", "alice")+"/cur/1.mail", "Subject: hello\n\nhi\n")
+	trashPath, moveErr := moveToTrash(appContext, "example.org", "alice", time.Now())
+	if moveErr != nil {
+		t.Fatal(moveErr)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT email, trash_path FROM trash_users WHERE id = ?")).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"email", "trash_path"}).AddRow("alice@example.org", trashPath))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM trash_users WHERE id = ?")).
+		WithArgs(42).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	if err := PurgeTrashEntry(appContext, 42); err != nil {
+		t.Fatalf("Purging failed: %s", err)
+	}
+	if _, err := os.Stat(trashPath); !os.IsNotExist(err) {
+		t.Errorf("Expected %s to be removed, got %v", trashPath, err)
+	}
+
+	archive := getDestPath(appContext.Backup, "example.org", "alice", false)
+	if err := RestoreUserDir(appContext, archive, "example.org", "alice"); err != nil {
+		t.Fatalf("Restoring failed: %s", err)
+	}
+	content, readErr := ioutil.ReadFile(getSourcePath(appContext.MailDir, "example.org", "alice") + "/cur/1.mail")
+	if readErr != nil {
+		t.Fatalf("Mail was not restored into the mail directory: %s", readErr)
+	}
+	if string(content) != "Subject: hello\n\nhi\n" {
+		t.Errorf("Restored mail has wrong content %q", content)
+	}
+	domainDir, _ := ioutil.ReadDir(filepath.Join(root, "mail", "example.org"))
+	if len(domainDir) != 1 {
+		t.Errorf("Expected only the mail directory of alice in the domain, got %d entries", len(domainDir))
+	}
+}
+
+// expectRestoreLookup adds the queries of RestoreMailUser up to the checks
+// of domain and address.
+func expectRestoreLookup(mock sqlmock.Sqlmock, domainCount int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT domain_id, email, password, trash_path FROM trash_users WHERE id = ?")).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"domain_id", "email", "password", "trash_path"}).
+			AddRow(3, "alice@example.org", "{SHA512-CRYPT}", ""))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM virtual_domains WHERE id = ?")).
+		WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(domainCount))
+}
+
+func TestRestoreMailUser(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	expectRestoreLookup(mock, 1)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM virtual_users WHERE email = ?")).
+		WithArgs("alice@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO virtual_users (id, domain_id, email, password, password_set)")).
+		WithArgs(42, 3, "alice@example.org", "{SHA512-CRYPT}", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(42, 1))
+	mock.ExpectExec(regexp.QuoteMeta("DELETE FROM trash_users WHERE id = ?")).
+		WithArgs(42).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	if err := RestoreMailUser(appContext, 42); err != nil {
+		t.Errorf("Restoring failed: %s", err)
+	}
+}
+
+func TestRestoreMailUserDomainDeleted(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	expectRestoreLookup(mock, 0)
+	mock.ExpectRollback()
+	if err := RestoreMailUser(appContext, 42); err != ErrRestoreDomainDeleted {
+		t.Errorf("Expected ErrRestoreDomainDeleted, got %v", err)
+	}
+}
+
+func TestRestoreMailUserAddressReused(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	expectRestoreLookup(mock, 1)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM virtual_users WHERE email = ?")).
+		WithArgs("alice@example.org").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+	if err := RestoreMailUser(appContext, 42); err != ErrRestoreMailExists {
+		t.Errorf("Expected ErrRestoreMailExists, got %v", err)
+	}
+}
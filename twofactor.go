@@ -0,0 +1,609 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+// This file contains the two-factor authentication for admins with TOTP
+// (RFC 6238). Admins can enroll an authenticator app and get a list of
+// recovery codes. If TOTP is enabled for an admin the login requires a
+// second step: CheckLogin doesn't create an auth session but a short lived
+// pending session, the auth session is created after the code was verified
+// (see SecondFactorLoginHandler).
+// If appContext.TwoFactorRequired is set admins without TOTP must enroll
+// before they get an auth session (see TOTPLoginEnrollHandler).
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/FabianWe/goauth"
+	"github.com/gorilla/csrf"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// totpIssuer is the issuer shown in authenticator apps.
+	totpIssuer = "mailwebadmin"
+	// totpPeriod is the validity of a code in seconds.
+	totpPeriod = 30
+	// recoveryCodeCount is the number of recovery codes created on enrollment.
+	recoveryCodeCount = 10
+	// pendingLoginSession is the name of the session that stores a login
+	// waiting for the second factor.
+	pendingLoginSession = "mailwebadmin-2fa"
+	// pendingLoginLifespan is the time an admin has to enter the second
+	// factor after entering the password.
+	pendingLoginLifespan = 5 * time.Minute
+)
+
+var (
+	// ErrTOTPEnabled is returned when starting an enrollment for an admin
+	// that already has TOTP enabled.
+	ErrTOTPEnabled = errors.New("Two-factor authentication is already enabled")
+	// ErrTOTPNotEnrolled is returned when confirming an enrollment that was
+	// never started.
+	ErrTOTPNotEnrolled = errors.New("No two-factor enrollment started")
+	// ErrInvalidTOTPCode is returned if a code is not valid.
+	ErrInvalidTOTPCode = errors.New("Invalid code")
+)
+
+// TOTPEnabled checks if the admin has TOTP enabled.
+func TOTPEnabled(appContext *MailAppContext, adminID goauth.UserKeyType) (bool, error) {
+	var enabled bool
+	err := appContext.DB.QueryRow("SELECT enabled FROM admin_totp WHERE user_id = ?;", uint64(adminID)).Scan(&enabled)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return enabled, nil
+}
+
+// StartTOTPEnrollment creates a new secret for the admin. The secret is not
+// used before the enrollment is confirmed with ConfirmTOTPEnrollment.
+// It returns ErrTOTPEnabled if TOTP is already enabled.
+func StartTOTPEnrollment(appContext *MailAppContext, adminID goauth.UserKeyType, accountName string) (*otp.Key, error) {
+	enabled, err := TOTPEnabled(appContext, adminID)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+	key, genErr := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: accountName, Period: totpPeriod})
+	if genErr != nil {
+		return nil, genErr
+	}
+	query := `INSERT INTO admin_totp (user_id, secret, enabled, last_step) VALUES (?, ?, FALSE, 0)
+	ON DUPLICATE KEY UPDATE secret = VALUES(secret), enabled = FALSE, last_step = 0;`
+	if _, err := appContext.DB.Exec(query, uint64(adminID), key.Secret()); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// validateTOTP checks the code against the secret for the current time step
+// and the steps before and after it (to allow some clock drift).
+// Steps <= lastStep are not accepted, this way a code can't be used twice.
+// It returns the step the code is valid for.
+func validateTOTP(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for skew := int64(-1); skew <= 1; skew++ {
+		step := current + skew
+		if step <= lastStep {
+			continue
+		}
+		expected, err := hotp.GenerateCodeCustom(secret, uint64(step), hotp.ValidateOpts{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkTOTP validates the code for the admin and stores the step so that
+// the code can't be used again. If enabled is true only enabled secrets
+// are checked, otherwise only secrets of a pending enrollment.
+func checkTOTP(appContext *MailAppContext, adminID goauth.UserKeyType, code string, enabled bool) (bool, error) {
+	var secret string
+	var lastStep int64
+	query := "SELECT secret, last_step FROM admin_totp WHERE user_id = ? AND enabled = ?;"
+	err := appContext.DB.QueryRow(query, uint64(adminID), enabled).Scan(&secret, &lastStep)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, ErrTOTPNotEnrolled
+	case err != nil:
+		return false, err
+	}
+	step, ok := validateTOTP(secret, strings.TrimSpace(code), lastStep, time.Now())
+	if !ok {
+		return false, nil
+	}
+	// update the step, if this fails another request used the code already
+	res, updateErr := appContext.DB.Exec("UPDATE admin_totp SET last_step = ? WHERE user_id = ? AND last_step < ?;",
+		step, uint64(adminID), step)
+	if updateErr != nil {
+		return false, updateErr
+	}
+	updated, _ := res.RowsAffected()
+	return updated == 1, nil
+}
+
+// normalizeRecoveryCode removes spaces and dashes from a recovery code and
+// converts it to lower case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// hashRecoveryCode returns the hex encoded sha256 of the normalized code.
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// genRecoveryCode returns a new random recovery code of the form
+// xxxxx-xxxxx.
+func genRecoveryCode() (string, error) {
+	buf := make([]byte, 7)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	enc := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf))[:10]
+	return enc[:5] + "-" + enc[5:], nil
+}
+
+// newRecoveryCodes replaces the recovery codes of the admin with new ones
+// and returns them. Only the hashes are stored in the database.
+func newRecoveryCodes(tx *sql.Tx, adminID goauth.UserKeyType) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM admin_recovery_codes WHERE user_id = ?;", uint64(adminID)); err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, genErr := genRecoveryCode()
+		if genErr != nil {
+			return nil, genErr
+		}
+		if _, err := tx.Exec("INSERT INTO admin_recovery_codes (user_id, code_hash) VALUES (?, ?);",
+			uint64(adminID), hashRecoveryCode(code)); err != nil {
+			return nil, err
+		}
+		res = append(res, code)
+	}
+	return res, nil
+}
+
+// ConfirmTOTPEnrollment enables TOTP for the admin if the code is valid for
+// the secret created by StartTOTPEnrollment. It returns the new recovery
+// codes, they're not stored in plain text and can't be shown again.
+func ConfirmTOTPEnrollment(appContext *MailAppContext, adminID goauth.UserKeyType, code string) ([]string, error) {
+	ok, err := checkTOTP(appContext, adminID, code, false)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrInvalidTOTPCode
+	}
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return nil, txErr
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE admin_totp SET enabled = TRUE WHERE user_id = ?;", uint64(adminID)); err != nil {
+		return nil, err
+	}
+	codes, codesErr := newRecoveryCodes(tx, adminID)
+	if codesErr != nil {
+		return nil, codesErr
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	appContext.Logger.WithField("admin-id", adminID).Info("Enabled two-factor authentication")
+	return codes, nil
+}
+
+// DisableTOTP removes the secret and recovery codes of the admin.
+func DisableTOTP(appContext *MailAppContext, adminID goauth.UserKeyType) error {
+	tx, txErr := appContext.DB.Begin()
+	if txErr != nil {
+		return txErr
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM admin_totp WHERE user_id = ?;", uint64(adminID)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM admin_recovery_codes WHERE user_id = ?;", uint64(adminID)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	appContext.Logger.WithField("admin-id", adminID).Info("Disabled two-factor authentication")
+	return nil
+}
+
+// countRecoveryCodes returns the number of unused recovery codes.
+func countRecoveryCodes(appContext *MailAppContext, adminID goauth.UserKeyType) (int, error) {
+	var res int
+	err := appContext.DB.QueryRow("SELECT COUNT(*) FROM admin_recovery_codes WHERE user_id = ?;", uint64(adminID)).Scan(&res)
+	return res, err
+}
+
+// VerifySecondFactor checks a TOTP code or, if the code is not a six digit
+// number, a recovery code. Recovery codes can only be used once.
+func VerifySecondFactor(appContext *MailAppContext, adminID goauth.UserKeyType, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if len(code) == 6 && strings.Trim(code, "0123456789") == "" {
+		ok, err := checkTOTP(appContext, adminID, code, true)
+		if err == ErrTOTPNotEnrolled {
+			return false, nil
+		}
+		return ok, err
+	}
+	res, err := appContext.DB.Exec("DELETE FROM admin_recovery_codes WHERE user_id = ? AND code_hash = ?;",
+		uint64(adminID), hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	deleted, _ := res.RowsAffected()
+	if deleted == 1 {
+		appContext.Logger.WithField("admin-id", adminID).Info("Admin used a recovery code")
+		return true, nil
+	}
+	return false, nil
+}
+
+// totpKeyJSON returns the information to set up an authenticator app:
+// {"secret": <secret>, "uri": <otpauth URI>, "qr": <data URI of a png>}.
+func totpKeyJSON(key *otp.Key) ([]byte, error) {
+	img, imgErr := key.Image(200, 200)
+	if imgErr != nil {
+		return nil, imgErr
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	res := map[string]string{
+		"secret": key.Secret(),
+		"uri":    key.URL(),
+		"qr":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+	}
+	return json.Marshal(res)
+}
+
+// readCode reads a request of the form {"code": <code>}.
+func readCode(r *http.Request) (string, error) {
+	body, readErr := ioutil.ReadAll(r.Body)
+	if readErr != nil {
+		return "", readErr
+	}
+	var codeData struct {
+		Code string
+	}
+	if jsonErr := json.Unmarshal(body, &codeData); jsonErr != nil {
+		return "", jsonErr
+	}
+	return codeData.Code, nil
+}
+
+// secondFactorState returns which second step is required after a correct
+// password: "totp" if the admin has TOTP enabled, "enroll" if TOTP is
+// required but not enabled and "" if no second step is required.
+func secondFactorState(appContext *MailAppContext, adminID goauth.UserKeyType) (string, error) {
+	enabled, err := TOTPEnabled(appContext, adminID)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case enabled:
+		return "totp", nil
+	case appContext.TwoFactorRequired:
+		return "enroll", nil
+	default:
+		return "", nil
+	}
+}
+
+// startPendingLogin stores the admin in the pending login session.
+func startPendingLogin(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, adminID goauth.UserKeyType, rememberMe bool, state string) error {
+	session, _ := appContext.Store.Get(r, pendingLoginSession)
+	session.Values["user-id"] = uint64(adminID)
+	session.Values["remember-me"] = rememberMe
+	session.Values["state"] = state
+	session.Values["created"] = time.Now().Unix()
+	session.Options.MaxAge = int(pendingLoginLifespan / time.Second)
+	return session.Save(r, w)
+}
+
+// pendingLogin returns the admin from the pending login session if the
+// session exists, has the given state and is not expired.
+func pendingLogin(appContext *MailAppContext, r *http.Request, state string) (goauth.UserKeyType, bool, bool) {
+	session, err := appContext.Store.Get(r, pendingLoginSession)
+	if err != nil {
+		return goauth.NoUserID, false, false
+	}
+	adminID, idOk := session.Values["user-id"].(uint64)
+	rememberMe, _ := session.Values["remember-me"].(bool)
+	sessionState, _ := session.Values["state"].(string)
+	created, createdOk := session.Values["created"].(int64)
+	if !idOk || !createdOk || sessionState != state {
+		return goauth.NoUserID, false, false
+	}
+	if time.Since(time.Unix(created, 0)) > pendingLoginLifespan {
+		return goauth.NoUserID, false, false
+	}
+	return goauth.UserKeyType(adminID), rememberMe, true
+}
+
+// finishPendingLogin removes the pending login session and creates the auth
+// session for the admin.
+func finishPendingLogin(appContext *MailAppContext, w http.ResponseWriter, r *http.Request, adminID goauth.UserKeyType, rememberMe bool) error {
+	session, _ := appContext.Store.Get(r, pendingLoginSession)
+	session.Options.MaxAge = -1
+	if saveErr := session.Save(r, w); saveErr != nil {
+		appContext.Logger.WithError(saveErr).Error("Saving session failed")
+	}
+	return createLoginSession(appContext, w, r, adminID, rememberMe)
+}
+
+// SecondFactorLoginHandler handles POST /login/2fa/, the second step of the
+// login for admins with TOTP enabled.
+// It accepts JSON requests of the form {"code": <code>} where code is either
+// the current TOTP code or a recovery code.
+// It replies with a 400 if the code is invalid or no login is pending and
+// counts failures as CheckLogin does.
+func SecondFactorLoginHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != postMethod {
+		http.Error(w, fmt.Sprintf("Invalid method for /login/2fa/: %s", r.Method), 400)
+		return nil
+	}
+	adminID, rememberMe, ok := pendingLogin(appcontext, r, "totp")
+	if !ok {
+		http.Error(w, "No login pending", 400)
+		return nil
+	}
+	userName, nameErr := appcontext.UserHandler.GetUserName(adminID)
+	if nameErr != nil {
+		return nameErr
+	}
+	if allowed, lockErr := checkAttemptAllowed(appcontext, w, r, LockoutScopeAdmin, userName); !allowed {
+		return lockErr
+	}
+	code, codeErr := readCode(r)
+	if codeErr != nil {
+		http.Error(w, "Invalid request syntax", 400)
+		return nil
+	}
+	valid, err := VerifySecondFactor(appcontext, adminID, code)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		appcontext.Logger.WithField("admin-id", adminID).WithField("remote", r.RemoteAddr).Warn("Invalid two-factor code on login")
+		attemptFailed(appcontext, r, LockoutScopeAdmin, userName)
+		http.Error(w, "Login failed", 400)
+		return nil
+	}
+	attemptSucceeded(appcontext, LockoutScopeAdmin, userName)
+	return finishPendingLogin(appcontext, w, r, adminID, rememberMe)
+}
+
+// TOTPLoginEnrollHandler handles /login/2fa/enroll/, used when two-factor
+// authentication is required and the admin has not enrolled yet.
+// GET starts the enrollment and returns the JSON described in totpKeyJSON,
+// POST confirms it with {"code": <code>}, creates the auth session and
+// returns {"recovery-codes": [<code>, ...]}.
+func TOTPLoginEnrollHandler(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	adminID, rememberMe, ok := pendingLogin(appcontext, r, "enroll")
+	if !ok {
+		http.Error(w, "No login pending", 400)
+		return nil
+	}
+	switch r.Method {
+	case getMethod:
+		userName, nameErr := appcontext.UserHandler.GetUserName(adminID)
+		if nameErr != nil {
+			return nameErr
+		}
+		key, err := StartTOTPEnrollment(appcontext, adminID, userName)
+		if err == ErrTOTPEnabled {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		jsonEnc, jsonErr := totpKeyJSON(key)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case postMethod:
+		code, codeErr := readCode(r)
+		if codeErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		codes, err := ConfirmTOTPEnrollment(appcontext, adminID, code)
+		switch err {
+		case nil:
+		case ErrInvalidTOTPCode, ErrTOTPNotEnrolled:
+			http.Error(w, err.Error(), 400)
+			return nil
+		default:
+			return err
+		}
+		recordAudit(appcontext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"2fa": true})
+		if loginErr := finishPendingLogin(appcontext, w, r, adminID, rememberMe); loginErr != nil {
+			return loginErr
+		}
+		jsonEnc, jsonErr := json.Marshal(map[string][]string{"recovery-codes": codes})
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /login/2fa/enroll/: %s", r.Method), 400)
+		return nil
+	}
+}
+
+// TwoFactorJSON is the main handler for /api/2fa/, it manages the
+// two-factor authentication of the admin that is logged in.
+// GET returns {"enabled": <bool>, "required": <bool>, "recovery-codes": <number left>},
+// POST starts an enrollment (see TOTPLoginEnrollHandler),
+// UPDATE confirms it with {"code": <code>} and returns the recovery codes
+// and DELETE disables TOTP, it requires a valid code as well and is not
+// allowed if two-factor authentication is required.
+// Requests authenticated with an API token can only use GET, see
+// rejectTokenWrite.
+func TwoFactorJSON(appcontext *MailAppContext, w http.ResponseWriter, r *http.Request) error {
+	adminID, _, ok := AdminFromRequest(r)
+	if !ok {
+		http.Error(w, "Forbidden", 403)
+		return nil
+	}
+	if rejectTokenWrite(w, r) {
+		return nil
+	}
+	switch r.Method {
+	default:
+		http.Error(w, fmt.Sprintf("Invalid method for /api/2fa/: %s", r.Method), 400)
+		return nil
+	case getMethod:
+		enabled, err := TOTPEnabled(appcontext, adminID)
+		if err != nil {
+			return err
+		}
+		codesLeft, countErr := countRecoveryCodes(appcontext, adminID)
+		if countErr != nil {
+			return countErr
+		}
+		res := map[string]interface{}{
+			"enabled":        enabled,
+			"required":       appcontext.TwoFactorRequired,
+			"recovery-codes": codesLeft,
+		}
+		// set csrf header
+		w.Header().Set("X-CSRF-Token", csrf.Token(r))
+		jsonEnc, jsonErr := json.Marshal(res)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case postMethod:
+		userName, nameErr := appcontext.UserHandler.GetUserName(adminID)
+		if nameErr != nil {
+			return nameErr
+		}
+		key, err := StartTOTPEnrollment(appcontext, adminID, userName)
+		if err == ErrTOTPEnabled {
+			http.Error(w, err.Error(), 400)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		jsonEnc, jsonErr := totpKeyJSON(key)
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case updateMethod:
+		code, codeErr := readCode(r)
+		if codeErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		codes, err := ConfirmTOTPEnrollment(appcontext, adminID, code)
+		switch err {
+		case nil:
+		case ErrInvalidTOTPCode, ErrTOTPNotEnrolled:
+			http.Error(w, err.Error(), 400)
+			return nil
+		default:
+			return err
+		}
+		recordAudit(appcontext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID), nil, AuditValues{"2fa": true})
+		jsonEnc, jsonErr := json.Marshal(map[string][]string{"recovery-codes": codes})
+		if jsonErr != nil {
+			return jsonErr
+		}
+		w.Write(jsonEnc)
+		return nil
+	case deleteMethod:
+		if appcontext.TwoFactorRequired {
+			http.Error(w, "Two-factor authentication is required and can't be disabled", 400)
+			return nil
+		}
+		code, codeErr := readCode(r)
+		if codeErr != nil {
+			http.Error(w, "Invalid request syntax", 400)
+			return nil
+		}
+		valid, err := VerifySecondFactor(appcontext, adminID, code)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			http.Error(w, ErrInvalidTOTPCode.Error(), 400)
+			return nil
+		}
+		if disableErr := DisableTOTP(appcontext, adminID); disableErr != nil {
+			return disableErr
+		}
+		recordAudit(appcontext, r, AuditUpdateAdmin, AuditTargetAdmin, int64(adminID), AuditValues{"2fa": true}, AuditValues{"2fa": false})
+		return nil
+	}
+}
@@ -0,0 +1,105 @@
+// The MIT License (MIT)
+//
+// Copyright (c) 2017 Fabian Wenzelmann
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package mailwebadmin
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/FabianWe/goauth"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+)
+
+// testTOTPSecret is the (base32 encoded) secret used in the tests.
+const testTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// testTOTPCode returns the code for the given step.
+func testTOTPCode(t *testing.T, step int64) string {
+	t.Helper()
+	code, err := hotp.GenerateCodeCustom(testTOTPSecret, uint64(step), hotp.ValidateOpts{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	current := now.Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		step     int64
+		lastStep int64
+		ok       bool
+	}{
+		{"current step", current, 0, true},
+		{"previous step", current - 1, 0, true},
+		{"next step", current + 1, 0, true},
+		{"too old", current - 2, 0, false},
+		{"step reused", current, current, false},
+		{"older than used step", current - 1, current, false},
+		{"newer than used step", current + 1, current, true},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(testTOTPSecret, testTOTPCode(t, tt.step), tt.lastStep, now)
+		if ok != tt.ok {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.ok, ok)
+			continue
+		}
+		if ok && step != tt.step {
+			t.Errorf("%s: expected step %d, got %d", tt.name, tt.step, step)
+		}
+	}
+}
+
+func TestCheckTOTPReplay(t *testing.T) {
+	appContext, mock := newTestContext(t)
+	adminID := goauth.UserKeyType(1)
+	step := time.Now().Unix() / totpPeriod
+	code := testTOTPCode(t, step)
+	selectQuery := regexp.QuoteMeta("SELECT secret, last_step FROM admin_totp WHERE user_id = ? AND enabled = ?;")
+	updateQuery := regexp.QuoteMeta("UPDATE admin_totp SET last_step = ? WHERE user_id = ? AND last_step < ?;")
+	// first use of the code
+	mock.ExpectQuery(selectQuery).WithArgs(1, true).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_step"}).AddRow(testTOTPSecret, step-2))
+	mock.ExpectExec(updateQuery).WithArgs(step, 1, step).WillReturnResult(sqlmock.NewResult(0, 1))
+	// the code again, the step is already stored
+	mock.ExpectQuery(selectQuery).WithArgs(1, true).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_step"}).AddRow(testTOTPSecret, step))
+	// a concurrent request stored the step between select and update
+	mock.ExpectQuery(selectQuery).WithArgs(1, true).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "last_step"}).AddRow(testTOTPSecret, step-2))
+	mock.ExpectExec(updateQuery).WithArgs(step, 1, step).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i, expected := range []bool{true, false, false} {
+		ok, err := checkTOTP(appContext, adminID, code, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != expected {
+			t.Errorf("check %d: expected %v, got %v", i+1, expected, ok)
+		}
+	}
+}
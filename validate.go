@@ -30,19 +30,8 @@ import (
 )
 
 // In this file there are some methods that check if certain inputs
-// are valid, i.e. passwords are long enough but not too long etc.
-
-// passwordValid checks if the password is valid, i.e. has a correct length.
-func passwordValid(password string) error {
-	len := utf8.RuneCountInString(password)
-	if len < 6 {
-		return errors.New("Password must be at least of length 6")
-	}
-	if len > 30 {
-		return errors.New("Password length must be at most 30")
-	}
-	return nil
-}
+// are valid, i.e. mail addresses and domain names are not too long etc.
+// Passwords are checked against the PasswordPolicy.
 
 // containsInvalidParts is used to check if a string contains an invalid
 // substring. Those invalid substrings are .., / and \.